@@ -0,0 +1,63 @@
+package bsdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WriteControlSplit(t *testing.T) {
+	const maxSize = 64
+
+	rng := rand.New(rand.NewSource(0xc0de))
+	randomBytes := func(n int) []byte {
+		buf := make([]byte, n)
+		rng.Read(buf)
+		return buf
+	}
+
+	old := randomBytes(1000)
+	controls := []*Control{
+		{Add: randomBytes(300), Copy: randomBytes(200), Seek: 100},
+		{Add: randomBytes(50), Copy: randomBytes(500), Seek: -400},
+		{Add: randomBytes(10)},
+		{Copy: randomBytes(maxSize)},
+		{Eof: true},
+	}
+
+	var newSize int64
+	for _, ctrl := range controls {
+		newSize += int64(len(ctrl.Add) + len(ctrl.Copy))
+	}
+
+	var split []*Control
+	for _, ctrl := range controls {
+		err := writeControlSplit(ctrl, maxSize, func(msg proto.Message) error {
+			split = append(split, proto.Clone(msg).(*Control))
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	assert.True(t, len(split) > len(controls))
+
+	for _, ctrl := range split {
+		assert.True(t, len(ctrl.Add)+len(ctrl.Copy) <= maxSize, "control has %d bytes", len(ctrl.Add)+len(ctrl.Copy))
+	}
+
+	apply := func(messages []*Control) []byte {
+		out := new(bytes.Buffer)
+		i := 0
+		err := NewPatchContext().Patch(bytes.NewReader(old), out, newSize, func(msg proto.Message) error {
+			*(msg.(*Control)) = *messages[i]
+			i++
+			return nil
+		})
+		assert.NoError(t, err)
+		return out.Bytes()
+	}
+
+	assert.True(t, bytes.Equal(apply(controls), apply(split)), "split controls give a different file")
+}
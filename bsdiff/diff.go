@@ -35,16 +35,14 @@ func (m Match) copyStart() int {
 	return m.addNewStart + m.addLength
 }
 
-// MaxFileSize is the largest size bsdiff will diff (for both old and new file): 2GB - 1 bytes
-// a different codepath could be used for larger files, at the cost of unreasonable memory usage
-// (even in 2016). If a big corporate user is willing to sponsor that part of the code, get in touch!
-// Fair warning though: it won't be covered, our CI workers don't have that much RAM :)
+// MaxFileSize is the largest size Do will diff (for both old and new file): 2GB - 1 bytes.
+// Larger files can be diffed with DoWindowed, which holds a few windows in memory
+// instead of whole files.
 const MaxFileSize = int64(math.MaxInt32 - 1)
 
 // MaxMessageSize is the maximum amount of bytes that will be stored
 // in a protobuf message generated by bsdiff. This enable friendlier streaming apply
-// at a small storage cost
-// TODO: actually use
+// at a small storage cost: larger add/copy runs are split across several controls.
 const MaxMessageSize int64 = 16 * 1024 * 1024
 
 // DiffContext holds settings for the diff process, along with some
@@ -70,6 +68,10 @@ type DiffContext struct {
 
 	Stats *DiffStats
 
+	// WindowSize is how much of the new file DoWindowed diffs at a time.
+	// A 0 value (default) uses DefaultWindowSize.
+	WindowSize int64
+
 	db bytes.Buffer
 
 	obuf bytes.Buffer
@@ -103,7 +105,7 @@ func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Mat
 		} else {
 			bsdc.Seek = int64(match.addOldStart - (prevMatch.addOldStart + prevMatch.addLength))
 
-			err := writeMessage(bsdc)
+			err := writeControl(bsdc, writeMessage)
 			if err != nil {
 				return err
 			}
@@ -127,7 +129,7 @@ func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Mat
 	}
 
 	bsdc.Seek = 0
-	err = writeMessage(bsdc)
+	err = writeControl(bsdc, writeMessage)
 	if err != nil {
 		return err
 	}
@@ -142,45 +144,62 @@ func (ctx *DiffContext) writeMessages(obuf []byte, nbuf []byte, matches chan Mat
 	return nil
 }
 
-// Do computes the difference between old and new, according to the bsdiff
-// algorithm, and writes the result to patch.
-func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, consumer *state.Consumer) error {
-	var memstats *runtime.MemStats
-	var err error
+// writeControl writes ctrl, split into several controls if its add and copy
+// data don't fit in MaxMessageSize. Only the last of them seeks: the patcher
+// reads old data right after the previous add, so splitting doesn't change the output.
+func writeControl(ctrl *Control, writeMessage WriteMessageFunc) error {
+	return writeControlSplit(ctrl, int(MaxMessageSize), writeMessage)
+}
 
-	if ctx.MeasureMem {
-		memstats = &runtime.MemStats{}
-		runtime.ReadMemStats(memstats)
-		fmt.Fprintf(os.Stderr, "\nAllocated bytes at start of bsdiff: %s (%s total)", united.FormatBytes(int64(memstats.Alloc)), united.FormatBytes(int64(memstats.TotalAlloc)))
+func writeControlSplit(ctrl *Control, maxSize int, writeMessage WriteMessageFunc) error {
+	if len(ctrl.Add)+len(ctrl.Copy) <= maxSize {
+		return writeMessage(ctrl)
 	}
 
-	ctx.obuf.Reset()
-	_, err = io.Copy(&ctx.obuf, old)
-	if err != nil {
-		return err
-	}
+	addData := ctrl.Add
+	copyData := ctrl.Copy
+	part := &Control{}
 
-	obuf := ctx.obuf.Bytes()
-	obuflen := ctx.obuf.Len()
+	for {
+		part.Reset()
 
-	ctx.nbuf.Reset()
-	_, err = io.Copy(&ctx.nbuf, new)
-	if err != nil {
-		return err
-	}
+		n := len(addData)
+		if n > maxSize {
+			n = maxSize
+		}
+		part.Add, addData = addData[:n], addData[n:]
 
-	nbuf := ctx.nbuf.Bytes()
-	nbuflen := ctx.nbuf.Len()
-	if nbuflen == 0 {
-		// empty "new" file, only write EOF message
-		bsdc := &Control{}
-		bsdc.Eof = true
-		err := writeMessage(bsdc)
+		if len(addData) == 0 {
+			// copy data can only come after all the add data
+			m := len(copyData)
+			if m > maxSize-n {
+				m = maxSize - n
+			}
+			part.Copy, copyData = copyData[:m], copyData[m:]
+		}
+
+		if len(addData) == 0 && len(copyData) == 0 {
+			part.Seek = ctrl.Seek
+			return writeMessage(part)
+		}
+
+		err := writeMessage(part)
 		if err != nil {
 			return err
 		}
-		return nil
 	}
+}
+
+// computeMatches suffix-sorts obuf, then scans nbuf for matches in the
+// background. The returned channel is closed once the scan is done.
+func (ctx *DiffContext) computeMatches(obuf []byte, nbuf []byte, consumer *state.Consumer) chan Match {
+	var memstats *runtime.MemStats
+	if ctx.MeasureMem {
+		memstats = &runtime.MemStats{}
+	}
+
+	obuflen := len(obuf)
+	nbuflen := len(nbuf)
 
 	matches := make(chan Match, 256)
 
@@ -217,8 +236,6 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 	consumer.ProgressLabel(fmt.Sprintf("Preparing to scan %s...", united.FormatBytes(int64(nbuflen))))
 	consumer.Progress(0.0)
 
-	startTime = time.Now()
-
 	analyzeBlock := func(nbuflen int, nbuf []byte, offset int, blockMatches chan Match) {
 		var lenf int
 
@@ -403,6 +420,51 @@ func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, co
 		close(matches)
 	}()
 
+	return matches
+}
+
+// Do computes the difference between old and new, according to the bsdiff
+// algorithm, and writes the result to patch.
+func (ctx *DiffContext) Do(old, new io.Reader, writeMessage WriteMessageFunc, consumer *state.Consumer) error {
+	var memstats *runtime.MemStats
+	var err error
+
+	if ctx.MeasureMem {
+		memstats = &runtime.MemStats{}
+		runtime.ReadMemStats(memstats)
+		fmt.Fprintf(os.Stderr, "\nAllocated bytes at start of bsdiff: %s (%s total)", united.FormatBytes(int64(memstats.Alloc)), united.FormatBytes(int64(memstats.TotalAlloc)))
+	}
+
+	ctx.obuf.Reset()
+	_, err = io.Copy(&ctx.obuf, old)
+	if err != nil {
+		return err
+	}
+
+	obuf := ctx.obuf.Bytes()
+
+	ctx.nbuf.Reset()
+	_, err = io.Copy(&ctx.nbuf, new)
+	if err != nil {
+		return err
+	}
+
+	nbuf := ctx.nbuf.Bytes()
+	nbuflen := ctx.nbuf.Len()
+	if nbuflen == 0 {
+		// empty "new" file, only write EOF message
+		bsdc := &Control{}
+		bsdc.Eof = true
+		err := writeMessage(bsdc)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	matches := ctx.computeMatches(obuf, nbuf, consumer)
+	startTime := time.Now()
+
 	err = ctx.writeMessages(obuf, nbuf, matches, writeMessage)
 	if err != nil {
 		return errors.WithStack(err)
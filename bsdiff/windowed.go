@@ -0,0 +1,187 @@
+package bsdiff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+	"github.com/pkg/errors"
+)
+
+// DefaultWindowSize is how much of the new file DoWindowed diffs at
+// a time, when DiffContext.WindowSize isn't set.
+const DefaultWindowSize int64 = 64 * 1024 * 1024
+
+// DoWindowed computes the difference between old and new like Do, but one
+// window of the new file at a time, against the region of the old file
+// around the same offsets (from half a window before to half a window after).
+//
+// It diffs files of any size with memory proportional to the window size,
+// at the cost of missing data that moved by more than half a window.
+// The patch it writes is applied just like Do's.
+func (ctx *DiffContext) DoWindowed(old, new io.ReadSeeker, writeMessage WriteMessageFunc, consumer *state.Consumer) error {
+	windowSize := ctx.WindowSize
+	if windowSize <= 0 {
+		windowSize = DefaultWindowSize
+	}
+	// old windows are twice as large as new windows
+	if windowSize > MaxFileSize/2 {
+		windowSize = MaxFileSize / 2
+	}
+
+	oldSize, err := old.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	newSize, err := new.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ww := &windowWriter{
+		ctx:          ctx,
+		writeMessage: writeMessage,
+	}
+
+	for newStart := int64(0); newStart < newSize; newStart += windowSize {
+		newEnd := newStart + windowSize
+		if newEnd > newSize {
+			newEnd = newSize
+		}
+
+		oldStart := newStart - windowSize/2
+		if oldStart < 0 {
+			oldStart = 0
+		}
+		oldEnd := newEnd + windowSize/2
+		if oldEnd > oldSize {
+			oldEnd = oldSize
+		}
+		if oldStart > oldEnd {
+			oldStart = oldEnd
+		}
+
+		consumer.ProgressLabel(fmt.Sprintf("Diffing window %s-%s of %s...",
+			united.FormatBytes(newStart), united.FormatBytes(newEnd), united.FormatBytes(newSize)))
+
+		err = readWindow(&ctx.obuf, old, oldStart, oldEnd-oldStart)
+		if err != nil {
+			return err
+		}
+		obuf := ctx.obuf.Bytes()
+
+		err = readWindow(&ctx.nbuf, new, newStart, newEnd-newStart)
+		if err != nil {
+			return err
+		}
+		nbuf := ctx.nbuf.Bytes()
+
+		if len(obuf) == 0 {
+			// nothing to diff against, it's all fresh data
+			err = ww.match(obuf, nbuf, oldStart, Match{copyEnd: len(nbuf)})
+			if err != nil {
+				return err
+			}
+		} else {
+			matches := ctx.computeMatches(obuf, nbuf, &state.Consumer{})
+			startTime := time.Now()
+
+			for match := range matches {
+				if err == nil {
+					err = ww.match(obuf, nbuf, oldStart, match)
+				}
+				// if we errored out, keep draining so the scanners can finish
+			}
+			if err != nil {
+				return err
+			}
+
+			if ctx.Stats != nil {
+				ctx.Stats.TimeSpentScanning += time.Since(startTime)
+			}
+		}
+
+		consumer.Progress(float64(newEnd) / float64(newSize))
+	}
+
+	return ww.finish()
+}
+
+func readWindow(buf *bytes.Buffer, r io.ReadSeeker, start int64, size int64) error {
+	buf.Reset()
+
+	_, err := r.Seek(start, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	copied, err := io.CopyN(buf, r, size)
+	if err != nil {
+		return errors.Wrapf(err, "bsdiff: reading window of %d bytes at %d (got %d)", size, start, copied)
+	}
+	return nil
+}
+
+// A windowWriter turns the matches of successive windows into a single
+// stream of controls, in terms of offsets in the whole old file.
+type windowWriter struct {
+	ctx          *DiffContext
+	writeMessage WriteMessageFunc
+
+	// the last control can only be written once we know where
+	// the next one starts in the old file.
+	pending       *Control
+	pendingOldEnd int64
+}
+
+func (ww *windowWriter) match(obuf []byte, nbuf []byte, oldOffset int64, match Match) error {
+	addOldStart := oldOffset + int64(match.addOldStart)
+
+	if ww.pending != nil {
+		ww.pending.Seek = addOldStart - ww.pendingOldEnd
+		err := writeControl(ww.pending, ww.writeMessage)
+		if err != nil {
+			return err
+		}
+	} else if addOldStart != 0 {
+		// patching starts at the beginning of the old file
+		err := ww.writeMessage(&Control{Seek: addOldStart})
+		if err != nil {
+			return err
+		}
+	}
+
+	add := make([]byte, match.addLength)
+	for i := range add {
+		add[i] = nbuf[match.addNewStart+i] - obuf[match.addOldStart+i]
+	}
+
+	ww.pending = &Control{
+		Add: add,
+		// nbuf gets overwritten by the next window
+		Copy: append([]byte(nil), nbuf[match.copyStart():match.copyEnd]...),
+	}
+	ww.pendingOldEnd = addOldStart + int64(match.addLength)
+
+	stats := ww.ctx.Stats
+	if stats != nil && stats.BiggestAdd < int64(len(add)) {
+		stats.BiggestAdd = int64(len(add))
+	}
+	return nil
+}
+
+func (ww *windowWriter) finish() error {
+	if ww.pending != nil {
+		ww.pending.Seek = 0
+		err := writeControl(ww.pending, ww.writeMessage)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ww.writeMessage(&Control{Eof: true})
+}
@@ -0,0 +1,82 @@
+package bsdiff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/headway/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DoWindowed(t *testing.T) {
+	const windowSize = 64 * 1024
+
+	rng := rand.New(rand.NewSource(0x5eed))
+	randomBytes := func(n int) []byte {
+		buf := make([]byte, n)
+		rng.Read(buf)
+		return buf
+	}
+
+	old := randomBytes(windowSize*10 + 123)
+
+	// small edits, an insertion that shifts everything after it
+	// (less than half a window), and fresh data at the end
+	var newData []byte
+	newData = append(newData, old[:windowSize*3]...)
+	newData = append(newData, randomBytes(4000)...)
+	newData = append(newData, old[windowSize*3:windowSize*8]...)
+	newData = append(newData, randomBytes(windowSize*2)...)
+	for i := 1000; i < len(newData); i += 7919 {
+		newData[i]++
+	}
+
+	cases := []struct {
+		description string
+		old         []byte
+		new         []byte
+	}{
+		{"edits and shifts", old, newData},
+		{"empty old", nil, newData[:windowSize*2+5]},
+		{"empty new", old, nil},
+		{"shorter new", old, old[:windowSize/2]},
+	}
+
+	for _, c := range cases {
+		var messages []*Control
+		ctx := &DiffContext{
+			WindowSize: windowSize,
+			Partitions: 2,
+		}
+		err := ctx.DoWindowed(bytes.NewReader(c.old), bytes.NewReader(c.new), func(msg proto.Message) error {
+			messages = append(messages, proto.Clone(msg).(*Control))
+			return nil
+		}, &state.Consumer{})
+		if !assert.NoError(t, err, c.description) {
+			continue
+		}
+
+		var copied int
+		for _, msg := range messages {
+			copied += len(msg.Copy)
+		}
+		if c.description == "edits and shifts" {
+			// the shifted data should be found, not copied as fresh data
+			assert.True(t, copied < windowSize*3, "%s: copied %d bytes", c.description, copied)
+		}
+
+		out := new(bytes.Buffer)
+		pctx := NewPatchContext()
+		i := 0
+		err = pctx.Patch(bytes.NewReader(c.old), out, int64(len(c.new)), func(msg proto.Message) error {
+			*(msg.(*Control)) = *messages[i]
+			i++
+			return nil
+		})
+		if assert.NoError(t, err, c.description) {
+			assert.True(t, bytes.Equal(c.new, out.Bytes()), "%s: patched file differs", c.description)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/itchio/wharf/pwr"
+)
+
+// FrameSize is the amount of uncompressed data stored in each zstd frame.
+// Frames are independent from each other, which lets the decompressor
+// emit checkpoints in-between them.
+const FrameSize = 4 * 1024 * 1024 // 4MiB
+
+// Each frame is preceded by a skippable frame holding the size of the
+// compressed frame that follows, so the decompressor knows exactly how
+// much to read. Standard zstd decoders simply ignore those.
+const frameSizeMagic = 0x184D2A57
+
+type zstdCompressor struct{}
+
+// Apply returns a writer that compresses to writer. Quality is a zstd level,
+// from 1 (fastest) to 22 (best compression).
+func (zc *zstdCompressor) Apply(writer io.Writer, quality int32) (io.Writer, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(quality))),
+		zstd.WithEncoderConcurrency(1),
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	fw := &frameWriter{
+		writer:  writer,
+		encoder: encoder,
+	}
+	return fw, nil
+}
+
+type frameWriter struct {
+	writer  io.Writer
+	encoder *zstd.Encoder
+
+	buf    []byte
+	frame  []byte
+	header [12]byte
+}
+
+var _ io.WriteCloser = (*frameWriter)(nil)
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		if fw.buf == nil {
+			fw.buf = make([]byte, 0, FrameSize)
+		}
+
+		n := FrameSize - len(fw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		fw.buf = append(fw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(fw.buf) == FrameSize {
+			err := fw.flushFrame()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+func (fw *frameWriter) flushFrame() error {
+	fw.frame = fw.encoder.EncodeAll(fw.buf, fw.frame[:0])
+	fw.buf = fw.buf[:0]
+
+	binary.LittleEndian.PutUint32(fw.header[0:4], frameSizeMagic)
+	binary.LittleEndian.PutUint32(fw.header[4:8], 4)
+	binary.LittleEndian.PutUint32(fw.header[8:12], uint32(len(fw.frame)))
+
+	_, err := fw.writer.Write(fw.header[:])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = fw.writer.Write(fw.frame)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// Close writes the last frame. It does not close the underlying writer.
+func (fw *frameWriter) Close() error {
+	if len(fw.buf) > 0 {
+		err := fw.flushFrame()
+		if err != nil {
+			return err
+		}
+	}
+
+	return fw.encoder.Close()
+}
+
+func init() {
+	pwr.RegisterCompressor(pwr.CompressionAlgorithm_ZSTD, &zstdCompressor{})
+}
@@ -0,0 +1,312 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Skippable frames use magic numbers in the [0x184D2A50, 0x184D2A5F] range.
+// The one below is written by compressors/zstd before each frame, and holds
+// the size of the compressed frame that follows.
+const (
+	skippableMagicMin = 0x184D2A50
+	skippableMagicMax = 0x184D2A5F
+	frameSizeMagic    = 0x184D2A57
+)
+
+type zstdDecompressor struct{}
+
+func (zd *zstdDecompressor) Apply(source savior.Source) (savior.Source, error) {
+	return newSource(source), nil
+}
+
+func init() {
+	pwr.RegisterDecompressor(pwr.CompressionAlgorithm_ZSTD, &zstdDecompressor{})
+	gob.Register(&ZstdSourceCheckpoint{})
+}
+
+// A ZstdSourceCheckpoint is emitted in-between frames, so it only needs
+// to remember where the underlying source was at.
+type ZstdSourceCheckpoint struct {
+	SourceCheckpoint *savior.SourceCheckpoint
+}
+
+type zstdSource struct {
+	// input
+	source savior.Source
+
+	// internal
+	decoder *zstd.Decoder
+	offset  int64
+	roffset int64
+
+	// where the current frame starts in the underlying source
+	frameStart int64
+	frame      []byte
+	framePos   int
+	compressed []byte
+	header     []byte
+
+	// set when the stream contains frames that weren't preceded by
+	// their size: we can still decompress them, but not checkpoint.
+	stream *zstd.Decoder
+
+	bytebuf []byte
+
+	ssc              savior.SourceSaveConsumer
+	sourceCheckpoint *savior.SourceCheckpoint
+}
+
+var _ savior.Source = (*zstdSource)(nil)
+
+func newSource(source savior.Source) *zstdSource {
+	return &zstdSource{
+		source:  source,
+		header:  make([]byte, 8),
+		bytebuf: []byte{0x00},
+	}
+}
+
+func (zs *zstdSource) Features() savior.SourceFeatures {
+	return savior.SourceFeatures{
+		Name:          "zstd",
+		ResumeSupport: savior.ResumeSupportBlock,
+	}
+}
+
+func (zs *zstdSource) SetSourceSaveConsumer(ssc savior.SourceSaveConsumer) {
+	zs.ssc = ssc
+	zs.source.SetSourceSaveConsumer(&savior.CallbackSourceSaveConsumer{
+		OnSave: func(checkpoint *savior.SourceCheckpoint) error {
+			zs.sourceCheckpoint = checkpoint
+			return nil
+		},
+	})
+}
+
+func (zs *zstdSource) WantSave() {
+	zs.source.WantSave()
+}
+
+func (zs *zstdSource) Resume(checkpoint *savior.SourceCheckpoint) (int64, error) {
+	savior.Debugf(`zstdsource: asked to resume`)
+
+	if zs.decoder == nil {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		zs.decoder = decoder
+	}
+
+	zs.frame = zs.frame[:0]
+	zs.framePos = 0
+	zs.sourceCheckpoint = nil
+	if zs.stream != nil {
+		zs.stream.Close()
+		zs.stream = nil
+	}
+
+	if checkpoint != nil {
+		if ourCheckpoint, ok := checkpoint.Data.(*ZstdSourceCheckpoint); ok {
+			sourceOffset, err := zs.source.Resume(ourCheckpoint.SourceCheckpoint)
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+
+			if sourceOffset == ourCheckpoint.SourceCheckpoint.Offset {
+				zs.roffset = sourceOffset
+				zs.offset = checkpoint.Offset
+				return zs.offset, nil
+			}
+			savior.Debugf(`zstdsource: expected source to resume at %d but got %d`, ourCheckpoint.SourceCheckpoint.Offset, sourceOffset)
+		}
+	}
+
+	// start from beginning
+	sourceOffset, err := zs.source.Resume(nil)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if sourceOffset != 0 {
+		msg := fmt.Sprintf("zstdsource: expected source to resume at start but got %d", sourceOffset)
+		return 0, errors.New(msg)
+	}
+
+	zs.roffset = 0
+	zs.offset = 0
+	return 0, nil
+}
+
+func (zs *zstdSource) Read(buf []byte) (int, error) {
+	if zs.decoder == nil {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	if zs.stream != nil {
+		n, err := zs.stream.Read(buf)
+		zs.offset += int64(n)
+		return n, err
+	}
+
+	if zs.framePos == len(zs.frame) {
+		err := zs.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		if zs.stream != nil {
+			return zs.Read(buf)
+		}
+
+		if zs.sourceCheckpoint != nil {
+			err = zs.save()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n := copy(buf, zs.frame[zs.framePos:])
+	zs.framePos += n
+	zs.offset += int64(n)
+	return n, nil
+}
+
+// save emits a checkpoint if the underlying source saved right at
+// the start of the current frame, otherwise it tries again on the next one.
+func (zs *zstdSource) save() error {
+	sourceCheckpoint := zs.sourceCheckpoint
+	zs.sourceCheckpoint = nil
+
+	if sourceCheckpoint.Offset != zs.frameStart {
+		savior.Debugf("zstdsource: source saved at %d, not on frame boundary %d, trying again", sourceCheckpoint.Offset, zs.frameStart)
+		zs.source.WantSave()
+		return nil
+	}
+
+	if zs.ssc == nil {
+		savior.Debugf("zstdsource: can't save, ssc is nil!")
+		return nil
+	}
+
+	checkpoint := &savior.SourceCheckpoint{
+		Offset: zs.offset,
+		Data: &ZstdSourceCheckpoint{
+			SourceCheckpoint: sourceCheckpoint,
+		},
+	}
+	savior.Debugf("zstdsource: saving checkpoint at byte %d (source byte %d)", zs.offset, sourceCheckpoint.Offset)
+	return zs.ssc.Save(checkpoint)
+}
+
+func (zs *zstdSource) readFull(buf []byte) error {
+	n, err := io.ReadFull(zs.source, buf)
+	zs.roffset += int64(n)
+	return err
+}
+
+func (zs *zstdSource) nextFrame() error {
+	for {
+		zs.frameStart = zs.roffset
+
+		magicBuf := zs.header[:4]
+		err := zs.readFull(magicBuf)
+		if err != nil {
+			if err == io.EOF {
+				// clean end of stream
+				return io.EOF
+			}
+			return errors.WithStack(err)
+		}
+
+		magic := binary.LittleEndian.Uint32(magicBuf)
+		if magic < skippableMagicMin || magic > skippableMagicMax {
+			savior.Debugf("zstdsource: found a frame without size, won't be able to checkpoint anymore")
+			stream, err := zstd.NewReader(io.MultiReader(bytes.NewReader(append([]byte{}, magicBuf...)), zs.source), zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			zs.stream = stream
+			return nil
+		}
+
+		err = zs.readFull(zs.header[:4])
+		if err != nil {
+			return errors.WithStack(noEOF(err))
+		}
+		skippableSize := int64(binary.LittleEndian.Uint32(zs.header[:4]))
+
+		if magic != frameSizeMagic || skippableSize != 4 {
+			// some other skippable frame, not for us
+			err = savior.DiscardByRead(zs.source, skippableSize)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			zs.roffset += skippableSize
+			continue
+		}
+
+		err = zs.readFull(zs.header[:4])
+		if err != nil {
+			return errors.WithStack(noEOF(err))
+		}
+		frameSize := int(binary.LittleEndian.Uint32(zs.header[:4]))
+
+		if cap(zs.compressed) < frameSize {
+			zs.compressed = make([]byte, frameSize)
+		}
+		zs.compressed = zs.compressed[:frameSize]
+
+		err = zs.readFull(zs.compressed)
+		if err != nil {
+			return errors.WithStack(noEOF(err))
+		}
+
+		zs.frame, err = zs.decoder.DecodeAll(zs.compressed, zs.frame[:0])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		zs.framePos = 0
+
+		if len(zs.frame) == 0 {
+			// empty frame, keep looking
+			continue
+		}
+		return nil
+	}
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (zs *zstdSource) ReadByte() (byte, error) {
+	if zs.decoder == nil {
+		return 0, errors.WithStack(savior.ErrUninitializedSource)
+	}
+
+	// Read never returns 0 bytes without an error, because frames
+	// are never empty.
+	_, err := zs.Read(zs.bytebuf)
+	return zs.bytebuf[0], err
+}
+
+func (zs *zstdSource) Progress() float64 {
+	// the size of the uncompressed stream isn't known until we're done
+	// decompressing it, the underlying source's progress is a good
+	// enough approximation.
+	return zs.source.Progress()
+}
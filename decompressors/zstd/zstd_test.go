@@ -0,0 +1,95 @@
+package zstd_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/savior/checker"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/savior/semirandom"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/itchio/wharf/compressors/zstd"
+	_ "github.com/itchio/wharf/decompressors/zstd"
+)
+
+func compress(t *testing.T, reference []byte) []byte {
+	buf := new(bytes.Buffer)
+	wc, err := pwr.CompressWire(wire.NewWriteContext(buf), &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+		Quality:   3,
+	})
+	assert.NoError(t, err)
+
+	_, err = wc.Writer().Write(reference)
+	assert.NoError(t, err)
+	assert.NoError(t, wc.Close())
+
+	return buf.Bytes()
+}
+
+func decompressor(t *testing.T, compressed []byte) savior.Source {
+	rc := wire.NewReadContext(seeksource.FromBytes(compressed))
+	_, err := rc.GetSource().Resume(nil)
+	assert.NoError(t, err)
+
+	drc, err := pwr.DecompressWire(rc, &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+	})
+	assert.NoError(t, err)
+
+	return drc.GetSource()
+}
+
+func Test_EmptyStream(t *testing.T) {
+	rc := wire.NewReadContext(seeksource.FromBytes(nil))
+	_, err := rc.GetSource().Resume(nil)
+	assert.NoError(t, err)
+
+	drc, err := pwr.DecompressWire(rc, &pwr.CompressionSettings{
+		Algorithm: pwr.CompressionAlgorithm_ZSTD,
+	})
+	assert.NoError(t, err)
+
+	// empty streams are valid
+	_, err = drc.GetSource().Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, errors.Cause(err))
+}
+
+func Test_Checkpoints(t *testing.T) {
+	reference := semirandom.Bytes(18 * 1024 * 1024 /* spans a few frames */)
+	compressed := compress(t, reference)
+	assert.True(t, len(compressed) < len(reference))
+
+	checker.RunSourceTest(t, decompressor(t, compressed), reference)
+}
+
+func Test_StandardDecoder(t *testing.T) {
+	reference := semirandom.Bytes(6 * 1024 * 1024)
+	compressed := compress(t, reference)
+
+	// size-prefixed frames are still regular zstd streams
+	dec, err := zstd.NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	defer dec.Close()
+
+	output, err := ioutil.ReadAll(dec)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(reference, output))
+
+	// and we can read streams written by other encoders, without checkpoints
+	enc, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	standard := enc.EncodeAll(reference, nil)
+
+	output, err = ioutil.ReadAll(decompressor(t, standard))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(reference, output))
+}
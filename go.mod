@@ -13,15 +13,17 @@ require (
 	github.com/itchio/go-brotli v0.0.0-20190702114328-3f28d645a45c
 	github.com/itchio/headway v0.0.0-20200301160421-e15721f23905
 	github.com/itchio/httpkit v0.0.0-20200618110940-5044e418b971
+	github.com/itchio/kompress v0.0.0-20200301155538-5c2eecce9e51
 	github.com/itchio/lake v0.0.0-20200305150023-cc4284ec2b2a
 	github.com/itchio/ox v0.0.0-20200301160301-4e131878ba64 // indirect
 	github.com/itchio/randsource v0.0.0-20190703104731-3f6d22f91927
 	github.com/itchio/savior v0.0.0-20200303195615-7cac7998294c
 	github.com/itchio/screw v0.0.0-20200301160148-75fc2d65fb38
 	github.com/jgallagher/gosaca v0.0.0-20130226042358-754749770f08
-	github.com/klauspost/compress v1.10.9 // indirect
+	github.com/klauspost/compress v1.10.9
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20200602114024-627f9648deb9 // indirect
 	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1 // indirect
 	golang.org/x/text v0.3.3 // indirect
@@ -0,0 +1,153 @@
+// Package mempool implements a lake.WritablePool that keeps
+// the contents of every file in memory.
+package mempool
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
+)
+
+// A MemPool holds the contents of the files of a container in memory.
+// Its container describes everything else: dirs, symlinks, and modes.
+type MemPool struct {
+	container *tlc.Container
+
+	lock  sync.Mutex
+	files map[int64][]byte
+}
+
+var _ lake.Pool = (*MemPool)(nil)
+var _ lake.WritablePool = (*MemPool)(nil)
+
+// New returns an empty MemPool for the given container
+func New(container *tlc.Container) *MemPool {
+	return &MemPool{
+		container: container,
+		files:     make(map[int64][]byte),
+	}
+}
+
+// Container returns the container this pool was created with
+func (mp *MemPool) Container() *tlc.Container {
+	return mp.container
+}
+
+// GetSize returns the size of a file, as specified by the container
+func (mp *MemPool) GetSize(fileIndex int64) int64 {
+	return mp.container.Files[fileIndex].Size
+}
+
+// GetReader returns a reader for the current contents of a file
+func (mp *MemPool) GetReader(fileIndex int64) (io.Reader, error) {
+	return mp.GetReadSeeker(fileIndex)
+}
+
+// GetReadSeeker returns a read-seeker for the current contents of a file
+func (mp *MemPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error) {
+	if fileIndex < 0 || fileIndex >= int64(len(mp.container.Files)) {
+		return nil, errors.Errorf("mempool: no such file %d", fileIndex)
+	}
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	// writers never modify bytes that were already handed out,
+	// so there's no need to copy them.
+	return bytes.NewReader(mp.files[fileIndex]), nil
+}
+
+// Bytes returns a copy of the current contents of a file
+func (mp *MemPool) Bytes(fileIndex int64) []byte {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	return append([]byte(nil), mp.files[fileIndex]...)
+}
+
+// GetWriter truncates a file and returns a writer for it
+func (mp *MemPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
+	return mp.GetWriterAt(fileIndex, 0)
+}
+
+// GetWriterAt truncates (or zero-extends) a file to offset, and returns
+// a writer that appends to it.
+func (mp *MemPool) GetWriterAt(fileIndex int64, offset int64) (io.WriteCloser, error) {
+	if fileIndex < 0 || fileIndex >= int64(len(mp.container.Files)) {
+		return nil, errors.Errorf("mempool: no such file %d", fileIndex)
+	}
+
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	data := mp.files[fileIndex]
+	if int64(len(data)) >= offset {
+		// cap the slice so the next append allocates a fresh one,
+		// instead of overwriting what readers may still be looking at.
+		data = data[:offset:offset]
+	} else {
+		data = append(data, make([]byte, offset-int64(len(data)))...)
+	}
+	mp.files[fileIndex] = data
+
+	return &memWriter{pool: mp, fileIndex: fileIndex}, nil
+}
+
+// Sizes returns the size of all the files written so far, by index
+func (mp *MemPool) Sizes() map[int64]int64 {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	res := make(map[int64]int64, len(mp.files))
+	for fileIndex, data := range mp.files {
+		res[fileIndex] = int64(len(data))
+	}
+	return res
+}
+
+// Rewind truncates files back to the sizes returned by an earlier
+// call to Sizes, and forgets files that were written since.
+func (mp *MemPool) Rewind(sizes map[int64]int64) error {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	for fileIndex, size := range sizes {
+		data := mp.files[fileIndex]
+		if int64(len(data)) < size {
+			return errors.Errorf("mempool: file %d has %d bytes, expected at least %d", fileIndex, len(data), size)
+		}
+	}
+
+	files := make(map[int64][]byte, len(sizes))
+	for fileIndex, size := range sizes {
+		files[fileIndex] = mp.files[fileIndex][:size:size]
+	}
+	mp.files = files
+	return nil
+}
+
+// Close does nothing, readers don't hold any resources
+func (mp *MemPool) Close() error {
+	return nil
+}
+
+type memWriter struct {
+	pool      *MemPool
+	fileIndex int64
+}
+
+func (mw *memWriter) Write(buf []byte) (int, error) {
+	mw.pool.lock.Lock()
+	defer mw.pool.lock.Unlock()
+
+	mw.pool.files[mw.fileIndex] = append(mw.pool.files[mw.fileIndex], buf...)
+	return len(buf), nil
+}
+
+func (mw *memWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,144 @@
+package mempool_test
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pools/mempool"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContainer() *tlc.Container {
+	return &tlc.Container{
+		Files: []*tlc.File{
+			{Path: "a", Size: 6},
+			{Path: "b", Size: 4},
+		},
+	}
+}
+
+func write(t *testing.T, w io.WriteCloser, s string) {
+	_, err := w.Write([]byte(s))
+	wtest.Must(t, err)
+	wtest.Must(t, w.Close())
+}
+
+func readAll(t *testing.T, mp *mempool.MemPool, fileIndex int64) string {
+	r, err := mp.GetReader(fileIndex)
+	wtest.Must(t, err)
+	buf, err := ioutil.ReadAll(r)
+	wtest.Must(t, err)
+	return string(buf)
+}
+
+func Test_GetWriterAt(t *testing.T) {
+	mp := mempool.New(testContainer())
+
+	w, err := mp.GetWriter(0)
+	wtest.Must(t, err)
+	write(t, w, "abcdef")
+	assert.EqualValues(t, "abcdef", readAll(t, mp, 0))
+
+	// truncates
+	w, err = mp.GetWriterAt(0, 2)
+	wtest.Must(t, err)
+	write(t, w, "XY")
+	assert.EqualValues(t, "abXY", readAll(t, mp, 0))
+
+	// zero-extends
+	w, err = mp.GetWriterAt(1, 3)
+	wtest.Must(t, err)
+	write(t, w, "z")
+	assert.EqualValues(t, "\x00\x00\x00z", readAll(t, mp, 1))
+
+	_, err = mp.GetWriterAt(2, 0)
+	assert.Error(t, err)
+	_, err = mp.GetWriterAt(-1, 0)
+	assert.Error(t, err)
+	_, err = mp.GetReader(2)
+	assert.Error(t, err)
+}
+
+func Test_Rewind(t *testing.T) {
+	mp := mempool.New(testContainer())
+
+	w, err := mp.GetWriter(0)
+	wtest.Must(t, err)
+	write(t, w, "abc")
+
+	sizes := mp.Sizes()
+	assert.EqualValues(t, map[int64]int64{0: 3}, sizes)
+
+	w, err = mp.GetWriterAt(0, 3)
+	wtest.Must(t, err)
+	write(t, w, "def")
+	w, err = mp.GetWriter(1)
+	wtest.Must(t, err)
+	write(t, w, "ghij")
+
+	wtest.Must(t, mp.Rewind(sizes))
+	assert.EqualValues(t, "abc", readAll(t, mp, 0))
+	assert.EqualValues(t, "", readAll(t, mp, 1), "files written since are forgotten")
+	assert.EqualValues(t, sizes, mp.Sizes())
+
+	// a file can't be rewound to a size it never had
+	w, err = mp.GetWriterAt(0, 1)
+	wtest.Must(t, err)
+	wtest.Must(t, w.Close())
+	assert.Error(t, mp.Rewind(sizes))
+}
+
+func Test_ReadersSurviveWrites(t *testing.T) {
+	mp := mempool.New(testContainer())
+
+	w, err := mp.GetWriter(0)
+	wtest.Must(t, err)
+	write(t, w, "abcdef")
+
+	r, err := mp.GetReader(0)
+	wtest.Must(t, err)
+
+	// overwrite the tail of the file, then rewind it away entirely
+	sizes := map[int64]int64{0: 0}
+	w, err = mp.GetWriterAt(0, 2)
+	wtest.Must(t, err)
+	write(t, w, "XYZW")
+	wtest.Must(t, mp.Rewind(sizes))
+	w, err = mp.GetWriter(0)
+	wtest.Must(t, err)
+	write(t, w, "123456")
+
+	buf, err := ioutil.ReadAll(r)
+	wtest.Must(t, err)
+	assert.EqualValues(t, "abcdef", string(buf), "readers see the bytes they were handed")
+	assert.EqualValues(t, "123456", readAll(t, mp, 0))
+
+	// readers and writers going at it at the same time, for -race
+	w, err = mp.GetWriter(1)
+	wtest.Must(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_, err := w.Write([]byte{byte(i)})
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, w.Close())
+	}()
+
+	for i := 0; i < 100; i++ {
+		s := readAll(t, mp, 1)
+		for j := 0; j < len(s); j++ {
+			assert.EqualValues(t, byte(j), s[j])
+		}
+	}
+	wg.Wait()
+
+	assert.Len(t, mp.Bytes(1), 1000)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"sync"
 
 	"github.com/itchio/headway/counter"
@@ -18,6 +17,8 @@ import (
 	"github.com/itchio/wharf/ctxcopy"
 	"github.com/itchio/wharf/werrors"
 
+	"github.com/itchio/savior/seeksource"
+
 	"github.com/itchio/arkive/zip"
 
 	"github.com/itchio/lake"
@@ -36,6 +37,11 @@ type ArchiveHealer struct {
 	// an eos path for the archive
 	ArchivePath string
 
+	// an eos path for a zip index of the archive (optional). When set, only
+	// the wounded parts of files are healed, by decompressing from the closest
+	// sync point, instead of redownloading whole files.
+	IndexPath string
+
 	archiveFile    eos.File
 	archiveFileErr error
 	archiveLock    sync.Mutex
@@ -54,10 +60,15 @@ type ArchiveHealer struct {
 
 	container *tlc.Container
 
+	// what has been healed so far, for checkpoints
+	healedFiles  map[int64]bool
+	healedWounds map[woundKey]bool
+	healedMutex  sync.Mutex
+
 	lockMap LockMap
 }
 
-var _ Healer = (*ArchiveHealer)(nil)
+var _ ResumableHealer = (*ArchiveHealer)(nil)
 
 type chunkHealedFunc func(chunkHealed int64)
 
@@ -68,8 +79,15 @@ func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container,
 
 	ah.container = container
 
+	ah.healedMutex.Lock()
+	ah.healedFiles = make(map[int64]bool)
+	ah.healedWounds = make(map[woundKey]bool)
+	ah.healedMutex.Unlock()
+
+	indexed := ah.IndexPath != ""
 	files := make(map[int64]bool)
 	fileIndices := make(chan int64, len(container.Files))
+	fileWounds := make(chan *Wound, 1024)
 
 	targetPool := fspool.New(container, ah.Target)
 
@@ -89,7 +107,11 @@ func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container,
 	}()
 
 	go func() {
-		errs <- ah.heal(ctx, container, targetPool, fileIndices, onChunkHealed)
+		if indexed {
+			errs <- ah.healIndexed(ctx, container, fileWounds, onChunkHealed)
+		} else {
+			errs <- ah.heal(ctx, container, targetPool, fileIndices, onChunkHealed)
+		}
 	}()
 
 	processWound := func(wound *Wound) error {
@@ -100,63 +122,35 @@ func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container,
 
 		switch wound.Kind {
 		case WoundKind_DIR:
-			dirEntry := container.Dirs[wound.Index]
-			path := filepath.Join(ah.Target, filepath.FromSlash(dirEntry.Path))
-
-			stats, err := os.Lstat(path)
-			if err == nil {
-				if stats.IsDir() {
-					ah.Consumer.Debugf("For dir wound, found existing dir (%s), all good", path)
-					return nil
-				} else {
-					ah.Consumer.Debugf("For dir wound, found file/symlink (%s), removing", path)
-					err = os.Remove(path)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-				}
-			}
-
-			ah.Consumer.Debugf("For dir wound, doing MkdirAll (%s)", path)
-			err = os.MkdirAll(path, 0o755)
+			err := healDirWound(ah.Consumer, ah.Target, container, wound)
 			if err != nil {
-				return errors.WithStack(err)
+				return err
 			}
 
 		case WoundKind_SYMLINK:
-			symlinkEntry := container.Symlinks[wound.Index]
-			path := filepath.Join(ah.Target, filepath.FromSlash(symlinkEntry.Path))
-
-			dir := filepath.Dir(path)
-			err := os.MkdirAll(dir, 0o755)
+			err := healSymlinkWound(ah.Consumer, ah.Target, container, wound)
 			if err != nil {
-				return errors.WithStack(err)
+				return err
 			}
 
-			stats, err := os.Lstat(path)
-			if err == nil {
-				if stats.IsDir() {
-					ah.Consumer.Debugf("For symlink wound, found dir (%s), doing RemoveAll", path)
-					err = os.RemoveAll(path)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-				} else {
-					ah.Consumer.Debugf("For symlink wound, found file/symlink (%s), doing Remove", path)
-					err = os.Remove(path)
-					if err != nil {
-						return errors.WithStack(err)
-					}
-				}
-			}
+		case WoundKind_FILE:
+			if indexed {
+				ah.Consumer.ProgressLabel(container.Files[wound.Index].Path)
 
-			ah.Consumer.Debugf("For symlink wound, doing Symlink (%s) => (%s)", path, symlinkEntry.Dest)
-			err = os.Symlink(symlinkEntry.Dest, path)
-			if err != nil {
-				return errors.WithStack(err)
+				ah.progressMutex.Lock()
+				ah.totalHealing += wound.Size()
+				ah.progressMutex.Unlock()
+				ah.updateProgress()
+
+				select {
+				case err := <-errs:
+					return errors.WithStack(err)
+				case fileWounds <- wound:
+					// queued for work!
+				}
+				return nil
 			}
 
-		case WoundKind_FILE:
 			if files[wound.Index] {
 				// already queued
 				return nil
@@ -216,6 +210,7 @@ func (ah *ArchiveHealer) Do(parentCtx context.Context, container *tlc.Container,
 
 	// queued everything
 	close(fileIndices)
+	close(fileWounds)
 
 	err := <-errs
 	if err != nil {
@@ -281,10 +276,161 @@ func (ah *ArchiveHealer) heal(ctx context.Context, container *tlc.Container, tar
 			if err != nil {
 				return errors.WithStack(err)
 			}
+
+			ah.healedMutex.Lock()
+			ah.healedFiles[fileIndex] = true
+			ah.healedMutex.Unlock()
 		}
 	}
 }
 
+func (ah *ArchiveHealer) healIndexed(ctx context.Context, container *tlc.Container, fileWounds chan *Wound, chunkHealed chunkHealedFunc) error {
+	var index *ZipIndex
+	unlocked := make(map[int64]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// something else stopped the healing
+			return nil
+		case wound, ok := <-fileWounds:
+			if !ok {
+				// no more wounds to heal
+				return nil
+			}
+
+			// lazily read index
+			if index == nil {
+				var err error
+				index, err = ah.readIndex()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+
+			if ah.lockMap != nil && !unlocked[wound.Index] {
+				select {
+				case <-ah.lockMap[wound.Index]:
+					unlocked[wound.Index] = true
+				case <-ctx.Done():
+					return werrors.ErrCancelled
+				}
+			}
+
+			err := ah.healWound(ctx, index, wound, chunkHealed)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			ah.healedMutex.Lock()
+			ah.healedWounds[keyOfWound(wound)] = true
+			ah.healedMutex.Unlock()
+		}
+	}
+}
+
+func (ah *ArchiveHealer) readIndex() (*ZipIndex, error) {
+	file, err := eos.Open(ah.IndexPath, option.WithConsumer(ah.Consumer))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	source := seeksource.FromFile(file)
+	_, err = source.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	index, err := ReadZipIndex(source)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	archiveFile, err := ah.openArchive()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stat, err := archiveFile.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if stat.Size() != index.ArchiveSize {
+		return nil, errors.Errorf("zip index is for a %s archive, but (%s) is %s",
+			united.FormatBytes(index.ArchiveSize), ah.ArchivePath, united.FormatBytes(stat.Size()))
+	}
+
+	return index, nil
+}
+
+// healWound decompresses only the wounded part of a file, starting from the
+// closest sync point in the zip index.
+func (ah *ArchiveHealer) healWound(ctx context.Context, index *ZipIndex, wound *Wound, chunkHealed chunkHealedFunc) error {
+	f := ah.container.Files[wound.Index]
+
+	ah.Consumer.Debugf("Healing (%s) %s into %s, with index", f.Path, united.FormatBytes(wound.Size()), united.FormatBytes(wound.Start))
+
+	entry := index.FindEntry(f.Path)
+	if entry == nil {
+		return errors.Errorf("(%s): not found in zip index", f.Path)
+	}
+
+	if entry.UncompressedSize != f.Size {
+		return errors.Errorf("(%s): is %s in zip index, but %s in container",
+			f.Path, united.FormatBytes(entry.UncompressedSize), united.FormatBytes(f.Size))
+	}
+
+	writer, err := openFileWoundTarget(ah.Consumer, ah.Target, ah.container, wound)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer writer.Close()
+
+	end := wound.End
+	if end > f.Size {
+		end = f.Size
+	}
+	if wound.Start >= end {
+		return nil
+	}
+
+	archiveFile, err := ah.openArchive()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	reader, err := entry.NewReaderAt(archiveFile, wound.Start)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer reader.Close()
+
+	_, err = writer.Seek(wound.Start, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	lastCount := int64(0)
+	cw := counter.NewWriterCallback(func(count int64) {
+		chunk := count - lastCount
+		chunkHealed(chunk)
+		lastCount = count
+	}, writer)
+
+	copied, err := ctxcopy.Do(ctx, cw, io.LimitReader(reader, end-wound.Start))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if copied != end-wound.Start {
+		return errors.Errorf("(%s): healed %s, expected %s", f.Path, united.FormatBytes(copied), united.FormatBytes(end-wound.Start))
+	}
+
+	return nil
+}
+
 func (ah *ArchiveHealer) healOne(ctx context.Context, sourcePool lake.Pool, targetPool lake.WritablePool, fileIndex int64, chunkHealed chunkHealedFunc) error {
 	if ah.lockMap != nil {
 		lock := ah.lockMap[fileIndex]
@@ -339,6 +485,15 @@ func (ah *ArchiveHealer) healOne(ctx context.Context, sourcePool lake.Pool, targ
 	return err
 }
 
+// IsHealed returns true if a wound like the given one (received by Do) has been
+// healed, either on its own or because its whole file was healed.
+func (ah *ArchiveHealer) IsHealed(wound *Wound) bool {
+	ah.healedMutex.Lock()
+	defer ah.healedMutex.Unlock()
+
+	return ah.healedWounds[keyOfWound(wound)] || ah.healedFiles[wound.Index]
+}
+
 // HasWounds returns true if the healer ever received wounds
 func (ah *ArchiveHealer) HasWounds() bool {
 	return ah.hasWounds
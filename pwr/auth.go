@@ -0,0 +1,530 @@
+package pwr
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding"
+	"encoding/gob"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/savior"
+	"github.com/pkg/errors"
+)
+
+// ErrUnsigned is returned when a patch or signature file that must be
+// signed with a trusted key doesn't have an authentication trailer
+var ErrUnsigned = errors.New("file is not signed")
+
+// ErrUntrustedKey is returned when a file is signed with a key that
+// isn't part of the trusted key set
+var ErrUntrustedKey = errors.New("file is signed with an untrusted key")
+
+// ErrBadAuthSignature is returned when the signature of a file doesn't
+// match its contents
+var ErrBadAuthSignature = errors.New("file signature does not match its contents")
+
+// the trailer ends with its length and AuthTrailerMagic, both 4 bytes
+const authTrailerFooterSize = 8
+
+// maxAuthTrailerSize guards against reading garbage as a trailer length
+const maxAuthTrailerSize = 1024
+
+// authDomain is prepended to the digest being signed, so that keys used
+// for wharf files can't be tricked into signing anything else
+const authDomain = "itch.io wharf auth v1\x00"
+
+// A KeySet is a set of trusted Ed25519 public keys
+type KeySet struct {
+	keys map[string]bool
+}
+
+// NewKeySet returns a key set that trusts all the given keys
+func NewKeySet(keys ...ed25519.PublicKey) *KeySet {
+	ks := &KeySet{
+		keys: make(map[string]bool),
+	}
+	for _, key := range keys {
+		ks.Add(key)
+	}
+	return ks
+}
+
+// Add marks a key as trusted
+func (ks *KeySet) Add(key ed25519.PublicKey) {
+	ks.keys[string(key)] = true
+}
+
+// Trusts returns true if the given public key is part of the set
+func (ks *KeySet) Trusts(key []byte) bool {
+	return ks != nil && len(key) == ed25519.PublicKeySize && ks.keys[string(key)]
+}
+
+// A SigningWriter hashes everything written through it, so that an
+// authentication trailer can be appended once the file is complete.
+type SigningWriter struct {
+	writer io.Writer
+	key    ed25519.PrivateKey
+	hasher hash.Hash
+}
+
+var _ io.Writer = (*SigningWriter)(nil)
+
+// NewSigningWriter returns a writer that signs everything written to w with key
+func NewSigningWriter(w io.Writer, key ed25519.PrivateKey) *SigningWriter {
+	return &SigningWriter{
+		writer: w,
+		key:    key,
+		hasher: sha256.New(),
+	}
+}
+
+func (sw *SigningWriter) Write(buf []byte) (int, error) {
+	n, err := sw.writer.Write(buf)
+	sw.hasher.Write(buf[:n])
+	return n, err
+}
+
+// WriteTrailer appends the authentication trailer. It must be called
+// once, after the whole file has been written.
+func (sw *SigningWriter) WriteTrailer() error {
+	if len(sw.key) != ed25519.PrivateKeySize {
+		return errors.Errorf("invalid signing key: expected %d bytes, got %d", ed25519.PrivateKeySize, len(sw.key))
+	}
+
+	trailer := &AuthTrailer{
+		PublicKey: sw.key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(sw.key, authMessage(sw.hasher.Sum(nil))),
+	}
+
+	buf, err := proto.Marshal(trailer)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	footer := make([]byte, authTrailerFooterSize)
+	Endianness.PutUint32(footer[0:4], uint32(len(buf)))
+	Endianness.PutUint32(footer[4:8], uint32(AuthTrailerMagic))
+	buf = append(buf, footer...)
+
+	_, err = sw.writer.Write(buf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func authMessage(digest []byte) []byte {
+	return append([]byte(authDomain), digest...)
+}
+
+// ReadAuthTrailer looks for an authentication trailer at the end of source.
+// It returns the trailer (or nil if the file isn't signed) and the size of
+// the data that precedes it. The source needs to be resumed afterwards.
+func ReadAuthTrailer(source savior.SeekSource) (*AuthTrailer, int64, error) {
+	size := source.Size()
+	if size < authTrailerFooterSize {
+		return nil, size, nil
+	}
+
+	footer := make([]byte, authTrailerFooterSize)
+	err := readAt(source, footer, size-authTrailerFooterSize)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	if int32(Endianness.Uint32(footer[4:8])) != AuthTrailerMagic {
+		return nil, size, nil
+	}
+
+	trailerSize := int64(Endianness.Uint32(footer[0:4]))
+	if trailerSize > maxAuthTrailerSize || trailerSize > size-authTrailerFooterSize {
+		return nil, 0, errors.Errorf("malformed authentication trailer: invalid size %d", trailerSize)
+	}
+
+	payloadSize := size - authTrailerFooterSize - trailerSize
+	buf := make([]byte, trailerSize)
+	err = readAt(source, buf, payloadSize)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	trailer := &AuthTrailer{}
+	err = proto.Unmarshal(buf, trailer)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "malformed authentication trailer")
+	}
+	return trailer, payloadSize, nil
+}
+
+func readAt(source savior.SeekSource, buf []byte, offset int64) error {
+	_, err := source.Resume(&savior.SourceCheckpoint{Offset: offset})
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(source, buf)
+	return err
+}
+
+// VerifyAuthTrailer checks that source is signed by one of the keys of ks,
+// and returns the size of the data covered by the signature. The source needs
+// to be resumed afterwards.
+func VerifyAuthTrailer(source savior.SeekSource, ks *KeySet) (int64, error) {
+	as, err := newAuthSource(source, ks)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	err = FinishAuthentication(as)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return as.Size(), nil
+}
+
+// AuthenticateSource checks that source is signed by one of the keys of ks,
+// and returns a resumed source that only covers the signed data. That data is
+// hashed as it's read, so it's only ever read once: reading up to its end
+// fails with ErrBadAuthSignature if it doesn't match the signature. Call
+// FinishAuthentication before trusting anything read from it.
+// If ks is nil, source is returned as-is.
+func AuthenticateSource(source savior.SeekSource, ks *KeySet) (savior.SeekSource, error) {
+	if ks == nil {
+		return source, nil
+	}
+
+	as, err := newAuthSource(source, ks)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return as, nil
+}
+
+// VerifySource reads all of the signed data of source to check that it's signed
+// by one of the keys of ks, so that nothing of it is used before it's known to
+// be trusted. It returns a resumed source that only covers the signed data.
+// If ks is nil, source is returned as-is.
+func VerifySource(source savior.SeekSource, ks *KeySet) (savior.SeekSource, error) {
+	if ks == nil {
+		return source, nil
+	}
+
+	payloadSize, err := VerifyAuthTrailer(source, ks)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	section, err := source.Section(0, payloadSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = section.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return section, nil
+}
+
+// FinishAuthentication reads the part of the signed data of a source returned
+// by AuthenticateSource that hasn't been read yet, if any, and returns an error
+// if the data doesn't match the signature. It does nothing for sources that
+// aren't authenticated.
+func FinishAuthentication(source savior.SeekSource) error {
+	as, ok := source.(*authSource)
+	if !ok {
+		return nil
+	}
+
+	auth := as.auth
+	if auth.err != nil || auth.verified {
+		return auth.err
+	}
+
+	// pick up where the last read stopped, which
+	// might have been through another section
+	if as.start+as.Tell() != auth.hashed {
+		_, err := as.Resume(&savior.SourceCheckpoint{Offset: auth.hashed - as.start})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	_, err := io.Copy(ioutil.Discard, as)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !auth.verified {
+		return errors.WithStack(ErrBadAuthSignature)
+	}
+	return nil
+}
+
+// AuthError is used when reading from a source returned by AuthenticateSource
+// failed with err. If the signed data doesn't match its signature, corrupt data
+// is the likely cause, so it returns ErrBadAuthSignature instead of err.
+func AuthError(source savior.SeekSource, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if aErr := FinishAuthentication(source); errors.Cause(aErr) == ErrBadAuthSignature {
+		return aErr
+	}
+	return err
+}
+
+// AuthSourceCheckpoint lets an authenticated source resume partway
+// through its signed data, without hashing it all over again.
+type AuthSourceCheckpoint struct {
+	// Hashed is how much of the signed data was hashed
+	Hashed int64
+	// HashState is the state of the hasher, as marshalled by sha256
+	HashState []byte
+	// Data is the checkpoint data of the source being authenticated
+	Data interface{}
+}
+
+// authState hashes the signed data of an authenticated source as it's read.
+// It's shared by all sections of that source.
+type authState struct {
+	trailer *AuthTrailer
+	size    int64
+
+	hasher hash.Hash
+	hashed int64
+
+	verified bool
+	err      error
+}
+
+func (auth *authState) consume(offset int64, buf []byte) error {
+	if auth.err != nil {
+		return auth.err
+	}
+
+	if offset != auth.hashed {
+		auth.err = errors.Errorf("authentication: read signed data at %d, expected %d", offset, auth.hashed)
+		return auth.err
+	}
+
+	auth.hasher.Write(buf)
+	auth.hashed += int64(len(buf))
+	return auth.check()
+}
+
+func (auth *authState) check() error {
+	if auth.verified || auth.hashed < auth.size {
+		return nil
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(auth.trailer.PublicKey), authMessage(auth.hasher.Sum(nil)), auth.trailer.Signature) {
+		auth.err = errors.WithStack(ErrBadAuthSignature)
+		return auth.err
+	}
+	auth.verified = true
+	return nil
+}
+
+// seek makes sure reading at offset doesn't skip (or re-read)
+// any data that wasn't hashed, restoring the hasher from ac if set.
+func (auth *authState) seek(offset int64, ac *AuthSourceCheckpoint) error {
+	if ac != nil {
+		if ac.Hashed != offset {
+			return errors.Errorf("authentication: checkpoint hashed %d bytes, but resumes at %d", ac.Hashed, offset)
+		}
+
+		hasher := sha256.New()
+		err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(ac.HashState)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		auth.hasher = hasher
+		auth.hashed = offset
+		auth.verified = false
+		auth.err = nil
+		return auth.check()
+	}
+
+	if offset == 0 {
+		// starting over
+		auth.hasher.Reset()
+		auth.hashed = 0
+		auth.verified = false
+		auth.err = nil
+		return nil
+	}
+
+	if offset != auth.hashed {
+		return errors.Errorf("authentication: can't resume signed data at %d, only %d bytes were hashed", offset, auth.hashed)
+	}
+	return nil
+}
+
+// authSource reads (a section of) the signed data of a source,
+// and has it hashed by auth along the way.
+type authSource struct {
+	source savior.SeekSource
+	start  int64
+	auth   *authState
+}
+
+var _ savior.SeekSource = (*authSource)(nil)
+
+func newAuthSource(source savior.SeekSource, ks *KeySet) (*authSource, error) {
+	trailer, payloadSize, err := ReadAuthTrailer(source)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if trailer == nil {
+		return nil, errors.WithStack(ErrUnsigned)
+	}
+
+	if !ks.Trusts(trailer.PublicKey) {
+		return nil, errors.WithStack(ErrUntrustedKey)
+	}
+
+	section, err := source.Section(0, payloadSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	as := &authSource{
+		source: section,
+		auth: &authState{
+			trailer: trailer,
+			size:    payloadSize,
+			hasher:  sha256.New(),
+		},
+	}
+
+	_, err = as.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return as, nil
+}
+
+func (as *authSource) Resume(c *savior.SourceCheckpoint) (int64, error) {
+	var ac *AuthSourceCheckpoint
+	if c != nil {
+		c = &savior.SourceCheckpoint{
+			Offset: c.Offset,
+			Data:   c.Data,
+		}
+		if data, ok := c.Data.(*AuthSourceCheckpoint); ok {
+			ac = data
+			c.Data = data.Data
+		}
+	}
+
+	offset, err := as.source.Resume(c)
+	if err != nil {
+		return offset, errors.WithStack(err)
+	}
+
+	err = as.auth.seek(as.start+offset, ac)
+	if err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (as *authSource) SetSourceSaveConsumer(ssc savior.SourceSaveConsumer) {
+	as.source.SetSourceSaveConsumer(&authSaveConsumer{as: as, ssc: ssc})
+}
+
+func (as *authSource) WantSave() {
+	as.source.WantSave()
+}
+
+func (as *authSource) Progress() float64 {
+	return as.source.Progress()
+}
+
+func (as *authSource) Features() savior.SourceFeatures {
+	return as.source.Features()
+}
+
+func (as *authSource) Tell() int64 {
+	return as.source.Tell()
+}
+
+func (as *authSource) Size() int64 {
+	return as.source.Size()
+}
+
+func (as *authSource) Section(start int64, size int64) (savior.SeekSource, error) {
+	section, err := as.source.Section(start, size)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &authSource{
+		source: section,
+		start:  as.start + start,
+		auth:   as.auth,
+	}, nil
+}
+
+func (as *authSource) Read(buf []byte) (int, error) {
+	offset := as.start + as.source.Tell()
+	n, err := as.source.Read(buf)
+
+	aErr := as.auth.consume(offset, buf[:n])
+	if aErr != nil {
+		return n, aErr
+	}
+	return n, err
+}
+
+func (as *authSource) ReadByte() (byte, error) {
+	offset := as.start + as.source.Tell()
+	b, err := as.source.ReadByte()
+	if err != nil {
+		return b, err
+	}
+
+	err = as.auth.consume(offset, []byte{b})
+	if err != nil {
+		return b, err
+	}
+	return b, nil
+}
+
+// authSaveConsumer adds the state of the hasher to checkpoints
+type authSaveConsumer struct {
+	as  *authSource
+	ssc savior.SourceSaveConsumer
+}
+
+func (asc *authSaveConsumer) Save(c *savior.SourceCheckpoint) error {
+	auth := asc.as.auth
+	if auth.err != nil || auth.hashed != asc.as.start+c.Offset {
+		// resuming from there would fail authentication anyway
+		return asc.ssc.Save(c)
+	}
+
+	state, err := auth.hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return asc.ssc.Save(&savior.SourceCheckpoint{
+		Offset: c.Offset,
+		Data: &AuthSourceCheckpoint{
+			Hashed:    auth.hashed,
+			HashState: state,
+			Data:      c.Data,
+		},
+	})
+}
+
+func init() {
+	gob.Register(&AuthSourceCheckpoint{})
+}
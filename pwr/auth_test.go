@@ -0,0 +1,137 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AuthTrailer(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "authtrailer")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	dir := filepath.Join(mainDir, "dir")
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file-1", Seed: 0x1, Size: BlockSize*3 + 12},
+			{Path: "file-2", Seed: 0x2, Size: BlockSize},
+		},
+	})
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	goodKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x1}, ed25519.SeedSize))
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x2}, ed25519.SeedSize))
+	ks := NewKeySet(goodKey.Public().(ed25519.PublicKey))
+
+	unsigned := new(bytes.Buffer)
+	dctx := &DiffContext{
+		Compression: &CompressionSettings{},
+
+		SourceContainer: container,
+		Pool:            fspool.New(container, dir),
+
+		TargetContainer: &tlc.Container{},
+	}
+	wtest.Must(t, dctx.WritePatch(context.Background(), ioutil.Discard, unsigned))
+
+	writeSigned := func(key ed25519.PrivateKey) []byte {
+		buf := new(bytes.Buffer)
+		sw := NewSigningWriter(buf, key)
+		_, err := sw.Write(unsigned.Bytes())
+		wtest.Must(t, err)
+		wtest.Must(t, sw.WriteTrailer())
+		return buf.Bytes()
+	}
+	signed := writeSigned(goodKey)
+
+	verify := func(data []byte) error {
+		_, err := VerifyAuthTrailer(seeksource.FromBytes(data), ks)
+		return errors.Cause(err)
+	}
+
+	payloadSize, err := VerifyAuthTrailer(seeksource.FromBytes(signed), ks)
+	wtest.Must(t, err)
+	assert.EqualValues(t, unsigned.Len(), payloadSize)
+
+	assert.Equal(t, ErrUnsigned, verify(unsigned.Bytes()))
+	assert.Equal(t, ErrUntrustedKey, verify(writeSigned(otherKey)))
+
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)/2] ^= 0xff
+	assert.Equal(t, ErrBadAuthSignature, verify(tampered))
+
+	readSig := func(data []byte, trustedKeys *KeySet) (*SignatureInfo, error) {
+		source := seeksource.FromBytes(data)
+		_, err := source.Resume(nil)
+		wtest.Must(t, err)
+		return ReadTrustedSignature(context.Background(), source, trustedKeys)
+	}
+
+	// without trusted keys, the trailer is ignored
+	sigInfo, err := readSig(signed, nil)
+	wtest.Must(t, err)
+	assert.Len(t, sigInfo.Container.Files, 2)
+
+	sigInfo, err = readSig(signed, ks)
+	wtest.Must(t, err)
+	assert.Len(t, sigInfo.Container.Files, 2)
+
+	_, err = readSig(unsigned.Bytes(), ks)
+	assert.Equal(t, ErrUnsigned, errors.Cause(err))
+
+	_, err = readSig(tampered, ks)
+	assert.Equal(t, ErrBadAuthSignature, errors.Cause(err))
+
+	// what's used is what was checked, even if the source changes
+	// when it's read again
+	reference, err := readSig(signed, nil)
+	wtest.Must(t, err)
+	swapped := append([]byte{}, signed...)
+	swapped[unsigned.Len()-3] ^= 0xff // in the last block hash
+	swapper := &swappingReadSeeker{
+		ReadSeeker: bytes.NewReader(signed),
+		next:       bytes.NewReader(swapped),
+	}
+	source := seeksource.NewWithSize(swapper, int64(len(signed)))
+	_, err = source.Resume(nil)
+	wtest.Must(t, err)
+	swapper.rewinds = 0
+	sigInfo, err = ReadTrustedSignature(context.Background(), source, ks)
+	if err == nil {
+		assert.EqualValues(t, reference.Hashes, sigInfo.Hashes)
+	} else {
+		assert.Equal(t, ErrBadAuthSignature, errors.Cause(err))
+	}
+}
+
+// swappingReadSeeker switches to reading from next the
+// second time it's asked to seek back to the start.
+type swappingReadSeeker struct {
+	io.ReadSeeker
+	next    io.ReadSeeker
+	rewinds int
+}
+
+func (srs *swappingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		srs.rewinds++
+		if srs.rewinds == 2 {
+			srs.ReadSeeker = srs.next
+		}
+	}
+	return srs.ReadSeeker.Seek(offset, whence)
+}
@@ -21,19 +21,19 @@ type BlockValidator interface {
 func NewBlockValidator(hashInfo *HashInfo) BlockValidator {
 	return &blockValidator{
 		hashInfo: hashInfo,
-		sctx:     wsync.NewContext(int(BlockSize)),
+		sctx:     wsync.NewContext(int(hashInfo.BlockSize)),
 	}
 }
 
 func (bv *blockValidator) BlockSize(fileIndex int64, blockIndex int64) int64 {
 	fileSize := bv.hashInfo.Container.Files[fileIndex].Size
-	return ComputeBlockSize(fileSize, blockIndex)
+	return ComputeBlockSizeFor(fileSize, blockIndex, bv.hashInfo.BlockSize)
 }
 
 func (bv *blockValidator) ValidateAsWound(fileIndex int64, blockIndex int64, data []byte) Wound {
 	weakHash, strongHash := bv.sctx.HashBlock(data)
 	hashGroup := bv.hashInfo.Groups[fileIndex]
-	start := blockIndex * BlockSize
+	start := blockIndex * bv.hashInfo.BlockSize
 	size := bv.BlockSize(fileIndex, blockIndex)
 
 	if blockIndex >= int64(len(hashGroup)) {
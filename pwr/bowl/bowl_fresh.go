@@ -21,6 +21,8 @@ type freshBowl struct {
 	TargetPool lake.Pool
 	OutputPool *fspool.FsPool
 
+	TransposeMode TransposeMode
+
 	buf []byte
 }
 
@@ -28,12 +30,32 @@ const freshBufferSize = 32 * 1024
 
 var _ Bowl = (*freshBowl)(nil)
 
+// TransposeMode determines how a fresh bowl puts files that haven't
+// changed from the target into the output folder.
+type TransposeMode int
+
+const (
+	// TransposeModeCopy copies their contents
+	TransposeModeCopy TransposeMode = iota
+	// TransposeModeHardlink hardlinks them, so the target and the output
+	// share the same files: neither should be modified in place afterwards.
+	TransposeModeHardlink
+	// TransposeModeReflink makes copy-on-write clones of them, which
+	// requires a filesystem that supports it (like btrfs or xfs on linux)
+	TransposeModeReflink
+)
+
 type FreshBowlParams struct {
 	TargetContainer *tlc.Container
 	SourceContainer *tlc.Container
 
 	TargetPool   lake.Pool
 	OutputFolder string
+
+	// TransposeMode is only honored when TargetPool is an *fspool.FsPool,
+	// and falls back to copying when linking fails, for example when the
+	// target and output folders are on different filesystems.
+	TransposeMode TransposeMode
 }
 
 // NewFreshBowl returns a bowl that applies all writes to
@@ -70,6 +92,8 @@ func NewFreshBowl(params FreshBowlParams) (Bowl, error) {
 		TargetPool:      params.TargetPool,
 
 		OutputPool: outputPool,
+
+		TransposeMode: params.TransposeMode,
 	}, nil
 }
 
@@ -91,6 +115,16 @@ func (b *freshBowl) GetWriter(index int64) (EntryWriter, error) {
 }
 
 func (b *freshBowl) Transpose(t Transposition) (rErr error) {
+	if b.TransposeMode != TransposeModeCopy {
+		linked, err := b.link(t)
+		if err != nil {
+			return err
+		}
+		if linked {
+			return nil
+		}
+	}
+
 	// alright y'all it's copy time
 
 	r, err := b.TargetPool.GetReader(t.TargetIndex)
@@ -124,6 +158,51 @@ func (b *freshBowl) Transpose(t Transposition) (rErr error) {
 	return
 }
 
+// link tries to hardlink or reflink a transposed file, and returns
+// false if it should be copied instead.
+func (b *freshBowl) link(t Transposition) (bool, error) {
+	targetPool, ok := b.TargetPool.(*fspool.FsPool)
+	if !ok {
+		return false, nil
+	}
+
+	targetFile := b.TargetContainer.Files[t.TargetIndex]
+	sourceFile := b.SourceContainer.Files[t.SourceIndex]
+	if b.TransposeMode == TransposeModeHardlink && targetFile.Mode != sourceFile.Mode {
+		// hardlinks share their mode, we can't change one without the other
+		return false, nil
+	}
+
+	targetPath := targetPool.GetPath(t.TargetIndex)
+	outputPath := b.OutputPool.GetPath(t.SourceIndex)
+
+	err := screw.MkdirAll(filepath.Dir(outputPath), 0755)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	// we might be resuming, or transposing over a file
+	err = screw.Remove(outputPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+
+	switch b.TransposeMode {
+	case TransposeModeHardlink:
+		err = os.Link(targetPath, outputPath)
+	case TransposeModeReflink:
+		err = reflinkFile(targetPath, outputPath, os.FileMode(sourceFile.Mode|tlc.ModeMask))
+	default:
+		return false, errors.Errorf("freshbowl: unknown transpose mode %d", b.TransposeMode)
+	}
+	if err != nil {
+		savior.Debugf("freshbowl: could not link (%s), copying instead: %v", sourceFile.Path, err)
+		return false, nil
+	}
+
+	return true, nil
+}
+
 func (b *freshBowl) Commit() error {
 	// it's all done buddy!
 	return nil
@@ -10,6 +10,7 @@ import (
 
 	"github.com/itchio/screw"
 	"github.com/itchio/wharf/archiver"
+	"github.com/itchio/wharf/pools/mempool"
 	"github.com/itchio/wharf/pwr/bowl"
 
 	"github.com/itchio/headway/state"
@@ -100,6 +101,7 @@ const (
 	bowlModeFresh   bowlMode = 1
 	bowlModeInPlace bowlMode = 2
 	bowlModeZip     bowlMode = 3
+	bowlModeMemory  bowlMode = 4
 )
 
 type bowlerParams struct {
@@ -113,9 +115,11 @@ type makeBowlParams struct {
 	SourceContainer *tlc.Container
 	TargetPool      lake.Pool
 	TargetFolder    string
+	RefFolder       string
 	FreshFolder     string
 
 	ZipFilePath string
+	MemoryPool  *mempool.MemPool
 	Cleanup     func()
 }
 
@@ -170,6 +174,7 @@ func runBowler(t *testing.T, params *bowlerParams) {
 		SourceContainer: b.SourceContainer,
 		TargetPool:      targetPool,
 		TargetFolder:    targetFolder,
+		RefFolder:       refFolder,
 		FreshFolder:     freshFolder,
 	}
 	bowl, bowlmode := params.makeBowl(mbp)
@@ -206,6 +211,25 @@ func runBowler(t *testing.T, params *bowlerParams) {
 		must(t, screw.Remove(mbp.ZipFilePath))
 	}
 
+	if bowlmode == bowlModeMemory {
+		refContainer, err := tlc.WalkDir(refFolder, tlc.WalkOpts{})
+		must(t, err)
+		memContainer := mbp.MemoryPool.Container()
+
+		must(t, refContainer.EnsureEqual(memContainer))
+		must(t, memContainer.EnsureEqual(refContainer))
+
+		refPool := fspool.New(refContainer, refFolder)
+		for index := range refContainer.Files {
+			refReader, err := refPool.GetReader(int64(index))
+			must(t, err)
+			refBytes, err := ioutil.ReadAll(refReader)
+			must(t, err)
+
+			assert.EqualValues(t, refBytes, mbp.MemoryPool.Bytes(int64(index)))
+		}
+	}
+
 	if outFolder != "" {
 		refContainer, err := tlc.WalkDir(refFolder, tlc.WalkOpts{})
 		must(t, err)
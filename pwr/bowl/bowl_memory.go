@@ -0,0 +1,206 @@
+package bowl
+
+import (
+	"encoding/gob"
+	"io"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pools/mempool"
+	"github.com/pkg/errors"
+)
+
+type memoryBowl struct {
+	TargetContainer *tlc.Container
+	SourceContainer *tlc.Container
+
+	TargetPool lake.Pool
+	OutputPool *mempool.MemPool
+
+	buf []byte
+}
+
+var _ Bowl = (*memoryBowl)(nil)
+
+type MemoryBowlParams struct {
+	TargetContainer *tlc.Container
+	SourceContainer *tlc.Container
+
+	TargetPool lake.Pool
+	// OutputPool receives the contents of every file of SourceContainer,
+	// it should be created with mempool.New(SourceContainer)
+	OutputPool *mempool.MemPool
+}
+
+// MemoryBowlCheckpoint holds the size of every file written to a memory
+// bowl so far. The contents stay in the output pool, so a memory bowl
+// can only be resumed with the same pool it was saved from.
+type MemoryBowlCheckpoint struct {
+	Sizes map[int64]int64
+}
+
+// NewMemoryBowl returns a bowl that applies all writes to
+// an in-memory pool, without touching the disk.
+func NewMemoryBowl(params MemoryBowlParams) (Bowl, error) {
+	// input validation
+
+	if params.TargetContainer == nil {
+		return nil, errors.New("memorybowl: TargetContainer must not be nil")
+	}
+
+	if params.TargetPool == nil {
+		return nil, errors.New("memorybowl: TargetPool must not be nil")
+	}
+
+	if params.SourceContainer == nil {
+		return nil, errors.New("memorybowl: SourceContainer must not be nil")
+	}
+
+	if params.OutputPool == nil {
+		return nil, errors.New("memorybowl: must specify OutputPool")
+	}
+
+	return &memoryBowl{
+		TargetContainer: params.TargetContainer,
+		SourceContainer: params.SourceContainer,
+		TargetPool:      params.TargetPool,
+		OutputPool:      params.OutputPool,
+	}, nil
+}
+
+func (b *memoryBowl) Save() (*BowlCheckpoint, error) {
+	c := &BowlCheckpoint{
+		Data: &MemoryBowlCheckpoint{
+			Sizes: b.OutputPool.Sizes(),
+		},
+	}
+	return c, nil
+}
+
+func (b *memoryBowl) Resume(c *BowlCheckpoint) error {
+	if c == nil || c.Data == nil {
+		return nil
+	}
+
+	mc, ok := c.Data.(*MemoryBowlCheckpoint)
+	if !ok {
+		return errors.Errorf("memorybowl: expected MemoryBowlCheckpoint, got %T", c.Data)
+	}
+
+	err := b.OutputPool.Rewind(mc.Sizes)
+	if err != nil {
+		return errors.Wrap(err, "memorybowl: resuming checkpoint")
+	}
+	return nil
+}
+
+func (b *memoryBowl) GetWriter(index int64) (EntryWriter, error) {
+	return &memoryEntryWriter{pool: b.OutputPool, index: index}, nil
+}
+
+func (b *memoryBowl) Transpose(t Transposition) (rErr error) {
+	r, err := b.TargetPool.GetReader(t.TargetIndex)
+	if err != nil {
+		rErr = errors.WithStack(err)
+		return
+	}
+
+	w, err := b.OutputPool.GetWriter(t.SourceIndex)
+	if err != nil {
+		rErr = errors.WithStack(err)
+		return
+	}
+	defer func() {
+		cErr := w.Close()
+		if cErr != nil && rErr == nil {
+			rErr = errors.WithStack(cErr)
+		}
+	}()
+
+	if len(b.buf) < freshBufferSize {
+		b.buf = make([]byte, freshBufferSize)
+	}
+
+	_, err = io.CopyBuffer(w, r, b.buf)
+	if err != nil {
+		rErr = errors.WithStack(err)
+		return
+	}
+
+	return
+}
+
+func (b *memoryBowl) Commit() error {
+	// everything is already in the output pool
+	return nil
+}
+
+func (b *memoryBowl) Close() error {
+	// nothing to close
+	return nil
+}
+
+// memoryEntryWriter
+
+type memoryEntryWriter struct {
+	pool   *mempool.MemPool
+	index  int64
+	w      io.WriteCloser
+	offset int64
+}
+
+var _ EntryWriter = (*memoryEntryWriter)(nil)
+
+func (mew *memoryEntryWriter) Tell() int64 {
+	return mew.offset
+}
+
+func (mew *memoryEntryWriter) Resume(c *WriterCheckpoint) (int64, error) {
+	var offset int64
+	if c != nil {
+		offset = c.Offset
+	}
+
+	w, err := mew.pool.GetWriterAt(mew.index, offset)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	mew.w = w
+	mew.offset = offset
+
+	return mew.offset, nil
+}
+
+func (mew *memoryEntryWriter) Save() (*WriterCheckpoint, error) {
+	return &WriterCheckpoint{
+		Offset: mew.offset,
+	}, nil
+}
+
+func (mew *memoryEntryWriter) Write(buf []byte) (int, error) {
+	if mew.w == nil {
+		return 0, errors.WithStack(ErrUninitializedWriter)
+	}
+
+	n, err := mew.w.Write(buf)
+	mew.offset += int64(n)
+	return n, err
+}
+
+func (mew *memoryEntryWriter) Finalize() error {
+	return nil
+}
+
+func (mew *memoryEntryWriter) Close() error {
+	if mew.w == nil {
+		return nil
+	}
+
+	w := mew.w
+	mew.w = nil
+	return w.Close()
+}
+
+func init() {
+	gob.Register(&MemoryBowlCheckpoint{})
+}
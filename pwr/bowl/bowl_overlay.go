@@ -11,6 +11,7 @@ import (
 	"github.com/itchio/headway/state"
 	"github.com/itchio/savior/filesource"
 	"github.com/itchio/screw"
+	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/pwr/overlay"
 
 	"github.com/itchio/lake"
@@ -36,10 +37,13 @@ type overlayBowl struct {
 	OutputFolder string
 	StageFolder  string
 
+	Signature *pwr.SignatureInfo
+
 	Consumer *state.Consumer
 
 	stagePool         *fspool.FsPool
 	targetFilesByPath map[string]int64
+	journalID         []byte
 
 	// files we'll have to move
 	transpositions []Transposition
@@ -64,6 +68,11 @@ type OverlayBowlParams struct {
 	OutputFolder string
 	StageFolder  string
 
+	// Signature (optional) describes the source container. When set, Commit
+	// first checks the staged result against it, and returns an
+	// *ErrVerificationFailed without touching OutputFolder if it doesn't match.
+	Signature *pwr.SignatureInfo
+
 	Consumer *state.Consumer
 }
 
@@ -106,6 +115,11 @@ func NewOverlayBowl(params OverlayBowlParams) (Bowl, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	journalID, err := overlayJournalID(params.SourceContainer, params.TargetContainer)
+	if err != nil {
+		return nil, err
+	}
+
 	targetPool := fspool.New(params.TargetContainer, params.OutputFolder)
 	stagePool := fspool.New(params.SourceContainer, params.StageFolder)
 
@@ -122,10 +136,13 @@ func NewOverlayBowl(params OverlayBowlParams) (Bowl, error) {
 		OutputFolder: params.OutputFolder,
 		StageFolder:  params.StageFolder,
 
+		Signature: params.Signature,
+
 		Consumer: params.Consumer,
 
 		stagePool:         stagePool,
 		targetFilesByPath: targetFilesByPath,
+		journalID:         journalID,
 	}, nil
 }
 
@@ -240,6 +257,23 @@ func (b *overlayBowl) Commit() error {
 		return errors.WithStack(err)
 	}
 
+	// - if a previous commit of this patch was interrupted, finish it instead
+	recovered, err := recoverOverlayFor(b.StageFolder, b.OutputFolder, b.journalID)
+	if err != nil {
+		return err
+	}
+	if recovered {
+		return nil
+	}
+
+	if b.Signature != nil {
+		// - make sure we're not about to break the install
+		err = b.verify()
+		if err != nil {
+			return err
+		}
+	}
+
 	if screw.IsCaseInsensitiveFS() {
 		// fix casing on-disk, reflect that on renames/etc.
 		err = b.fixExistingCase()
@@ -248,37 +282,33 @@ func (b *overlayBowl) Commit() error {
 		}
 	}
 
-	// - ensure dirs and symlinks
-	err = b.ensureDirsAndSymlinks()
-	if err != nil {
-		return err
-	}
+	// - plan everything we're about to do to the output folder:
+	// ensure dirs and symlinks, apply transpositions, move files we
+	// need to move, merge overlays, and delete ghosts.
+	journal := &overlayJournal{ID: b.journalID}
+	b.planDirsAndSymlinks(journal)
+	b.planTranspositions(journal)
 
-	// - apply transpositions
-	err = b.applyTranspositions()
+	err = b.planMoves(journal)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
-	// - move files we need to move
-	err = b.applyMoves()
+	err = b.planOverlays(journal)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
-	// - merge overlays
-	err = b.applyOverlays()
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	b.planGhosts(journal)
 
-	// - delete ghosts
-	err = b.deleteGhosts()
+	// - write it down, so that an interrupted commit can be finished
+	err = writeOverlayJournal(b.StageFolder, journal)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
-	return nil
+	// - and do it
+	return runOverlayJournal(b.StageFolder, b.OutputFolder, journal, 0, false)
 }
 
 func (b *overlayBowl) Close() error {
@@ -326,102 +356,95 @@ func (b *overlayBowl) fixExistingCase() error {
 	return nil
 }
 
-func (b *overlayBowl) ensureDirsAndSymlinks() error {
-	outputPath := b.OutputFolder
+func (b *overlayBowl) planDirsAndSymlinks(journal *overlayJournal) {
+	for _, dir := range b.SourceContainer.Dirs {
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind: journalOpDir,
+			Path: dir.Path,
+		})
+	}
 
-	processDir := func(dir *tlc.Dir) error {
-		path := filepath.Join(outputPath, filepath.FromSlash(dir.Path))
+	// TODO: behave like github.com/itchio/savior for symlinks on windows ?
 
-		stats, err := screw.Lstat(path)
-		if err == nil {
-			// did stat
-			if stats.IsDir() {
-				// good!
-				return nil
-			}
+	for _, symlink := range b.SourceContainer.Symlinks {
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind: journalOpSymlink,
+			Path: symlink.Path,
+			Dest: symlink.Dest,
+		})
+	}
+}
 
-			// probably a file or a symlink, clear out
-			err = screw.RemoveAll(path)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+func ensureDir(path string) error {
+	stats, err := screw.Lstat(path)
+	if err == nil {
+		// did stat
+		if stats.IsDir() {
+			// good!
+			return nil
 		}
 
-		err = screw.MkdirAll(path, 0755)
+		// probably a file or a symlink, clear out
+		err = screw.RemoveAll(path)
 		if err != nil {
-			// If path is already a directory, MkdirAll does nothing and returns nil.
-			// so if we get a non-nil error, we know it's serious business (permissions, etc.)
 			return errors.WithStack(err)
 		}
-		return nil
 	}
 
-	for _, dir := range b.SourceContainer.Dirs {
-		err := processDir(dir)
-		if err != nil {
-			return err
-		}
+	err = screw.MkdirAll(path, 0755)
+	if err != nil {
+		// If path is already a directory, MkdirAll does nothing and returns nil.
+		// so if we get a non-nil error, we know it's serious business (permissions, etc.)
+		return errors.WithStack(err)
 	}
+	return nil
+}
 
-	// TODO: behave like github.com/itchio/savior for symlinks on windows ?
-
-	processSymlink := func(symlink *tlc.Symlink) error {
-		path := filepath.Join(outputPath, filepath.FromSlash(symlink.Path))
-
-		stats, err := screw.Lstat(path)
-		if err == nil {
-			// did stat
-			if stats.Mode()&os.ModeSymlink == 0 {
-				// not a symlink! clear out
-				err = screw.RemoveAll(path)
-				if err != nil {
-					return errors.WithStack(err)
-				}
-			}
-		}
-
-		dest, err := screw.Readlink(path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				// symlink was missing
-				debugf("Was missing, linking (%s) => (%s)\n", path, symlink.Dest)
-				err = screw.Symlink(filepath.FromSlash(symlink.Dest), path)
-				if err != nil {
-					return errors.WithStack(err)
-				}
-				return nil
-			} else {
-				return errors.WithStack(err)
-			}
-		}
-
-		// symlink is there
-		if dest != filepath.FromSlash(symlink.Dest) {
-			// wrong dest, fixing that
-			err = screw.Remove(path)
+func ensureSymlink(path string, symlinkDest string) error {
+	stats, err := screw.Lstat(path)
+	if err == nil {
+		// did stat
+		if stats.Mode()&os.ModeSymlink == 0 {
+			// not a symlink! clear out
+			err = screw.RemoveAll(path)
 			if err != nil {
 				return errors.WithStack(err)
 			}
+		}
+	}
 
-			debugf("Was wrong path, removed and linking (%s) => (%s)\n", path, symlink.Dest)
-			err = screw.Symlink(filepath.FromSlash(symlink.Dest), path)
+	dest, err := screw.Readlink(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// symlink was missing
+			debugf("Was missing, linking (%s) => (%s)\n", path, symlinkDest)
+			err = screw.Symlink(filepath.FromSlash(symlinkDest), path)
 			if err != nil {
 				return errors.WithStack(err)
 			}
 			return nil
+		} else {
+			return errors.WithStack(err)
 		}
-
-		// existed, was symlink, and pointed to right file
-		return nil
 	}
 
-	for _, symlink := range b.SourceContainer.Symlinks {
-		err := processSymlink(symlink)
+	// symlink is there
+	if dest != filepath.FromSlash(symlinkDest) {
+		// wrong dest, fixing that
+		err = screw.Remove(path)
 		if err != nil {
-			return err
+			return errors.WithStack(err)
+		}
+
+		debugf("Was wrong path, removed and linking (%s) => (%s)\n", path, symlinkDest)
+		err = screw.Symlink(filepath.FromSlash(symlinkDest), path)
+		if err != nil {
+			return errors.WithStack(err)
 		}
+		return nil
 	}
 
+	// existed, was symlink, and pointed to right file
 	return nil
 }
 
@@ -444,9 +467,8 @@ const (
 	transpoBehaviorCopy
 )
 
-func (b *overlayBowl) applyTranspositions() error {
+func (b *overlayBowl) planTranspositions(journal *overlayJournal) {
 	transpositions := make(map[string][]*pathTranspo)
-	outputPath := b.OutputFolder
 
 	for _, t := range b.transpositions {
 		targetFile := b.TargetContainer.Files[t.TargetIndex]
@@ -458,7 +480,24 @@ func (b *overlayBowl) applyTranspositions() error {
 		})
 	}
 
-	applyMultipleTranspositions := func(behavior transpoBehavior, targetPath string, group []*pathTranspo) error {
+	copyOp := func(oldPath string, newPath string, mkdirBehavior mkdirBehavior) {
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind:  journalOpCopy,
+			Path:  oldPath,
+			Dest:  newPath,
+			Mkdir: mkdirBehavior == mkdirBehaviorIfNeeded,
+		})
+	}
+
+	moveOp := func(oldPath string, newPath string) {
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind: journalOpMove,
+			Path: oldPath,
+			Dest: newPath,
+		})
+	}
+
+	planMultipleTranspositions := func(behavior transpoBehavior, targetPath string, group []*pathTranspo) {
 		// a file got duplicated!
 		var noop *pathTranspo
 		for _, transpo := range group {
@@ -480,48 +519,41 @@ func (b *overlayBowl) applyTranspositions() error {
 				continue
 			}
 
-			oldAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(targetPath))
-			newAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(transpo.OutputPath))
-			err := b.copy(oldAbsolutePath, newAbsolutePath, mkdirBehaviorIfNeeded)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+			copyOp(targetPath, transpo.OutputPath, mkdirBehaviorIfNeeded)
 		}
 
 		if noop == nil {
 			// we treated the first transpo as being the rename, gotta do it now
 			transpo := group[0]
-			oldAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(targetPath))
-			newAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(transpo.OutputPath))
 
 			switch behavior {
 			case transpoBehaviorCopy:
 				// no, wait, the target file is itself being patched, meaning it has a pending overlay.
 				// in order for that overlay to apply cleanly, we must copy the file, not move it.
 				// we should also not need mkdir, since we already ensured dirs and symlinks.
-				err := b.copy(oldAbsolutePath, newAbsolutePath, mkdirBehaviorNever)
-				if err != nil {
-					return errors.WithStack(err)
-				}
+				copyOp(targetPath, transpo.OutputPath, mkdirBehaviorNever)
 			case transpoBehaviorMove:
-				err := b.move(oldAbsolutePath, newAbsolutePath)
-				if err != nil {
-					return errors.WithStack(err)
-				}
+				moveOp(targetPath, transpo.OutputPath)
 			}
 		} else {
 			// muffin!
 		}
-
-		return nil
 	}
 
 	var cleanupRenames []*pathTranspo
 	alreadyDone := make(map[string]bool)
 	renameSeed := int64(0)
 
-	for _, group := range transpositions {
-		for _, transpo := range group {
+	// the journal must be the same no matter what order we walk
+	// transpositions in, so walk them sorted.
+	var targetPaths []string
+	for targetPath := range transpositions {
+		targetPaths = append(targetPaths, targetPath)
+	}
+	sort.Strings(targetPaths)
+
+	for _, targetPath := range targetPaths {
+		for _, transpo := range transpositions[targetPath] {
 			if transpo.TargetPath == transpo.OutputPath {
 				// no-ops can't clash
 				continue
@@ -548,7 +580,8 @@ func (b *overlayBowl) applyTranspositions() error {
 		overlayFilesByPath[f.Path] = true
 	}
 
-	for groupTargetPath, group := range transpositions {
+	for _, groupTargetPath := range targetPaths {
+		group := transpositions[groupTargetPath]
 		if alreadyDone[groupTargetPath] {
 			continue
 		}
@@ -568,44 +601,25 @@ func (b *overlayBowl) applyTranspositions() error {
 				// file wasn't touched at all
 			} else {
 				// file was renamed
-				oldAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(transpo.TargetPath))
-				newAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(transpo.OutputPath))
-
 				switch behavior {
 				case transpoBehaviorCopy:
 					// we should never need to mkdir, because we already ensured dirs and symlinks.
-					err := b.copy(oldAbsolutePath, newAbsolutePath, mkdirBehaviorNever)
-					if err != nil {
-						return errors.WithStack(err)
-					}
+					copyOp(transpo.TargetPath, transpo.OutputPath, mkdirBehaviorNever)
 				case transpoBehaviorMove:
-					err := b.move(oldAbsolutePath, newAbsolutePath)
-					if err != nil {
-						return errors.WithStack(err)
-					}
+					moveOp(transpo.TargetPath, transpo.OutputPath)
 				}
 			}
 		} else {
-			err := applyMultipleTranspositions(behavior, groupTargetPath, group)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+			planMultipleTranspositions(behavior, groupTargetPath, group)
 		}
 	}
 
 	for _, rename := range cleanupRenames {
-		oldAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(rename.TargetPath))
-		newAbsolutePath := filepath.Join(outputPath, filepath.FromSlash(rename.OutputPath))
-		err := b.move(oldAbsolutePath, newAbsolutePath)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+		moveOp(rename.TargetPath, rename.OutputPath)
 	}
-
-	return nil
 }
 
-func (b *overlayBowl) copy(oldAbsolutePath string, newAbsolutePath string, mkdirBehavior mkdirBehavior) error {
+func copyPath(oldAbsolutePath string, newAbsolutePath string, mkdirBehavior mkdirBehavior) error {
 	debugf("cp '%s' '%s'", oldAbsolutePath, newAbsolutePath)
 	if mkdirBehavior == mkdirBehaviorIfNeeded {
 		err := screw.MkdirAll(filepath.Dir(newAbsolutePath), os.FileMode(0755))
@@ -640,7 +654,7 @@ func (b *overlayBowl) copy(oldAbsolutePath string, newAbsolutePath string, mkdir
 	return nil
 }
 
-func (b *overlayBowl) move(oldAbsolutePath string, newAbsolutePath string) error {
+func movePath(oldAbsolutePath string, newAbsolutePath string) error {
 	debugf("mv '%s' '%s'", oldAbsolutePath, newAbsolutePath)
 
 	err := screw.Remove(newAbsolutePath)
@@ -666,7 +680,7 @@ func (b *overlayBowl) move(oldAbsolutePath string, newAbsolutePath string) error
 			debugf("mhh our rename error was that old does not exist")
 		}
 
-		cErr := b.copy(oldAbsolutePath, newAbsolutePath, mkdirBehaviorNever)
+		cErr := copyPath(oldAbsolutePath, newAbsolutePath, mkdirBehaviorNever)
 		if cErr != nil {
 			return cErr
 		}
@@ -680,74 +694,73 @@ func (b *overlayBowl) move(oldAbsolutePath string, newAbsolutePath string) error
 	return nil
 }
 
-func (b *overlayBowl) applyMoves() error {
+func (b *overlayBowl) planMoves(journal *overlayJournal) error {
 	for _, moveIndex := range b.moveFiles {
 		file := b.SourceContainer.Files[moveIndex]
 		if file == nil {
-			return errors.Errorf("overlaybowl: applyMoves: no such file %d", moveIndex)
+			return errors.Errorf("overlaybowl: planMoves: no such file %d", moveIndex)
 		}
-		debugf("applying move '%s'", file.Path)
-		nativePath := filepath.FromSlash(file.Path)
 
-		stagePath := filepath.Join(b.StageFolder, nativePath)
-		outputPath := filepath.Join(b.OutputFolder, nativePath)
-		err := b.move(stagePath, outputPath)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind:      journalOpMove,
+			Path:      file.Path,
+			Dest:      file.Path,
+			FromStage: true,
+		})
 	}
 
 	return nil
 }
 
-func (b *overlayBowl) applyOverlays() error {
-	ctx := &overlay.OverlayPatchContext{}
-
-	handleOverlay := func(overlaySourceFileIndex int64) error {
-		file := b.SourceContainer.Files[overlaySourceFileIndex]
+func (b *overlayBowl) planOverlays(journal *overlayJournal) error {
+	for _, overlayIndex := range b.overlayFiles {
+		file := b.SourceContainer.Files[overlayIndex]
 		if file == nil {
-			return errors.Errorf("overlaybowl: applyOverlays: no such file %d", overlaySourceFileIndex)
+			return errors.Errorf("overlaybowl: planOverlays: no such file %d", overlayIndex)
 		}
-		debugf("applying overlay '%s'", file.Path)
-		nativePath := filepath.FromSlash(file.Path)
 
-		stagePath := filepath.Join(b.StageFolder, nativePath)
-		r, err := filesource.Open(stagePath)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		defer r.Close()
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind: journalOpOverlay,
+			Path: file.Path,
+			Mode: file.Mode,
+		})
+	}
 
-		outputPath := filepath.Join(b.OutputFolder, nativePath)
-		w, err := screw.OpenFile(outputPath, os.O_WRONLY, os.FileMode(file.Mode|tlc.ModeMask))
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		defer w.Close()
+	return nil
+}
 
-		err = ctx.Patch(r, w)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+// applyOverlay patches outputPath in place. Applying the same overlay
+// twice gives the same result: it only ever writes fresh data at the
+// same offsets, and keeps everything else.
+func applyOverlay(stagePath string, outputPath string, mode uint32) error {
+	debugf("applying overlay '%s'", outputPath)
 
-		finalSize, err := w.Seek(0, io.SeekCurrent)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	r, err := filesource.Open(stagePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer r.Close()
 
-		err = w.Truncate(finalSize)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	w, err := screw.OpenFile(outputPath, os.O_WRONLY, os.FileMode(mode|tlc.ModeMask))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer w.Close()
 
-		return nil
+	ctx := &overlay.OverlayPatchContext{}
+	err = ctx.Patch(r, w)
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
-	for _, overlayIndex := range b.overlayFiles {
-		err := handleOverlay(overlayIndex)
-		if err != nil {
-			return errors.WithStack(err)
-		}
+	finalSize, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = w.Truncate(finalSize)
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
 	return nil
@@ -830,33 +843,40 @@ func (s byDecreasingLength) Less(i, j int) bool {
 	return len(s[j].Path) < len(s[i].Path)
 }
 
-func (b *overlayBowl) deleteGhosts() error {
+func (b *overlayBowl) planGhosts(journal *overlayJournal) {
 	ghosts := detectGhosts(b.SourceContainer, b.TargetContainer)
 	debugf("%d total ghosts", len(ghosts))
 
 	sort.Sort(byDecreasingLength(ghosts))
 
 	for _, ghost := range ghosts {
-		debugf("ghost: %v", ghost)
-		op := filepath.Join(b.OutputFolder, filepath.FromSlash(ghost.Path))
+		journal.Ops = append(journal.Ops, journalOp{
+			Kind:      journalOpGhost,
+			Path:      ghost.Path,
+			GhostKind: ghost.Kind,
+		})
+	}
+}
 
-		_, err := screw.Lstat(op)
-		if err != nil {
-			debugf("ghost already gone, bye bye! (%v)", err)
-			continue
-		}
+func deleteGhost(path string, kind GhostKind) error {
+	debugf("ghost: %s", path)
+
+	_, err := screw.Lstat(path)
+	if err != nil {
+		debugf("ghost already gone, bye bye! (%v)", err)
+		return nil
+	}
 
-		err = screw.Remove(op)
-		if err == nil || os.IsNotExist(err) {
-			// removed or already removed, good
-			debugf("ghost removed or already gone '%s'", ghost.Path)
+	err = screw.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		// removed or already removed, good
+		debugf("ghost removed or already gone '%s'", path)
+	} else {
+		if kind == GhostKindDir {
+			// sometimes we can't delete directories, it's okay
+			debugf("ghost dir left behind '%s'", path)
 		} else {
-			if ghost.Kind == GhostKindDir {
-				// sometimes we can't delete directories, it's okay
-				debugf("ghost dir left behind '%s'", ghost.Path)
-			} else {
-				return errors.WithStack(err)
-			}
+			return errors.WithStack(err)
 		}
 	}
 
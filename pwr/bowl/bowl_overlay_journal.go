@@ -0,0 +1,320 @@
+package bowl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/screw"
+	"github.com/pkg/errors"
+)
+
+const (
+	// overlayJournalName is the name of the file, in the stage folder, that
+	// lists every operation an overlay bowl's commit is going to perform.
+	overlayJournalName = ".butler-overlay-journal"
+	// overlayProgressName is the name of the file, in the stage folder, that
+	// gets one byte appended to it every time an operation is done.
+	overlayProgressName = ".butler-overlay-journal-progress"
+)
+
+// when set to N (by tests), a commit stops after performing its Nth
+// operation, right before marking it as done, as if the machine lost
+// power: marks that weren't synced to disk are lost as well.
+var interruptCommitAfter = -1
+
+type journalOpKind int
+
+const (
+	// make sure a directory exists
+	journalOpDir journalOpKind = 0x6a10 + iota
+	// make sure a symlink exists and points to Dest
+	journalOpSymlink
+	// copy an output file to Dest
+	journalOpCopy
+	// move an output (or stage) file to Dest
+	journalOpMove
+	// patch an output file in place with its overlay from the stage folder
+	journalOpOverlay
+	// delete something that's no longer part of the build
+	journalOpGhost
+)
+
+// A journalOp is a single filesystem operation of an overlay bowl's commit.
+// Paths are slash-separated, and relative to the output folder, except for
+// FromStage moves and overlays, which are read from the stage folder.
+type journalOp struct {
+	Kind journalOpKind
+	Path string
+	Dest string
+
+	FromStage bool
+	Mkdir     bool
+	Mode      uint32
+	GhostKind GhostKind
+}
+
+// overlayJournal is written to the stage folder before an overlay bowl's
+// commit touches the output folder. Every operation can be performed
+// again if we don't know whether it completed, so an interrupted commit
+// is finished by starting again from the first operation not marked done.
+type overlayJournal struct {
+	// ID identifies the patch being committed, see overlayJournalID
+	ID  []byte
+	Ops []journalOp
+}
+
+// overlayJournalID hashes the containers an overlay bowl patches from and to,
+// so that a commit only ever picks up a journal left behind by the same patch.
+func overlayJournalID(sourceContainer *tlc.Container, targetContainer *tlc.Container) ([]byte, error) {
+	hasher := sha256.New()
+	for _, container := range []*tlc.Container{sourceContainer, targetContainer} {
+		buf, err := proto.Marshal(container)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		_, err = hasher.Write(buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return hasher.Sum(nil), nil
+}
+
+// recoverOverlayFor finishes an interrupted commit of the patch identified by
+// id. It returns false if no commit was interrupted, and an error if the
+// journal found belongs to another patch.
+func recoverOverlayFor(stageFolder string, outputFolder string, id []byte) (bool, error) {
+	journal, err := readOverlayJournal(stageFolder)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !bytes.Equal(journal.ID, id) {
+		return false, errors.Errorf("overlaybowl: '%s' holds an interrupted commit of another patch, RecoverOverlay must be called first", stageFolder)
+	}
+
+	return true, RecoverOverlay(stageFolder, outputFolder)
+}
+
+// RecoverOverlay finishes an overlay bowl commit that was interrupted
+// (by a crash, a force-quit, etc.), by performing the operations that
+// weren't marked as done in its journal. It does nothing if no commit
+// was interrupted. stageFolder and outputFolder must be the ones
+// the overlay bowl was created with.
+func RecoverOverlay(stageFolder string, outputFolder string) error {
+	journal, err := readOverlayJournal(stageFolder)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			// nothing to recover from
+			return nil
+		}
+		return err
+	}
+
+	var done int64
+	stats, err := screw.Lstat(filepath.Join(stageFolder, overlayProgressName))
+	if err == nil {
+		done = stats.Size()
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if done > int64(len(journal.Ops)) {
+		done = int64(len(journal.Ops))
+	}
+
+	debugf("recovering commit, %d/%d ops were done", done, len(journal.Ops))
+	return runOverlayJournal(stageFolder, outputFolder, journal, int(done), true)
+}
+
+func writeOverlayJournal(stageFolder string, journal *overlayJournal) error {
+	journalPath := filepath.Join(stageFolder, overlayJournalName)
+	progressPath := filepath.Join(stageFolder, overlayProgressName)
+
+	err := screw.Remove(progressPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	// write to a temporary file first, so that a half-written
+	// journal is never mistaken for an interrupted commit.
+	tmpPath := journalPath + ".tmp"
+	f, err := screw.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = gob.NewEncoder(f).Encode(journal)
+	if err == nil {
+		err = f.Sync()
+	}
+	cErr := f.Close()
+	if err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = screw.Rename(tmpPath, journalPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func readOverlayJournal(stageFolder string) (*overlayJournal, error) {
+	f, err := screw.Open(filepath.Join(stageFolder, overlayJournalName))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	journal := &overlayJournal{}
+	err = gob.NewDecoder(f).Decode(journal)
+	if err != nil {
+		return nil, errors.Wrap(err, "overlaybowl: reading commit journal")
+	}
+
+	return journal, nil
+}
+
+// runOverlayJournal performs every operation of journal starting at index
+// done, marks each of them as done, then removes the journal. When
+// recovering, the first operation might have been performed already.
+func runOverlayJournal(stageFolder string, outputFolder string, journal *overlayJournal, done int, recovering bool) error {
+	journalPath := filepath.Join(stageFolder, overlayJournalName)
+	progressPath := filepath.Join(stageFolder, overlayProgressName)
+
+	progress, err := screw.OpenFile(progressPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer progress.Close()
+
+	// moves can't be performed twice, and neither can ops that read a file
+	// a later op changes or removes: copying a file that was overlaid since
+	// would copy the patched version. Progress is synced before every op
+	// that changes or removes existing files (moves, overlays and ghosts),
+	// so that once they've started, nothing before them is redone, and
+	// after moves, so that a move is only redone if it got interrupted.
+	marked := done
+	synced := done
+	sync := func() error {
+		if synced == marked {
+			return nil
+		}
+		synced = marked
+		return progress.Sync()
+	}
+
+	for i := done; i < len(journal.Ops); i++ {
+		op := journal.Ops[i]
+		switch op.Kind {
+		case journalOpMove, journalOpOverlay, journalOpGhost:
+			err = sync()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		maybeDone := recovering && i == done
+		err = runJournalOp(stageFolder, outputFolder, op, maybeDone)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if interruptCommitAfter >= 0 && i-done+1 >= interruptCommitAfter {
+			err = progress.Truncate(int64(synced))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.Errorf("overlaybowl: commit interrupted after %d ops", i+1)
+		}
+
+		_, err = progress.Write([]byte{1})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		marked = i + 1
+
+		if op.Kind == journalOpMove {
+			err = sync()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	err = progress.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the journal goes first: a progress file on its own means nothing
+	err = screw.Remove(journalPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = screw.Remove(progressPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func runJournalOp(stageFolder string, outputFolder string, op journalOp, maybeDone bool) error {
+	outputPath := func(path string) string {
+		return filepath.Join(outputFolder, filepath.FromSlash(path))
+	}
+	stagePath := func(path string) string {
+		return filepath.Join(stageFolder, filepath.FromSlash(path))
+	}
+
+	switch op.Kind {
+	case journalOpDir:
+		return ensureDir(outputPath(op.Path))
+	case journalOpSymlink:
+		return ensureSymlink(outputPath(op.Path), op.Dest)
+	case journalOpCopy:
+		mkdirBehavior := mkdirBehaviorNever
+		if op.Mkdir {
+			mkdirBehavior = mkdirBehaviorIfNeeded
+		}
+		return copyPath(outputPath(op.Path), outputPath(op.Dest), mkdirBehavior)
+	case journalOpMove:
+		oldPath := outputPath(op.Path)
+		if op.FromStage {
+			oldPath = stagePath(op.Path)
+		}
+		newPath := outputPath(op.Dest)
+
+		if maybeDone {
+			if _, err := screw.Lstat(oldPath); os.IsNotExist(err) {
+				if _, err := screw.Lstat(newPath); err == nil {
+					// we got interrupted after moving, but before
+					// marking it as done.
+					debugf("already moved '%s'", op.Dest)
+					return nil
+				}
+			}
+		}
+		return movePath(oldPath, newPath)
+	case journalOpOverlay:
+		return applyOverlay(stagePath(op.Path), outputPath(op.Path), op.Mode)
+	case journalOpGhost:
+		return deleteGhost(outputPath(op.Path), op.GhostKind)
+	}
+
+	return errors.Errorf("overlaybowl: unknown journal op kind %d", op.Kind)
+}
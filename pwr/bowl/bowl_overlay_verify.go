@@ -0,0 +1,226 @@
+package bowl
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/savior/filesource"
+	"github.com/itchio/screw"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/overlay"
+
+	"github.com/itchio/lake/pools/nullpool"
+	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
+)
+
+// ErrVerificationFailed is returned by an overlay bowl's Commit when the
+// staged result doesn't match the signature it was given. When it's
+// returned, the output folder hasn't been touched.
+type ErrVerificationFailed struct {
+	Wounds    []*pwr.Wound
+	Container *tlc.Container
+}
+
+var _ error = (*ErrVerificationFailed)(nil)
+
+func (e *ErrVerificationFailed) Error() string {
+	return fmt.Sprintf("overlaybowl: staged result has %d wounds, first one: %s",
+		len(e.Wounds), e.Wounds[0].PrettyString(e.Container))
+}
+
+// verify checks what every file of the output folder will look like after
+// committing, against the signature, without touching the output folder.
+func (b *overlayBowl) verify() error {
+	container := b.Signature.Container
+
+	if len(container.Files) != len(b.SourceContainer.Files) {
+		return errors.Errorf("overlaybowl: signature has %d files, but source container has %d",
+			len(container.Files), len(b.SourceContainer.Files))
+	}
+	for i, f := range container.Files {
+		sf := b.SourceContainer.Files[i]
+		if f.Path != sf.Path || f.Size != sf.Size {
+			return errors.Errorf("overlaybowl: signature file %d is (%s), but source container file is (%s)", i, f.Path, sf.Path)
+		}
+	}
+
+	transposed := make(map[int64]int64)
+	for _, t := range b.transpositions {
+		transposed[t.SourceIndex] = t.TargetIndex
+	}
+	overlayFiles := make(map[int64]bool)
+	for _, i := range b.overlayFiles {
+		overlayFiles[i] = true
+	}
+	moveFiles := make(map[int64]bool)
+	for _, i := range b.moveFiles {
+		moveFiles[i] = true
+	}
+
+	wounds := make(chan *pwr.Wound)
+	var found []*pwr.Wound
+	collectDone := make(chan struct{})
+	go func() {
+		defer close(collectDone)
+		for wound := range wounds {
+			if !wound.Healthy() {
+				found = append(found, wound)
+			}
+		}
+	}()
+
+	vp := &pwr.ValidatingPool{
+		Pool:      nullpool.New(container),
+		Container: container,
+		Signature: b.Signature,
+
+		Wounds: wounds,
+		WoundsFilter: func(wounds chan *pwr.Wound) chan *pwr.Wound {
+			return pwr.AggregateWounds(wounds, pwr.MaxWoundSize)
+		},
+	}
+
+	verifyOne := func(fileIndex int64) error {
+		file := container.Files[fileIndex]
+		nativePath := filepath.FromSlash(file.Path)
+
+		wholeFileWound := func() {
+			wounds <- &pwr.Wound{
+				Kind:  pwr.WoundKind_FILE,
+				Index: fileIndex,
+				Start: 0,
+				End:   file.Size,
+			}
+		}
+
+		// where the final contents of that file are
+		var basePath string
+		switch {
+		case overlayFiles[fileIndex]:
+			basePath = filepath.Join(b.OutputFolder, nativePath)
+		case moveFiles[fileIndex]:
+			basePath = filepath.Join(b.StageFolder, nativePath)
+		default:
+			if targetIndex, ok := transposed[fileIndex]; ok {
+				targetFile := b.TargetContainer.Files[targetIndex]
+				basePath = filepath.Join(b.OutputFolder, filepath.FromSlash(targetFile.Path))
+			} else {
+				// untouched, reused as-is
+				basePath = filepath.Join(b.OutputFolder, nativePath)
+			}
+		}
+
+		base, err := screw.Open(basePath)
+		if err != nil {
+			debugf("verify: could not open (%s): %v", basePath, err)
+			wholeFileWound()
+			return nil
+		}
+		defer base.Close()
+
+		w, err := vp.GetWriter(fileIndex)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		cw := counter.NewWriter(w)
+
+		err = func() error {
+			defer w.Close()
+
+			if overlayFiles[fileIndex] {
+				r, err := filesource.Open(filepath.Join(b.StageFolder, nativePath))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				defer r.Close()
+
+				ctx := &overlay.OverlayPatchContext{}
+				return ctx.Patch(r, &overlayView{base: base, out: cw})
+			}
+
+			_, err := io.Copy(cw, base)
+			return errors.WithStack(err)
+		}()
+		if err != nil {
+			return err
+		}
+
+		if cw.Count() < file.Size {
+			wounds <- &pwr.Wound{
+				Kind:  pwr.WoundKind_FILE,
+				Index: fileIndex,
+				Start: cw.Count(),
+				End:   file.Size,
+			}
+		}
+		return nil
+	}
+
+	var err error
+	for fileIndex := range container.Files {
+		err = verifyOne(int64(fileIndex))
+		if err != nil {
+			break
+		}
+	}
+
+	close(wounds)
+	<-collectDone
+
+	if err != nil {
+		return err
+	}
+
+	if len(found) > 0 {
+		return &ErrVerificationFailed{
+			Wounds:    found,
+			Container: container,
+		}
+	}
+	return nil
+}
+
+// overlayView streams what a file will look like once an overlay has
+// been applied to it, without modifying the file.
+type overlayView struct {
+	// the file the overlay will be applied to, read sequentially
+	base io.Reader
+	// receives the patched contents
+	out io.Writer
+
+	offset int64
+}
+
+var _ io.WriteSeeker = (*overlayView)(nil)
+
+// Write replaces as many bytes of base with fresh data
+func (ov *overlayView) Write(buf []byte) (int, error) {
+	// fresh data may extend past the end of base, that's fine
+	_, err := io.CopyN(ioutil.Discard, ov.base, int64(len(buf)))
+	if err != nil && err != io.EOF {
+		return 0, errors.WithStack(err)
+	}
+
+	n, err := ov.out.Write(buf)
+	ov.offset += int64(n)
+	return n, err
+}
+
+// Seek keeps bytes from base, it only supports seeking forward from
+// the current offset, which is all overlays do.
+func (ov *overlayView) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekCurrent || offset < 0 {
+		return ov.offset, errors.Errorf("overlayView: unsupported seek (%d, %d)", offset, whence)
+	}
+
+	copied, err := io.CopyN(ov.out, ov.base, offset)
+	ov.offset += copied
+	if err != nil {
+		return ov.offset, errors.Wrapf(err, "overlayView: skipping %d bytes", offset)
+	}
+	return ov.offset, nil
+}
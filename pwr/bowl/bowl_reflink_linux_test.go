@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package bowl_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/screw"
+	"github.com/itchio/wharf/pwr/bowl"
+	"github.com/stretchr/testify/assert"
+)
+
+// FS_IOC_FIEMAP and FIEMAP_FLAG_SYNC from linux/fs.h and linux/fiemap.h
+const (
+	fsIocFiemap    = 0xC020660B
+	fiemapFlagSync = 0x1
+)
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	reserved64 [2]uint64
+	Flags      uint32
+	reserved   [3]uint32
+}
+
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	reserved      uint32
+	Extents       [1]fiemapExtent
+}
+
+// firstPhysicalExtent returns where the first extent of a file is on disk
+func firstPhysicalExtent(t *testing.T, path string) uint64 {
+	f, err := screw.Open(path)
+	must(t, err)
+	defer f.Close()
+
+	fm := &fiemap{
+		Length:      ^uint64(0),
+		Flags:       fiemapFlagSync,
+		ExtentCount: 1,
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(fm)))
+	if errno != 0 {
+		t.Skipf("FIEMAP isn't supported here: %v", errno)
+	}
+	if fm.MappedExtents == 0 {
+		t.Fatalf("(%s) has no extents", path)
+	}
+	return fm.Extents[0].Physical
+}
+
+func Test_FreshBowlReflink(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "freshbowlreflink")
+	must(t, err)
+	defer screw.RemoveAll(mainDir)
+
+	targetFolder := filepath.Join(mainDir, "target")
+	outputFolder := filepath.Join(mainDir, "output")
+	must(t, screw.MkdirAll(targetFolder, 0755))
+
+	// probe support first: if the filesystem can't clone, there's
+	// nothing to assert, the bowl falls back to copying.
+	probePath := filepath.Join(mainDir, "probe")
+	must(t, ioutil.WriteFile(probePath, []byte("probe"), 0644))
+	err = bowl.ReflinkFile(probePath, probePath+"-clone", 0644)
+	if err != nil {
+		t.Skipf("reflinks aren't supported here: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("reflinked "), 16*1024)
+	must(t, ioutil.WriteFile(filepath.Join(targetFolder, "same"), data, 0644))
+
+	targetContainer, err := tlc.WalkDir(targetFolder, tlc.WalkOpts{})
+	must(t, err)
+	sourceContainer := targetContainer.Clone()
+
+	targetPool := fspool.New(targetContainer, targetFolder)
+	b, err := bowl.NewFreshBowl(bowl.FreshBowlParams{
+		SourceContainer: sourceContainer,
+		TargetContainer: targetContainer,
+		TargetPool:      targetPool,
+		OutputFolder:    outputFolder,
+		TransposeMode:   bowl.TransposeModeReflink,
+	})
+	must(t, err)
+
+	must(t, b.Transpose(bowl.Transposition{
+		TargetIndex: findFile(t, targetContainer, "same"),
+		SourceIndex: findFile(t, sourceContainer, "same"),
+	}))
+	must(t, b.Commit())
+	must(t, targetPool.Close())
+
+	targetPath := filepath.Join(targetFolder, "same")
+	outputPath := filepath.Join(outputFolder, "same")
+
+	outputData, err := ioutil.ReadFile(outputPath)
+	must(t, err)
+	assert.True(t, bytes.Equal(data, outputData))
+
+	assert.EqualValues(t, firstPhysicalExtent(t, targetPath), firstPhysicalExtent(t, outputPath), "output should share its extents with the target")
+}
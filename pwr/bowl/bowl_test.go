@@ -1,14 +1,26 @@
 package bowl_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/itchio/arkive/zip"
 	"github.com/itchio/screw"
 
+	"github.com/itchio/lake/pools/fspool"
 	"github.com/itchio/lake/pools/zipwriterpool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/pools/mempool"
+	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/pwr/bowl"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_PatchOneSameLength(t *testing.T) {
@@ -132,6 +144,19 @@ func Test_DuplicateTwo(t *testing.T) {
 	})
 }
 
+func Test_CopyThenPatch(t *testing.T) {
+	runScenario(t, &bowlerParams{
+		makeTarget: func(p *bowlerPreparator) {
+			p.file("original", []byte("moon"))
+		},
+		apply: func(p *bowlerSimulator) {
+			// copied before the original is patched in place
+			p.transpose("original", "copy")
+			p.patch("original", []byte("moonish"))
+		},
+	})
+}
+
 func Test_Swaperoo(t *testing.T) {
 	runScenario(t, &bowlerParams{
 		makeTarget: func(p *bowlerPreparator) {
@@ -191,6 +216,32 @@ func runScenario(t *testing.T, params *bowlerParams) {
 		runBowler(t, params)
 	})
 
+	// fresh bowl, linking unchanged files
+	for _, mode := range []struct {
+		name string
+		mode bowl.TransposeMode
+	}{
+		{"hardlinkFreshBowl", bowl.TransposeModeHardlink},
+		{"reflinkFreshBowl", bowl.TransposeModeReflink},
+	} {
+		transposeMode := mode.mode
+		params.makeBowl = func(p *makeBowlParams) (bowl.Bowl, bowlMode) {
+			b, err := bowl.NewFreshBowl(bowl.FreshBowlParams{
+				SourceContainer: p.SourceContainer,
+				TargetContainer: p.TargetContainer,
+				TargetPool:      p.TargetPool,
+				OutputFolder:    p.FreshFolder,
+				TransposeMode:   transposeMode,
+			})
+			must(t, err)
+
+			return b, bowlModeFresh
+		}
+		t.Run(mode.name, func(t *testing.T) {
+			runBowler(t, params)
+		})
+	}
+
 	// overlay bowl
 	params.makeBowl = func(p *makeBowlParams) (bowl.Bowl, bowlMode) {
 		b, err := bowl.NewOverlayBowl(bowl.OverlayBowlParams{
@@ -207,6 +258,77 @@ func runScenario(t *testing.T, params *bowlerParams) {
 		runBowler(t, params)
 	})
 
+	// overlay bowl, verified before commit
+	params.makeBowl = func(p *makeBowlParams) (bowl.Bowl, bowlMode) {
+		hashes, err := pwr.ComputeSignature(context.Background(), p.SourceContainer, fspool.New(p.SourceContainer, p.RefFolder), nil)
+		must(t, err)
+
+		b, err := bowl.NewOverlayBowl(bowl.OverlayBowlParams{
+			SourceContainer: p.SourceContainer,
+			TargetContainer: p.TargetContainer,
+			OutputFolder:    p.TargetFolder,
+			StageFolder:     p.FreshFolder,
+			Signature: &pwr.SignatureInfo{
+				Container: p.SourceContainer,
+				Hashes:    hashes,
+			},
+		})
+		must(t, err)
+
+		return b, bowlModeInPlace
+	}
+	t.Run("verifiedOverlayBowl", func(t *testing.T) {
+		runBowler(t, params)
+	})
+
+	// overlay bowl, interrupted after each op while committing
+	t.Run("interruptedOverlayBowl", func(t *testing.T) {
+		for interruptAfter := 1; ; interruptAfter++ {
+			ib := &interruptedBowl{
+				t:              t,
+				interruptAfter: interruptAfter,
+			}
+			params.makeBowl = func(p *makeBowlParams) (bowl.Bowl, bowlMode) {
+				b, err := bowl.NewOverlayBowl(bowl.OverlayBowlParams{
+					SourceContainer: p.SourceContainer,
+					TargetContainer: p.TargetContainer,
+					OutputFolder:    p.TargetFolder,
+					StageFolder:     p.FreshFolder,
+				})
+				must(t, err)
+
+				ib.Bowl = b
+				ib.stageFolder = p.FreshFolder
+				ib.outputFolder = p.TargetFolder
+				return ib, bowlModeInPlace
+			}
+			ok := t.Run(fmt.Sprintf("after%d", interruptAfter), func(t *testing.T) {
+				runBowler(t, params)
+			})
+			if !ok || ib.finished {
+				break
+			}
+		}
+	})
+
+	// memory bowl
+	params.makeBowl = func(p *makeBowlParams) (bowl.Bowl, bowlMode) {
+		p.MemoryPool = mempool.New(p.SourceContainer)
+
+		b, err := bowl.NewMemoryBowl(bowl.MemoryBowlParams{
+			SourceContainer: p.SourceContainer,
+			TargetContainer: p.TargetContainer,
+			TargetPool:      p.TargetPool,
+			OutputPool:      p.MemoryPool,
+		})
+		must(t, err)
+
+		return b, bowlModeMemory
+	}
+	t.Run("memoryBowl", func(t *testing.T) {
+		runBowler(t, params)
+	})
+
 	// pool bowl
 	params.makeBowl = func(p *makeBowlParams) (bowl.Bowl, bowlMode) {
 		p.ZipFilePath = filepath.Join(p.FreshFolder, "archive.zip")
@@ -236,3 +358,346 @@ func runScenario(t *testing.T, params *bowlerParams) {
 		runBowler(t, params)
 	})
 }
+
+func Test_FreshBowlHardlink(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "freshbowlhardlink")
+	must(t, err)
+	defer screw.RemoveAll(mainDir)
+
+	targetFolder := filepath.Join(mainDir, "target")
+	outputFolder := filepath.Join(mainDir, "output")
+
+	must(t, screw.MkdirAll(filepath.Join(targetFolder, "dir"), 0755))
+	must(t, ioutil.WriteFile(filepath.Join(targetFolder, "dir", "same"), []byte("unchanged"), 0644))
+	must(t, ioutil.WriteFile(filepath.Join(targetFolder, "exec"), []byte("mode changed"), 0644))
+
+	targetContainer, err := tlc.WalkDir(targetFolder, tlc.WalkOpts{})
+	must(t, err)
+	sourceContainer := targetContainer.Clone()
+	sourceContainer.Files[findFile(t, sourceContainer, "exec")].Mode = 0755
+
+	targetPool := fspool.New(targetContainer, targetFolder)
+	b, err := bowl.NewFreshBowl(bowl.FreshBowlParams{
+		SourceContainer: sourceContainer,
+		TargetContainer: targetContainer,
+		TargetPool:      targetPool,
+		OutputFolder:    outputFolder,
+		TransposeMode:   bowl.TransposeModeHardlink,
+	})
+	must(t, err)
+
+	for _, path := range []string{"dir/same", "exec"} {
+		must(t, b.Transpose(bowl.Transposition{
+			TargetIndex: findFile(t, targetContainer, path),
+			SourceIndex: findFile(t, sourceContainer, path),
+		}))
+	}
+	must(t, b.Commit())
+	must(t, targetPool.Close())
+
+	sameFile := func(path string) bool {
+		targetStats, err := os.Stat(filepath.Join(targetFolder, filepath.FromSlash(path)))
+		must(t, err)
+		outputStats, err := os.Stat(filepath.Join(outputFolder, filepath.FromSlash(path)))
+		must(t, err)
+		return os.SameFile(targetStats, outputStats)
+	}
+	assert.True(t, sameFile("dir/same"), "unchanged file should be hardlinked")
+	assert.False(t, sameFile("exec"), "file whose mode changed should be copied")
+
+	data, err := ioutil.ReadFile(filepath.Join(outputFolder, "exec"))
+	must(t, err)
+	assert.EqualValues(t, "mode changed", string(data))
+}
+
+func Test_MemoryBowlCheckpoint(t *testing.T) {
+	container := &tlc.Container{
+		Dirs: []*tlc.Dir{
+			{Path: "dir", Mode: 0755},
+		},
+		Files: []*tlc.File{
+			{Path: "dir/kept", Mode: 0644, Size: 4},
+			{Path: "dir/patched", Mode: 0755, Size: 11},
+		},
+		Symlinks: []*tlc.Symlink{
+			{Path: "link", Mode: 0644, Dest: "dir/kept"},
+		},
+	}
+	targetPool := mempool.New(container)
+	w, err := targetPool.GetWriter(0)
+	must(t, err)
+	_, err = w.Write([]byte("kept"))
+	must(t, err)
+	must(t, w.Close())
+
+	// gob round-trips checkpoints, like a patcher saving them to disk would
+	roundtrip := func(in interface{}, out interface{}) {
+		buf := new(bytes.Buffer)
+		must(t, gob.NewEncoder(buf).Encode(in))
+		must(t, gob.NewDecoder(buf).Decode(out))
+	}
+
+	newBowl := func(pool *mempool.MemPool) bowl.Bowl {
+		b, err := bowl.NewMemoryBowl(bowl.MemoryBowlParams{
+			SourceContainer: container,
+			TargetContainer: container,
+			TargetPool:      targetPool,
+			OutputPool:      pool,
+		})
+		must(t, err)
+		return b
+	}
+
+	pool := mempool.New(container)
+	b := newBowl(pool)
+	must(t, b.Resume(nil))
+	must(t, b.Transpose(bowl.Transposition{TargetIndex: 0, SourceIndex: 0}))
+
+	ew, err := b.GetWriter(1)
+	must(t, err)
+	_, err = ew.Resume(nil)
+	must(t, err)
+	_, err = ew.Write([]byte("hello "))
+	must(t, err)
+
+	var bc bowl.BowlCheckpoint
+	c, err := b.Save()
+	must(t, err)
+	roundtrip(c, &bc)
+	var wc bowl.WriterCheckpoint
+	c2, err := ew.Save()
+	must(t, err)
+	roundtrip(c2, &wc)
+
+	// written past the checkpoint, will be discarded
+	_, err = ew.Write([]byte("lost"))
+	must(t, err)
+	must(t, ew.Close())
+
+	// the contents live in the pool, a whole new one can't be resumed
+	assert.Error(t, newBowl(mempool.New(container)).Resume(&bc))
+
+	// other readers don't see writes past the checkpoint go away
+	r, err := pool.GetReadSeeker(1)
+	must(t, err)
+
+	b = newBowl(pool)
+	must(t, b.Resume(&bc))
+
+	ew, err = b.GetWriter(1)
+	must(t, err)
+	offset, err := ew.Resume(&wc)
+	must(t, err)
+	assert.EqualValues(t, 6, offset)
+	_, err = ew.Write([]byte("world"))
+	must(t, err)
+	must(t, ew.Finalize())
+	must(t, ew.Close())
+	must(t, b.Commit())
+
+	assert.EqualValues(t, "kept", string(pool.Bytes(0)))
+	assert.EqualValues(t, "hello world", string(pool.Bytes(1)))
+	before, err := ioutil.ReadAll(r)
+	must(t, err)
+	assert.EqualValues(t, "hello lost", string(before))
+	assert.EqualValues(t, 0755, pool.Container().Files[1].Mode)
+	assert.EqualValues(t, "dir/kept", pool.Container().Symlinks[0].Dest)
+}
+
+// interruptedBowl has its commit interrupted after interruptAfter ops,
+// then the recovery interrupted as well, before letting Commit finish
+// the job. It's finished once interruptAfter is past the last op.
+type interruptedBowl struct {
+	bowl.Bowl
+
+	t              *testing.T
+	stageFolder    string
+	outputFolder   string
+	interruptAfter int
+	finished       bool
+}
+
+func (ib *interruptedBowl) Commit() error {
+	defer bowl.SetInterruptCommitAfter(-1)
+
+	bowl.SetInterruptCommitAfter(ib.interruptAfter)
+	err := ib.Bowl.Commit()
+	if err == nil {
+		ib.finished = true
+		return nil
+	}
+
+	// redo the op we got interrupted after, and only that one
+	bowl.SetInterruptCommitAfter(1)
+	err = bowl.RecoverOverlay(ib.stageFolder, ib.outputFolder)
+	assert.Error(ib.t, err)
+
+	bowl.SetInterruptCommitAfter(-1)
+	err = ib.Bowl.Commit()
+	if err != nil {
+		return err
+	}
+
+	// nothing left to recover from
+	return bowl.RecoverOverlay(ib.stageFolder, ib.outputFolder)
+}
+
+func Test_OverlayBowlStaleJournal(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "overlaybowlstale")
+	must(t, err)
+	defer screw.RemoveAll(mainDir)
+
+	targetFolder := filepath.Join(mainDir, "target")
+	stageFolder := filepath.Join(mainDir, "stage")
+	must(t, screw.MkdirAll(targetFolder, 0755))
+
+	targetContainer := &tlc.Container{}
+	commit := func(dir string) error {
+		sourceContainer := &tlc.Container{
+			Dirs: []*tlc.Dir{{Path: dir, Mode: 0755}},
+		}
+		b, err := bowl.NewOverlayBowl(bowl.OverlayBowlParams{
+			SourceContainer: sourceContainer,
+			TargetContainer: targetContainer,
+			OutputFolder:    targetFolder,
+			StageFolder:     stageFolder,
+		})
+		must(t, err)
+		defer b.Close()
+		return b.Commit()
+	}
+
+	bowl.SetInterruptCommitAfter(1)
+	assert.Error(t, commit("first"))
+	bowl.SetInterruptCommitAfter(-1)
+
+	// another patch must not pick up where the first one left off
+	assert.Error(t, commit("second"))
+	_, err = screw.Lstat(filepath.Join(targetFolder, "second"))
+	assert.True(t, os.IsNotExist(err))
+
+	// the same patch does
+	must(t, commit("first"))
+	must(t, commit("second"))
+	for _, dir := range []string{"first", "second"} {
+		stats, err := screw.Lstat(filepath.Join(targetFolder, dir))
+		must(t, err)
+		assert.True(t, stats.IsDir())
+	}
+}
+
+func Test_OverlayBowlVerify(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "overlaybowlverify")
+	must(t, err)
+	defer screw.RemoveAll(mainDir)
+
+	targetFolder := filepath.Join(mainDir, "target")
+	refFolder := filepath.Join(mainDir, "ref")
+	stageFolder := filepath.Join(mainDir, "stage")
+
+	writeFile := func(path string, data string) {
+		must(t, screw.MkdirAll(filepath.Dir(path), 0755))
+		must(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	writeFile(filepath.Join(targetFolder, "patched"), "moon and stars")
+	writeFile(filepath.Join(targetFolder, "kept"), "untouched")
+	writeFile(filepath.Join(refFolder, "patched"), "moon and stars and then some")
+	writeFile(filepath.Join(refFolder, "kept"), "untouched")
+	writeFile(filepath.Join(refFolder, "added"), "brand new")
+
+	targetContainer, err := tlc.WalkDir(targetFolder, tlc.WalkOpts{})
+	must(t, err)
+	sourceContainer, err := tlc.WalkDir(refFolder, tlc.WalkOpts{})
+	must(t, err)
+
+	hashes, err := pwr.ComputeSignature(context.Background(), sourceContainer, fspool.New(sourceContainer, refFolder), nil)
+	must(t, err)
+	sigInfo := &pwr.SignatureInfo{
+		Container: sourceContainer,
+		Hashes:    hashes,
+	}
+
+	commit := func(contents map[string]string) error {
+		must(t, screw.RemoveAll(stageFolder))
+
+		b, err := bowl.NewOverlayBowl(bowl.OverlayBowlParams{
+			SourceContainer: sourceContainer,
+			TargetContainer: targetContainer,
+			OutputFolder:    targetFolder,
+			StageFolder:     stageFolder,
+			Signature:       sigInfo,
+		})
+		must(t, err)
+		defer b.Close()
+
+		for path, data := range contents {
+			w, err := b.GetWriter(findFile(t, sourceContainer, path))
+			must(t, err)
+			_, err = w.Resume(nil)
+			must(t, err)
+			_, err = w.Write([]byte(data))
+			must(t, err)
+			must(t, w.Finalize())
+			must(t, w.Close())
+		}
+
+		must(t, b.Transpose(bowl.Transposition{
+			TargetIndex: findFile(t, targetContainer, "kept"),
+			SourceIndex: findFile(t, sourceContainer, "kept"),
+		}))
+
+		return b.Commit()
+	}
+
+	assertUntouched := func() {
+		data, err := ioutil.ReadFile(filepath.Join(targetFolder, "patched"))
+		must(t, err)
+		assert.EqualValues(t, "moon and stars", string(data))
+		_, err = screw.Lstat(filepath.Join(targetFolder, "added"))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// a bad patch
+	err = commit(map[string]string{
+		"patched": "moon and stars and then sum",
+		"added":   "brand new",
+	})
+	verr, ok := errors.Cause(err).(*bowl.ErrVerificationFailed)
+	if assert.True(t, ok, "expected verification error, got %v", err) {
+		assert.NotEmpty(t, verr.Wounds)
+		for _, wound := range verr.Wounds {
+			assert.EqualValues(t, findFile(t, sourceContainer, "patched"), wound.Index)
+		}
+	}
+	assertUntouched()
+
+	// a reused file that got corrupted on disk
+	writeFile(filepath.Join(targetFolder, "kept"), "untouchet")
+	err = commit(map[string]string{
+		"patched": "moon and stars and then some",
+		"added":   "brand new",
+	})
+	verr, ok = errors.Cause(err).(*bowl.ErrVerificationFailed)
+	if assert.True(t, ok, "expected verification error, got %v", err) {
+		assert.NotEmpty(t, verr.Wounds)
+		for _, wound := range verr.Wounds {
+			assert.EqualValues(t, findFile(t, sourceContainer, "kept"), wound.Index)
+		}
+	}
+	assertUntouched()
+
+	// a good patch
+	writeFile(filepath.Join(targetFolder, "kept"), "untouched")
+	must(t, commit(map[string]string{
+		"patched": "moon and stars and then some",
+		"added":   "brand new",
+	}))
+
+	for _, path := range []string{"patched", "kept", "added"} {
+		expected, err := ioutil.ReadFile(filepath.Join(refFolder, path))
+		must(t, err)
+		actual, err := ioutil.ReadFile(filepath.Join(targetFolder, path))
+		must(t, err)
+		assert.EqualValues(t, string(expected), string(actual))
+	}
+}
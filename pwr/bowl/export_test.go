@@ -0,0 +1,11 @@
+package bowl
+
+// SetInterruptCommitAfter makes commits (and recoveries) stop after
+// performing their nth operation, as if the process was killed.
+// A negative n lets them run to completion.
+func SetInterruptCommitAfter(n int) {
+	interruptCommitAfter = n
+}
+
+// ReflinkFile clones src into dst, if the platform and filesystem allow it.
+var ReflinkFile = reflinkFile
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package bowl
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/itchio/savior"
+	"github.com/itchio/screw"
+	"github.com/pkg/errors"
+)
+
+// FICLONE from linux/fs.h, supported by btrfs and xfs (among others)
+const ficlone = 0x40049409
+
+// reflinkFile creates dst as a copy-on-write clone of src, or returns
+// an error if the filesystem doesn't support that.
+func reflinkFile(src string, dst string, mode os.FileMode) error {
+	in, err := screw.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	out, err := screw.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno != 0 {
+		savior.Debugf("reflink: FICLONE (%s) => (%s) failed: %v", src, dst, errno)
+		out.Close()
+		screw.Remove(dst)
+		return errors.WithStack(errno)
+	}
+
+	err = out.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package bowl
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// reflinkFile is only supported on linux for now
+func reflinkFile(src string, dst string, mode os.FileMode) error {
+	return errors.New("reflinks are not supported on this platform")
+}
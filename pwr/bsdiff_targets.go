@@ -0,0 +1,132 @@
+package pwr
+
+import (
+	"io"
+
+	"github.com/itchio/lake"
+	"github.com/pkg/errors"
+)
+
+// BsdiffTargetIndices returns the target files a bsdiff'd file is
+// patched against: their concatenation, in order, is the "old file".
+func BsdiffTargetIndices(bh *BsdiffHeader) []int64 {
+	res := []int64{bh.TargetIndex}
+	return append(res, bh.ExtraTargetIndices...)
+}
+
+// OpenBsdiffTargets returns a reader for the concatenation of the target
+// files targetIndices, as read from pool. With a single target file, that's
+// just the pool's ReadSeeker for it.
+func OpenBsdiffTargets(pool lake.Pool, targetIndices []int64) (io.ReadSeeker, error) {
+	if len(targetIndices) == 0 {
+		return nil, errors.New("bsdiff: no target files to patch against")
+	}
+
+	if len(targetIndices) == 1 {
+		r, err := pool.GetReadSeeker(targetIndices[0])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return r, nil
+	}
+
+	cr := &concatReader{
+		pool:    pool,
+		indices: targetIndices,
+	}
+	for _, index := range targetIndices {
+		cr.starts = append(cr.starts, cr.size)
+		cr.size += pool.GetSize(index)
+	}
+	return cr, nil
+}
+
+// concatReader reads several files of a pool as if they were
+// a single one. Pools may only keep one reader open at a time, so
+// it asks for the right one (and seeks it) on every read. Reads fill
+// the whole buffer unless the end is reached, even across files.
+type concatReader struct {
+	pool    lake.Pool
+	indices []int64
+	starts  []int64
+	size    int64
+	offset  int64
+}
+
+var _ io.ReadSeeker = (*concatReader)(nil)
+
+func (cr *concatReader) Read(buf []byte) (int, error) {
+	if cr.offset >= cr.size {
+		return 0, io.EOF
+	}
+
+	var total int
+	for len(buf) > 0 && cr.offset < cr.size {
+		n, err := cr.readSome(buf)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		buf = buf[n:]
+	}
+	return total, nil
+}
+
+// readSome reads from the file our offset is in, up to its end
+func (cr *concatReader) readSome(buf []byte) (int, error) {
+	// find the last file starting at or before our offset,
+	// which skips over empty files.
+	i := len(cr.starts) - 1
+	for cr.starts[i] > cr.offset {
+		i--
+	}
+
+	end := cr.size
+	if i+1 < len(cr.starts) {
+		end = cr.starts[i+1]
+	}
+	if int64(len(buf)) > end-cr.offset {
+		buf = buf[:end-cr.offset]
+	}
+
+	r, err := cr.pool.GetReadSeeker(cr.indices[i])
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	_, err = r.Seek(cr.offset-cr.starts[i], io.SeekStart)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	n, err := io.ReadFull(r, buf)
+	cr.offset += int64(n)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the file is shorter than the pool says
+			return n, errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		return n, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+func (cr *concatReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		// offset is already absolute
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return cr.offset, errors.Errorf("bsdiff: invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return cr.offset, errors.Errorf("bsdiff: negative seek offset %d", offset)
+	}
+
+	cr.offset = offset
+	return cr.offset, nil
+}
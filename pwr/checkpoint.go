@@ -0,0 +1,155 @@
+package pwr
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// AfterSaveAction describes what should happen after a checkpoint was saved.
+// This can be used to gracefully stop long-running operations.
+type AfterSaveAction int
+
+const (
+	// AfterSaveContinue indicates that the operation should continue after saving.
+	AfterSaveContinue AfterSaveAction = 1
+	// AfterSaveStop indicates that the operation should stop and return ErrStop
+	AfterSaveStop AfterSaveAction = 2
+)
+
+// ErrStop is returned by ValidatorContext.Resume if it just saved a checkpoint
+// and the ValidatorSaveConsumer returned AfterSaveStop.
+var ErrStop = errors.New("validation was stopped after save")
+
+// ValidatorCheckpoint contains state information for validation (and healing)
+// that can be written to disk and read back to resume roughly where we left off.
+// Checkpoints are only saved while validating: healing the wounds that are left
+// once all files have been checked isn't checkpointed, and getting interrupted
+// then means resuming from the last checkpoint saved while validating.
+type ValidatorCheckpoint struct {
+	// FileIndex is the index of the file being validated: all files before
+	// it have been validated.
+	FileIndex int64
+
+	// Offset is how much of file FileIndex has been validated, it's always
+	// a multiple of the signature's block size.
+	Offset int64
+
+	// Wounds found in the part of the container that has been validated, and
+	// that haven't been healed yet. If the wounds consumer isn't a ResumableHealer,
+	// that's all wounds found so far.
+	Wounds []*Wound
+}
+
+// A ValidatorSaveConsumer can be set on a ValidatorContext to decide if it should
+// save (whenever it reaches a convenient place for a checkpoint), to receive the
+// checkpoints, and to let the validator know if it should stop or continue.
+type ValidatorSaveConsumer interface {
+	ShouldSave() bool
+	Save(c *ValidatorCheckpoint) (AfterSaveAction, error)
+}
+
+// A ResumableHealer knows which of the wounds it received have been healed,
+// so that validation checkpoints don't need to remember them.
+type ResumableHealer interface {
+	Healer
+
+	IsHealed(wound *Wound) bool
+}
+
+// A woundKey identifies a wound by value: wounds rebuilt by AggregateWounds,
+// or decoded from a ValidatorCheckpoint, aren't the ones a healer received.
+type woundKey struct {
+	Kind  WoundKind
+	Index int64
+	Start int64
+	End   int64
+}
+
+func keyOfWound(wound *Wound) woundKey {
+	return woundKey{
+		Kind:  wound.Kind,
+		Index: wound.Index,
+		Start: wound.Start,
+		End:   wound.End,
+	}
+}
+
+// DefaultCheckpointInterval is the default for ValidatorContext.CheckpointInterval
+const DefaultCheckpointInterval int64 = 64 * 1024 * 1024 // 64MB
+
+// A woundTracker sits between the validator and the wounds consumer, and
+// remembers file wounds so that they can be saved in checkpoints.
+type woundTracker struct {
+	in    chan *Wound
+	syncs chan chan struct{}
+
+	wounds      []*Wound
+	woundsMutex sync.Mutex
+}
+
+// newWoundTracker returns a tracker that relays wounds to out, and
+// closes out when its own input channel is closed.
+func newWoundTracker(out chan *Wound) *woundTracker {
+	wt := &woundTracker{
+		// unbuffered, so that once a send completes, the tracker
+		// is guaranteed to record the wound before the next sync.
+		in:    make(chan *Wound),
+		syncs: make(chan chan struct{}),
+	}
+
+	go func() {
+		defer close(out)
+
+		for {
+			select {
+			case wound, ok := <-wt.in:
+				if !ok {
+					return
+				}
+
+				if wound.Kind == WoundKind_FILE {
+					wt.woundsMutex.Lock()
+					wt.wounds = append(wt.wounds, wound)
+					wt.woundsMutex.Unlock()
+				}
+				out <- wound
+			case done := <-wt.syncs:
+				close(done)
+			}
+		}
+	}()
+
+	return wt
+}
+
+// sync returns once all wounds sent to the tracker so far have been recorded
+func (wt *woundTracker) sync() {
+	done := make(chan struct{})
+	wt.syncs <- done
+	<-done
+}
+
+// pending returns copies of all the recorded wounds that haven't been healed
+func (wt *woundTracker) pending(consumer WoundsConsumer) []*Wound {
+	rh, _ := consumer.(ResumableHealer)
+
+	wt.woundsMutex.Lock()
+	defer wt.woundsMutex.Unlock()
+
+	// forget about healed wounds, they'll never be needed again
+	remaining := wt.wounds[:0]
+	var result []*Wound
+	for _, wound := range wt.wounds {
+		if rh != nil && rh.IsHealed(wound) {
+			continue
+		}
+		remaining = append(remaining, wound)
+
+		woundCopy := *wound
+		result = append(result, &woundCopy)
+	}
+	wt.wounds = remaining
+
+	return result
+}
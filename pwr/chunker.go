@@ -0,0 +1,25 @@
+package pwr
+
+import (
+	"github.com/itchio/wharf/wsync"
+)
+
+// DefaultChunkerSettings returns settings for content-defined chunking
+// that yield chunks of BlockSize on average
+func DefaultChunkerSettings() *ChunkerSettings {
+	params := wsync.DefaultChunkerParams
+	return &ChunkerSettings{
+		MinSize: int64(params.MinSize),
+		AvgSize: int64(params.AvgSize),
+		MaxSize: int64(params.MaxSize),
+	}
+}
+
+// Params returns the wsync chunker params corresponding to those settings
+func (cs *ChunkerSettings) Params() wsync.ChunkerParams {
+	return wsync.ChunkerParams{
+		MinSize: int(cs.MinSize),
+		AvgSize: int(cs.AvgSize),
+		MaxSize: int(cs.MaxSize),
+	}
+}
@@ -0,0 +1,313 @@
+package pwr
+
+import (
+	"bytes"
+
+	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
+)
+
+// FileChangeKind describes what happened to a file between two versions of a container
+type FileChangeKind int
+
+const (
+	// FileUnchanged files have the same path and the same contents in both versions
+	FileUnchanged FileChangeKind = iota
+	// FileModified files have the same path but different contents
+	FileModified
+	// FileRenamed files have the same contents as a file that had a different path
+	FileRenamed
+	// FileAdded files only exist in the new version
+	FileAdded
+	// FileRemoved files only exist in the old version
+	FileRemoved
+)
+
+func (k FileChangeKind) String() string {
+	switch k {
+	case FileUnchanged:
+		return "unchanged"
+	case FileModified:
+		return "modified"
+	case FileRenamed:
+		return "renamed"
+	case FileAdded:
+		return "added"
+	case FileRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// A BlockRange is a series of consecutive blocks (or chunks) of a file
+type BlockRange struct {
+	BlockIndex int64
+	BlockSpan  int64
+}
+
+// A FileChange describes what happened to a single file
+type FileChange struct {
+	Kind FileChangeKind
+
+	// Path of the file in the new container, or in the old container for removed files
+	Path string
+	// OldPath is the path the file had in the old container, for renamed files
+	OldPath string
+	// Size of the file in the new container, or in the old container for removed files
+	Size int64
+
+	// FileIndex is the index of the file in the new container, or in the old
+	// container for removed files
+	FileIndex int64
+
+	// ChangedBlocks lists the blocks of a modified file that differ from the
+	// old version. For fixed-size blocks, a block is changed if the old file
+	// had different contents at the same index. For content-defined chunks, a
+	// chunk is changed if the old file had no such chunk.
+	ChangedBlocks []BlockRange
+
+	// FreshBytes is the number of bytes of this file that can't be found
+	// anywhere in the old container
+	FreshBytes int64
+}
+
+// A SignatureComparison is the result of comparing two signatures
+type SignatureComparison struct {
+	// Files contains one entry per file of the new container, in order,
+	// followed by one entry per removed file of the old container
+	Files []*FileChange
+
+	// FreshBytes is an upper bound on the amount of fresh data a patch from
+	// the old container to the new container would need.
+	FreshBytes int64
+}
+
+// Count returns the number of files of a given kind
+func (sc *SignatureComparison) Count(kind FileChangeKind) int {
+	count := 0
+	for _, fc := range sc.Files {
+		if fc.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+type compareKey struct {
+	strongHash string
+	size       int64
+}
+
+type compareSide struct {
+	sigInfo   *SignatureInfo
+	blockSize int64
+	groups    map[int64][]wsync.BlockHash
+}
+
+func newCompareSide(sigInfo *SignatureInfo) *compareSide {
+	cs := &compareSide{
+		sigInfo:   sigInfo,
+		blockSize: ResolveBlockSize(sigInfo.BlockSize),
+		groups:    make(map[int64][]wsync.BlockHash),
+	}
+	for _, bh := range sigInfo.Hashes {
+		cs.groups[bh.FileIndex] = append(cs.groups[bh.FileIndex], bh)
+	}
+	return cs
+}
+
+// hashedSize returns the number of bytes covered by a block hash
+func (cs *compareSide) hashedSize(bh wsync.BlockHash) int64 {
+	if cs.sigInfo.Chunker != nil {
+		return bh.Size
+	}
+	if bh.ShortSize != 0 {
+		return int64(bh.ShortSize)
+	}
+	if cs.sigInfo.Container.Files[bh.FileIndex].Size == 0 {
+		// empty files have a 0-length shortblock
+		return 0
+	}
+	return cs.blockSize
+}
+
+func (cs *compareSide) key(bh wsync.BlockHash) compareKey {
+	return compareKey{
+		strongHash: string(bh.StrongHash),
+		size:       cs.hashedSize(bh),
+	}
+}
+
+// sameContents returns true if both hash series describe the same data
+func sameContents(a []wsync.BlockHash, b []wsync.BlockHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ShortSize != b[i].ShortSize || a[i].Size != b[i].Size {
+			return false
+		}
+		if !bytes.Equal(a[i].StrongHash, b[i].StrongHash) {
+			return false
+		}
+	}
+	return true
+}
+
+// CompareSignatures classifies every file of the new container as unchanged,
+// modified, renamed, or added, and every file missing from it as removed, without
+// needing access to either build. Both signatures must use the same block size,
+// or the same content-defined chunking settings.
+func CompareSignatures(oldSig *SignatureInfo, newSig *SignatureInfo) (*SignatureComparison, error) {
+	if oldSig == nil || newSig == nil {
+		return nil, errors.New("CompareSignatures: both signatures are required")
+	}
+
+	if (oldSig.Chunker == nil) != (newSig.Chunker == nil) {
+		return nil, errors.New("can't compare signatures of fixed-size blocks with signatures of content-defined chunks")
+	}
+	if oldSig.Chunker != nil {
+		if oldSig.Chunker.Params() != newSig.Chunker.Params() {
+			return nil, errors.Errorf("can't compare signatures with different chunker settings (%v vs %v)", oldSig.Chunker.Params(), newSig.Chunker.Params())
+		}
+	} else if ResolveBlockSize(oldSig.BlockSize) != ResolveBlockSize(newSig.BlockSize) {
+		return nil, errors.Errorf("can't compare signatures with different block sizes (%d vs %d)",
+			ResolveBlockSize(oldSig.BlockSize), ResolveBlockSize(newSig.BlockSize))
+	}
+
+	oldSide := newCompareSide(oldSig)
+	newSide := newCompareSide(newSig)
+
+	oldPathToIndex := make(map[string]int64)
+	for fileIndex, f := range oldSig.Container.Files {
+		oldPathToIndex[f.Path] = int64(fileIndex)
+	}
+	newPaths := make(map[string]bool)
+	for _, f := range newSig.Container.Files {
+		newPaths[f.Path] = true
+	}
+
+	oldKeys := make(map[compareKey]bool)
+	for _, bh := range oldSig.Hashes {
+		oldKeys[oldSide.key(bh)] = true
+	}
+
+	// files that disappeared are the best candidates for renames
+	oldByContents := make(map[compareKey][]int64)
+	for fileIndex, f := range oldSig.Container.Files {
+		if f.Size == 0 || newPaths[f.Path] {
+			continue
+		}
+		hashes := oldSide.groups[int64(fileIndex)]
+		if len(hashes) == 0 {
+			continue
+		}
+		k := oldSide.key(hashes[0])
+		oldByContents[k] = append(oldByContents[k], int64(fileIndex))
+	}
+	renamedFrom := make(map[int64]bool)
+
+	findRenameSource := func(hashes []wsync.BlockHash) (int64, bool) {
+		if len(hashes) == 0 {
+			return 0, false
+		}
+		for _, candidate := range oldByContents[newSide.key(hashes[0])] {
+			if renamedFrom[candidate] {
+				continue
+			}
+			if sameContents(oldSide.groups[candidate], hashes) {
+				return candidate, true
+			}
+		}
+		return 0, false
+	}
+
+	sc := &SignatureComparison{}
+
+	for fileIndex, f := range newSig.Container.Files {
+		hashes := newSide.groups[int64(fileIndex)]
+		fc := &FileChange{
+			Path:      f.Path,
+			Size:      f.Size,
+			FileIndex: int64(fileIndex),
+		}
+		sc.Files = append(sc.Files, fc)
+
+		if oldIndex, ok := oldPathToIndex[f.Path]; ok {
+			oldHashes := oldSide.groups[oldIndex]
+			if oldSig.Container.Files[oldIndex].Size == f.Size && sameContents(oldHashes, hashes) {
+				fc.Kind = FileUnchanged
+				continue
+			}
+
+			fc.Kind = FileModified
+			fc.ChangedBlocks = changedBlocks(oldSide, newSide, oldHashes, hashes)
+		} else if f.Size > 0 {
+			if oldIndex, ok := findRenameSource(hashes); ok {
+				renamedFrom[oldIndex] = true
+				fc.Kind = FileRenamed
+				fc.OldPath = oldSig.Container.Files[oldIndex].Path
+				continue
+			}
+			fc.Kind = FileAdded
+		} else {
+			fc.Kind = FileAdded
+		}
+
+		for _, bh := range hashes {
+			if !oldKeys[newSide.key(bh)] {
+				fc.FreshBytes += newSide.hashedSize(bh)
+			}
+		}
+		sc.FreshBytes += fc.FreshBytes
+	}
+
+	for fileIndex, f := range oldSig.Container.Files {
+		if newPaths[f.Path] || renamedFrom[int64(fileIndex)] {
+			continue
+		}
+		sc.Files = append(sc.Files, &FileChange{
+			Kind:      FileRemoved,
+			Path:      f.Path,
+			Size:      f.Size,
+			FileIndex: int64(fileIndex),
+		})
+	}
+
+	return sc, nil
+}
+
+func changedBlocks(oldSide *compareSide, newSide *compareSide, oldHashes []wsync.BlockHash, newHashes []wsync.BlockHash) []BlockRange {
+	var changed []bool
+	if newSide.sigInfo.Chunker != nil {
+		oldChunks := make(map[compareKey]bool)
+		for _, bh := range oldHashes {
+			oldChunks[oldSide.key(bh)] = true
+		}
+		for _, bh := range newHashes {
+			changed = append(changed, !oldChunks[newSide.key(bh)])
+		}
+	} else {
+		for i, bh := range newHashes {
+			same := i < len(oldHashes) && oldSide.key(oldHashes[i]) == newSide.key(bh)
+			changed = append(changed, !same)
+		}
+	}
+
+	var ranges []BlockRange
+	for i, c := range changed {
+		if !c {
+			continue
+		}
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if last.BlockIndex+last.BlockSpan == int64(i) {
+				last.BlockSpan++
+				continue
+			}
+		}
+		ranges = append(ranges, BlockRange{BlockIndex: int64(i), BlockSpan: 1})
+	}
+	return ranges
+}
@@ -0,0 +1,114 @@
+package pwr
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CompareSignatures(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "comparesigs")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	rng := rand.New(rand.NewSource(0xfeed))
+	randomData := func(size int64) []byte {
+		data := make([]byte, size)
+		_, err := rng.Read(data)
+		wtest.Must(t, err)
+		return data
+	}
+
+	same := randomData(BlockSize*4 + 12)
+	moved := randomData(BlockSize * 2)
+	removed := randomData(BlockSize + 1)
+	oldModified := randomData(BlockSize * 8)
+	newModified := append([]byte{}, oldModified...)
+	newModified[BlockSize*3+7]++
+	newModified[BlockSize*6]++
+	newModified[BlockSize*7]++
+	newModified = append(newModified, randomData(100)...)
+	added := randomData(BlockSize*2 + 3)
+
+	v1 := filepath.Join(mainDir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "same", Data: same},
+			{Path: "old/moved", Data: moved},
+			{Path: "removed", Data: removed},
+			{Path: "modified", Data: oldModified},
+			{Path: "empty", Size: -1},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "same", Data: same},
+			{Path: "new/moved", Data: moved},
+			{Path: "modified", Data: newModified},
+			{Path: "added", Data: added},
+			{Path: "empty", Size: -1},
+		},
+	})
+
+	computeSig := func(dir string) *SignatureInfo {
+		container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+		wtest.Must(t, err)
+		hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, dir), nil)
+		wtest.Must(t, err)
+		return &SignatureInfo{Container: container, Hashes: hashes}
+	}
+	oldSig := computeSig(v1)
+	newSig := computeSig(v2)
+
+	sc, err := CompareSignatures(oldSig, newSig)
+	wtest.Must(t, err)
+
+	changes := make(map[string]*FileChange)
+	for _, fc := range sc.Files {
+		changes[fc.Path] = fc
+	}
+	assert.Len(t, sc.Files, 6)
+
+	assert.EqualValues(t, FileUnchanged, changes["same"].Kind)
+	assert.EqualValues(t, FileUnchanged, changes["empty"].Kind)
+
+	assert.EqualValues(t, FileRenamed, changes["new/moved"].Kind)
+	assert.EqualValues(t, "old/moved", changes["new/moved"].OldPath)
+
+	assert.EqualValues(t, FileRemoved, changes["removed"].Kind)
+	assert.EqualValues(t, BlockSize+1, changes["removed"].Size)
+
+	assert.EqualValues(t, FileAdded, changes["added"].Kind)
+	assert.EqualValues(t, len(added), changes["added"].FreshBytes)
+
+	modified := changes["modified"]
+	assert.EqualValues(t, FileModified, modified.Kind)
+	assert.EqualValues(t, []BlockRange{
+		{BlockIndex: 3, BlockSpan: 1},
+		{BlockIndex: 6, BlockSpan: 3},
+	}, modified.ChangedBlocks)
+	assert.EqualValues(t, BlockSize*3+100, modified.FreshBytes)
+
+	assert.EqualValues(t, len(added)+int(modified.FreshBytes), sc.FreshBytes)
+	assert.Equal(t, 1, sc.Count(FileRenamed))
+
+	// comparing a signature with itself finds nothing to do
+	sc, err = CompareSignatures(newSig, newSig)
+	wtest.Must(t, err)
+	assert.Equal(t, len(newSig.Container.Files), sc.Count(FileUnchanged))
+	assert.EqualValues(t, 0, sc.FreshBytes)
+
+	// block sizes must match
+	_, err = CompareSignatures(oldSig, &SignatureInfo{Container: newSig.Container, Hashes: newSig.Hashes, BlockSize: MinBlockSize})
+	assert.Error(t, err)
+}
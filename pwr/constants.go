@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 
 	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
 )
 
 // Endianness defines the byte order of all fixed-size integers written or read by wharf
@@ -24,14 +25,59 @@ const (
 
 	// ZipIndexMagic is the magic number for wharf zip index files (.pzi)
 	ZipIndexMagic
+
+	// AuthTrailerMagic ends authenticated patch and signature files
+	AuthTrailerMagic
+
+	// ValidationCacheMagic is the magic number for validation cache files
+	ValidationCacheMagic
+
+	// FeaturePatchMagic replaces PatchMagic for patches whose header lists
+	// features, so that patchers that don't know about those refuse them.
+	FeaturePatchMagic
+
+	// FeatureSignatureMagic replaces SignatureMagic for signatures whose
+	// header lists features, so that readers that don't know about those
+	// refuse them.
+	FeatureSignatureMagic
 )
 
 // ModeMask is or'd with files being applied/created
 const ModeMask = 0644
 
-// BlockSize is the standard block size files are broken into when ran through wharf's diff
+// BlockSize is the standard block size files are broken into when ran through wharf's diff.
+// Patches, signatures and manifests can specify another one in their header, those that
+// don't use this one.
 const BlockSize int64 = 64 * 1024 // 64k
 
-func mksync() *wsync.Context {
-	return wsync.NewContext(int(BlockSize))
+const (
+	// MinBlockSize is the smallest block size that can be specified
+	MinBlockSize int64 = 4 * 1024 // 4k
+	// MaxBlockSize is the largest block size that can be specified
+	MaxBlockSize int64 = 16 * 1024 * 1024 // 16M
+)
+
+// ResolveBlockSize returns blockSize, or BlockSize if it's zero, which
+// is what headers written before block sizes were configurable have.
+func ResolveBlockSize(blockSize int64) int64 {
+	if blockSize == 0 {
+		return BlockSize
+	}
+	return blockSize
+}
+
+// ValidateBlockSize returns an error if blockSize isn't zero (the default)
+// or between MinBlockSize and MaxBlockSize
+func ValidateBlockSize(blockSize int64) error {
+	if blockSize == 0 {
+		return nil
+	}
+	if blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		return errors.Errorf("invalid block size %d: must be between %d and %d", blockSize, MinBlockSize, MaxBlockSize)
+	}
+	return nil
+}
+
+func mksync(blockSize int64) *wsync.Context {
+	return wsync.NewContext(int(ResolveBlockSize(blockSize)))
 }
@@ -2,6 +2,7 @@ package pwr
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 
@@ -29,9 +30,35 @@ type DiffContext struct {
 	TargetContainer *tlc.Container
 	TargetSignature []wsync.BlockHash
 
+	// BlockSize is the size of rsync blocks, 0 means the default BlockSize.
+	// TargetSignature must have been computed with the same block size, and
+	// the signature written by WritePatch uses it as well.
+	BlockSize int64
+
+	// Chunker, when set, makes WritePatch split source files into
+	// content-defined chunks rather than fixed-size blocks. TargetSignature
+	// must have been computed with the same settings, and the signature
+	// written by WritePatch uses them as well.
+	Chunker *ChunkerSettings
+
+	// Workers is the number of source files diffed concurrently. When it's
+	// greater than 1, PoolFactory must be set. The resulting patch and signature
+	// are identical to the ones produced when diffing sequentially.
+	Workers int
+	// PoolFactory returns a new pool for the source container. Pools can't be
+	// used concurrently, so each worker gets its own.
+	PoolFactory func() (lake.Pool, error)
+
+	// FileDigests makes WritePatch store the SHA-256 digest of every
+	// source file in the signature, for quick validation.
+	FileDigests bool
+
 	ReusedBytes int64
 	FreshBytes  int64
 
+	// SourceDigests is set by WritePatch when FileDigests is enabled
+	SourceDigests [][]byte
+
 	AddedBytes int64
 	SavedBytes int64
 }
@@ -42,15 +69,26 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		return errors.WithStack(fmt.Errorf("No compression settings specified, bailing out"))
 	}
 
-	// signature header
-	rawSigWire := wire.NewWriteContext(signatureWriter)
-	err := rawSigWire.WriteMagic(SignatureMagic)
+	err := ValidateBlockSize(dctx.BlockSize)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	dctx.SourceDigests = nil
 
-	err = rawSigWire.WriteMessage(&SignatureHeader{
+	if dctx.Chunker != nil {
+		err := dctx.Chunker.Params().Validate()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// signature header
+	rawSigWire := wire.NewWriteContext(signatureWriter)
+	err = WriteSignatureHeader(rawSigWire, &SignatureHeader{
 		Compression: dctx.Compression,
+		Chunker:     dctx.Chunker,
+		BlockSize:   dctx.BlockSize,
+		FileDigests: dctx.FileDigests,
 	})
 	if err != nil {
 		return errors.WithStack(err)
@@ -68,16 +106,12 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 
 	// patch header
 	rawPatchWire := wire.NewWriteContext(patchWriter)
-	err = rawPatchWire.WriteMagic(PatchMagic)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
 	header := &PatchHeader{
 		Compression: dctx.Compression,
+		BlockSize:   dctx.BlockSize,
 	}
 
-	err = rawPatchWire.WriteMessage(header)
+	err = WritePatchHeader(rawPatchWire, header)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -97,29 +131,62 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		return errors.WithStack(err)
 	}
 
-	sourceBytes := dctx.SourceContainer.Size
-	fileOffset := int64(0)
+	targetContainerPathToIndex := make(map[string]int64)
+	for index, f := range dctx.TargetContainer.Files {
+		targetContainerPathToIndex[f.Path] = int64(index)
+	}
 
-	onSourceRead := func(count int64) {
-		dctx.Consumer.Progress(float64(fileOffset+count) / float64(sourceBytes))
+	fd := &fileDiffer{
+		targetContainer:            dctx.TargetContainer,
+		sourceContainer:            dctx.SourceContainer,
+		targetContainerPathToIndex: targetContainerPathToIndex,
+		blockSize:                  ResolveBlockSize(dctx.BlockSize),
+		fileDigests:                dctx.FileDigests,
+	}
+	if dctx.Chunker != nil {
+		fd.chunkerParams = dctx.Chunker.Params()
+		fd.chunkLibrary = wsync.NewChunkLibrary(dctx.TargetSignature)
+	} else {
+		fd.blockLibrary = wsync.NewBlockLibrary(dctx.TargetSignature)
 	}
 
-	sigWriter := makeSigWriter(sigWire)
-	opsWriter := makeOpsWriter(patchWire, dctx)
+	if dctx.Workers > 1 {
+		err = dctx.diffFilesParallel(ctx, patchWire, sigWire, fd)
+	} else {
+		err = dctx.diffFiles(ctx, patchWire, sigWire, fd.clone())
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-	diffContext := mksync()
-	signContext := mksync()
-	blockLibrary := wsync.NewBlockLibrary(dctx.TargetSignature)
+	if dctx.FileDigests {
+		err = sigWire.WriteMessage(&FileDigests{
+			Sha256: dctx.SourceDigests,
+		})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 
-	targetContainerPathToIndex := make(map[string]int64)
-	for index, f := range dctx.TargetContainer.Files {
-		targetContainerPathToIndex[f.Path] = int64(index)
+	err = patchWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = sigWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
-	// re-used messages
-	syncHeader := &SyncHeader{}
-	syncDelimiter := &SyncOp{
-		Type: SyncOp_HEY_YOU_DID_IT,
+	return nil
+}
+
+func (dctx *DiffContext) diffFiles(ctx context.Context, patchWire *wire.WriteContext, sigWire *wire.WriteContext, fd *fileDiffer) (err error) {
+
+	sourceBytes := dctx.SourceContainer.Size
+	fileOffset := int64(0)
+
+	onSourceRead := func(count int64) {
+		dctx.Consumer.Progress(float64(fileOffset+count) / float64(sourceBytes))
 	}
 
 	pool := dctx.Pool
@@ -133,55 +200,151 @@ func (dctx *DiffContext) WritePatch(ctx context.Context, patchWriter io.Writer,
 		dctx.Consumer.ProgressLabel(f.Path)
 		fileOffset = f.Offset
 
-		syncHeader.Reset()
-		syncHeader.FileIndex = int64(fileIndex)
-		err = patchWire.WriteMessage(syncHeader)
-		if err != nil {
-			return errors.WithStack(err)
-		}
-
 		var sourceReader io.Reader
 		sourceReader, err = pool.GetReader(int64(fileIndex))
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		var preferredFileIndex int64 = -1
-		if oldIndex, ok := targetContainerPathToIndex[f.Path]; ok {
-			preferredFileIndex = oldIndex
-		}
-
-		mr := multiread.New(counter.NewReaderCallback(onSourceRead, sourceReader))
-		diffReader := mr.Reader()
-		signReader := mr.Reader()
-
-		err := taskgroup.Do(
-			ctx,
-			func() error {
-				return diffContext.ComputeDiff(diffReader, blockLibrary, opsWriter, preferredFileIndex)
-			},
-			func() error {
-				return signContext.CreateSignature(ctx, int64(fileIndex), signReader, sigWriter)
-			},
-			func() error {
-				return mr.Do(ctx)
-			},
-		)
+		var stats diffStats
+		err = fd.diffFile(ctx, int64(fileIndex), counter.NewReaderCallback(onSourceRead, sourceReader), patchWire, sigWire, &stats)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		err = patchWire.WriteMessage(syncDelimiter)
-		if err != nil {
-			return errors.WithStack(err)
+		dctx.ReusedBytes += stats.reusedBytes
+		dctx.FreshBytes += stats.freshBytes
+		if fd.fileDigests {
+			dctx.SourceDigests = append(dctx.SourceDigests, stats.digest)
 		}
 	}
 
-	err = patchWire.Close()
+	return nil
+}
+
+// diffStats holds the amount of data reused from the target container
+// and the amount of fresh data for a single file
+type diffStats struct {
+	reusedBytes int64
+	freshBytes  int64
+
+	// SHA-256 of the file, only computed if file digests are enabled
+	digest []byte
+}
+
+// A fileDiffer computes the patch operations and signature of source
+// files, one at a time.
+type fileDiffer struct {
+	targetContainer            *tlc.Container
+	sourceContainer            *tlc.Container
+	targetContainerPathToIndex map[string]int64
+	blockSize                  int64
+	fileDigests                bool
+
+	// only one of those is set, depending on whether we're
+	// using fixed-size blocks or content-defined chunks
+	blockLibrary  *wsync.BlockLibrary
+	chunkLibrary  *wsync.ChunkLibrary
+	chunkerParams wsync.ChunkerParams
+
+	diffContext *wsync.Context
+	signContext *wsync.Context
+
+	// re-used messages
+	syncHeader    *SyncHeader
+	syncDelimiter *SyncOp
+}
+
+// clone returns a fileDiffer that shares fd's (read-only) libraries,
+// but has its own sync contexts, so it can be used concurrently with fd.
+func (fd *fileDiffer) clone() *fileDiffer {
+	return &fileDiffer{
+		targetContainer:            fd.targetContainer,
+		sourceContainer:            fd.sourceContainer,
+		targetContainerPathToIndex: fd.targetContainerPathToIndex,
+		blockSize:                  fd.blockSize,
+		fileDigests:                fd.fileDigests,
+
+		blockLibrary:  fd.blockLibrary,
+		chunkLibrary:  fd.chunkLibrary,
+		chunkerParams: fd.chunkerParams,
+
+		diffContext: mksync(fd.blockSize),
+		signContext: mksync(fd.blockSize),
+
+		syncHeader: &SyncHeader{},
+		syncDelimiter: &SyncOp{
+			Type: SyncOp_HEY_YOU_DID_IT,
+		},
+	}
+}
+
+// diffFile writes the sync header, operations and delimiter for a single
+// source file to patchWire, and its block hashes to sigWire.
+func (fd *fileDiffer) diffFile(ctx context.Context, fileIndex int64, sourceReader io.Reader,
+	patchWire *wire.WriteContext, sigWire *wire.WriteContext, stats *diffStats) error {
+
+	f := fd.sourceContainer.Files[fileIndex]
+
+	fd.syncHeader.Reset()
+	fd.syncHeader.FileIndex = fileIndex
+	if fd.chunkLibrary != nil {
+		fd.syncHeader.Type = SyncHeader_CDC
+	}
+	err := patchWire.WriteMessage(fd.syncHeader)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	err = sigWire.Close()
+
+	var preferredFileIndex int64 = -1
+	if oldIndex, ok := fd.targetContainerPathToIndex[f.Path]; ok {
+		preferredFileIndex = oldIndex
+	}
+
+	sigWriter := makeSigWriter(sigWire)
+	opsWriter := makeOpsWriter(patchWire, fd.targetContainer, fd.blockSize, stats)
+
+	mr := multiread.New(sourceReader)
+	diffReader := mr.Reader()
+	signReader := mr.Reader()
+
+	tasks := []taskgroup.Task{
+		func() error {
+			if fd.chunkLibrary != nil {
+				return fd.diffContext.ComputeChunkDiff(diffReader, fd.chunkLibrary, fd.chunkerParams, opsWriter, preferredFileIndex)
+			}
+			return fd.diffContext.ComputeDiff(diffReader, fd.blockLibrary, opsWriter, preferredFileIndex)
+		},
+		func() error {
+			if fd.chunkLibrary != nil {
+				return fd.signContext.CreateChunkSignature(ctx, fileIndex, signReader, fd.chunkerParams, sigWriter)
+			}
+			return fd.signContext.CreateSignature(ctx, fileIndex, signReader, sigWriter)
+		},
+		func() error {
+			return mr.Do(ctx)
+		},
+	}
+
+	if fd.fileDigests {
+		digestReader := mr.Reader()
+		tasks = append(tasks, func() error {
+			hasher := sha256.New()
+			_, err := io.Copy(hasher, digestReader)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			stats.digest = hasher.Sum(nil)
+			return nil
+		})
+	}
+
+	err = taskgroup.Do(ctx, tasks...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = patchWire.WriteMessage(fd.syncDelimiter)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -194,6 +357,7 @@ func makeSigWriter(wc *wire.WriteContext) wsync.SignatureWriter {
 		return wc.WriteMessage(&BlockHash{
 			WeakHash:   bl.WeakHash,
 			StrongHash: bl.StrongHash,
+			Size:       bl.Size,
 		})
 	}
 }
@@ -201,24 +365,34 @@ func makeSigWriter(wc *wire.WriteContext) wsync.SignatureWriter {
 // ComputeNumBlocks returns the number of small blocks a file is made up of.
 // It returns a correct result even when the file's size is not a multiple of BlockSize
 func ComputeNumBlocks(fileSize int64) int64 {
-	return (fileSize + BlockSize - 1) / BlockSize
+	return ComputeNumBlocksFor(fileSize, BlockSize)
+}
+
+// ComputeNumBlocksFor is like ComputeNumBlocks, for a given block size
+func ComputeNumBlocksFor(fileSize int64, blockSize int64) int64 {
+	return (fileSize + blockSize - 1) / blockSize
 }
 
 // ComputeBlockSize returns the size of one of the file's blocks, given the size of the file
 // and the position of the block in the file. It'll return BlockSize for all blocks except
 // the last one, if the file size is not a multiple of BlockSize
 func ComputeBlockSize(fileSize int64, blockIndex int64) int64 {
-	if BlockSize*(blockIndex+1) > fileSize {
-		return fileSize % BlockSize
+	return ComputeBlockSizeFor(fileSize, blockIndex, BlockSize)
+}
+
+// ComputeBlockSizeFor is like ComputeBlockSize, for a given block size
+func ComputeBlockSizeFor(fileSize int64, blockIndex int64, blockSize int64) int64 {
+	if blockSize*(blockIndex+1) > fileSize {
+		return fileSize % blockSize
 	}
-	return BlockSize
+	return blockSize
 }
 
-func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWriter {
+func makeOpsWriter(wc *wire.WriteContext, targetContainer *tlc.Container, blockSize int64, stats *diffStats) wsync.OperationWriter {
 	numOps := 0
 	wop := &SyncOp{}
 
-	files := dctx.TargetContainer.Files
+	files := targetContainer.Files
 
 	return func(op wsync.Operation) error {
 		numOps++
@@ -233,14 +407,22 @@ func makeOpsWriter(wc *wire.WriteContext, dctx *DiffContext) wsync.OperationWrit
 
 			fileSize := files[op.FileIndex].Size
 			lastBlockIndex := op.BlockIndex + op.BlockSpan - 1
-			tailSize := ComputeBlockSize(fileSize, lastBlockIndex)
-			dctx.ReusedBytes += BlockSize*(op.BlockSpan-1) + tailSize
+			tailSize := ComputeBlockSizeFor(fileSize, lastBlockIndex, blockSize)
+			stats.reusedBytes += blockSize*(op.BlockSpan-1) + tailSize
+
+		case wsync.OpChunkRange:
+			wop.Type = SyncOp_CHUNK_RANGE
+			wop.FileIndex = op.FileIndex
+			wop.Offset = op.Offset
+			wop.Size = op.Size
+
+			stats.reusedBytes += op.Size
 
 		case wsync.OpData:
 			wop.Type = SyncOp_DATA
 			wop.Data = op.Data
 
-			dctx.FreshBytes += int64(len(op.Data))
+			stats.freshBytes += int64(len(op.Data))
 
 		default:
 			return errors.WithStack(fmt.Errorf("unknown rsync op type: %d", op.Type))
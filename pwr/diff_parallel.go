@@ -0,0 +1,254 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/itchio/headway/counter"
+	"github.com/itchio/lake"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// diffSpoolMemoryLimit is how much of a single file's patch (or signature)
+// is kept in memory before spilling to a temporary file
+const diffSpoolMemoryLimit = 4 * 1024 * 1024
+
+// A diffSpool holds the output for a single file until it's its turn
+// to be written out.
+type diffSpool struct {
+	buf  bytes.Buffer
+	file *os.File
+}
+
+var _ io.Writer = (*diffSpool)(nil)
+
+func (ds *diffSpool) Write(p []byte) (int, error) {
+	if ds.file == nil && ds.buf.Len()+len(p) > diffSpoolMemoryLimit {
+		file, err := ioutil.TempFile("", "wharf-diff-spool")
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		ds.file = file
+
+		_, err = ds.buf.WriteTo(file)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		ds.buf = bytes.Buffer{}
+	}
+
+	if ds.file != nil {
+		return ds.file.Write(p)
+	}
+	return ds.buf.Write(p)
+}
+
+// writeTo copies everything that was spooled to w
+func (ds *diffSpool) writeTo(w io.Writer) error {
+	if ds.file == nil {
+		_, err := ds.buf.WriteTo(w)
+		return errors.WithStack(err)
+	}
+
+	_, err := ds.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = io.Copy(w, ds.file)
+	return errors.WithStack(err)
+}
+
+// release frees the memory or temporary file used by the spool
+func (ds *diffSpool) release() error {
+	ds.buf = bytes.Buffer{}
+	if ds.file == nil {
+		return nil
+	}
+
+	file := ds.file
+	ds.file = nil
+	err := file.Close()
+	if rErr := os.Remove(file.Name()); rErr != nil && err == nil {
+		err = rErr
+	}
+	return errors.WithStack(err)
+}
+
+// A diffJob is a single source file being diffed by one of the workers
+type diffJob struct {
+	fileIndex int64
+
+	patchSpool diffSpool
+	sigSpool   diffSpool
+	stats      diffStats
+	err        error
+
+	// closed when the worker is done with this job
+	done chan struct{}
+}
+
+// diffFilesParallel diffs up to dctx.Workers files at once, and writes out
+// their patch operations and signatures in file index order, so that the
+// output is the same as diffFiles'.
+func (dctx *DiffContext) diffFilesParallel(ctx context.Context, patchWire *wire.WriteContext, sigWire *wire.WriteContext, baseDiffer *fileDiffer) (err error) {
+	if dctx.PoolFactory == nil {
+		return errors.WithStack(fmt.Errorf("Diffing with %d workers requires a PoolFactory, bailing out", dctx.Workers))
+	}
+
+	if dctx.Pool != nil {
+		// each worker uses its own pool, but we still own this one
+		defer func() {
+			if fErr := dctx.Pool.Close(); fErr != nil && err == nil {
+				err = errors.WithStack(fErr)
+			}
+		}()
+	}
+
+	files := dctx.SourceContainer.Files
+	jobs := make([]*diffJob, len(files))
+	for i := range jobs {
+		jobs[i] = &diffJob{
+			fileIndex: int64(i),
+			done:      make(chan struct{}),
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+		for _, job := range jobs {
+			job.patchSpool.release()
+			job.sigSpool.release()
+		}
+	}()
+
+	// bounds the number of files that have been diffed (or are being
+	// diffed) but haven't been written out yet
+	slots := make(chan struct{}, dctx.Workers*2)
+
+	jobsChan := make(chan *diffJob)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobsChan)
+
+		for _, job := range jobs {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case jobsChan <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	sourceBytes := dctx.SourceContainer.Size
+	var readBytes int64
+	var consumerMutex sync.Mutex
+
+	for i := 0; i < dctx.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fd := baseDiffer.clone()
+			var pool lake.Pool
+			defer func() {
+				if pool != nil {
+					pool.Close()
+				}
+			}()
+
+			for job := range jobsChan {
+				job.err = func() error {
+					if pool == nil {
+						var err error
+						pool, err = dctx.PoolFactory()
+						if err != nil {
+							return errors.WithStack(err)
+						}
+					}
+
+					consumerMutex.Lock()
+					dctx.Consumer.ProgressLabel(files[job.fileIndex].Path)
+					consumerMutex.Unlock()
+
+					sourceReader, err := pool.GetReader(job.fileIndex)
+					if err != nil {
+						return errors.WithStack(err)
+					}
+
+					var lastCount int64
+					onSourceRead := func(count int64) {
+						done := atomic.AddInt64(&readBytes, count-lastCount)
+						lastCount = count
+
+						consumerMutex.Lock()
+						dctx.Consumer.Progress(float64(done) / float64(sourceBytes))
+						consumerMutex.Unlock()
+					}
+
+					return fd.diffFile(ctx, job.fileIndex, counter.NewReaderCallback(onSourceRead, sourceReader),
+						wire.NewWriteContext(&job.patchSpool), wire.NewWriteContext(&job.sigSpool), &job.stats)
+				}()
+				close(job.done)
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		}
+
+		if job.err != nil {
+			return errors.WithStack(job.err)
+		}
+
+		err = job.patchSpool.writeTo(patchWire.Writer())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = job.sigSpool.writeTo(sigWire.Writer())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = job.patchSpool.release()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = job.sigSpool.release()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		dctx.ReusedBytes += job.stats.reusedBytes
+		dctx.FreshBytes += job.stats.freshBytes
+		if baseDiffer.fileDigests {
+			dctx.SourceDigests = append(dctx.SourceDigests, job.stats.digest)
+		}
+
+		<-slots
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WritePatchParallel(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "diffparallel")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	var v1Entries, v2Entries []wtest.TestDirEntry
+	for i := 0; i < 12; i++ {
+		path := fmt.Sprintf("dir%d/file%d", i%3, i)
+		size := BlockSize*int64(i+1) + int64(i*17)
+		v1Entries = append(v1Entries, wtest.TestDirEntry{Path: path, Seed: int64(i), Size: size})
+		v2Entries = append(v2Entries, wtest.TestDirEntry{Path: path, Seed: int64(i), Size: size, Bsmods: []wtest.Bsmod{
+			{Interval: BlockSize/2 + int64(i), Delta: 0x4},
+		}})
+	}
+	v2Entries = append(v2Entries,
+		wtest.TestDirEntry{Path: "fresh", Seed: 0x99, Size: BlockSize*3 + 5},
+		wtest.TestDirEntry{Path: "empty", Size: -1},
+	)
+
+	v1 := filepath.Join(mainDir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{Entries: v1Entries})
+	v2 := filepath.Join(mainDir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{Entries: v2Entries})
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), nil)
+	wtest.Must(t, err)
+
+	makeDiffContext := func(workers int) *DiffContext {
+		return &DiffContext{
+			Compression: &CompressionSettings{},
+
+			SourceContainer: sourceContainer,
+			Pool:            fspool.New(sourceContainer, v2),
+
+			TargetContainer: targetContainer,
+			TargetSignature: targetSignature,
+
+			Workers: workers,
+			PoolFactory: func() (lake.Pool, error) {
+				return fspool.New(sourceContainer, v2), nil
+			},
+		}
+	}
+
+	seqPatch := new(bytes.Buffer)
+	seqSig := new(bytes.Buffer)
+	seqCtx := makeDiffContext(1)
+	wtest.Must(t, seqCtx.WritePatch(context.Background(), seqPatch, seqSig))
+
+	for _, workers := range []int{2, 4, 32} {
+		t.Logf("Using %d workers", workers)
+
+		patch := new(bytes.Buffer)
+		sig := new(bytes.Buffer)
+		dctx := makeDiffContext(workers)
+		wtest.Must(t, dctx.WritePatch(context.Background(), patch, sig))
+
+		assert.True(t, bytes.Equal(seqPatch.Bytes(), patch.Bytes()), "patches should be identical")
+		assert.True(t, bytes.Equal(seqSig.Bytes(), sig.Bytes()), "signatures should be identical")
+		assert.EqualValues(t, seqCtx.ReusedBytes, dctx.ReusedBytes)
+		assert.EqualValues(t, seqCtx.FreshBytes, dctx.FreshBytes)
+	}
+
+	dctx := makeDiffContext(4)
+	dctx.PoolFactory = nil
+	assert.Error(t, dctx.WritePatch(context.Background(), ioutil.Discard, ioutil.Discard))
+}
@@ -0,0 +1,479 @@
+package pwr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wsync"
+
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+
+	"github.com/pkg/errors"
+)
+
+// A DirHealer can repair from another local copy of the same build, or of
+// an older build. Blocks are first looked for at the same path and offset
+// in SourceDir, and if that fails, anywhere in SourceDir: its files are
+// then scanned one by one, using the signature's block library, until
+// the block turns up. Each file is scanned at most once.
+type DirHealer struct {
+	// the directory we should heal
+	Target string
+
+	// the directory we should heal from
+	SourceDir string
+
+	// Signature describes the container we're healing. It's required,
+	// and set by ValidatorContext when used with a HealPath.
+	Signature *SignatureInfo
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	progressMutex  sync.Mutex
+	totalCorrupted int64
+	totalHealed    int64
+	totalHealthy   int64
+	hasWounds      bool
+
+	container *tlc.Container
+	hashInfo  *HashInfo
+	validator BlockValidator
+	buf       []byte
+
+	// where blocks can be found in SourceDir, filled as files are scanned
+	locations      map[dirBlockKey]dirBlockLocation
+	scanned        map[int64]bool
+	scanLibrary    *wsync.BlockLibrary
+	scanCtx        *wsync.Context
+	scanPool       lake.Pool
+	scanFiles      *tlc.Container
+	scanFileByPath map[string]int64
+
+	sourceFile     *os.File
+	sourceFilePath string
+
+	healedWounds map[woundKey]bool
+	healedMutex  sync.Mutex
+
+	lockMap LockMap
+}
+
+var _ ResumableHealer = (*DirHealer)(nil)
+var _ SignatureHealer = (*DirHealer)(nil)
+
+// dirBlockKey identifies the contents of a block
+type dirBlockKey struct {
+	weakHash   uint32
+	strongHash string
+	size       int64
+}
+
+// dirBlockLocation is where a block can be found in SourceDir
+type dirBlockLocation struct {
+	path   string
+	offset int64
+}
+
+// Do starts receiving from the wounds channel and healing
+func (dh *DirHealer) Do(parentCtx context.Context, container *tlc.Container, wounds chan *Wound) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	if dh.Signature == nil {
+		return errors.New("DirHealer: a signature is required")
+	}
+
+	dh.container = container
+
+	var err error
+	dh.hashInfo, err = ComputeHashInfo(dh.Signature)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dh.validator = NewBlockValidator(dh.hashInfo)
+
+	dh.healedMutex.Lock()
+	dh.healedWounds = make(map[woundKey]bool)
+	dh.healedMutex.Unlock()
+
+	defer func() {
+		if dh.sourceFile != nil {
+			dh.sourceFile.Close()
+			dh.sourceFile = nil
+			dh.sourceFilePath = ""
+		}
+		if dh.scanPool != nil {
+			dh.scanPool.Close()
+			dh.scanPool = nil
+		}
+	}()
+
+	unlocked := make(map[int64]bool)
+
+	processWound := func(wound *Wound) error {
+		if !wound.Healthy() {
+			dh.totalCorrupted += wound.Size()
+			dh.hasWounds = true
+		}
+
+		switch wound.Kind {
+		case WoundKind_DIR:
+			return healDirWound(dh.Consumer, dh.Target, container, wound)
+
+		case WoundKind_SYMLINK:
+			return healSymlinkWound(dh.Consumer, dh.Target, container, wound)
+
+		case WoundKind_FILE:
+			dh.Consumer.ProgressLabel(container.Files[wound.Index].Path)
+
+			if dh.lockMap != nil && !unlocked[wound.Index] {
+				select {
+				case <-dh.lockMap[wound.Index]:
+					unlocked[wound.Index] = true
+				case <-ctx.Done():
+					return werrors.ErrCancelled
+				}
+			}
+
+			err := dh.healOne(ctx, wound)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			dh.healedMutex.Lock()
+			dh.healedWounds[keyOfWound(wound)] = true
+			dh.healedMutex.Unlock()
+
+		case WoundKind_CLOSED_FILE:
+			fileSize := container.Files[wound.Index].Size
+
+			// whole file was healthy
+			if wound.End == fileSize {
+				dh.progressMutex.Lock()
+				dh.totalHealthy += fileSize
+				dh.progressMutex.Unlock()
+				dh.updateProgress()
+			}
+
+		default:
+			return fmt.Errorf("Unknown wound kind: %d", wound.Kind)
+		}
+
+		return nil
+	}
+
+	for wound := range wounds {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		err := processWound(wound)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (dh *DirHealer) healOne(ctx context.Context, wound *Wound) error {
+	f := dh.container.Files[wound.Index]
+
+	dh.Consumer.Debugf("Healing (%s) %s into %s", f.Path, united.FormatBytes(wound.Size()), united.FormatBytes(wound.Start))
+
+	writer, err := openFileWoundTarget(dh.Consumer, dh.Target, dh.container, wound)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer writer.Close()
+
+	end := wound.End
+	if end > f.Size {
+		end = f.Size
+	}
+	if wound.Start >= end {
+		return nil
+	}
+
+	blockSize := dh.hashInfo.BlockSize
+	firstBlock := wound.Start / blockSize
+	lastBlock := (end - 1) / blockSize
+
+	for blockIndex := firstBlock; blockIndex <= lastBlock; blockIndex++ {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		data, err := dh.findBlock(ctx, wound.Index, blockIndex)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = writer.WriteAt(data, blockIndex*blockSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		dh.progressMutex.Lock()
+		dh.totalHealed += int64(len(data))
+		dh.progressMutex.Unlock()
+		dh.updateProgress()
+	}
+
+	return nil
+}
+
+// findBlock returns the contents of a block, read from SourceDir and checked
+// against the signature. The returned slice is only valid until the next call.
+func (dh *DirHealer) findBlock(ctx context.Context, fileIndex int64, blockIndex int64) ([]byte, error) {
+	f := dh.container.Files[fileIndex]
+	blockSize := dh.hashInfo.BlockSize
+
+	// most of the time, the block is where we left it
+	data, err := dh.readBlock(fileIndex, blockIndex, f.Path, blockIndex*blockSize)
+	if err == nil {
+		return data, nil
+	}
+
+	key, ok := dh.blockKey(fileIndex, blockIndex)
+	if ok {
+		for {
+			if location, ok := dh.locations[key]; ok {
+				data, err = dh.readBlock(fileIndex, blockIndex, location.path, location.offset)
+				if err == nil {
+					return data, nil
+				}
+				// it's not there anymore, keep looking
+				delete(dh.locations, key)
+			}
+
+			scanned, err := dh.scanNext(ctx, f.Path, key.size)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if !scanned {
+				break
+			}
+		}
+	}
+
+	return nil, errors.Errorf("(%s) block %d not found in (%s)", f.Path, blockIndex, dh.SourceDir)
+}
+
+// readBlock reads a block from a file of SourceDir, and makes sure it's the
+// block we're looking for.
+func (dh *DirHealer) readBlock(fileIndex int64, blockIndex int64, path string, offset int64) ([]byte, error) {
+	blockSize := dh.hashInfo.BlockSize
+	if int64(len(dh.buf)) < blockSize {
+		dh.buf = make([]byte, blockSize)
+	}
+	data := dh.buf[:dh.validator.BlockSize(fileIndex, blockIndex)]
+
+	if dh.sourceFilePath != path {
+		if dh.sourceFile != nil {
+			dh.sourceFile.Close()
+			dh.sourceFile = nil
+			dh.sourceFilePath = ""
+		}
+
+		file, err := os.Open(filepath.Join(dh.SourceDir, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		dh.sourceFile = file
+		dh.sourceFilePath = path
+	}
+
+	_, err := dh.sourceFile.ReadAt(data, offset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = dh.validator.ValidateAsError(fileIndex, blockIndex, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (dh *DirHealer) blockKey(fileIndex int64, blockIndex int64) (dirBlockKey, bool) {
+	group := dh.hashInfo.Groups[fileIndex]
+	if blockIndex >= int64(len(group)) {
+		return dirBlockKey{}, false
+	}
+
+	bh := group[blockIndex]
+	return dirBlockKey{
+		weakHash:   bh.WeakHash,
+		strongHash: string(bh.StrongHash),
+		size:       dh.validator.BlockSize(fileIndex, blockIndex),
+	}, true
+}
+
+// scanNext scans a file of SourceDir we haven't scanned yet, and that's
+// large enough to contain a block of the given size, for blocks of the
+// signature. The file at path goes first, since blocks are often just
+// shifted within a file. It returns false if there are no such files left.
+func (dh *DirHealer) scanNext(ctx context.Context, path string, size int64) (bool, error) {
+	if dh.scanFiles == nil {
+		dh.Consumer.Debugf("Walking (%s) to look for blocks", dh.SourceDir)
+
+		container, err := tlc.WalkDir(dh.SourceDir, tlc.WalkOpts{})
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		dh.scanFiles = container
+		dh.scanPool = fspool.New(container, dh.SourceDir)
+		dh.scanFileByPath = make(map[string]int64)
+		for index, file := range container.Files {
+			dh.scanFileByPath[file.Path] = int64(index)
+		}
+		dh.scanned = make(map[int64]bool)
+		dh.locations = make(map[dirBlockKey]dirBlockLocation)
+		dh.scanLibrary = wsync.NewBlockLibrary(dh.Signature.Hashes)
+		dh.scanCtx = wsync.NewContext(int(dh.hashInfo.BlockSize))
+	}
+
+	canContain := func(index int64) bool {
+		return !dh.scanned[index] && dh.scanFiles.Files[index].Size >= size
+	}
+
+	if index, ok := dh.scanFileByPath[path]; ok && canContain(index) {
+		return true, dh.scan(ctx, index)
+	}
+
+	for index := range dh.scanFiles.Files {
+		if canContain(int64(index)) {
+			return true, dh.scan(ctx, int64(index))
+		}
+	}
+
+	return false, nil
+}
+
+// scan looks for blocks of the signature in a file of SourceDir, at any
+// offset, and remembers where they were found.
+func (dh *DirHealer) scan(ctx context.Context, sourceFileIndex int64) error {
+	select {
+	case <-ctx.Done():
+		return werrors.ErrCancelled
+	default:
+		// keep going!
+	}
+
+	dh.scanned[sourceFileIndex] = true
+	sourceFile := dh.scanFiles.Files[sourceFileIndex]
+
+	dh.Consumer.Debugf("Scanning (%s) for blocks", sourceFile.Path)
+
+	reader, err := dh.scanPool.GetReader(sourceFileIndex)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var offset int64
+	opsWriter := func(op wsync.Operation) error {
+		switch op.Type {
+		case wsync.OpData:
+			offset += int64(len(op.Data))
+		case wsync.OpBlockRange:
+			for i := int64(0); i < op.BlockSpan; i++ {
+				blockIndex := op.BlockIndex + i
+				key, ok := dh.blockKey(op.FileIndex, blockIndex)
+				if !ok {
+					return errors.Errorf("block library returned unknown block %d of file %d", blockIndex, op.FileIndex)
+				}
+
+				if _, found := dh.locations[key]; !found {
+					dh.locations[key] = dirBlockLocation{
+						path:   sourceFile.Path,
+						offset: offset,
+					}
+				}
+				offset += key.size
+			}
+		}
+		return nil
+	}
+
+	err = dh.scanCtx.ComputeDiff(reader, dh.scanLibrary, opsWriter, -1)
+	if err != nil && errors.Cause(err) != io.EOF {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// SetSignature gives this healer the signature of the container it's healing
+func (dh *DirHealer) SetSignature(signature *SignatureInfo) {
+	dh.Signature = signature
+}
+
+// IsHealed returns true if a wound like the given one (received by Do) has been healed
+func (dh *DirHealer) IsHealed(wound *Wound) bool {
+	dh.healedMutex.Lock()
+	defer dh.healedMutex.Unlock()
+
+	return dh.healedWounds[keyOfWound(wound)]
+}
+
+// HasWounds returns true if the healer ever received wounds
+func (dh *DirHealer) HasWounds() bool {
+	return dh.hasWounds
+}
+
+// TotalCorrupted returns the total amount of corrupted data
+// contained in the wounds this healer has received. Dirs
+// and symlink wounds have 0-size, use HasWounds to know
+// if there were any wounds at all.
+func (dh *DirHealer) TotalCorrupted() int64 {
+	return dh.totalCorrupted
+}
+
+// TotalHealed returns the total amount of data written to disk
+// to repair the wounds. Since DirHealer works with whole
+// blocks, this may be slightly more than TotalCorrupted.
+func (dh *DirHealer) TotalHealed() int64 {
+	return dh.totalHealed
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (dh *DirHealer) SetConsumer(consumer *state.Consumer) {
+	dh.Consumer = consumer
+}
+
+// SetLockMap sets the lock map that must be waited on
+// before healing a file.
+func (dh *DirHealer) SetLockMap(lockMap LockMap) {
+	dh.lockMap = lockMap
+}
+
+func (dh *DirHealer) updateProgress() {
+	if dh.Consumer == nil {
+		return
+	}
+
+	dh.progressMutex.Lock()
+	progress := float64(dh.totalHealthy+dh.totalHealed) / float64(dh.container.Size)
+	dh.Consumer.Progress(progress)
+	dh.progressMutex.Unlock()
+}
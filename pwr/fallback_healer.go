@@ -0,0 +1,456 @@
+package pwr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/wharf/werrors"
+
+	"github.com/itchio/lake/tlc"
+
+	"github.com/pkg/errors"
+)
+
+// A FallbackHealer repairs from an ordered list of sources, for example a
+// local cache, then a folder on a LAN peer, then a remote archive. File
+// wounds are given to the first source as they arrive. Once it's done, the
+// ones it couldn't heal (it failed, or the healed data doesn't match the
+// signature) are given to the next one all at once, and so on.
+type FallbackHealer struct {
+	// the directory we should heal
+	Target string
+
+	// Sources, in the order in which they should be tried
+	Sources []Healer
+
+	// Signature (optional) is used to check data written by each source.
+	// If nil, sources are only checked for errors.
+	Signature *SignatureInfo
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	progressMutex  sync.Mutex
+	totalCorrupted int64
+	totalHealthy   int64
+	hasWounds      bool
+
+	healedWounds map[woundKey]bool
+	healedBy     []int64
+	healedMutex  sync.Mutex
+
+	container *tlc.Container
+	validator BlockValidator
+
+	lockMap LockMap
+}
+
+var _ ResumableHealer = (*FallbackHealer)(nil)
+var _ SignatureHealer = (*FallbackHealer)(nil)
+
+// NewFallbackHealer returns a healer that tries each of the given specs
+// (of the form "type,url") in order.
+func NewFallbackHealer(specs []string, target string) (*FallbackHealer, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("FallbackHealer: no sources")
+	}
+
+	fh := &FallbackHealer{
+		Target: target,
+	}
+
+	for _, spec := range specs {
+		source, err := NewHealer(spec, target)
+		if err != nil {
+			return nil, err
+		}
+		fh.Sources = append(fh.Sources, source)
+	}
+
+	return fh, nil
+}
+
+// Do starts receiving from the wounds channel and healing
+func (fh *FallbackHealer) Do(parentCtx context.Context, container *tlc.Container, wounds chan *Wound) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	if len(fh.Sources) == 0 {
+		return errors.New("FallbackHealer: no sources")
+	}
+
+	fh.container = container
+
+	fh.healedMutex.Lock()
+	fh.healedWounds = make(map[woundKey]bool)
+	fh.healedBy = make([]int64, len(fh.Sources))
+	fh.healedMutex.Unlock()
+
+	if fh.Signature != nil {
+		hashInfo, err := ComputeHashInfo(fh.Signature)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fh.validator = NewBlockValidator(hashInfo)
+	}
+
+	sourceConsumer := &state.Consumer{
+		OnProgress: func(progress float64) {
+			fh.updateProgress()
+		},
+		OnProgressLabel: func(label string) {
+			fh.Consumer.ProgressLabel(label)
+		},
+		OnMessage: func(lvl string, msg string) {
+			if fh.Consumer != nil && fh.Consumer.OnMessage != nil {
+				fh.Consumer.OnMessage(lvl, msg)
+			}
+		},
+	}
+
+	for _, source := range fh.Sources {
+		source.SetConsumer(sourceConsumer)
+		source.SetLockMap(fh.lockMap)
+	}
+
+	// the first source heals wounds as they arrive
+	firstWounds := make(chan *Wound, 1024)
+	firstDone := make(chan struct{})
+	var firstErr error
+	go func() {
+		defer close(firstDone)
+		firstErr = fh.Sources[0].Do(ctx, container, firstWounds)
+	}()
+
+	var fileWounds []*Wound
+
+	processWound := func(wound *Wound) error {
+		if !wound.Healthy() {
+			fh.totalCorrupted += wound.Size()
+			fh.hasWounds = true
+		}
+
+		switch wound.Kind {
+		case WoundKind_DIR:
+			err := healDirWound(fh.Consumer, fh.Target, container, wound)
+			if err != nil {
+				return err
+			}
+
+		case WoundKind_SYMLINK:
+			err := healSymlinkWound(fh.Consumer, fh.Target, container, wound)
+			if err != nil {
+				return err
+			}
+
+		case WoundKind_FILE:
+			// remembered for the next sources, in case the first can't heal it
+			fileWounds = append(fileWounds, wound)
+
+			woundCopy := *wound
+			select {
+			case firstWounds <- &woundCopy:
+				// queued for work!
+			case <-firstDone:
+				// the first source stopped early, the next ones will get it
+			case <-ctx.Done():
+				return werrors.ErrCancelled
+			}
+
+		case WoundKind_CLOSED_FILE:
+			fileSize := container.Files[wound.Index].Size
+
+			// whole file was healthy
+			if wound.End == fileSize {
+				fh.progressMutex.Lock()
+				fh.totalHealthy += fileSize
+				fh.progressMutex.Unlock()
+				fh.updateProgress()
+			}
+
+		default:
+			return fmt.Errorf("Unknown wound kind: %d", wound.Kind)
+		}
+
+		return nil
+	}
+
+	receive := func() error {
+		for wound := range wounds {
+			select {
+			case <-ctx.Done():
+				return werrors.ErrCancelled
+			default:
+				// keep going!
+			}
+
+			err := processWound(wound)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := receive()
+	if err != nil {
+		cancel()
+	}
+	close(firstWounds)
+	<-firstDone
+	if err != nil {
+		return err
+	}
+
+	return fh.healFileWounds(ctx, fileWounds, firstErr)
+}
+
+// healFileWounds finds out which file wounds the first source healed (it
+// returned firstErr), then gives the others to each next source in turn,
+// until all of them are healed.
+func (fh *FallbackHealer) healFileWounds(ctx context.Context, wounds []*Wound, firstErr error) error {
+	var errs []string
+	for sourceIndex, source := range fh.Sources {
+		if len(wounds) == 0 {
+			break
+		}
+
+		err := firstErr
+		if sourceIndex > 0 {
+			err = fh.healFromSource(ctx, source, wounds)
+		}
+		if err != nil {
+			if errors.Cause(err) == werrors.ErrCancelled || ctx.Err() != nil {
+				return werrors.ErrCancelled
+			}
+
+			fh.Consumer.Debugf("source %d could not heal everything: %+v", sourceIndex, err)
+			errs = append(errs, fmt.Sprintf("source %d: %s", sourceIndex, err.Error()))
+		}
+
+		// sources that can't tell what they've healed
+		// have healed everything unless they failed
+		rh, resumable := source.(ResumableHealer)
+
+		var unhealed []*Wound
+		for _, wound := range wounds {
+			healed := err == nil
+			if resumable {
+				healed = rh.IsHealed(wound)
+			}
+
+			if healed {
+				cErr := fh.credit(sourceIndex, wound)
+				if cErr != nil {
+					f := fh.container.Files[wound.Index]
+					fh.Consumer.Debugf("(%s) source %d healed %s at %s with bad data: %+v",
+						f.Path, sourceIndex, united.FormatBytes(wound.Size()), united.FormatBytes(wound.Start), cErr)
+					errs = append(errs, fmt.Sprintf("source %d: (%s) %s", sourceIndex, f.Path, cErr.Error()))
+					healed = false
+				}
+			}
+
+			if !healed {
+				unhealed = append(unhealed, wound)
+			}
+		}
+		wounds = unhealed
+		fh.updateProgress()
+	}
+
+	if len(wounds) > 0 {
+		f := fh.container.Files[wounds[0].Index]
+		return errors.Errorf("(%s) and %d other wounds: no source could heal them:\n%s", f.Path, len(wounds)-1, strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// healFromSource runs a source's Do with the given wounds.
+func (fh *FallbackHealer) healFromSource(ctx context.Context, source Healer, wounds []*Wound) error {
+	sourceWounds := make(chan *Wound, len(wounds))
+	for _, wound := range wounds {
+		woundCopy := *wound
+		sourceWounds <- &woundCopy
+	}
+	close(sourceWounds)
+
+	return source.Do(ctx, fh.container, sourceWounds)
+}
+
+// credit remembers a wound as healed by the source at sourceIndex,
+// if the wounded part of the file now matches the signature.
+func (fh *FallbackHealer) credit(sourceIndex int, wound *Wound) error {
+	key := keyOfWound(wound)
+
+	fh.healedMutex.Lock()
+	healed := fh.healedWounds[key]
+	fh.healedMutex.Unlock()
+	if healed {
+		return nil
+	}
+
+	err := fh.check(wound)
+	if err != nil {
+		return err
+	}
+
+	fh.healedMutex.Lock()
+	defer fh.healedMutex.Unlock()
+	if !fh.healedWounds[key] {
+		fh.healedWounds[key] = true
+		fh.healedBy[sourceIndex] += wound.Size()
+	}
+	return nil
+}
+
+// check makes sure the wounded part of a file now matches the signature
+func (fh *FallbackHealer) check(wound *Wound) error {
+	if fh.validator == nil {
+		return nil
+	}
+
+	f := fh.container.Files[wound.Index]
+	end := wound.End
+	if end > f.Size {
+		end = f.Size
+	}
+	if wound.Start >= end {
+		return nil
+	}
+
+	path := filepath.Join(fh.Target, filepath.FromSlash(f.Path))
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	blockSize := ResolveBlockSize(fh.Signature.BlockSize)
+	firstBlock := wound.Start / blockSize
+	lastBlock := (end - 1) / blockSize
+	buf := make([]byte, blockSize)
+
+	for blockIndex := firstBlock; blockIndex <= lastBlock; blockIndex++ {
+		data := buf[:fh.validator.BlockSize(wound.Index, blockIndex)]
+		_, err = file.ReadAt(data, blockIndex*blockSize)
+		if err != nil && err != io.EOF {
+			return errors.WithStack(err)
+		}
+
+		err = fh.validator.ValidateAsError(wound.Index, blockIndex, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetSignature gives this healer the signature of the container it's healing,
+// which is used to check data written by each source. Sources that need
+// the signature are given it as well.
+func (fh *FallbackHealer) SetSignature(signature *SignatureInfo) {
+	fh.Signature = signature
+	for _, source := range fh.Sources {
+		if sh, ok := source.(SignatureHealer); ok {
+			sh.SetSignature(signature)
+		}
+	}
+}
+
+// IsHealed returns true if a wound like the given one (received by Do) has been
+// healed by one of the sources.
+func (fh *FallbackHealer) IsHealed(wound *Wound) bool {
+	fh.healedMutex.Lock()
+	healed := fh.healedWounds[keyOfWound(wound)]
+	fh.healedMutex.Unlock()
+	if healed {
+		return true
+	}
+
+	// the first source heals wounds while they're still arriving,
+	// so that validation checkpoints don't need to remember them.
+	if len(fh.Sources) > 0 {
+		if rh, ok := fh.Sources[0].(ResumableHealer); ok && rh.IsHealed(wound) {
+			return fh.credit(0, wound) == nil
+		}
+	}
+	return false
+}
+
+// HasWounds returns true if the healer ever received wounds
+func (fh *FallbackHealer) HasWounds() bool {
+	return fh.hasWounds
+}
+
+// TotalCorrupted returns the total amount of corrupted data
+// contained in the wounds this healer has received. Dirs
+// and symlink wounds have 0-size, use HasWounds to know
+// if there were any wounds at all.
+func (fh *FallbackHealer) TotalCorrupted() int64 {
+	return fh.totalCorrupted
+}
+
+// TotalHealed returns the total amount of data in the wounds that were healed.
+// Data written by sources that failed, or that doesn't match the signature,
+// isn't counted. Use TotalHealedBy to know how much each source healed.
+func (fh *FallbackHealer) TotalHealed() int64 {
+	fh.healedMutex.Lock()
+	defer fh.healedMutex.Unlock()
+
+	var total int64
+	for _, healed := range fh.healedBy {
+		total += healed
+	}
+	return total
+}
+
+// TotalHealedBy returns the amount of data in the wounds healed by the source
+// at index sourceIndex.
+func (fh *FallbackHealer) TotalHealedBy(sourceIndex int) int64 {
+	fh.healedMutex.Lock()
+	defer fh.healedMutex.Unlock()
+
+	if sourceIndex >= len(fh.healedBy) {
+		return 0
+	}
+	return fh.healedBy[sourceIndex]
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (fh *FallbackHealer) SetConsumer(consumer *state.Consumer) {
+	fh.Consumer = consumer
+}
+
+// SetLockMap sets the lock map that sources must wait on before
+// healing a file.
+func (fh *FallbackHealer) SetLockMap(lockMap LockMap) {
+	fh.lockMap = lockMap
+}
+
+func (fh *FallbackHealer) updateProgress() {
+	if fh.Consumer == nil || fh.container == nil {
+		return
+	}
+
+	// sources report what they've written so far, even
+	// if it turns out later they didn't heal anything.
+	var totalWritten int64
+	for _, source := range fh.Sources {
+		totalWritten += source.TotalHealed()
+	}
+
+	fh.progressMutex.Lock()
+	progress := float64(fh.totalHealthy+totalWritten) / float64(fh.container.Size)
+	fh.Consumer.Progress(progress)
+	fh.progressMutex.Unlock()
+}
@@ -3,6 +3,7 @@ package genie
 import (
 	"github.com/itchio/lake/tlc"
 	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
 	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/wire"
 	"github.com/pkg/errors"
@@ -19,6 +20,9 @@ type Genie struct {
 
 	TargetContainer *tlc.Container
 	SourceContainer *tlc.Container
+
+	// size of the rsync blocks SyncOps refer to, read from the patch header
+	smallBlockSize int64
 }
 
 // ParseHeader is the first step of the genie's operation - it reads both
@@ -26,16 +30,16 @@ type Genie struct {
 // the contents
 func (g *Genie) ParseHeader(patchReader savior.SeekSource) error {
 	rawPatchWire := wire.NewReadContext(patchReader)
-	err := rawPatchWire.ExpectMagic(pwr.PatchMagic)
+	header, err := pwr.ReadPatchHeader(rawPatchWire)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	header := &pwr.PatchHeader{}
-	err = rawPatchWire.ReadMessage(header)
+	err = pwr.ValidateBlockSize(header.BlockSize)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	g.smallBlockSize = pwr.ResolveBlockSize(header.BlockSize)
 
 	patchWire, err := pwr.DecompressWire(rawPatchWire, header.Compression)
 	if err != nil {
@@ -62,8 +66,9 @@ func (g *Genie) ParseHeader(patchReader savior.SeekSource) error {
 func (g *Genie) ParseContents(onComp CompositionListener) error {
 	patchWire := g.PatchWire
 
-	// for each file, the patch contains a SyncHeader followed by a series of
-	// operations, always ending in HEY_YOU_DID_IT
+	// for each file, the patch contains a SyncHeader followed by either a series
+	// of rsync operations, or a BsdiffHeader and a series of bsdiff controls,
+	// always ending in HEY_YOU_DID_IT
 	sh := &pwr.SyncHeader{}
 	for fileIndex, f := range g.SourceContainer.Files {
 		sh.Reset()
@@ -76,7 +81,14 @@ func (g *Genie) ParseContents(onComp CompositionListener) error {
 			return errors.Errorf("Malformed patch: expected fileIndex = %d, got fileIndex %d", fileIndex, sh.FileIndex)
 		}
 
-		err = g.analyzeFile(patchWire, int64(fileIndex), f.Size, onComp)
+		switch sh.Type {
+		case pwr.SyncHeader_RSYNC, pwr.SyncHeader_CDC:
+			err = g.analyzeFile(patchWire, int64(fileIndex), f.Size, onComp)
+		case pwr.SyncHeader_BSDIFF:
+			err = g.analyzeBsdiffFile(patchWire, int64(fileIndex), f.Size, onComp)
+		default:
+			err = errors.Errorf("Malformed patch: unknown sync header type %s", sh.Type)
+		}
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -88,12 +100,8 @@ func (g *Genie) ParseContents(onComp CompositionListener) error {
 func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSize int64, onComp CompositionListener) error {
 	rop := &pwr.SyncOp{}
 
-	smallBlockSize := int64(pwr.BlockSize)
-	bigBlockSize := g.BlockSize
-
-	comp := &Composition{
-		FileIndex: int64(fileIndex),
-	}
+	smallBlockSize := g.smallBlockSize
+	cb := g.newCompositionBuilder(fileIndex, onComp)
 
 	// infinite loop, explicitly "break"'d out of
 	for {
@@ -106,87 +114,213 @@ func (g *Genie) analyzeFile(patchWire *wire.ReadContext, fileIndex int64, fileSi
 		switch rop.Type {
 		case pwr.SyncOp_BLOCK_RANGE:
 			// SyncOps operate in terms of small blocks, we want byte offsets
-			bo := &BlockOrigin{
+			cb.appendBlockOrigin(&BlockOrigin{
 				FileIndex: rop.FileIndex,
 				Offset:    rop.BlockIndex * smallBlockSize,
 				Size:      rop.BlockSpan * smallBlockSize,
-			}
-
-			// As long as the block origin would span beyond the end of the
-			// big block we're currently analyzing, split it into {A, B},
-			// where A fits into the current big block, and B is the rest
-			for comp.Size+bo.Size > bigBlockSize {
-				truncatedSize := bigBlockSize - comp.Size
-
-				// truncatedSize may be 0 if `comp.Size == bigBlockSize`, ie. comp already
-				// explains all the contents of the current big block - in this case,
-				// we keep this BlockOrigin intact for the next iteration of the loop
-				// (during which comp.Size will == 0)
-				if truncatedSize > 0 {
-					// this is A
-					comp.Append(&BlockOrigin{
-						FileIndex: rop.FileIndex,
-						Offset:    bo.Offset,
-						Size:      truncatedSize,
-					})
-
-					// and bo becomes B
-					bo.Offset += truncatedSize
-					bo.Size -= truncatedSize
-				}
-
-				onComp(comp)
-
-				// after sending over the composition, we allocate a new one - same file, next block
-				// (sent comps should not be modified afterwards)
-				comp = &Composition{
-					FileIndex:  int64(fileIndex),
-					BlockIndex: comp.BlockIndex + 1,
-				}
-			}
-
-			// after all the splitting, there might still be some data left over
-			// (that's smaller than bigBlockSize)
-			if bo.Size > 0 {
-				comp.Append(bo)
-			}
+			})
+		case pwr.SyncOp_CHUNK_RANGE:
+			// content-defined chunk ops are already in byte offsets
+			cb.appendBlockOrigin(&BlockOrigin{
+				FileIndex: rop.FileIndex,
+				Offset:    rop.Offset,
+				Size:      rop.Size,
+			})
 		case pwr.SyncOp_DATA:
 			// Data SyncOps are not aligned either in target or source. Since genie
 			// works in byte offsets, this suits us just fine.
-			fo := &FreshOrigin{
+			cb.appendFreshOrigin(&FreshOrigin{
 				Size: int64(len(rop.Data)),
-			}
-
-			for comp.Size+fo.Size > bigBlockSize {
-				truncatedSize := bigBlockSize - comp.Size
+			})
+		case pwr.SyncOp_HEY_YOU_DID_IT:
+			cb.finish(fileSize)
+			return nil
+		}
+	}
+}
 
-				// only if we can fit some of the data in this block, otherwise, clear
-				// the current comp, wait for next loop iteration where comp.Size will be 0
-				if truncatedSize > 0 {
-					comp.Append(&FreshOrigin{
-						Size: truncatedSize,
-					})
+func (g *Genie) analyzeBsdiffFile(patchWire *wire.ReadContext, fileIndex int64, fileSize int64, onComp CompositionListener) error {
+	bh := &pwr.BsdiffHeader{}
+	err := patchWire.ReadMessage(bh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
-					fo.Size -= truncatedSize
-				}
+	cb := g.newCompositionBuilder(fileIndex, onComp)
 
-				onComp(comp)
+	// the old file is the concatenation of one or more target files
+	targetIndices := pwr.BsdiffTargetIndices(bh)
+	targetStarts := make([]int64, len(targetIndices))
+	var oldSize int64
+	for i, targetIndex := range targetIndices {
+		if targetIndex < 0 || targetIndex >= int64(len(g.TargetContainer.Files)) {
+			return errors.Errorf("Malformed patch: bsdiff against unknown target file %d", targetIndex)
+		}
+		targetStarts[i] = oldSize
+		oldSize += g.TargetContainer.Files[targetIndex].Size
+	}
 
-				// allocate a new comp after sending, so we don't write to the previous one
-				comp = &Composition{
-					FileIndex:  int64(fileIndex),
-					BlockIndex: comp.BlockIndex + 1,
-				}
+	appendOldOrigin := func(offset int64, size int64) {
+		for i, targetIndex := range targetIndices {
+			start := targetStarts[i]
+			end := start + g.TargetContainer.Files[targetIndex].Size
+			if size == 0 || offset < start {
+				return
 			}
-
-			if fo.Size > 0 {
-				comp.Append(fo)
+			if offset >= end && i+1 < len(targetIndices) {
+				continue
 			}
-		case pwr.SyncOp_HEY_YOU_DID_IT:
-			if comp.Size > 0 && fileSize > 0 {
-				onComp(comp)
+
+			n := size
+			if i+1 < len(targetIndices) && offset+n > end {
+				n = end - offset
 			}
-			return nil
+			cb.appendBlockOrigin(&BlockOrigin{
+				FileIndex: targetIndex,
+				Offset:    offset - start,
+				Size:      n,
+			})
+			offset += n
+			size -= n
+		}
+	}
+
+	// bsdiff controls don't have absolute offsets: "add" reads from the
+	// old file at the current offset, and "seek" moves it, relatively.
+	oldOffset := int64(0)
+
+	ctrl := &bsdiff.Control{}
+	for {
+		ctrl.Reset()
+		err = patchWire.ReadMessage(ctrl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if ctrl.Eof {
+			break
+		}
+
+		// "add" bytes are old bytes plus a delta: they originate
+		// from the target file, even if they're not an exact copy.
+		if len(ctrl.Add) > 0 {
+			appendOldOrigin(oldOffset, int64(len(ctrl.Add)))
+			oldOffset += int64(len(ctrl.Add))
+		}
+
+		// "copy" bytes are brand new
+		if len(ctrl.Copy) > 0 {
+			cb.appendFreshOrigin(&FreshOrigin{
+				Size: int64(len(ctrl.Copy)),
+			})
 		}
+
+		oldOffset += ctrl.Seek
+	}
+
+	// the bsdiff series is followed by a sentinel SyncOp
+	rop := &pwr.SyncOp{}
+	err = patchWire.ReadMessage(rop)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if rop.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+		return errors.Errorf("Malformed patch: expected sentinel SyncOp after bsdiff series, got %s", rop.Type)
+	}
+
+	cb.finish(fileSize)
+	return nil
+}
+
+// A compositionBuilder accumulates origins into compositions, splitting them
+// so that each composition explains exactly one big block of the source file.
+type compositionBuilder struct {
+	bigBlockSize int64
+	comp         *Composition
+	onComp       CompositionListener
+}
+
+func (g *Genie) newCompositionBuilder(fileIndex int64, onComp CompositionListener) *compositionBuilder {
+	return &compositionBuilder{
+		bigBlockSize: g.BlockSize,
+		comp: &Composition{
+			FileIndex: fileIndex,
+		},
+		onComp: onComp,
+	}
+}
+
+// next sends over the current composition and allocates a new one - same file, next block
+// (sent comps should not be modified afterwards)
+func (cb *compositionBuilder) next() {
+	cb.onComp(cb.comp)
+
+	cb.comp = &Composition{
+		FileIndex:  cb.comp.FileIndex,
+		BlockIndex: cb.comp.BlockIndex + 1,
+	}
+}
+
+func (cb *compositionBuilder) appendBlockOrigin(bo *BlockOrigin) {
+	// As long as the block origin would span beyond the end of the
+	// big block we're currently analyzing, split it into {A, B},
+	// where A fits into the current big block, and B is the rest
+	for cb.comp.Size+bo.Size > cb.bigBlockSize {
+		truncatedSize := cb.bigBlockSize - cb.comp.Size
+
+		// truncatedSize may be 0 if `comp.Size == bigBlockSize`, ie. comp already
+		// explains all the contents of the current big block - in this case,
+		// we keep this BlockOrigin intact for the next iteration of the loop
+		// (during which comp.Size will == 0)
+		if truncatedSize > 0 {
+			// this is A
+			cb.comp.Append(&BlockOrigin{
+				FileIndex: bo.FileIndex,
+				Offset:    bo.Offset,
+				Size:      truncatedSize,
+			})
+
+			// and bo becomes B
+			bo.Offset += truncatedSize
+			bo.Size -= truncatedSize
+		}
+
+		cb.next()
+	}
+
+	// after all the splitting, there might still be some data left over
+	// (that's smaller than bigBlockSize)
+	if bo.Size > 0 {
+		cb.comp.Append(bo)
+	}
+}
+
+func (cb *compositionBuilder) appendFreshOrigin(fo *FreshOrigin) {
+	for cb.comp.Size+fo.Size > cb.bigBlockSize {
+		truncatedSize := cb.bigBlockSize - cb.comp.Size
+
+		// only if we can fit some of the data in this block, otherwise, clear
+		// the current comp, wait for next loop iteration where comp.Size will be 0
+		if truncatedSize > 0 {
+			cb.comp.Append(&FreshOrigin{
+				Size: truncatedSize,
+			})
+
+			fo.Size -= truncatedSize
+		}
+
+		cb.next()
+	}
+
+	if fo.Size > 0 {
+		cb.comp.Append(fo)
+	}
+}
+
+// finish sends over the last, possibly partial, composition
+func (cb *compositionBuilder) finish(fileSize int64) {
+	if cb.comp.Size > 0 && fileSize > 0 {
+		cb.onComp(cb.comp)
 	}
 }
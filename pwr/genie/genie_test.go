@@ -0,0 +1,198 @@
+package genie_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/genie"
+	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// makePatches returns an rsync patch from v1 to v2, along
+// with its bsdiff-optimized version
+func makePatches(t *testing.T, v1 string, v2 string) ([]byte, []byte) {
+	compression := &pwr.CompressionSettings{}
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), consumer)
+	wtest.Must(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	dctx := &pwr.DiffContext{
+		Compression: compression,
+		Consumer:    consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, ioutil.Discard))
+
+	rc, err := rediff.NewContext(rediff.Params{
+		Consumer:    consumer,
+		Compression: compression,
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+	})
+	wtest.Must(t, err)
+
+	optimizedBuffer := new(bytes.Buffer)
+	wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+		TargetPool:  fspool.New(rc.GetTargetContainer(), v1),
+		SourcePool:  fspool.New(rc.GetSourceContainer(), v2),
+		PatchWriter: optimizedBuffer,
+	}))
+
+	return patchBuffer.Bytes(), optimizedBuffer.Bytes()
+}
+
+func Test_GenieRsyncAndBsdiff(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "genie")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	v1 := filepath.Join(mainDir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "modified", Seed: 0x1, Size: pwr.BlockSize*5 + 14},
+			{Path: "same", Seed: 0x2, Size: pwr.BlockSize * 3},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "modified", Seed: 0x1, Size: pwr.BlockSize*5 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: pwr.BlockSize/2 + 3, Delta: 0x4},
+				{Interval: pwr.BlockSize/3 + 7, Delta: 0x18},
+			}},
+			{Path: "same", Seed: 0x2, Size: pwr.BlockSize * 3},
+			{Path: "empty", Size: -1},
+		},
+	})
+
+	patch, optimizedPatch := makePatches(t, v1, v2)
+
+	bigBlockSize := int64(4 * 1024 * 1024)
+	for i, patch := range [][]byte{patch, optimizedPatch} {
+		optimized := i == 1
+
+		g := &genie.Genie{
+			BlockSize: bigBlockSize,
+		}
+
+		patchReader := seeksource.FromBytes(patch)
+		_, err = patchReader.Resume(nil)
+		wtest.Must(t, err)
+		wtest.Must(t, g.ParseHeader(patchReader))
+
+		comps := make(map[int64][]*genie.Composition)
+		wtest.Must(t, g.ParseContents(func(comp *genie.Composition) {
+			comps[comp.FileIndex] = append(comps[comp.FileIndex], comp)
+		}))
+
+		for fileIndex, f := range g.SourceContainer.Files {
+			fileComps := comps[int64(fileIndex)]
+			if f.Size == 0 {
+				assert.EqualValues(t, 0, len(fileComps), f.Path)
+				continue
+			}
+
+			if !assert.EqualValues(t, 1, len(fileComps), f.Path) {
+				continue
+			}
+			comp := fileComps[0]
+
+			var blockSize, freshSize int64
+			for _, origin := range comp.Origins {
+				switch o := origin.(type) {
+				case *genie.BlockOrigin:
+					targetFile := g.TargetContainer.Files[o.FileIndex]
+					assert.True(t, o.Offset >= 0 && o.Offset < targetFile.Size,
+						"origin %+v should be within target file (%s)", o, targetFile.Path)
+					blockSize += o.Size
+				case *genie.FreshOrigin:
+					freshSize += o.Size
+				}
+			}
+
+			if f.Path == "modified" && optimized {
+				// with bsdiff, most of the file comes from the old version
+				assert.True(t, blockSize > freshSize, "%s: %d from target, %d fresh", f.Path, blockSize, freshSize)
+			}
+			if f.Path == "same" {
+				assert.EqualValues(t, 0, freshSize)
+			}
+		}
+	}
+}
+
+func Test_GenieSplitsBigBlocks(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "genie")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	v1 := filepath.Join(mainDir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: pwr.BlockSize * 8},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: pwr.BlockSize*8 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: pwr.BlockSize/2 + 3, Delta: 0x4},
+			}},
+		},
+	})
+
+	_, optimizedPatch := makePatches(t, v1, v2)
+
+	bigBlockSize := pwr.BlockSize * 2
+	g := &genie.Genie{
+		BlockSize: bigBlockSize,
+	}
+
+	patchReader := seeksource.FromBytes(optimizedPatch)
+	_, err = patchReader.Resume(nil)
+	wtest.Must(t, err)
+	wtest.Must(t, g.ParseHeader(patchReader))
+
+	var comps []*genie.Composition
+	wtest.Must(t, g.ParseContents(func(comp *genie.Composition) {
+		comps = append(comps, comp)
+	}))
+
+	f := g.SourceContainer.Files[0]
+	numBigBlocks := (f.Size + bigBlockSize - 1) / bigBlockSize
+	assert.EqualValues(t, numBigBlocks, len(comps))
+
+	for i, comp := range comps {
+		assert.EqualValues(t, i, comp.BlockIndex)
+
+		expectedSize := bigBlockSize
+		if int64(i) == numBigBlocks-1 {
+			expectedSize = f.Size - bigBlockSize*int64(i)
+		}
+		assert.EqualValues(t, expectedSize, comp.Size, "block %d", i)
+	}
+}
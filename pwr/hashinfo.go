@@ -9,6 +9,9 @@ import (
 type HashInfo struct {
 	Container *tlc.Container
 	Groups    HashGroups
+
+	// BlockSize is the size of hashed blocks, never 0
+	BlockSize int64
 }
 
 type HashGroups = map[int64][]wsync.BlockHash
@@ -19,6 +22,11 @@ func ComputeHashInfo(sigInfo *SignatureInfo) (*HashInfo, error) {
 		pathToFileIndex[f.Path] = int64(fileIndex)
 	}
 
+	if sigInfo.Chunker != nil {
+		return nil, errors.Errorf("signatures made of content-defined chunks can't be grouped in blocks")
+	}
+
+	blockSize := ResolveBlockSize(sigInfo.BlockSize)
 	hashGroups := make(HashGroups)
 	hashIndex := int64(0)
 
@@ -31,7 +39,7 @@ func ComputeHashInfo(sigInfo *SignatureInfo) (*HashInfo, error) {
 			continue
 		}
 
-		numBlocks := ComputeNumBlocks(f.Size)
+		numBlocks := ComputeNumBlocksFor(f.Size, blockSize)
 		hashGroups[fileIndex] = sigInfo.Hashes[hashIndex : hashIndex+numBlocks]
 		hashIndex += numBlocks
 	}
@@ -44,6 +52,7 @@ func ComputeHashInfo(sigInfo *SignatureInfo) (*HashInfo, error) {
 	hashInfo := &HashInfo{
 		Container: sigInfo.Container,
 		Groups:    hashGroups,
+		BlockSize: blockSize,
 	}
 
 	return hashInfo, nil
@@ -2,10 +2,13 @@ package pwr
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/itchio/headway/state"
 	"github.com/itchio/lake/tlc"
+	"github.com/pkg/errors"
 )
 
 // A LockMap is an array of channels, corresponding to file indices
@@ -33,8 +36,19 @@ type Healer interface {
 	TotalHealed() int64
 }
 
+// A SignatureHealer needs the signature of the container it's healing,
+// which ValidatorContext gives it before starting.
+type SignatureHealer interface {
+	Healer
+
+	SetSignature(signature *SignatureInfo)
+}
+
 // NewHealer takes a spec of the form "type,url", and a target folder
 // and returns a healer that knows how to repair target from spec.
+// Archive healers also accept "archive,url,index-url", where index-url
+// ends in .pzi, to heal from a zip index (see ArchiveHealer.IndexPath).
+// See NewFallbackHealer to heal from several specs.
 func NewHealer(spec string, target string) (Healer, error) {
 	tokens := strings.SplitN(spec, ",", 2)
 	if len(tokens) != 2 {
@@ -50,10 +64,131 @@ func NewHealer(spec string, target string) (Healer, error) {
 			ArchivePath: healerURL,
 			Target:      target,
 		}
+
+		// urls may contain commas, so only take the last part
+		// as an index if it looks like one
+		if i := strings.LastIndex(healerURL, ","); i >= 0 && strings.HasSuffix(healerURL[i+1:], ".pzi") {
+			ah.ArchivePath = healerURL[:i]
+			ah.IndexPath = healerURL[i+1:]
+		}
 		return ah, nil
 	case "manifest":
-		return nil, fmt.Errorf("Manifest healer: stub")
+		mh := &ManifestHealer{
+			StorePath: healerURL,
+			Target:    target,
+		}
+		return mh, nil
+	case "dir":
+		dh := &DirHealer{
+			SourceDir: healerURL,
+			Target:    target,
+		}
+		return dh, nil
 	}
 
 	return nil, fmt.Errorf("Unknown healer type %s", healerType)
 }
+
+// healDirWound makes sure the directory described by a DIR wound
+// exists in target, removing any file or symlink in its way.
+func healDirWound(consumer *state.Consumer, target string, container *tlc.Container, wound *Wound) error {
+	dirEntry := container.Dirs[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(dirEntry.Path))
+
+	stats, err := os.Lstat(path)
+	if err == nil {
+		if stats.IsDir() {
+			consumer.Debugf("For dir wound, found existing dir (%s), all good", path)
+			return nil
+		}
+
+		consumer.Debugf("For dir wound, found file/symlink (%s), removing", path)
+		err = os.Remove(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	consumer.Debugf("For dir wound, doing MkdirAll (%s)", path)
+	err = os.MkdirAll(path, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// healSymlinkWound (re-)creates the symbolic link described by a SYMLINK
+// wound in target, removing anything in its way.
+func healSymlinkWound(consumer *state.Consumer, target string, container *tlc.Container, wound *Wound) error {
+	symlinkEntry := container.Symlinks[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(symlinkEntry.Path))
+
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	stats, err := os.Lstat(path)
+	if err == nil {
+		if stats.IsDir() {
+			consumer.Debugf("For symlink wound, found dir (%s), doing RemoveAll", path)
+			err = os.RemoveAll(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		} else {
+			consumer.Debugf("For symlink wound, found file/symlink (%s), doing Remove", path)
+			err = os.Remove(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+
+	consumer.Debugf("For symlink wound, doing Symlink (%s) => (%s)", path, symlinkEntry.Dest)
+	err = os.Symlink(symlinkEntry.Dest, path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// openFileWoundTarget opens the file described by a FILE wound in target for
+// writing, creating it (and its parents) if needed, removing any directory or
+// symlink in its way, and truncating it to the size it should have.
+func openFileWoundTarget(consumer *state.Consumer, target string, container *tlc.Container, wound *Wound) (*os.File, error) {
+	f := container.Files[wound.Index]
+	path := filepath.Join(target, filepath.FromSlash(f.Path))
+
+	stats, err := os.Lstat(path)
+	if err == nil && !stats.Mode().IsRegular() {
+		consumer.Debugf("For file wound, found dir/symlink (%s), doing RemoveAll", path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, os.FileMode(f.Mode|ModeMask))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// files that are too long (or too short) are wounded past their end
+	// (or up to their end), truncating takes care of that.
+	err = writer.Truncate(f.Size)
+	if err != nil {
+		writer.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return writer, nil
+}
@@ -13,10 +13,12 @@ import (
 	"time"
 
 	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/pools/fspool"
 
 	"github.com/itchio/arkive/zip"
 
 	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/wire"
 	"github.com/itchio/wharf/wtest"
 
 	"github.com/itchio/headway/state"
@@ -37,6 +39,21 @@ func Test_NewHealer(t *testing.T) {
 
 	_, ok := healer.(*ArchiveHealer)
 	assert.True(t, ok)
+
+	healer, err = NewHealer("manifest,/dev/null", "invalid")
+	assert.NoError(t, err)
+
+	_, ok = healer.(*ManifestHealer)
+	assert.True(t, ok)
+
+	healer, err = NewHealer("archive,https://example.org/a,b.zip,https://example.org/a.pzi", "invalid")
+	assert.NoError(t, err)
+
+	ah, ok := healer.(*ArchiveHealer)
+	if assert.True(t, ok) {
+		assert.EqualValues(t, "https://example.org/a,b.zip", ah.ArchivePath)
+		assert.EqualValues(t, "https://example.org/a.pzi", ah.IndexPath)
+	}
 }
 
 type healMethod func()
@@ -176,3 +193,369 @@ func Test_ArchiveHealer(t *testing.T) {
 		assertAllFilesHealed()
 	}
 }
+
+func Test_ManifestHealer(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "manifesthealer")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	sourceDir := filepath.Join(mainDir, "source")
+	wtest.MakeTestDir(t, sourceDir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: BlockSize*12 + 14},
+			{Path: "sub/small", Seed: 0x2, Size: 193},
+			{Path: "sub/empty", Size: -1},
+		},
+	})
+
+	container, err := tlc.WalkAny(sourceDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	storeDir := filepath.Join(mainDir, "store")
+	algorithm := HashAlgorithm_SHAKE128_32
+
+	// lay out a block store, along with its manifest
+	func() {
+		manifestWriter, err := os.Create(storeDir + "-manifest.pwm")
+		wtest.Must(t, err)
+		defer manifestWriter.Close()
+
+		wc := wire.NewWriteContext(manifestWriter)
+		wtest.Must(t, wc.WriteMagic(ManifestMagic))
+		wtest.Must(t, wc.WriteMessage(&ManifestHeader{
+			Compression: &CompressionSettings{},
+			Algorithm:   algorithm,
+		}))
+		wtest.Must(t, wc.WriteMessage(container))
+
+		for _, f := range container.Files {
+			data, err := ioutil.ReadFile(filepath.Join(sourceDir, filepath.FromSlash(f.Path)))
+			wtest.Must(t, err)
+
+			for blockIndex := int64(0); blockIndex < ComputeNumBlocks(f.Size); blockIndex++ {
+				size := ComputeBlockSize(f.Size, blockIndex)
+				block := data[blockIndex*BlockSize : blockIndex*BlockSize+size]
+				hash, err := HashManifestBlock(algorithm, block)
+				wtest.Must(t, err)
+
+				blockPath := filepath.Join(storeDir, filepath.FromSlash(ComputeBlockAddress(algorithm, hash, size)))
+				wtest.Must(t, os.MkdirAll(filepath.Dir(blockPath), 0755))
+				wtest.Must(t, ioutil.WriteFile(blockPath, block, 0644))
+
+				wtest.Must(t, wc.WriteMessage(&ManifestBlockHash{Hash: hash}))
+			}
+		}
+	}()
+	wtest.Must(t, os.Rename(storeDir+"-manifest.pwm", filepath.Join(storeDir, BlockStoreManifestName)))
+
+	consumer := &state.Consumer{}
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, sourceDir), consumer)
+	wtest.Must(t, err)
+
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	targetDir := filepath.Join(mainDir, "target")
+	bigPath := filepath.Join(targetDir, "big")
+
+	t.Logf("...with one block corrupted")
+	wtest.CpDir(t, sourceDir, targetDir)
+	bigData, err := ioutil.ReadFile(bigPath)
+	wtest.Must(t, err)
+	bigData[BlockSize*7+3]++
+	wtest.Must(t, ioutil.WriteFile(bigPath, bigData, 0644))
+
+	healer, err := NewHealer(fmt.Sprintf("manifest,%s", storeDir), targetDir)
+	wtest.Must(t, err)
+
+	vc := &ValidatorContext{
+		Consumer: consumer,
+		HealPath: fmt.Sprintf("manifest,%s", storeDir),
+	}
+	wtest.Must(t, vc.Validate(context.Background(), targetDir, sigInfo))
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	t.Logf("...healing one block directly")
+	bigData, err = ioutil.ReadFile(bigPath)
+	wtest.Must(t, err)
+	bigData[BlockSize*2]++
+	wtest.Must(t, ioutil.WriteFile(bigPath, bigData, 0644))
+
+	wounds := make(chan *Wound, 1)
+	wounds <- &Wound{
+		Kind:  WoundKind_FILE,
+		Index: 0,
+		Start: BlockSize * 2,
+		End:   BlockSize * 3,
+	}
+	close(wounds)
+	wtest.Must(t, healer.Do(context.Background(), container, wounds))
+	assert.EqualValues(t, BlockSize, healer.TotalHealed())
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	t.Logf("...with everything missing")
+	wtest.Must(t, os.RemoveAll(targetDir))
+	wtest.Must(t, vc.Validate(context.Background(), targetDir, sigInfo))
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	t.Logf("...with a file too long")
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(targetDir, "sub", "small"), bytes.Repeat([]byte{0x4}, 1024), 0644))
+	wtest.Must(t, vc.Validate(context.Background(), targetDir, sigInfo))
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	t.Logf("...with a corrupted block store")
+	manifest := healer.(*ManifestHealer).Manifest
+	storedBlockPath := filepath.Join(storeDir, filepath.FromSlash(ComputeBlockAddress(algorithm, manifest.Groups[0][0], BlockSize)))
+	wtest.Must(t, ioutil.WriteFile(storedBlockPath, make([]byte, BlockSize), 0644))
+	bigData, err = ioutil.ReadFile(bigPath)
+	wtest.Must(t, err)
+	bigData[0]++
+	wtest.Must(t, ioutil.WriteFile(bigPath, bigData, 0644))
+	assert.Error(t, vc.Validate(context.Background(), targetDir, sigInfo))
+}
+
+func Test_FallbackHealer(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "fallbackhealer")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	prng := randsource.Reader{
+		Source: rand.New(rand.NewSource(0x42)),
+	}
+
+	names := []string{"file-1", "sub/file-2", "sub/file-3"}
+	sizes := []int64{BlockSize*2 + 14, 4 * 1024, BlockSize}
+
+	writeArchive := func(archivePath string) {
+		archiveWriter, err := os.Create(archivePath)
+		wtest.Must(t, err)
+		defer archiveWriter.Close()
+
+		zw := zip.NewWriter(archiveWriter)
+		for i, name := range names {
+			fh := &zip.FileHeader{
+				Name: name,
+			}
+			fh.Method = zip.Deflate
+			fh.SetMode(0644)
+
+			writer, err := zw.CreateHeader(fh)
+			wtest.Must(t, err)
+			_, err = io.Copy(writer, io.LimitReader(prng, sizes[i]))
+			wtest.Must(t, err)
+		}
+		wtest.Must(t, zw.Close())
+	}
+
+	// same names and sizes, different contents
+	badArchivePath := filepath.Join(mainDir, "bad.zip")
+	writeArchive(badArchivePath)
+	goodArchivePath := filepath.Join(mainDir, "good.zip")
+	writeArchive(goodArchivePath)
+
+	container, err := tlc.WalkAny(goodArchivePath, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	pool, err := pools.New(container, goodArchivePath)
+	wtest.Must(t, err)
+
+	hashes, err := ComputeSignature(context.Background(), container, pool, nil)
+	wtest.Must(t, err)
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	targetDir := filepath.Join(mainDir, "target")
+	specs := []string{
+		fmt.Sprintf("archive,%s", badArchivePath),
+		fmt.Sprintf("manifest,%s", filepath.Join(mainDir, "no-such-store")),
+		fmt.Sprintf("archive,%s", goodArchivePath),
+	}
+
+	fh, err := NewFallbackHealer(specs, targetDir)
+	wtest.Must(t, err)
+	assert.Len(t, fh.Sources, 3)
+
+	_, err = NewFallbackHealer([]string{specs[0], "nope,/dev/null"}, targetDir)
+	assert.Error(t, err)
+
+	vctx := &ValidatorContext{
+		HealPaths: specs,
+	}
+	wtest.Must(t, vctx.Validate(context.Background(), targetDir, sigInfo))
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	fh, ok := vctx.WoundsConsumer.(*FallbackHealer)
+	assert.True(t, ok)
+	assert.EqualValues(t, container.Size, fh.TotalCorrupted())
+	assert.EqualValues(t, 0, fh.TotalHealedBy(0), "bad data was written, then rejected")
+	assert.EqualValues(t, 0, fh.TotalHealedBy(1))
+	assert.EqualValues(t, container.Size, fh.TotalHealedBy(2))
+	assert.EqualValues(t, container.Size, fh.TotalHealed())
+
+	// without a signature, sources are only checked for errors
+	wtest.Must(t, os.RemoveAll(targetDir))
+	fh, err = NewFallbackHealer(specs[1:], targetDir)
+	wtest.Must(t, err)
+	counter := &doCounter{ResumableHealer: fh.Sources[1].(ResumableHealer)}
+	fh.Sources[1] = counter
+
+	wounds := make(chan *Wound, len(container.Files))
+	for i, f := range container.Files {
+		wounds <- &Wound{
+			Kind:  WoundKind_FILE,
+			Index: int64(i),
+			Start: 0,
+			End:   f.Size,
+		}
+	}
+	close(wounds)
+	wtest.Must(t, fh.Do(context.Background(), container, wounds))
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+	assert.EqualValues(t, container.Size, fh.TotalHealedBy(1))
+	assert.EqualValues(t, 1, counter.calls, "all wounds are given to a source at once")
+
+	// the first source heals wounds as they arrive
+	wtest.Must(t, os.RemoveAll(targetDir))
+	fh, err = NewFallbackHealer(specs[2:], targetDir)
+	wtest.Must(t, err)
+	fh.SetSignature(sigInfo)
+
+	wounds = make(chan *Wound)
+	done := make(chan error, 1)
+	go func() {
+		done <- fh.Do(context.Background(), container, wounds)
+	}()
+
+	for i, f := range container.Files {
+		wound := &Wound{
+			Kind:  WoundKind_FILE,
+			Index: int64(i),
+			Start: 0,
+			End:   f.Size,
+		}
+		wounds <- wound
+
+		healed := false
+		for attempt := 0; attempt < 500 && !healed; attempt++ {
+			time.Sleep(10 * time.Millisecond)
+			healed = fh.IsHealed(wound)
+		}
+		assert.True(t, healed, "(%s) healed before the next wound is sent", f.Path)
+	}
+	close(wounds)
+	wtest.Must(t, <-done)
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+	assert.EqualValues(t, container.Size, fh.TotalHealedBy(0))
+}
+
+// doCounter counts how many times a healer's Do is called
+type doCounter struct {
+	ResumableHealer
+	calls int
+}
+
+func (dc *doCounter) Do(ctx context.Context, container *tlc.Container, wounds chan *Wound) error {
+	dc.calls++
+	return dc.ResumableHealer.Do(ctx, container, wounds)
+}
+
+func Test_DirHealer(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "dirhealer")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	settings := wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: BlockSize * 4},
+			{Path: "sub/small", Seed: 0x2, Size: 193},
+			{Path: "sub/empty", Size: -1},
+		},
+	}
+
+	targetDir := filepath.Join(mainDir, "target")
+	wtest.MakeTestDir(t, targetDir, settings)
+	copyDir := filepath.Join(mainDir, "copy")
+	wtest.MakeTestDir(t, copyDir, settings)
+
+	container, err := tlc.WalkAny(targetDir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, targetDir), nil)
+	wtest.Must(t, err)
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	bigData, err := ioutil.ReadFile(filepath.Join(copyDir, "big"))
+	wtest.Must(t, err)
+	smallData, err := ioutil.ReadFile(filepath.Join(copyDir, "sub", "small"))
+	wtest.Must(t, err)
+
+	heal := func(sourceDir string) (*DirHealer, error) {
+		vctx := &ValidatorContext{
+			HealPath: fmt.Sprintf("dir,%s", sourceDir),
+		}
+		err := vctx.Validate(context.Background(), targetDir, sigInfo)
+		dh, ok := vctx.WoundsConsumer.(*DirHealer)
+		assert.True(t, ok)
+		return dh, err
+	}
+
+	t.Logf("...with a corrupted block, from the same path")
+	corrupted := append([]byte{}, bigData...)
+	corrupted[BlockSize*2+12] ^= 0xff
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(targetDir, "big"), corrupted, 0644))
+
+	dh, err := heal(copyDir)
+	wtest.Must(t, err)
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+	assert.EqualValues(t, BlockSize, dh.TotalHealed())
+
+	// healed wounds are remembered by value, not by pointer,
+	// for wounds decoded from checkpoints to match
+	assert.True(t, dh.IsHealed(&Wound{
+		Kind:  WoundKind_FILE,
+		Index: 0,
+		Start: BlockSize * 2,
+		End:   BlockSize * 3,
+	}))
+
+	t.Logf("...with a corrupted block, shifted within the same path")
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(targetDir, "big"), corrupted, 0644))
+	shiftedDir := filepath.Join(mainDir, "shifted")
+	wtest.Must(t, os.MkdirAll(shiftedDir, 0755))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(shiftedDir, "big"), append([]byte("shift"), bigData...), 0644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(shiftedDir, "aaa-unrelated"), bytes.Repeat([]byte{0x7}, int(BlockSize*8)), 0644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(shiftedDir, "tiny"), []byte("tiny"), 0644))
+
+	dh, err = heal(shiftedDir)
+	wtest.Must(t, err)
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+	assert.EqualValues(t, BlockSize, dh.TotalHealed())
+	assert.EqualValues(t, 1, len(dh.scanned), "only the file at the same path is scanned")
+
+	t.Logf("...with everything missing, from blocks at other paths and offsets")
+	otherDir := filepath.Join(mainDir, "other")
+	wtest.Must(t, os.MkdirAll(otherDir, 0755))
+	var mixed []byte
+	mixed = append(mixed, []byte("thirteen byte")...)
+	mixed = append(mixed, bigData...)
+	mixed = append(mixed, smallData...)
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(otherDir, "renamed.bin"), mixed, 0644))
+
+	wtest.Must(t, os.RemoveAll(targetDir))
+	dh, err = heal(otherDir)
+	wtest.Must(t, err)
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+	assert.EqualValues(t, container.Size, dh.TotalHealed())
+
+	t.Logf("...with blocks that can't be found anywhere")
+	wtest.Must(t, os.Remove(filepath.Join(targetDir, "sub", "small")))
+	_, err = heal(filepath.Join(mainDir, "empty"))
+	assert.Error(t, err)
+}
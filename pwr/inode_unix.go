@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package pwr
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of a file, or 0 if it's not available
+func fileInode(stats os.FileInfo) uint64 {
+	if st, ok := stats.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+package pwr
+
+import "os"
+
+// fileInode returns 0: file indices aren't part of os.FileInfo on Windows,
+// so the validation cache relies on size and modification time there.
+func fileInode(stats os.FileInfo) uint64 {
+	return 0
+}
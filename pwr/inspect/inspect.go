@@ -0,0 +1,278 @@
+// Package inspect summarizes the contents of a wharf patch, without applying it.
+package inspect
+
+import (
+	"context"
+	"sort"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// FileStats describes how a single file of the source container
+// is reconstructed by a patch.
+type FileStats struct {
+	FileIndex int64
+	Path      string
+	Size      int64
+
+	// Type is either RSYNC, CDC or BSDIFF
+	Type pwr.SyncHeader_Type
+
+	// ReusedBytes is the amount of data taken from target files. For bsdiff
+	// files, this is the size of all "add" runs, since they're made of old data
+	// plus a delta.
+	ReusedBytes int64
+	// FreshBytes is the amount of data stored as-is in the patch. For bsdiff
+	// files, this is the size of all "copy" runs.
+	FreshBytes int64
+
+	// BsdiffAddBytes is the total size of all "add" runs (bsdiff files only)
+	BsdiffAddBytes int64
+	// BsdiffCopyBytes is the total size of all "copy" runs (bsdiff files only)
+	BsdiffCopyBytes int64
+
+	// NumOps is the number of rsync operations or bsdiff controls for this file
+	NumOps int64
+
+	// TargetIndices lists the target files this file borrows data from, sorted
+	TargetIndices []int64
+}
+
+// PatchStats summarizes a whole patch
+type PatchStats struct {
+	Compression *pwr.CompressionSettings
+	// BlockSize is the size of rsync blocks
+	BlockSize int64
+
+	TargetContainer *tlc.Container
+	SourceContainer *tlc.Container
+
+	// Files has one entry per file of the source container
+	Files []*FileStats
+
+	// ReusedBytes and FreshBytes are comparable to the ones
+	// DiffContext reports when writing the patch (for rsync-only patches,
+	// they're equal).
+	ReusedBytes int64
+	FreshBytes  int64
+
+	BsdiffAddBytes  int64
+	BsdiffCopyBytes int64
+
+	NumRsyncFiles  int64
+	NumCdcFiles    int64
+	NumBsdiffFiles int64
+}
+
+// Inspect reads a patch from start to finish, and returns statistics
+// about each of the files it produces.
+func Inspect(ctx context.Context, patchReader savior.SeekSource, consumer *state.Consumer) (*PatchStats, error) {
+	if consumer == nil {
+		consumer = &state.Consumer{}
+	}
+
+	_, err := patchReader.Resume(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rawPatchWire := wire.NewReadContext(patchReader)
+	header, err := pwr.ReadPatchHeader(rawPatchWire)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = pwr.ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	patchWire, err := pwr.DecompressWire(rawPatchWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	stats := &PatchStats{
+		Compression:     header.Compression,
+		BlockSize:       pwr.ResolveBlockSize(header.BlockSize),
+		TargetContainer: &tlc.Container{},
+		SourceContainer: &tlc.Container{},
+	}
+
+	err = patchWire.ReadMessage(stats.TargetContainer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = patchWire.ReadMessage(stats.SourceContainer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sh := &pwr.SyncHeader{}
+	for fileIndex, f := range stats.SourceContainer.Files {
+		select {
+		case <-ctx.Done():
+			return nil, werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		consumer.ProgressLabel(f.Path)
+		consumer.Progress(patchReader.Progress())
+
+		sh.Reset()
+		err = patchWire.ReadMessage(sh)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if sh.FileIndex != int64(fileIndex) {
+			return nil, errors.Errorf("Malformed patch: expected fileIndex = %d, got fileIndex %d", fileIndex, sh.FileIndex)
+		}
+
+		fs := &FileStats{
+			FileIndex: int64(fileIndex),
+			Path:      f.Path,
+			Size:      f.Size,
+			Type:      sh.Type,
+		}
+
+		switch sh.Type {
+		case pwr.SyncHeader_RSYNC:
+			err = inspectRsync(patchWire, stats.TargetContainer, stats.BlockSize, fs)
+			stats.NumRsyncFiles++
+		case pwr.SyncHeader_CDC:
+			err = inspectRsync(patchWire, stats.TargetContainer, stats.BlockSize, fs)
+			stats.NumCdcFiles++
+		case pwr.SyncHeader_BSDIFF:
+			err = inspectBsdiff(patchWire, fs)
+			stats.NumBsdiffFiles++
+		default:
+			err = errors.Errorf("Malformed patch: unknown sync header type %s", sh.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspecting (%s)", f.Path)
+		}
+
+		stats.Files = append(stats.Files, fs)
+		stats.ReusedBytes += fs.ReusedBytes
+		stats.FreshBytes += fs.FreshBytes
+		stats.BsdiffAddBytes += fs.BsdiffAddBytes
+		stats.BsdiffCopyBytes += fs.BsdiffCopyBytes
+	}
+
+	consumer.Progress(1.0)
+	return stats, nil
+}
+
+func inspectRsync(patchWire *wire.ReadContext, targetContainer *tlc.Container, blockSize int64, fs *FileStats) error {
+	targets := make(map[int64]bool)
+	rop := &pwr.SyncOp{}
+
+	for {
+		rop.Reset()
+		err := patchWire.ReadMessage(rop)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		switch rop.Type {
+		case pwr.SyncOp_BLOCK_RANGE:
+			if rop.FileIndex < 0 || rop.FileIndex >= int64(len(targetContainer.Files)) {
+				return errors.Errorf("Malformed patch: block range refers to target file %d, but there are only %d", rop.FileIndex, len(targetContainer.Files))
+			}
+
+			// same as DiffContext: the last block may be short
+			fileSize := targetContainer.Files[rop.FileIndex].Size
+			lastBlockIndex := rop.BlockIndex + rop.BlockSpan - 1
+			tailSize := pwr.ComputeBlockSizeFor(fileSize, lastBlockIndex, blockSize)
+			fs.ReusedBytes += blockSize*(rop.BlockSpan-1) + tailSize
+			targets[rop.FileIndex] = true
+
+		case pwr.SyncOp_CHUNK_RANGE:
+			if rop.FileIndex < 0 || rop.FileIndex >= int64(len(targetContainer.Files)) {
+				return errors.Errorf("Malformed patch: chunk range refers to target file %d, but there are only %d", rop.FileIndex, len(targetContainer.Files))
+			}
+
+			fs.ReusedBytes += rop.Size
+			targets[rop.FileIndex] = true
+
+		case pwr.SyncOp_DATA:
+			fs.FreshBytes += int64(len(rop.Data))
+
+		case pwr.SyncOp_HEY_YOU_DID_IT:
+			fs.TargetIndices = sortedIndices(targets)
+			return nil
+
+		default:
+			return errors.Errorf("Malformed patch: unknown rsync op type %s", rop.Type)
+		}
+		fs.NumOps++
+	}
+}
+
+func inspectBsdiff(patchWire *wire.ReadContext, fs *FileStats) error {
+	bh := &pwr.BsdiffHeader{}
+	err := patchWire.ReadMessage(bh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ctrl := &bsdiff.Control{}
+	for {
+		ctrl.Reset()
+		err = patchWire.ReadMessage(ctrl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if ctrl.Eof {
+			break
+		}
+
+		fs.BsdiffAddBytes += int64(len(ctrl.Add))
+		fs.BsdiffCopyBytes += int64(len(ctrl.Copy))
+		fs.NumOps++
+	}
+
+	// the bsdiff series is followed by a sentinel SyncOp
+	rop := &pwr.SyncOp{}
+	err = patchWire.ReadMessage(rop)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if rop.Type != pwr.SyncOp_HEY_YOU_DID_IT {
+		return errors.Errorf("Malformed patch: expected sentinel SyncOp after bsdiff series, got %s", rop.Type)
+	}
+
+	fs.ReusedBytes = fs.BsdiffAddBytes
+	fs.FreshBytes = fs.BsdiffCopyBytes
+	if fs.BsdiffAddBytes > 0 {
+		targets := make(map[int64]bool)
+		for _, targetIndex := range pwr.BsdiffTargetIndices(bh) {
+			targets[targetIndex] = true
+		}
+		fs.TargetIndices = sortedIndices(targets)
+	}
+	return nil
+}
+
+func sortedIndices(set map[int64]bool) []int64 {
+	var res []int64
+	for index := range set {
+		res = append(res, index)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
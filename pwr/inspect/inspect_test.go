@@ -0,0 +1,133 @@
+package inspect_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/inspect"
+	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Inspect(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "inspect")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	v1 := filepath.Join(mainDir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "modified", Seed: 0x1, Size: pwr.BlockSize*5 + 14},
+			{Path: "same", Seed: 0x2, Size: pwr.BlockSize*3 + 7},
+		},
+	})
+
+	v2 := filepath.Join(mainDir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "modified", Seed: 0x1, Size: pwr.BlockSize*5 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: pwr.BlockSize/2 + 3, Delta: 0x4},
+			}},
+			{Path: "new", Seed: 0x3, Size: pwr.BlockSize + 5},
+			{Path: "same", Seed: 0x2, Size: pwr.BlockSize*3 + 7},
+		},
+	})
+
+	compression := &pwr.CompressionSettings{}
+	consumer := &state.Consumer{}
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), consumer)
+	wtest.Must(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	dctx := &pwr.DiffContext{
+		Compression: compression,
+		Consumer:    consumer,
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, ioutil.Discard))
+
+	stats, err := inspect.Inspect(context.Background(), seeksource.FromBytes(patchBuffer.Bytes()), nil)
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, dctx.ReusedBytes, stats.ReusedBytes)
+	assert.EqualValues(t, dctx.FreshBytes, stats.FreshBytes)
+	assert.EqualValues(t, 3, stats.NumRsyncFiles)
+	assert.EqualValues(t, 0, stats.NumBsdiffFiles)
+	assert.EqualValues(t, len(sourceContainer.Files), len(stats.Files))
+
+	byPath := func(stats *inspect.PatchStats, path string) *inspect.FileStats {
+		for _, fs := range stats.Files {
+			if fs.Path == path {
+				return fs
+			}
+		}
+		t.Fatalf("no stats for %s", path)
+		return nil
+	}
+
+	same := byPath(stats, "same")
+	assert.EqualValues(t, same.Size, same.ReusedBytes)
+	assert.EqualValues(t, 0, same.FreshBytes)
+	assert.EqualValues(t, []int64{1}, same.TargetIndices)
+
+	fresh := byPath(stats, "new")
+	assert.EqualValues(t, 0, fresh.ReusedBytes)
+	assert.EqualValues(t, fresh.Size, fresh.FreshBytes)
+	assert.EqualValues(t, 0, len(fresh.TargetIndices))
+
+	rc, err := rediff.NewContext(rediff.Params{
+		Consumer:    consumer,
+		Compression: compression,
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+	})
+	wtest.Must(t, err)
+
+	optimizedBuffer := new(bytes.Buffer)
+	wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+		TargetPool:  fspool.New(rc.GetTargetContainer(), v1),
+		SourcePool:  fspool.New(rc.GetSourceContainer(), v2),
+		PatchWriter: optimizedBuffer,
+	}))
+
+	stats, err = inspect.Inspect(context.Background(), seeksource.FromBytes(optimizedBuffer.Bytes()), nil)
+	wtest.Must(t, err)
+
+	assert.EqualValues(t, 1, stats.NumBsdiffFiles)
+	modified := byPath(stats, "modified")
+	assert.EqualValues(t, pwr.SyncHeader_BSDIFF, modified.Type)
+	assert.EqualValues(t, modified.Size, modified.BsdiffAddBytes+modified.BsdiffCopyBytes)
+	assert.EqualValues(t, modified.BsdiffAddBytes, modified.ReusedBytes)
+	assert.EqualValues(t, []int64{0}, modified.TargetIndices)
+	assert.True(t, modified.BsdiffAddBytes > modified.BsdiffCopyBytes)
+
+	var total int64
+	for _, fs := range stats.Files {
+		total += fs.ReusedBytes + fs.FreshBytes
+	}
+	assert.EqualValues(t, sourceContainer.Size, total)
+	assert.EqualValues(t, stats.ReusedBytes+stats.FreshBytes, total)
+
+	_, err = inspect.Inspect(context.Background(), seeksource.FromBytes([]byte{0x1, 0x2, 0x3, 0x4}), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package pwr
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/sha3"
+)
+
+// A ManifestInfo contains the hashes for all small-blocks of a given container,
+// as found in a wharf manifest file (.pwm)
+type ManifestInfo struct {
+	Container *tlc.Container
+	Algorithm HashAlgorithm
+	Groups    ManifestGroups
+
+	// BlockSize is the size of hashed blocks, 0 means the default BlockSize
+	BlockSize int64
+}
+
+// ManifestGroups maps file indices to the hashes of each of their blocks.
+// Empty files have no blocks, and thus no hashes.
+type ManifestGroups = map[int64][][]byte
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// HashManifestBlock returns the hash of a single block, using the given algorithm
+func HashManifestBlock(algorithm HashAlgorithm, data []byte) ([]byte, error) {
+	switch algorithm {
+	case HashAlgorithm_SHAKE128_32:
+		h := make([]byte, 32)
+		sha3.ShakeSum128(h, data)
+		return h, nil
+	case HashAlgorithm_CRC32C:
+		h := make([]byte, 4)
+		Endianness.PutUint32(h, crc32.Checksum(data, crc32cTable))
+		return h, nil
+	default:
+		return nil, errors.Errorf("unknown hash algorithm %s", algorithm.String())
+	}
+}
+
+// ComputeBlockAddress returns the path of a block in a content-addressed
+// block store, relative to the root of the store.
+func ComputeBlockAddress(algorithm HashAlgorithm, hash []byte, size int64) string {
+	return fmt.Sprintf("%s/%x/%d", strings.ToLower(algorithm.String()), hash, size)
+}
+
+// ManifestSettings controls how a manifest file is written
+type ManifestSettings struct {
+	// Compression used for the body of the manifest. Required.
+	Compression *CompressionSettings
+
+	// Algorithm used to hash each block
+	Algorithm HashAlgorithm
+
+	// BlockSize is the size of hashed blocks, 0 means the default BlockSize
+	BlockSize int64
+
+	// Consumer (optional) to report progress to
+	Consumer *state.Consumer
+}
+
+// WriteManifest hashes all blocks of all files in a given container, by reading
+// them from pool, and writes them as a wharf manifest file (.pwm) to manifestWriter.
+// Like ComputeSignatureToWriter, it closes the pool when it's done.
+func WriteManifest(ctx context.Context, container *tlc.Container, pool lake.Pool, settings *ManifestSettings, manifestWriter io.Writer) (err error) {
+	defer func() {
+		if pErr := pool.Close(); pErr != nil && err == nil {
+			err = errors.WithStack(pErr)
+		}
+	}()
+
+	if settings == nil || settings.Compression == nil {
+		return errors.New("No compression settings specified, bailing out")
+	}
+
+	err = ValidateBlockSize(settings.BlockSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	blockSize := ResolveBlockSize(settings.BlockSize)
+
+	consumer := settings.Consumer
+	if consumer == nil {
+		consumer = &state.Consumer{}
+	}
+
+	rawManifestWire := wire.NewWriteContext(manifestWriter)
+	err = rawManifestWire.WriteMagic(ManifestMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawManifestWire.WriteMessage(&ManifestHeader{
+		Compression: settings.Compression,
+		Algorithm:   settings.Algorithm,
+		BlockSize:   settings.BlockSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	manifestWire, err := CompressWire(rawManifestWire, settings.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = manifestWire.WriteMessage(container)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	buf := make([]byte, blockSize)
+	mbh := &ManifestBlockHash{}
+
+	for fileIndex, f := range container.Files {
+		consumer.ProgressLabel(f.Path)
+
+		reader, err := pool.GetReader(int64(fileIndex))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		numBlocks := ComputeNumBlocksFor(f.Size, blockSize)
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			select {
+			case <-ctx.Done():
+				return werrors.ErrCancelled
+			default:
+				// keep going!
+			}
+
+			block := buf[:ComputeBlockSizeFor(f.Size, blockIndex, blockSize)]
+			_, err = io.ReadFull(reader, block)
+			if err != nil {
+				return errors.Wrapf(err, "reading block %d of (%s)", blockIndex, f.Path)
+			}
+
+			mbh.Hash, err = HashManifestBlock(settings.Algorithm, block)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			err = manifestWire.WriteMessage(mbh)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if container.Size > 0 {
+				consumer.Progress(float64(f.Offset+blockIndex*blockSize+int64(len(block))) / float64(container.Size))
+			}
+		}
+	}
+
+	err = manifestWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads the hashes for all blocks of all files of a given container,
+// from a wharf manifest file.
+func ReadManifest(manifestReader savior.SeekSource) (*ManifestInfo, error) {
+	rawManifestWire := wire.NewReadContext(manifestReader)
+	err := rawManifestWire.ExpectMagic(ManifestMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := &ManifestHeader{}
+	err = rawManifestWire.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	blockSize := ResolveBlockSize(header.BlockSize)
+
+	manifestWire, err := DecompressWire(rawManifestWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	container := &tlc.Container{}
+	err = manifestWire.ReadMessage(container)
+	if err != nil {
+		if errors.Cause(err) == io.EOF {
+			// ok
+		} else {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	groups := make(ManifestGroups)
+	mbh := &ManifestBlockHash{}
+
+	for fileIndex, f := range container.Files {
+		numBlocks := ComputeNumBlocksFor(f.Size, blockSize)
+		hashes := make([][]byte, numBlocks)
+
+		for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+			mbh.Reset()
+			err = manifestWire.ReadMessage(mbh)
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading hash for block %d of (%s)", blockIndex, f.Path)
+			}
+
+			hashes[blockIndex] = append([]byte{}, mbh.Hash...)
+		}
+
+		groups[int64(fileIndex)] = hashes
+	}
+
+	manifest := &ManifestInfo{
+		Container: container,
+		Algorithm: header.Algorithm,
+		Groups:    groups,
+		BlockSize: blockSize,
+	}
+	return manifest, nil
+}
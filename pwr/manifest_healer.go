@@ -0,0 +1,348 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/headway/united"
+
+	"github.com/itchio/httpkit/eos"
+	"github.com/itchio/httpkit/eos/option"
+
+	"github.com/itchio/savior/seeksource"
+
+	"github.com/itchio/wharf/werrors"
+
+	"github.com/itchio/lake/tlc"
+
+	"github.com/pkg/errors"
+)
+
+// BlockStoreManifestName is the name of the manifest file found at
+// the root of a block store.
+const BlockStoreManifestName = "manifest.pwm"
+
+// A ManifestHealer can repair from a content-addressed block store (remote or local).
+// Unlike ArchiveHealer, it only fetches the blocks that are actually wounded.
+//
+// Blocks are looked up relative to StorePath, at the address returned
+// by ComputeBlockAddress.
+type ManifestHealer struct {
+	// the directory we should heal
+	Target string
+
+	// an eos path for the root of the block store
+	StorePath string
+
+	// Manifest (optional) describes the blocks of the container we're healing.
+	// If nil, it's read from BlockStoreManifestName at the root of the store.
+	Manifest *ManifestInfo
+
+	// A consumer to report progress to
+	Consumer *state.Consumer
+
+	// internal
+	progressMutex  sync.Mutex
+	totalCorrupted int64
+	totalHealed    int64
+	totalHealthy   int64
+	hasWounds      bool
+
+	container *tlc.Container
+	buf       []byte
+
+	lockMap LockMap
+}
+
+var _ Healer = (*ManifestHealer)(nil)
+
+// Do starts receiving from the wounds channel and healing
+func (mh *ManifestHealer) Do(parentCtx context.Context, container *tlc.Container, wounds chan *Wound) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	mh.container = container
+
+	err := mh.loadManifest()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fileWounds := make(chan *Wound, 1024)
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- mh.heal(ctx, fileWounds)
+	}()
+
+	processWound := func(wound *Wound) error {
+		if !wound.Healthy() {
+			mh.totalCorrupted += wound.Size()
+			mh.hasWounds = true
+		}
+
+		switch wound.Kind {
+		case WoundKind_DIR:
+			return healDirWound(mh.Consumer, mh.Target, container, wound)
+
+		case WoundKind_SYMLINK:
+			return healSymlinkWound(mh.Consumer, mh.Target, container, wound)
+
+		case WoundKind_FILE:
+			mh.Consumer.ProgressLabel(container.Files[wound.Index].Path)
+
+			select {
+			case err := <-errs:
+				return errors.WithStack(err)
+			case fileWounds <- wound:
+				// queued for work!
+			}
+
+		case WoundKind_CLOSED_FILE:
+			mh.progressMutex.Lock()
+			mh.totalHealthy += wound.Size()
+			mh.progressMutex.Unlock()
+			mh.updateProgress()
+
+		default:
+			return fmt.Errorf("Unknown wound kind: %d", wound.Kind)
+		}
+
+		return nil
+	}
+
+	for wound := range wounds {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		err := processWound(wound)
+		if err != nil {
+			return err
+		}
+	}
+
+	// queued everything
+	close(fileWounds)
+
+	err = <-errs
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (mh *ManifestHealer) loadManifest() error {
+	if mh.Manifest == nil {
+		file, err := eos.Open(mh.storePath(BlockStoreManifestName), option.WithConsumer(mh.Consumer))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer file.Close()
+
+		source := seeksource.FromFile(file)
+		_, err = source.Resume(nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		mh.Manifest, err = ReadManifest(source)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	mc := mh.Manifest.Container
+	if len(mc.Files) != len(mh.container.Files) {
+		return errors.Errorf("manifest has %d files, but container has %d", len(mc.Files), len(mh.container.Files))
+	}
+
+	for i, f := range mh.container.Files {
+		if mc.Files[i].Size != f.Size {
+			return errors.Errorf("(%s) is %s in manifest, but %s in container",
+				f.Path, united.FormatBytes(mc.Files[i].Size), united.FormatBytes(f.Size))
+		}
+	}
+
+	return nil
+}
+
+func (mh *ManifestHealer) blockSize() int64 {
+	return ResolveBlockSize(mh.Manifest.BlockSize)
+}
+
+func (mh *ManifestHealer) storePath(address string) string {
+	return strings.TrimSuffix(mh.StorePath, "/") + "/" + address
+}
+
+func (mh *ManifestHealer) heal(ctx context.Context, fileWounds chan *Wound) error {
+	unlocked := make(map[int64]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// something else stopped the healing
+			return nil
+		case wound, ok := <-fileWounds:
+			if !ok {
+				// no more wounds to heal
+				return nil
+			}
+
+			if mh.lockMap != nil && !unlocked[wound.Index] {
+				select {
+				case <-mh.lockMap[wound.Index]:
+					unlocked[wound.Index] = true
+				case <-ctx.Done():
+					return werrors.ErrCancelled
+				}
+			}
+
+			err := mh.healOne(ctx, wound)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func (mh *ManifestHealer) healOne(ctx context.Context, wound *Wound) error {
+	f := mh.container.Files[wound.Index]
+
+	mh.Consumer.Debugf("Healing (%s) %s into %s", f.Path, united.FormatBytes(wound.Size()), united.FormatBytes(wound.Start))
+
+	writer, err := openFileWoundTarget(mh.Consumer, mh.Target, mh.container, wound)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer writer.Close()
+
+	end := wound.End
+	if end > f.Size {
+		end = f.Size
+	}
+	if wound.Start >= end {
+		return nil
+	}
+
+	blockSize := mh.blockSize()
+	firstBlock := wound.Start / blockSize
+	lastBlock := (end - 1) / blockSize
+
+	for blockIndex := firstBlock; blockIndex <= lastBlock; blockIndex++ {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		data, err := mh.fetchBlock(wound.Index, blockIndex)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		_, err = writer.WriteAt(data, blockIndex*blockSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		mh.progressMutex.Lock()
+		mh.totalHealed += int64(len(data))
+		mh.progressMutex.Unlock()
+		mh.updateProgress()
+	}
+
+	return nil
+}
+
+// fetchBlock reads a block from the store and makes sure it has the hash
+// listed in the manifest. The returned slice is only valid until the next call.
+func (mh *ManifestHealer) fetchBlock(fileIndex int64, blockIndex int64) ([]byte, error) {
+	f := mh.container.Files[fileIndex]
+	hashes := mh.Manifest.Groups[fileIndex]
+	if blockIndex >= int64(len(hashes)) {
+		return nil, errors.Errorf("(%s): manifest has %d blocks, tried to look up block %d", f.Path, len(hashes), blockIndex)
+	}
+
+	expectedHash := hashes[blockIndex]
+	blockSize := mh.blockSize()
+	size := ComputeBlockSizeFor(f.Size, blockIndex, blockSize)
+	address := ComputeBlockAddress(mh.Manifest.Algorithm, expectedHash, size)
+
+	file, err := eos.Open(mh.storePath(address), option.WithConsumer(mh.Consumer))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	if int64(len(mh.buf)) < blockSize {
+		mh.buf = make([]byte, blockSize)
+	}
+	data := mh.buf[:size]
+
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading block %s", address)
+	}
+
+	hash, err := HashManifestBlock(mh.Manifest.Algorithm, data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if !bytes.Equal(hash, expectedHash) {
+		return nil, errors.Errorf("block %s: expected hash %x, got %x", address, expectedHash, hash)
+	}
+
+	return data, nil
+}
+
+// HasWounds returns true if the healer ever received wounds
+func (mh *ManifestHealer) HasWounds() bool {
+	return mh.hasWounds
+}
+
+// TotalCorrupted returns the total amount of corrupted data
+// contained in the wounds this healer has received. Dirs
+// and symlink wounds have 0-size, use HasWounds to know
+// if there were any wounds at all.
+func (mh *ManifestHealer) TotalCorrupted() int64 {
+	return mh.totalCorrupted
+}
+
+// TotalHealed returns the total amount of data written to disk
+// to repair the wounds. Since ManifestHealer works with whole
+// blocks, this may be slightly more than TotalCorrupted.
+func (mh *ManifestHealer) TotalHealed() int64 {
+	return mh.totalHealed
+}
+
+// SetConsumer gives this healer a consumer to report progress to
+func (mh *ManifestHealer) SetConsumer(consumer *state.Consumer) {
+	mh.Consumer = consumer
+}
+
+func (mh *ManifestHealer) updateProgress() {
+	if mh.Consumer == nil {
+		return
+	}
+
+	mh.progressMutex.Lock()
+	progress := float64(mh.totalHealthy+mh.totalHealed) / float64(mh.container.Size)
+	mh.Consumer.Progress(progress)
+	mh.progressMutex.Unlock()
+}
+
+func (mh *ManifestHealer) SetLockMap(lockMap LockMap) {
+	mh.lockMap = lockMap
+}
@@ -0,0 +1,92 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Manifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	wtest.Must(t, err)
+	defer os.RemoveAll(dir)
+
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "big", Seed: 0x1, Size: BlockSize*4 + 17},
+			{Path: "sub/exact", Seed: 0x2, Size: BlockSize * 2},
+			{Path: "sub/empty", Size: -1},
+		},
+	})
+
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	for _, algorithm := range []HashAlgorithm{HashAlgorithm_SHAKE128_32, HashAlgorithm_CRC32C} {
+		t.Logf("Using %s", algorithm.String())
+
+		var lastProgress float64
+		consumer := &state.Consumer{
+			OnProgress: func(progress float64) {
+				lastProgress = progress
+			},
+		}
+
+		buf := new(bytes.Buffer)
+		wtest.Must(t, WriteManifest(context.Background(), container, fspool.New(container, dir), &ManifestSettings{
+			Compression: &CompressionSettings{},
+			Algorithm:   algorithm,
+			Consumer:    consumer,
+		}, buf))
+		assert.EqualValues(t, 1.0, lastProgress)
+
+		source := seeksource.FromBytes(buf.Bytes())
+		_, err = source.Resume(nil)
+		wtest.Must(t, err)
+
+		manifest, err := ReadManifest(source)
+		wtest.Must(t, err)
+
+		assert.EqualValues(t, algorithm, manifest.Algorithm)
+		assert.NoError(t, manifest.Container.EnsureEqual(container))
+
+		for fileIndex, f := range container.Files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+			wtest.Must(t, err)
+
+			hashes := manifest.Groups[int64(fileIndex)]
+			assert.EqualValues(t, ComputeNumBlocks(f.Size), len(hashes))
+			if f.Path == "sub/empty" {
+				assert.EqualValues(t, 0, len(hashes))
+			}
+
+			for blockIndex, hash := range hashes {
+				start := int64(blockIndex) * BlockSize
+				expected, err := HashManifestBlock(algorithm, data[start:start+ComputeBlockSize(f.Size, int64(blockIndex))])
+				wtest.Must(t, err)
+				assert.EqualValues(t, expected, hash)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = WriteManifest(ctx, container, fspool.New(container, dir), &ManifestSettings{
+		Compression: &CompressionSettings{},
+	}, ioutil.Discard)
+	assert.Equal(t, werrors.ErrCancelled, err)
+
+	err = WriteManifest(context.Background(), container, fspool.New(container, dir), &ManifestSettings{}, ioutil.Discard)
+	assert.Error(t, err)
+}
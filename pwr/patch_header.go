@@ -0,0 +1,86 @@
+package pwr
+
+import (
+	"fmt"
+
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupportedPatchFeature is returned when a patch needs
+// something this version of wharf can't do
+var ErrUnsupportedPatchFeature = fmt.Errorf("patch needs an unsupported feature")
+
+// supportedPatchFeatures lists the features this version of wharf can apply
+var supportedPatchFeatures = map[PatchFeature]bool{
+	PatchFeature_MULTI_TARGET_BSDIFF: true,
+	PatchFeature_CUSTOM_BLOCK_SIZE:   true,
+}
+
+// HasFeature returns true if the patch header lists feature
+func (ph *PatchHeader) HasFeature(feature PatchFeature) bool {
+	for _, f := range ph.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadPatchHeader reads the magic number and header of a patch, and
+// makes sure we support all the features it lists.
+func ReadPatchHeader(rctx *wire.ReadContext) (*PatchHeader, error) {
+	magic, err := rctx.ReadMagic()
+	if err != nil {
+		return nil, err
+	}
+
+	if magic != PatchMagic && magic != FeaturePatchMagic {
+		return nil, errors.WithStack(wire.ErrFormat)
+	}
+
+	header := &PatchHeader{}
+	err = rctx.ReadMessage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if (magic == FeaturePatchMagic) != (len(header.Features) > 0) {
+		return nil, errors.Errorf("patch header lists %d features, but magic is %x", len(header.Features), magic)
+	}
+
+	for _, f := range header.Features {
+		if !supportedPatchFeatures[f] {
+			return nil, errors.Wrapf(ErrUnsupportedPatchFeature, "feature %s", f)
+		}
+	}
+
+	return header, nil
+}
+
+// WritePatchHeader writes the magic number that goes with the
+// features of a patch header, then the header itself. Headers with
+// a custom block size get the CUSTOM_BLOCK_SIZE feature.
+func WritePatchHeader(wctx *wire.WriteContext, header *PatchHeader) error {
+	if header.BlockSize != 0 && !header.HasFeature(PatchFeature_CUSTOM_BLOCK_SIZE) {
+		// patchers that only know about 64KB blocks would corrupt their output
+		header.Features = append(header.Features, PatchFeature_CUSTOM_BLOCK_SIZE)
+	}
+
+	magic := PatchMagic
+	if len(header.Features) > 0 {
+		magic = FeaturePatchMagic
+	}
+
+	err := wctx.WriteMagic(magic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
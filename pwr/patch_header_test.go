@@ -0,0 +1,70 @@
+package pwr
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PatchHeaderFeatures(t *testing.T) {
+	roundtrip := func(magic int32, header *PatchHeader) (*PatchHeader, error) {
+		buf := new(bytes.Buffer)
+		wctx := wire.NewWriteContext(buf)
+		wtest.Must(t, wctx.WriteMagic(magic))
+		wtest.Must(t, wctx.WriteMessage(header))
+		wtest.Must(t, wctx.Close())
+
+		rctx := wire.NewReadContext(seeksource.FromBytes(buf.Bytes()))
+		wtest.Must(t, rctx.Resume(nil))
+		return ReadPatchHeader(rctx)
+	}
+
+	header, err := roundtrip(PatchMagic, &PatchHeader{})
+	wtest.Must(t, err)
+	assert.False(t, header.HasFeature(PatchFeature_MULTI_TARGET_BSDIFF))
+
+	header, err = roundtrip(FeaturePatchMagic, &PatchHeader{
+		Features: []PatchFeature{PatchFeature_MULTI_TARGET_BSDIFF},
+	})
+	wtest.Must(t, err)
+	assert.True(t, header.HasFeature(PatchFeature_MULTI_TARGET_BSDIFF))
+
+	_, err = roundtrip(FeaturePatchMagic, &PatchHeader{
+		Features: []PatchFeature{PatchFeature(42)},
+	})
+	assert.Equal(t, ErrUnsupportedPatchFeature, errors.Cause(err))
+
+	// features and magic have to agree
+	_, err = roundtrip(PatchMagic, &PatchHeader{
+		Features: []PatchFeature{PatchFeature_MULTI_TARGET_BSDIFF},
+	})
+	assert.Error(t, err)
+
+	_, err = roundtrip(FeaturePatchMagic, &PatchHeader{})
+	assert.Error(t, err)
+
+	_, err = roundtrip(SignatureMagic, &PatchHeader{})
+	assert.Equal(t, wire.ErrFormat, errors.Cause(err))
+
+	// custom block sizes are a feature of their own
+	buf := new(bytes.Buffer)
+	wctx := wire.NewWriteContext(buf)
+	wtest.Must(t, WritePatchHeader(wctx, &PatchHeader{BlockSize: MinBlockSize}))
+	wtest.Must(t, wctx.Close())
+
+	rctx := wire.NewReadContext(seeksource.FromBytes(buf.Bytes()))
+	wtest.Must(t, rctx.Resume(nil))
+	assert.Equal(t, wire.ErrFormat, errors.Cause(rctx.ExpectMagic(PatchMagic)))
+
+	rctx = wire.NewReadContext(seeksource.FromBytes(buf.Bytes()))
+	wtest.Must(t, rctx.Resume(nil))
+	header, err = ReadPatchHeader(rctx)
+	wtest.Must(t, err)
+	assert.True(t, header.HasFeature(PatchFeature_CUSTOM_BLOCK_SIZE))
+	assert.EqualValues(t, MinBlockSize, header.BlockSize)
+}
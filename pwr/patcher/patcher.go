@@ -18,8 +18,9 @@ import (
 )
 
 type savingPatcher struct {
-	rctx     *wire.ReadContext
-	consumer *state.Consumer
+	patchReader savior.SeekSource
+	rctx        *wire.ReadContext
+	consumer    *state.Consumer
 
 	sc SaveConsumer
 
@@ -37,10 +38,48 @@ type savingPatcher struct {
 
 var _ Patcher = (*savingPatcher)(nil)
 
+// DefaultMaxMessageSize is the default for Params.MaxMessageSize. bsdiff
+// controls are kept under bsdiff.MaxMessageSize, but the containers of
+// large builds can be bigger.
+const DefaultMaxMessageSize = 16 * bsdiff.MaxMessageSize
+
+// Params configures a patcher, see NewWithParams
+type Params struct {
+	PatchReader savior.SeekSource
+	Consumer    *state.Consumer
+
+	// TrustedKeys (optional) is the key set the patch must be signed with.
+	// Unsigned or mis-signed patches are refused by New, before anything
+	// is applied, see pwr.VerifySource.
+	TrustedKeys *pwr.KeySet
+
+	// MaxMessageSize (optional) is the largest message read from the patch,
+	// so that patches can't make us allocate without limit. 0 means
+	// DefaultMaxMessageSize. It's never raised by what the patch says.
+	//
+	// Patches with a message larger than that are refused, which patchers
+	// used not to do. Builds with millions of files may have larger
+	// containers, and patches made before bsdiff controls were split can
+	// hold a control as large as the file it patches: applying those
+	// needs a MaxMessageSize that fits them.
+	MaxMessageSize int64
+}
+
 // New reads the patch header and returns a patcher that
 // is ready to Resume, either from the start (nil checkpoint)
 // or partway through the patch
 func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, error) {
+	return NewWithParams(Params{
+		PatchReader: patchReader,
+		Consumer:    consumer,
+	})
+}
+
+// NewWithParams is like New, with more options
+func NewWithParams(params Params) (Patcher, error) {
+	patchReader := params.PatchReader
+	consumer := params.Consumer
+
 	// Reading the header & both containers is done even
 	// when we resume patching partway through (from a checkpoint)
 	// Downside: more network usage when resuming
@@ -55,19 +94,30 @@ func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, erro
 		return nil, errors.Errorf("expected source to resume at 0, got %d", startOffset)
 	}
 
+	// Refuse unsigned or mis-signed patches if we have trusted keys.
+	// This reads the whole patch once more, but nothing is written
+	// from a patch we can't trust.
+	patchReader, err = pwr.VerifySource(patchReader, params.TrustedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	maxMessageSize := params.MaxMessageSize
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+
 	rawWire := wire.NewReadContext(patchReader)
+	rawWire.SetMaxMessageSize(maxMessageSize)
 
-	// Ensure magic
+	// Read header & decompress if needed
 
-	err = rawWire.ExpectMagic(pwr.PatchMagic)
+	header, err := pwr.ReadPatchHeader(rawWire)
 	if err != nil {
 		return nil, err
 	}
 
-	// Read header & decompress if needed
-
-	header := &pwr.PatchHeader{}
-	err = rawWire.ReadMessage(header)
+	err = pwr.ValidateBlockSize(header.BlockSize)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +126,7 @@ func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, erro
 	if err != nil {
 		return nil, err
 	}
+	rctx.SetMaxMessageSize(maxMessageSize)
 
 	// Read both containers
 
@@ -108,8 +159,9 @@ func New(patchReader savior.SeekSource, consumer *state.Consumer) (Patcher, erro
 	}
 
 	sp := &savingPatcher{
-		rctx:     rctx,
-		consumer: consumer,
+		patchReader: patchReader,
+		rctx:        rctx,
+		consumer:    consumer,
 
 		targetContainer: targetContainer,
 		sourceContainer: sourceContainer,
@@ -169,7 +221,8 @@ func (sp *savingPatcher) Resume(c *Checkpoint, targetPool lake.Pool, bwl bowl.Bo
 			}
 
 			switch sh.Type {
-			case pwr.SyncHeader_RSYNC:
+			case pwr.SyncHeader_RSYNC, pwr.SyncHeader_CDC:
+				// content-defined chunk ops are applied just like rsync ops
 				c.FileKind = FileKindRsync
 			case pwr.SyncHeader_BSDIFF:
 				c.FileKind = FileKindBsdiff
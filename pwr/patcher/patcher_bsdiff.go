@@ -19,13 +19,14 @@ func (sp *savingPatcher) processBsdiff(c *Checkpoint, targetPool lake.Pool, sh *
 
 	var old io.ReadSeeker
 	var oldOffset int64
-	var targetIndex int64
+	bh := &pwr.BsdiffHeader{}
 
 	if c.BsdiffCheckpoint != nil {
-		targetIndex = c.BsdiffCheckpoint.TargetIndex
+		bh.TargetIndex = c.BsdiffCheckpoint.TargetIndex
+		bh.ExtraTargetIndices = c.BsdiffCheckpoint.ExtraTargetIndices
 		oldOffset = c.BsdiffCheckpoint.OldOffset
 
-		old, err = targetPool.GetReadSeeker(targetIndex)
+		old, err = pwr.OpenBsdiffTargets(targetPool, pwr.BsdiffTargetIndices(bh))
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -57,15 +58,16 @@ func (sp *savingPatcher) processBsdiff(c *Checkpoint, targetPool lake.Pool, sh *
 		// starting from the beginning!
 		var err error
 
-		bh := &pwr.BsdiffHeader{}
 		err = sp.rctx.ReadMessage(bh)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
-		targetIndex = bh.TargetIndex
+		if len(bh.ExtraTargetIndices) > 0 && !sp.header.HasFeature(pwr.PatchFeature_MULTI_TARGET_BSDIFF) {
+			return errors.Errorf("Malformed patch, file %d has extra bsdiff targets but the header doesn't list %s", sh.FileIndex, pwr.PatchFeature_MULTI_TARGET_BSDIFF)
+		}
 
-		old, err = targetPool.GetReadSeeker(targetIndex)
+		old, err = pwr.OpenBsdiffTargets(targetPool, pwr.BsdiffTargetIndices(bh))
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -129,9 +131,10 @@ func (sp *savingPatcher) processBsdiff(c *Checkpoint, targetPool lake.Pool, sh *
 					MessageCheckpoint: messageCheckpoint,
 					BowlCheckpoint:    bowlCheckpoint,
 					BsdiffCheckpoint: &BsdiffCheckpoint{
-						WriterCheckpoint: writerCheckpoint,
-						OldOffset:        ipc.OldOffset,
-						TargetIndex:      targetIndex,
+						WriterCheckpoint:   writerCheckpoint,
+						OldOffset:          ipc.OldOffset,
+						TargetIndex:        bh.TargetIndex,
+						ExtraTargetIndices: bh.ExtraTargetIndices,
 					},
 				}
 				action, err := sp.sc.Save(checkpoint)
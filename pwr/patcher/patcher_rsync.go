@@ -111,7 +111,7 @@ func (sp *savingPatcher) processRsync(c *Checkpoint, targetPool lake.Pool, sh *p
 	}
 
 	if sp.rsyncCtx == nil {
-		sp.rsyncCtx = wsync.NewContext(int(pwr.BlockSize))
+		sp.rsyncCtx = wsync.NewContext(int(pwr.ResolveBlockSize(sp.header.BlockSize)))
 	}
 
 	if op == nil {
@@ -219,6 +219,13 @@ func makeWop(op *pwr.SyncOp) (wsync.Operation, error) {
 			BlockIndex: op.BlockIndex,
 			BlockSpan:  op.BlockSpan,
 		}, nil
+	case pwr.SyncOp_CHUNK_RANGE:
+		return wsync.Operation{
+			Type:      wsync.OpChunkRange,
+			FileIndex: op.FileIndex,
+			Offset:    op.Offset,
+			Size:      op.Size,
+		}, nil
 	case pwr.SyncOp_DATA:
 		return wsync.Operation{
 			Type: wsync.OpData,
@@ -230,7 +237,13 @@ func makeWop(op *pwr.SyncOp) (wsync.Operation, error) {
 }
 
 func (sp *savingPatcher) isFullFileOp(sh *pwr.SyncHeader, op *pwr.SyncOp) bool {
-	// only block range ops can be full-file ops
+	if op.Type == pwr.SyncOp_CHUNK_RANGE {
+		targetFile := sp.targetContainer.Files[op.FileIndex]
+		outputFile := sp.sourceContainer.Files[sh.FileIndex]
+		return op.Offset == 0 && op.Size == targetFile.Size && op.Size == outputFile.Size
+	}
+
+	// otherwise, only block range ops can be full-file ops
 	if op.Type != pwr.SyncOp_BLOCK_RANGE {
 		return false
 	}
@@ -248,7 +261,7 @@ func (sp *savingPatcher) isFullFileOp(sh *pwr.SyncHeader, op *pwr.SyncOp) bool {
 		return false
 	}
 
-	numOutputBlocks := pwr.ComputeNumBlocks(outputFile.Size)
+	numOutputBlocks := pwr.ComputeNumBlocksFor(outputFile.Size, pwr.ResolveBlockSize(sp.header.BlockSize))
 
 	// and it's gotta, well, span the full file
 	spansFullFile := op.BlockSpan == numOutputBlocks
@@ -3,10 +3,13 @@ package patcher_test
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -21,6 +24,7 @@ import (
 	"github.com/itchio/wharf/pwr/bowl"
 	"github.com/itchio/wharf/pwr/patcher"
 	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/wire"
 	"github.com/itchio/wharf/wtest"
 
 	"github.com/itchio/headway/state"
@@ -352,3 +356,455 @@ func (ep *explodingPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error) {
 func (ep *explodingPool) Close() error {
 	return nil
 }
+
+func Test_ContentDefinedChunking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patcher-cdc")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	bigData := make([]byte, 4*1024*1024)
+	_, err = rand.New(rand.NewSource(0xcdc)).Read(bigData)
+	wtest.Must(t, err)
+	movedData := bigData[:300*1024]
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.Must(t, os.MkdirAll(v1, 0755))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(v1, "big.pak"), bigData, 0644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(v1, "old-name"), movedData, 0644))
+
+	// insert some bytes near the start, which shifts every fixed-size block
+	insertedData := append(append(append([]byte{}, bigData[:5000]...), []byte("new header")...), bigData[5000:]...)
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.Must(t, os.MkdirAll(v2, 0755))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(v2, "big.pak"), insertedData, 0644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(v2, "new-name"), movedData, 0644))
+	wtest.Must(t, ioutil.WriteFile(filepath.Join(v2, "empty"), nil, 0644))
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	chunker := pwr.DefaultChunkerSettings()
+	targetSignature, err := pwr.ComputeChunkSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), chunker, nil)
+	wtest.Must(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	signatureBuffer := new(bytes.Buffer)
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+
+		Chunker: chunker,
+	}
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+	assert.True(t, dctx.FreshBytes < int64(4*wsync.DefaultChunkerParams.MaxSize), "fresh bytes: %d", dctx.FreshBytes)
+	assert.EqualValues(t, sourceContainer.Size, dctx.FreshBytes+dctx.ReusedBytes)
+
+	// the signature written along the patch can be used for the next one
+	signatureReader := seeksource.FromBytes(signatureBuffer.Bytes())
+	_, err = signatureReader.Resume(nil)
+	wtest.Must(t, err)
+	sigInfo, err := pwr.ReadSignature(context.Background(), signatureReader)
+	wtest.Must(t, err)
+	assert.EqualValues(t, chunker, sigInfo.Chunker)
+
+	sourceSignature, err := pwr.ComputeChunkSignature(context.Background(), sourceContainer, fspool.New(sourceContainer, v2), chunker, nil)
+	wtest.Must(t, err)
+	assert.EqualValues(t, sourceSignature, sigInfo.Hashes)
+
+	fixedSignature, err := pwr.ComputeSignature(context.Background(), sourceContainer, fspool.New(sourceContainer, v2), nil)
+	wtest.Must(t, err)
+	fixedSigInfo := &pwr.SignatureInfo{
+		Container: sourceContainer,
+		Hashes:    fixedSignature,
+	}
+
+	optimizedPatchBuffer := new(bytes.Buffer)
+	rc, err := rediff.NewContext(rediff.Params{
+		PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+	})
+	wtest.Must(t, err)
+	wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+		TargetPool:  fspool.New(targetContainer, v1),
+		SourcePool:  fspool.New(sourceContainer, v2),
+		PatchWriter: optimizedPatchBuffer,
+	}))
+
+	for _, patchBytes := range [][]byte{patchBuffer.Bytes(), optimizedPatchBuffer.Bytes()} {
+		out := filepath.Join(dir, "out")
+		wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+			PatchReader: seeksource.FromBytes(patchBytes),
+			TargetDir:   v1,
+			OutputDir:   out,
+		}))
+		wtest.Must(t, pwr.AssertValid(out, fixedSigInfo))
+		wtest.Must(t, screw.RemoveAll(out))
+	}
+}
+
+func Test_CustomBlockSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patcher-blocksize")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1, Size: wtest.BlockSize*40 + 14},
+			{Path: "file-2", Seed: 0x2, Size: wtest.BlockSize * 3},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "subdir/file-1", Seed: 0x1, Size: wtest.BlockSize*45 + 14, Bsmods: []wtest.Bsmod{
+				{Interval: wtest.BlockSize*4 + 3, Delta: 0x4},
+			}},
+			{Path: "file-2-renamed", Seed: 0x2, Size: wtest.BlockSize * 3},
+			{Path: "empty", Size: -1},
+		},
+	})
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	// smaller blocks should survive more of the modifications
+	var freshBytes []int64
+	for _, blockSize := range []int64{16 * 1024, 1024 * 1024} {
+		t.Logf("Using %d-byte blocks", blockSize)
+
+		targetSignature, err := pwr.ComputeSignatureWithBlockSize(context.Background(), targetContainer, fspool.New(targetContainer, v1), blockSize, nil)
+		wtest.Must(t, err)
+
+		patchBuffer := new(bytes.Buffer)
+		signatureBuffer := new(bytes.Buffer)
+		dctx := &pwr.DiffContext{
+			Compression: &pwr.CompressionSettings{},
+
+			SourceContainer: sourceContainer,
+			Pool:            fspool.New(sourceContainer, v2),
+
+			TargetContainer: targetContainer,
+			TargetSignature: targetSignature,
+
+			BlockSize: blockSize,
+		}
+		wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, signatureBuffer))
+		freshBytes = append(freshBytes, dctx.FreshBytes)
+
+		signatureReader := seeksource.FromBytes(signatureBuffer.Bytes())
+		_, err = signatureReader.Resume(nil)
+		wtest.Must(t, err)
+		sigInfo, err := pwr.ReadSignature(context.Background(), signatureReader)
+		wtest.Must(t, err)
+		assert.EqualValues(t, blockSize, sigInfo.BlockSize)
+
+		optimizedPatchBuffer := new(bytes.Buffer)
+		rc, err := rediff.NewContext(rediff.Params{
+			PatchReader: seeksource.FromBytes(patchBuffer.Bytes()),
+		})
+		wtest.Must(t, err)
+		wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+			TargetPool:  fspool.New(targetContainer, v1),
+			SourcePool:  fspool.New(sourceContainer, v2),
+			PatchWriter: optimizedPatchBuffer,
+		}))
+
+		// older versions only know about 64KB blocks, and must refuse these
+		expectMagic := func(data []byte, magic int32) error {
+			rctx := wire.NewReadContext(seeksource.FromBytes(data))
+			wtest.Must(t, rctx.Resume(nil))
+			return rctx.ExpectMagic(magic)
+		}
+		assert.Equal(t, wire.ErrFormat, errors.Cause(expectMagic(signatureBuffer.Bytes(), pwr.SignatureMagic)))
+
+		for _, patchBytes := range [][]byte{patchBuffer.Bytes(), optimizedPatchBuffer.Bytes()} {
+			assert.Equal(t, wire.ErrFormat, errors.Cause(expectMagic(patchBytes, pwr.PatchMagic)))
+
+			out := filepath.Join(dir, "out")
+			wtest.Must(t, patcher.PatchFresh(patcher.PatchFreshParams{
+				PatchReader: seeksource.FromBytes(patchBytes),
+				TargetDir:   v1,
+				OutputDir:   out,
+			}))
+			wtest.Must(t, pwr.AssertValid(out, sigInfo))
+
+			// corrupting a single byte should be caught with the custom block size
+			corruptedPath := filepath.Join(out, "subdir", "file-1")
+			data, err := ioutil.ReadFile(corruptedPath)
+			wtest.Must(t, err)
+			data[blockSize+12] ^= 0xff
+			wtest.Must(t, ioutil.WriteFile(corruptedPath, data, 0644))
+			assert.Error(t, pwr.AssertValid(out, sigInfo))
+
+			wtest.Must(t, screw.RemoveAll(out))
+		}
+	}
+
+	assert.True(t, freshBytes[0] < freshBytes[1], "fresh bytes: %v", freshBytes)
+}
+
+func Test_InvalidBlockSize(t *testing.T) {
+	dctx := &pwr.DiffContext{
+		Compression:     &pwr.CompressionSettings{},
+		SourceContainer: &tlc.Container{},
+		TargetContainer: &tlc.Container{},
+		BlockSize:       pwr.MaxBlockSize * 2,
+	}
+	assert.Error(t, dctx.WritePatch(context.Background(), new(bytes.Buffer), new(bytes.Buffer)))
+}
+
+func Test_AuthenticatedPatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patcher-auth")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: wtest.BlockSize*5 + 3},
+		},
+	})
+
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: wtest.BlockSize*6 + 3, Bsmods: []wtest.Bsmod{
+				{Interval: wtest.BlockSize*2 + 1, Delta: 0x3},
+			}},
+		},
+	})
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), nil)
+	wtest.Must(t, err)
+
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x7}, ed25519.SeedSize))
+
+	patchBuffer := new(bytes.Buffer)
+	patchWriter := pwr.NewSigningWriter(patchBuffer, key)
+
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_BROTLI,
+			Quality:   1,
+		},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchWriter, ioutil.Discard))
+	wtest.Must(t, patchWriter.WriteTrailer())
+
+	signedPatch := patchBuffer.Bytes()
+	_, payloadSize, err := pwr.ReadAuthTrailer(seeksource.FromBytes(signedPatch))
+	wtest.Must(t, err)
+	unsignedPatch := signedPatch[:payloadSize]
+
+	tamperedPatch := append([]byte{}, signedPatch...)
+	tamperedPatch[payloadSize-10] ^= 0xff
+
+	applyPatch := func(patch []byte, trustedKeys *pwr.KeySet) error {
+		out := filepath.Join(dir, "out")
+		defer screw.RemoveAll(out)
+
+		err := patcher.PatchFresh(patcher.PatchFreshParams{
+			PatchReader: seeksource.FromBytes(patch),
+			TargetDir:   v1,
+			OutputDir:   out,
+			TrustedKeys: trustedKeys,
+		})
+		if err != nil {
+			return err
+		}
+		return pwr.AssertValid(out, &pwr.SignatureInfo{Container: sourceContainer, Hashes: mustSignature(t, sourceContainer, v2)})
+	}
+
+	// without trusted keys, the trailer is ignored
+	wtest.Must(t, applyPatch(signedPatch, nil))
+	wtest.Must(t, applyPatch(unsignedPatch, nil))
+
+	ks := pwr.NewKeySet(key.Public().(ed25519.PublicKey))
+	wtest.Must(t, applyPatch(signedPatch, ks))
+	assert.Equal(t, pwr.ErrUnsigned, errors.Cause(applyPatch(unsignedPatch, ks)))
+	assert.Equal(t, pwr.ErrBadAuthSignature, errors.Cause(applyPatch(tamperedPatch, ks)))
+
+	// the patch is authenticated every time a patcher is made for it,
+	// before anything is applied
+	applyPatchWithSaves := func(patch []byte) (int, error) {
+		out := filepath.Join(dir, "out")
+		defer screw.RemoveAll(out)
+
+		var checkpoint *patcher.Checkpoint
+		numCheckpoints := 0
+		for {
+			p, err := patcher.NewWithParams(patcher.Params{
+				PatchReader: seeksource.FromBytes(patch),
+				TrustedKeys: ks,
+			})
+			if err != nil {
+				return numCheckpoints, err
+			}
+
+			var saved *patcher.Checkpoint
+			p.SetSaveConsumer(&patcherSaveConsumer{
+				shouldSave: func() bool {
+					return true
+				},
+				save: func(c *patcher.Checkpoint) (patcher.AfterSaveAction, error) {
+					saved = c
+					return patcher.AfterSaveStop, nil
+				},
+			})
+
+			targetPool := fspool.New(p.GetTargetContainer(), v1)
+			b, err := bowl.NewFreshBowl(bowl.FreshBowlParams{
+				SourceContainer: p.GetSourceContainer(),
+				TargetContainer: p.GetTargetContainer(),
+				TargetPool:      targetPool,
+				OutputFolder:    out,
+			})
+			wtest.Must(t, err)
+
+			err = p.Resume(checkpoint, targetPool, b)
+			if errors.Cause(err) == patcher.ErrStop {
+				numCheckpoints++
+
+				checkpointBuf := new(bytes.Buffer)
+				wtest.Must(t, gob.NewEncoder(checkpointBuf).Encode(saved))
+				checkpoint = &patcher.Checkpoint{}
+				wtest.Must(t, gob.NewDecoder(checkpointBuf).Decode(checkpoint))
+				continue
+			}
+			if err != nil {
+				return numCheckpoints, err
+			}
+
+			wtest.Must(t, b.Commit())
+			return numCheckpoints, pwr.AssertValid(out, &pwr.SignatureInfo{Container: sourceContainer, Hashes: mustSignature(t, sourceContainer, v2)})
+		}
+	}
+
+	numCheckpoints, err := applyPatchWithSaves(signedPatch)
+	wtest.Must(t, err)
+	assert.True(t, numCheckpoints > 0, "had at least one checkpoint")
+
+	numCheckpoints, err = applyPatchWithSaves(tamperedPatch)
+	assert.Equal(t, pwr.ErrBadAuthSignature, errors.Cause(err))
+	assert.EqualValues(t, 0, numCheckpoints, "nothing applied from a mis-signed patch")
+
+	_, err = patcher.NewWithParams(patcher.Params{
+		PatchReader: seeksource.FromBytes(tamperedPatch),
+		TrustedKeys: ks,
+	})
+	assert.Equal(t, pwr.ErrBadAuthSignature, errors.Cause(err))
+
+	_, err = rediff.NewContext(rediff.Params{
+		PatchReader: seeksource.FromBytes(signedPatch),
+		TrustedKeys: ks,
+	})
+	wtest.Must(t, err)
+
+	_, err = rediff.NewContext(rediff.Params{
+		PatchReader: seeksource.FromBytes(unsignedPatch),
+		TrustedKeys: ks,
+	})
+	assert.Equal(t, pwr.ErrUnsigned, errors.Cause(err))
+
+	_, err = rediff.NewContext(rediff.Params{
+		PatchReader: seeksource.FromBytes(tamperedPatch),
+		TrustedKeys: ks,
+	})
+	assert.Equal(t, pwr.ErrBadAuthSignature, errors.Cause(err))
+}
+
+func Test_MaxMessageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patcher-maxmessagesize")
+	wtest.Must(t, err)
+	defer screw.RemoveAll(dir)
+
+	v1 := filepath.Join(dir, "v1")
+	wtest.MakeTestDir(t, v1, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: wtest.BlockSize * 2},
+		},
+	})
+
+	// fresh data goes in a data op larger than our limit
+	v2 := filepath.Join(dir, "v2")
+	wtest.MakeTestDir(t, v2, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file", Seed: 0x1, Size: wtest.BlockSize * 2},
+			{Path: "fresh", Seed: 0x2, Size: wtest.BlockSize * 4},
+		},
+	})
+
+	targetContainer, err := tlc.WalkAny(v1, tlc.WalkOpts{})
+	wtest.Must(t, err)
+	sourceContainer, err := tlc.WalkAny(v2, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	targetSignature, err := pwr.ComputeSignature(context.Background(), targetContainer, fspool.New(targetContainer, v1), nil)
+	wtest.Must(t, err)
+
+	patchBuffer := new(bytes.Buffer)
+	dctx := &pwr.DiffContext{
+		Compression: &pwr.CompressionSettings{
+			Algorithm: pwr.CompressionAlgorithm_NONE,
+		},
+
+		SourceContainer: sourceContainer,
+		Pool:            fspool.New(sourceContainer, v2),
+
+		TargetContainer: targetContainer,
+		TargetSignature: targetSignature,
+	}
+	wtest.Must(t, dctx.WritePatch(context.Background(), patchBuffer, ioutil.Discard))
+
+	applyPatch := func(maxMessageSize int64) error {
+		out := filepath.Join(dir, "out")
+		defer screw.RemoveAll(out)
+
+		err := patcher.PatchFresh(patcher.PatchFreshParams{
+			PatchReader:    seeksource.FromBytes(patchBuffer.Bytes()),
+			TargetDir:      v1,
+			OutputDir:      out,
+			MaxMessageSize: maxMessageSize,
+		})
+		if err != nil {
+			return err
+		}
+		return pwr.AssertValid(out, &pwr.SignatureInfo{Container: sourceContainer, Hashes: mustSignature(t, sourceContainer, v2)})
+	}
+
+	wtest.Must(t, applyPatch(0))
+
+	// the limit isn't raised to fit files the patch declares
+	assert.Equal(t, wire.ErrMessageTooLarge, errors.Cause(applyPatch(wtest.BlockSize)))
+
+	// and the containers have to fit in it
+	assert.Equal(t, wire.ErrMessageTooLarge, errors.Cause(applyPatch(16)))
+}
+
+func mustSignature(t *testing.T, container *tlc.Container, dir string) []wsync.BlockHash {
+	signature, err := pwr.ComputeSignature(context.Background(), container, fspool.New(container, dir), nil)
+	wtest.Must(t, err)
+	return signature
+}
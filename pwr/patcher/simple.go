@@ -4,6 +4,7 @@ import (
 	"github.com/itchio/headway/state"
 	"github.com/itchio/lake/pools/fspool"
 	"github.com/itchio/savior"
+	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/pwr/bowl"
 	"github.com/pkg/errors"
 )
@@ -15,6 +16,12 @@ type PatchFreshParams struct {
 	OutputDir string
 
 	Consumer *state.Consumer
+
+	// TrustedKeys (optional) is the key set the patch must be signed with
+	TrustedKeys *pwr.KeySet
+
+	// MaxMessageSize (optional), see Params.MaxMessageSize
+	MaxMessageSize int64
 }
 
 func PatchFresh(params PatchFreshParams) error {
@@ -28,7 +35,12 @@ func PatchFresh(params PatchFreshParams) error {
 		return errors.Errorf("PatchFreshParams.SourceDir can't be empty")
 	}
 
-	pat, err := New(params.PatchReader, params.Consumer)
+	pat, err := NewWithParams(Params{
+		PatchReader:    params.PatchReader,
+		Consumer:       params.Consumer,
+		TrustedKeys:    params.TrustedKeys,
+		MaxMessageSize: params.MaxMessageSize,
+	})
 	if err != nil {
 		return err
 	}
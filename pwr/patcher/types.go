@@ -47,12 +47,14 @@ type BsdiffCheckpoint struct {
 	WriterCheckpoint *bowl.WriterCheckpoint
 
 	// instructions in bsdiff are relative seeks, so we need to keep track of
-	// the offset in the (single) target file
+	// the offset in the old file
 	OldOffset int64
 
-	// bsdiff series are applied against a single target file, and its index
-	// is in a past message, so we need to keep track of it
-	TargetIndex int64
+	// bsdiff series are applied against a target file (or the concatenation
+	// of several), and their indices are in a past message, so we need to
+	// keep track of them
+	TargetIndex        int64
+	ExtraTargetIndices []int64
 }
 
 // A Patcher applies a wharf patch, either standard (rsync-only) or optimized
@@ -72,13 +74,13 @@ type Patcher interface {
 
 // AfterSaveAction describes what the patcher should do after it saved.
 // This can be used to gracefully stop it.
-type AfterSaveAction int
+type AfterSaveAction = pwr.AfterSaveAction
 
 const (
 	// AfterSaveContinue indicates that the patcher should continue after saving.
-	AfterSaveContinue AfterSaveAction = 1
+	AfterSaveContinue = pwr.AfterSaveContinue
 	// AfterSaveStop indicates that the patcher should stop and return ErrStop
-	AfterSaveStop AfterSaveAction = 2
+	AfterSaveStop = pwr.AfterSaveStop
 )
 
 // A SaveConsumer can be set on a Patcher to decide if the patcher should save
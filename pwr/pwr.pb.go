@@ -14,11 +14,19 @@ It has these top-level messages:
 	SyncOp
 	SignatureHeader
 	BlockHash
+	FileDigests
+	ChunkerSettings
 	CompressionSettings
 	ManifestHeader
 	ManifestBlockHash
 	WoundsHeader
 	Wound
+	ZipIndexHeader
+	ZipIndexEntry
+	ZipIndexSyncPoint
+	AuthTrailer
+	ValidationCacheHeader
+	ValidationCacheEntry
 */
 package pwr
 
@@ -37,6 +45,54 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
+type PatchFeature int32
+
+const (
+	PatchFeature_NO_FEATURE PatchFeature = 0
+	// bsdiff headers may have extraTargetIndices
+	PatchFeature_MULTI_TARGET_BSDIFF PatchFeature = 1
+	// blockSize is set: rsync ops refer to blocks of that size
+	PatchFeature_CUSTOM_BLOCK_SIZE PatchFeature = 2
+)
+
+var PatchFeature_name = map[int32]string{
+	0: "NO_FEATURE",
+	1: "MULTI_TARGET_BSDIFF",
+	2: "CUSTOM_BLOCK_SIZE",
+}
+var PatchFeature_value = map[string]int32{
+	"NO_FEATURE":          0,
+	"MULTI_TARGET_BSDIFF": 1,
+	"CUSTOM_BLOCK_SIZE":   2,
+}
+
+func (x PatchFeature) String() string {
+	return proto.EnumName(PatchFeature_name, int32(x))
+}
+func (PatchFeature) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+type SignatureFeature int32
+
+const (
+	SignatureFeature_NO_SIGNATURE_FEATURE SignatureFeature = 0
+	// blockSize is set: hashes are of blocks of that size
+	SignatureFeature_SIGNATURE_CUSTOM_BLOCK_SIZE SignatureFeature = 1
+)
+
+var SignatureFeature_name = map[int32]string{
+	0: "NO_SIGNATURE_FEATURE",
+	1: "SIGNATURE_CUSTOM_BLOCK_SIZE",
+}
+var SignatureFeature_value = map[string]int32{
+	"NO_SIGNATURE_FEATURE":        0,
+	"SIGNATURE_CUSTOM_BLOCK_SIZE": 1,
+}
+
+func (x SignatureFeature) String() string {
+	return proto.EnumName(SignatureFeature_name, int32(x))
+}
+func (SignatureFeature) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
 type CompressionAlgorithm int32
 
 const (
@@ -62,7 +118,7 @@ var CompressionAlgorithm_value = map[string]int32{
 func (x CompressionAlgorithm) String() string {
 	return proto.EnumName(CompressionAlgorithm_name, int32(x))
 }
-func (CompressionAlgorithm) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+func (CompressionAlgorithm) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
 
 type HashAlgorithm int32
 
@@ -83,7 +139,7 @@ var HashAlgorithm_value = map[string]int32{
 func (x HashAlgorithm) String() string {
 	return proto.EnumName(HashAlgorithm_name, int32(x))
 }
-func (HashAlgorithm) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+func (HashAlgorithm) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
 type WoundKind int32
 
@@ -111,7 +167,7 @@ var WoundKind_value = map[string]int32{
 func (x WoundKind) String() string {
 	return proto.EnumName(WoundKind_name, int32(x))
 }
-func (WoundKind) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+func (WoundKind) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 type SyncHeader_Type int32
 
@@ -119,15 +175,19 @@ const (
 	SyncHeader_RSYNC SyncHeader_Type = 0
 	// when set, bsdiffTargetIndex must be set
 	SyncHeader_BSDIFF SyncHeader_Type = 1
+	// ops are CHUNK_RANGE or DATA, computed with content-defined chunking
+	SyncHeader_CDC SyncHeader_Type = 2
 )
 
 var SyncHeader_Type_name = map[int32]string{
 	0: "RSYNC",
 	1: "BSDIFF",
+	2: "CDC",
 }
 var SyncHeader_Type_value = map[string]int32{
 	"RSYNC":  0,
 	"BSDIFF": 1,
+	"CDC":    2,
 }
 
 func (x SyncHeader_Type) String() string {
@@ -138,19 +198,23 @@ func (SyncHeader_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0
 type SyncOp_Type int32
 
 const (
-	SyncOp_BLOCK_RANGE    SyncOp_Type = 0
-	SyncOp_DATA           SyncOp_Type = 1
+	SyncOp_BLOCK_RANGE SyncOp_Type = 0
+	SyncOp_DATA        SyncOp_Type = 1
+	// copies size bytes at offset from target file fileIndex
+	SyncOp_CHUNK_RANGE    SyncOp_Type = 3
 	SyncOp_HEY_YOU_DID_IT SyncOp_Type = 2049
 )
 
 var SyncOp_Type_name = map[int32]string{
 	0:    "BLOCK_RANGE",
 	1:    "DATA",
+	3:    "CHUNK_RANGE",
 	2049: "HEY_YOU_DID_IT",
 }
 var SyncOp_Type_value = map[string]int32{
 	"BLOCK_RANGE":    0,
 	"DATA":           1,
+	"CHUNK_RANGE":    3,
 	"HEY_YOU_DID_IT": 2049,
 }
 
@@ -159,8 +223,34 @@ func (x SyncOp_Type) String() string {
 }
 func (SyncOp_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{3, 0} }
 
+type ZipIndexEntry_Method int32
+
+const (
+	ZipIndexEntry_STORE   ZipIndexEntry_Method = 0
+	ZipIndexEntry_DEFLATE ZipIndexEntry_Method = 8
+)
+
+var ZipIndexEntry_Method_name = map[int32]string{
+	0: "STORE",
+	8: "DEFLATE",
+}
+var ZipIndexEntry_Method_value = map[string]int32{
+	"STORE":   0,
+	"DEFLATE": 8,
+}
+
+func (x ZipIndexEntry_Method) String() string {
+	return proto.EnumName(ZipIndexEntry_Method_name, int32(x))
+}
+func (ZipIndexEntry_Method) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{14, 0} }
+
 type PatchHeader struct {
 	Compression *CompressionSettings `protobuf:"bytes,1,opt,name=compression" json:"compression,omitempty"`
+	// size of rsync blocks, 0 means the default (64KB)
+	BlockSize int64 `protobuf:"varint,2,opt,name=blockSize" json:"blockSize,omitempty"`
+	// what a patcher must support to apply this patch. Patches that
+	// list any start with FeaturePatchMagic, which older patchers refuse.
+	Features []PatchFeature `protobuf:"varint,3,rep,packed,name=features,enum=io.itch.wharf.pwr.PatchFeature" json:"features,omitempty"`
 }
 
 func (m *PatchHeader) Reset()                    { *m = PatchHeader{} }
@@ -175,6 +265,20 @@ func (m *PatchHeader) GetCompression() *CompressionSettings {
 	return nil
 }
 
+func (m *PatchHeader) GetBlockSize() int64 {
+	if m != nil {
+		return m.BlockSize
+	}
+	return 0
+}
+
+func (m *PatchHeader) GetFeatures() []PatchFeature {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
 type SyncHeader struct {
 	Type      SyncHeader_Type `protobuf:"varint,1,opt,name=type,enum=io.itch.wharf.pwr.SyncHeader_Type" json:"type,omitempty"`
 	FileIndex int64           `protobuf:"varint,16,opt,name=fileIndex" json:"fileIndex,omitempty"`
@@ -201,6 +305,9 @@ func (m *SyncHeader) GetFileIndex() int64 {
 
 type BsdiffHeader struct {
 	TargetIndex int64 `protobuf:"varint,1,opt,name=targetIndex" json:"targetIndex,omitempty"`
+	// when set, the old file is the target file targetIndex, followed
+	// by each of these target files, in order.
+	ExtraTargetIndices []int64 `protobuf:"varint,2,rep,packed,name=extraTargetIndices" json:"extraTargetIndices,omitempty"`
 }
 
 func (m *BsdiffHeader) Reset()                    { *m = BsdiffHeader{} }
@@ -215,12 +322,21 @@ func (m *BsdiffHeader) GetTargetIndex() int64 {
 	return 0
 }
 
+func (m *BsdiffHeader) GetExtraTargetIndices() []int64 {
+	if m != nil {
+		return m.ExtraTargetIndices
+	}
+	return nil
+}
+
 type SyncOp struct {
 	Type       SyncOp_Type `protobuf:"varint,1,opt,name=type,enum=io.itch.wharf.pwr.SyncOp_Type" json:"type,omitempty"`
 	FileIndex  int64       `protobuf:"varint,2,opt,name=fileIndex" json:"fileIndex,omitempty"`
 	BlockIndex int64       `protobuf:"varint,3,opt,name=blockIndex" json:"blockIndex,omitempty"`
 	BlockSpan  int64       `protobuf:"varint,4,opt,name=blockSpan" json:"blockSpan,omitempty"`
 	Data       []byte      `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	Offset     int64       `protobuf:"varint,6,opt,name=offset" json:"offset,omitempty"`
+	Size       int64       `protobuf:"varint,7,opt,name=size" json:"size,omitempty"`
 }
 
 func (m *SyncOp) Reset()                    { *m = SyncOp{} }
@@ -263,8 +379,31 @@ func (m *SyncOp) GetData() []byte {
 	return nil
 }
 
+func (m *SyncOp) GetOffset() int64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *SyncOp) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
 type SignatureHeader struct {
 	Compression *CompressionSettings `protobuf:"bytes,1,opt,name=compression" json:"compression,omitempty"`
+	// when set, hashes are of content-defined chunks rather than fixed-size blocks
+	Chunker *ChunkerSettings `protobuf:"bytes,2,opt,name=chunker" json:"chunker,omitempty"`
+	// size of blocks, 0 means the default (64KB)
+	BlockSize int64 `protobuf:"varint,3,opt,name=blockSize" json:"blockSize,omitempty"`
+	// when set, a FileDigests message follows the block hashes
+	FileDigests bool `protobuf:"varint,4,opt,name=fileDigests" json:"fileDigests,omitempty"`
+	// what a reader must support to use this signature. Signatures that
+	// list any start with FeatureSignatureMagic, which older readers refuse.
+	Features []SignatureFeature `protobuf:"varint,5,rep,packed,name=features,enum=io.itch.wharf.pwr.SignatureFeature" json:"features,omitempty"`
 }
 
 func (m *SignatureHeader) Reset()                    { *m = SignatureHeader{} }
@@ -279,9 +418,39 @@ func (m *SignatureHeader) GetCompression() *CompressionSettings {
 	return nil
 }
 
+func (m *SignatureHeader) GetChunker() *ChunkerSettings {
+	if m != nil {
+		return m.Chunker
+	}
+	return nil
+}
+
+func (m *SignatureHeader) GetBlockSize() int64 {
+	if m != nil {
+		return m.BlockSize
+	}
+	return 0
+}
+
+func (m *SignatureHeader) GetFileDigests() bool {
+	if m != nil {
+		return m.FileDigests
+	}
+	return false
+}
+
+func (m *SignatureHeader) GetFeatures() []SignatureFeature {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
 type BlockHash struct {
 	WeakHash   uint32 `protobuf:"varint,1,opt,name=weakHash" json:"weakHash,omitempty"`
 	StrongHash []byte `protobuf:"bytes,2,opt,name=strongHash,proto3" json:"strongHash,omitempty"`
+	// only set for content-defined chunks
+	Size int64 `protobuf:"varint,3,opt,name=size" json:"size,omitempty"`
 }
 
 func (m *BlockHash) Reset()                    { *m = BlockHash{} }
@@ -303,6 +472,62 @@ func (m *BlockHash) GetStrongHash() []byte {
 	return nil
 }
 
+func (m *BlockHash) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+type FileDigests struct {
+	// SHA-256 digest of each file of the container, in order
+	Sha256 [][]byte `protobuf:"bytes,1,rep,name=sha256,proto3" json:"sha256,omitempty"`
+}
+
+func (m *FileDigests) Reset()                    { *m = FileDigests{} }
+func (m *FileDigests) String() string            { return proto.CompactTextString(m) }
+func (*FileDigests) ProtoMessage()               {}
+func (*FileDigests) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *FileDigests) GetSha256() [][]byte {
+	if m != nil {
+		return m.Sha256
+	}
+	return nil
+}
+
+type ChunkerSettings struct {
+	MinSize int64 `protobuf:"varint,1,opt,name=minSize" json:"minSize,omitempty"`
+	AvgSize int64 `protobuf:"varint,2,opt,name=avgSize" json:"avgSize,omitempty"`
+	MaxSize int64 `protobuf:"varint,3,opt,name=maxSize" json:"maxSize,omitempty"`
+}
+
+func (m *ChunkerSettings) Reset()                    { *m = ChunkerSettings{} }
+func (m *ChunkerSettings) String() string            { return proto.CompactTextString(m) }
+func (*ChunkerSettings) ProtoMessage()               {}
+func (*ChunkerSettings) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *ChunkerSettings) GetMinSize() int64 {
+	if m != nil {
+		return m.MinSize
+	}
+	return 0
+}
+
+func (m *ChunkerSettings) GetAvgSize() int64 {
+	if m != nil {
+		return m.AvgSize
+	}
+	return 0
+}
+
+func (m *ChunkerSettings) GetMaxSize() int64 {
+	if m != nil {
+		return m.MaxSize
+	}
+	return 0
+}
+
 type CompressionSettings struct {
 	Algorithm CompressionAlgorithm `protobuf:"varint,1,opt,name=algorithm,enum=io.itch.wharf.pwr.CompressionAlgorithm" json:"algorithm,omitempty"`
 	Quality   int32                `protobuf:"varint,2,opt,name=quality" json:"quality,omitempty"`
@@ -311,7 +536,7 @@ type CompressionSettings struct {
 func (m *CompressionSettings) Reset()                    { *m = CompressionSettings{} }
 func (m *CompressionSettings) String() string            { return proto.CompactTextString(m) }
 func (*CompressionSettings) ProtoMessage()               {}
-func (*CompressionSettings) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+func (*CompressionSettings) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
 
 func (m *CompressionSettings) GetAlgorithm() CompressionAlgorithm {
 	if m != nil {
@@ -330,12 +555,14 @@ func (m *CompressionSettings) GetQuality() int32 {
 type ManifestHeader struct {
 	Compression *CompressionSettings `protobuf:"bytes,1,opt,name=compression" json:"compression,omitempty"`
 	Algorithm   HashAlgorithm        `protobuf:"varint,2,opt,name=algorithm,enum=io.itch.wharf.pwr.HashAlgorithm" json:"algorithm,omitempty"`
+	// size of blocks, 0 means the default (64KB)
+	BlockSize int64 `protobuf:"varint,3,opt,name=blockSize" json:"blockSize,omitempty"`
 }
 
 func (m *ManifestHeader) Reset()                    { *m = ManifestHeader{} }
 func (m *ManifestHeader) String() string            { return proto.CompactTextString(m) }
 func (*ManifestHeader) ProtoMessage()               {}
-func (*ManifestHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+func (*ManifestHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
 
 func (m *ManifestHeader) GetCompression() *CompressionSettings {
 	if m != nil {
@@ -351,6 +578,13 @@ func (m *ManifestHeader) GetAlgorithm() HashAlgorithm {
 	return HashAlgorithm_SHAKE128_32
 }
 
+func (m *ManifestHeader) GetBlockSize() int64 {
+	if m != nil {
+		return m.BlockSize
+	}
+	return 0
+}
+
 type ManifestBlockHash struct {
 	Hash []byte `protobuf:"bytes,1,opt,name=hash,proto3" json:"hash,omitempty"`
 }
@@ -358,7 +592,7 @@ type ManifestBlockHash struct {
 func (m *ManifestBlockHash) Reset()                    { *m = ManifestBlockHash{} }
 func (m *ManifestBlockHash) String() string            { return proto.CompactTextString(m) }
 func (*ManifestBlockHash) ProtoMessage()               {}
-func (*ManifestBlockHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+func (*ManifestBlockHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
 
 func (m *ManifestBlockHash) GetHash() []byte {
 	if m != nil {
@@ -375,7 +609,7 @@ type WoundsHeader struct {
 func (m *WoundsHeader) Reset()                    { *m = WoundsHeader{} }
 func (m *WoundsHeader) String() string            { return proto.CompactTextString(m) }
 func (*WoundsHeader) ProtoMessage()               {}
-func (*WoundsHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+func (*WoundsHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
 
 // Describe a corrupted portion of a file, in [start,end)
 type Wound struct {
@@ -388,7 +622,7 @@ type Wound struct {
 func (m *Wound) Reset()                    { *m = Wound{} }
 func (m *Wound) String() string            { return proto.CompactTextString(m) }
 func (*Wound) ProtoMessage()               {}
-func (*Wound) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+func (*Wound) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
 
 func (m *Wound) GetIndex() int64 {
 	if m != nil {
@@ -418,6 +652,273 @@ func (m *Wound) GetKind() WoundKind {
 	return WoundKind_FILE
 }
 
+// Zip index files format: header, then any number of
+// entries, each followed by its sync points.
+type ZipIndexHeader struct {
+	Compression *CompressionSettings `protobuf:"bytes,1,opt,name=compression" json:"compression,omitempty"`
+	// size of the indexed archive, in bytes
+	ArchiveSize int64 `protobuf:"varint,2,opt,name=archiveSize" json:"archiveSize,omitempty"`
+}
+
+func (m *ZipIndexHeader) Reset()                    { *m = ZipIndexHeader{} }
+func (m *ZipIndexHeader) String() string            { return proto.CompactTextString(m) }
+func (*ZipIndexHeader) ProtoMessage()               {}
+func (*ZipIndexHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *ZipIndexHeader) GetCompression() *CompressionSettings {
+	if m != nil {
+		return m.Compression
+	}
+	return nil
+}
+
+func (m *ZipIndexHeader) GetArchiveSize() int64 {
+	if m != nil {
+		return m.ArchiveSize
+	}
+	return 0
+}
+
+type ZipIndexEntry struct {
+	// path of the entry, as found in the central directory
+	Name              string               `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Method            ZipIndexEntry_Method `protobuf:"varint,2,opt,name=method,enum=io.itch.wharf.pwr.ZipIndexEntry_Method" json:"method,omitempty"`
+	LocalHeaderOffset int64                `protobuf:"varint,3,opt,name=localHeaderOffset" json:"localHeaderOffset,omitempty"`
+	// offset of the compressed data, right after the local header
+	DataOffset       int64  `protobuf:"varint,4,opt,name=dataOffset" json:"dataOffset,omitempty"`
+	CompressedSize   int64  `protobuf:"varint,5,opt,name=compressedSize" json:"compressedSize,omitempty"`
+	UncompressedSize int64  `protobuf:"varint,6,opt,name=uncompressedSize" json:"uncompressedSize,omitempty"`
+	Crc32            uint32 `protobuf:"varint,7,opt,name=crc32" json:"crc32,omitempty"`
+	// number of ZipIndexSyncPoint messages following this entry
+	NumSyncPoints int64 `protobuf:"varint,8,opt,name=numSyncPoints" json:"numSyncPoints,omitempty"`
+}
+
+func (m *ZipIndexEntry) Reset()                    { *m = ZipIndexEntry{} }
+func (m *ZipIndexEntry) String() string            { return proto.CompactTextString(m) }
+func (*ZipIndexEntry) ProtoMessage()               {}
+func (*ZipIndexEntry) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *ZipIndexEntry) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *ZipIndexEntry) GetMethod() ZipIndexEntry_Method {
+	if m != nil {
+		return m.Method
+	}
+	return ZipIndexEntry_STORE
+}
+
+func (m *ZipIndexEntry) GetLocalHeaderOffset() int64 {
+	if m != nil {
+		return m.LocalHeaderOffset
+	}
+	return 0
+}
+
+func (m *ZipIndexEntry) GetDataOffset() int64 {
+	if m != nil {
+		return m.DataOffset
+	}
+	return 0
+}
+
+func (m *ZipIndexEntry) GetCompressedSize() int64 {
+	if m != nil {
+		return m.CompressedSize
+	}
+	return 0
+}
+
+func (m *ZipIndexEntry) GetUncompressedSize() int64 {
+	if m != nil {
+		return m.UncompressedSize
+	}
+	return 0
+}
+
+func (m *ZipIndexEntry) GetCrc32() uint32 {
+	if m != nil {
+		return m.Crc32
+	}
+	return 0
+}
+
+func (m *ZipIndexEntry) GetNumSyncPoints() int64 {
+	if m != nil {
+		return m.NumSyncPoints
+	}
+	return 0
+}
+
+// Records the state of the inflater on a deflate block boundary,
+// so decompression can start from there instead of from the start
+// of the entry.
+type ZipIndexSyncPoint struct {
+	// offset into the compressed data of the entry
+	CompressedOffset int64 `protobuf:"varint,1,opt,name=compressedOffset" json:"compressedOffset,omitempty"`
+	// offset into the uncompressed data of the entry
+	UncompressedOffset int64 `protobuf:"varint,2,opt,name=uncompressedOffset" json:"uncompressedOffset,omitempty"`
+	// bits already read from compressedOffset
+	Bits    uint32 `protobuf:"varint,3,opt,name=bits" json:"bits,omitempty"`
+	NumBits uint32 `protobuf:"varint,4,opt,name=numBits" json:"numBits,omitempty"`
+	// sliding window of the inflater
+	Window         []byte `protobuf:"bytes,5,opt,name=window,proto3" json:"window,omitempty"`
+	WindowReadPos  int64  `protobuf:"varint,6,opt,name=windowReadPos" json:"windowReadPos,omitempty"`
+	WindowWritePos int64  `protobuf:"varint,7,opt,name=windowWritePos" json:"windowWritePos,omitempty"`
+	WindowFull     bool   `protobuf:"varint,8,opt,name=windowFull" json:"windowFull,omitempty"`
+}
+
+func (m *ZipIndexSyncPoint) Reset()                    { *m = ZipIndexSyncPoint{} }
+func (m *ZipIndexSyncPoint) String() string            { return proto.CompactTextString(m) }
+func (*ZipIndexSyncPoint) ProtoMessage()               {}
+func (*ZipIndexSyncPoint) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+
+func (m *ZipIndexSyncPoint) GetCompressedOffset() int64 {
+	if m != nil {
+		return m.CompressedOffset
+	}
+	return 0
+}
+
+func (m *ZipIndexSyncPoint) GetUncompressedOffset() int64 {
+	if m != nil {
+		return m.UncompressedOffset
+	}
+	return 0
+}
+
+func (m *ZipIndexSyncPoint) GetBits() uint32 {
+	if m != nil {
+		return m.Bits
+	}
+	return 0
+}
+
+func (m *ZipIndexSyncPoint) GetNumBits() uint32 {
+	if m != nil {
+		return m.NumBits
+	}
+	return 0
+}
+
+func (m *ZipIndexSyncPoint) GetWindow() []byte {
+	if m != nil {
+		return m.Window
+	}
+	return nil
+}
+
+func (m *ZipIndexSyncPoint) GetWindowReadPos() int64 {
+	if m != nil {
+		return m.WindowReadPos
+	}
+	return 0
+}
+
+func (m *ZipIndexSyncPoint) GetWindowWritePos() int64 {
+	if m != nil {
+		return m.WindowWritePos
+	}
+	return 0
+}
+
+func (m *ZipIndexSyncPoint) GetWindowFull() bool {
+	if m != nil {
+		return m.WindowFull
+	}
+	return false
+}
+
+type AuthTrailer struct {
+	// Ed25519 public key of the signer
+	PublicKey []byte `protobuf:"bytes,1,opt,name=publicKey,proto3" json:"publicKey,omitempty"`
+	// Ed25519 signature of the SHA-256 digest of everything before the trailer
+	Signature []byte `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
+}
+
+func (m *AuthTrailer) Reset()                    { *m = AuthTrailer{} }
+func (m *AuthTrailer) String() string            { return proto.CompactTextString(m) }
+func (*AuthTrailer) ProtoMessage()               {}
+func (*AuthTrailer) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{16} }
+
+func (m *AuthTrailer) GetPublicKey() []byte {
+	if m != nil {
+		return m.PublicKey
+	}
+	return nil
+}
+
+func (m *AuthTrailer) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+type ValidationCacheHeader struct {
+}
+
+func (m *ValidationCacheHeader) Reset()                    { *m = ValidationCacheHeader{} }
+func (m *ValidationCacheHeader) String() string            { return proto.CompactTextString(m) }
+func (*ValidationCacheHeader) ProtoMessage()               {}
+func (*ValidationCacheHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{17} }
+
+// A file that was found valid, and what it looked like on disk then
+type ValidationCacheEntry struct {
+	Path string `protobuf:"bytes,1,opt,name=path" json:"path,omitempty"`
+	Size int64  `protobuf:"varint,2,opt,name=size" json:"size,omitempty"`
+	// modification time, in nanoseconds since the Unix epoch
+	ModTime int64 `protobuf:"varint,3,opt,name=modTime" json:"modTime,omitempty"`
+	// 0 on platforms where it's not available
+	Inode uint64 `protobuf:"varint,4,opt,name=inode" json:"inode,omitempty"`
+	// hash of what the signature says the file should contain
+	SignatureHash []byte `protobuf:"bytes,5,opt,name=signatureHash,proto3" json:"signatureHash,omitempty"`
+}
+
+func (m *ValidationCacheEntry) Reset()                    { *m = ValidationCacheEntry{} }
+func (m *ValidationCacheEntry) String() string            { return proto.CompactTextString(m) }
+func (*ValidationCacheEntry) ProtoMessage()               {}
+func (*ValidationCacheEntry) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{18} }
+
+func (m *ValidationCacheEntry) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *ValidationCacheEntry) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *ValidationCacheEntry) GetModTime() int64 {
+	if m != nil {
+		return m.ModTime
+	}
+	return 0
+}
+
+func (m *ValidationCacheEntry) GetInode() uint64 {
+	if m != nil {
+		return m.Inode
+	}
+	return 0
+}
+
+func (m *ValidationCacheEntry) GetSignatureHash() []byte {
+	if m != nil {
+		return m.SignatureHash
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*PatchHeader)(nil), "io.itch.wharf.pwr.PatchHeader")
 	proto.RegisterType((*SyncHeader)(nil), "io.itch.wharf.pwr.SyncHeader")
@@ -425,61 +926,114 @@ func init() {
 	proto.RegisterType((*SyncOp)(nil), "io.itch.wharf.pwr.SyncOp")
 	proto.RegisterType((*SignatureHeader)(nil), "io.itch.wharf.pwr.SignatureHeader")
 	proto.RegisterType((*BlockHash)(nil), "io.itch.wharf.pwr.BlockHash")
+	proto.RegisterType((*FileDigests)(nil), "io.itch.wharf.pwr.FileDigests")
+	proto.RegisterType((*ChunkerSettings)(nil), "io.itch.wharf.pwr.ChunkerSettings")
 	proto.RegisterType((*CompressionSettings)(nil), "io.itch.wharf.pwr.CompressionSettings")
 	proto.RegisterType((*ManifestHeader)(nil), "io.itch.wharf.pwr.ManifestHeader")
 	proto.RegisterType((*ManifestBlockHash)(nil), "io.itch.wharf.pwr.ManifestBlockHash")
 	proto.RegisterType((*WoundsHeader)(nil), "io.itch.wharf.pwr.WoundsHeader")
 	proto.RegisterType((*Wound)(nil), "io.itch.wharf.pwr.Wound")
+	proto.RegisterType((*ZipIndexHeader)(nil), "io.itch.wharf.pwr.ZipIndexHeader")
+	proto.RegisterType((*ZipIndexEntry)(nil), "io.itch.wharf.pwr.ZipIndexEntry")
+	proto.RegisterType((*ZipIndexSyncPoint)(nil), "io.itch.wharf.pwr.ZipIndexSyncPoint")
+	proto.RegisterType((*AuthTrailer)(nil), "io.itch.wharf.pwr.AuthTrailer")
+	proto.RegisterType((*ValidationCacheHeader)(nil), "io.itch.wharf.pwr.ValidationCacheHeader")
+	proto.RegisterType((*ValidationCacheEntry)(nil), "io.itch.wharf.pwr.ValidationCacheEntry")
+	proto.RegisterEnum("io.itch.wharf.pwr.PatchFeature", PatchFeature_name, PatchFeature_value)
+	proto.RegisterEnum("io.itch.wharf.pwr.SignatureFeature", SignatureFeature_name, SignatureFeature_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.CompressionAlgorithm", CompressionAlgorithm_name, CompressionAlgorithm_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.HashAlgorithm", HashAlgorithm_name, HashAlgorithm_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.WoundKind", WoundKind_name, WoundKind_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.SyncHeader_Type", SyncHeader_Type_name, SyncHeader_Type_value)
 	proto.RegisterEnum("io.itch.wharf.pwr.SyncOp_Type", SyncOp_Type_name, SyncOp_Type_value)
+	proto.RegisterEnum("io.itch.wharf.pwr.ZipIndexEntry_Method", ZipIndexEntry_Method_name, ZipIndexEntry_Method_value)
 }
 
 func init() { proto.RegisterFile("pwr/pwr.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 653 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x94, 0xc1, 0x4e, 0xdb, 0x4c,
-	0x10, 0xc7, 0x71, 0xe2, 0x00, 0x99, 0x84, 0xb0, 0x2c, 0x1c, 0xa2, 0x4f, 0x7c, 0x28, 0xf2, 0xa1,
-	0x20, 0x54, 0xb9, 0xd4, 0x48, 0xa8, 0x87, 0xaa, 0x6a, 0x62, 0x07, 0x62, 0x25, 0xc4, 0x68, 0x9d,
-	0x0a, 0x85, 0x1e, 0xa2, 0x25, 0x76, 0x12, 0x8b, 0x60, 0xbb, 0xf6, 0x52, 0x37, 0x47, 0x5e, 0xa3,
-	0xcf, 0xd7, 0x07, 0xa9, 0x76, 0xed, 0x90, 0xd0, 0x86, 0x9e, 0xb8, 0xcd, 0xcc, 0xce, 0xfc, 0xe7,
-	0xb7, 0xb3, 0x63, 0xc3, 0x56, 0x98, 0x44, 0xef, 0xc2, 0x24, 0x52, 0xc3, 0x28, 0x60, 0x01, 0xde,
-	0xf1, 0x02, 0xd5, 0x63, 0xc3, 0x89, 0x9a, 0x4c, 0x68, 0x34, 0x52, 0xc3, 0x24, 0x52, 0xae, 0xa1,
-	0x74, 0x45, 0xd9, 0x70, 0xd2, 0x72, 0xa9, 0xe3, 0x46, 0xb8, 0x05, 0xa5, 0x61, 0x70, 0x1f, 0x46,
-	0x6e, 0x1c, 0x7b, 0x81, 0x5f, 0x95, 0x6a, 0xd2, 0x51, 0x49, 0x7b, 0xa3, 0xfe, 0x55, 0xa7, 0xea,
-	0x8b, 0x2c, 0xdb, 0x65, 0xcc, 0xf3, 0xc7, 0x31, 0x59, 0x2e, 0x55, 0x1e, 0x25, 0x00, 0x7b, 0xe6,
-	0x0f, 0x33, 0xe1, 0x33, 0x90, 0xd9, 0x2c, 0x74, 0x85, 0x62, 0x45, 0x53, 0x56, 0x28, 0x2e, 0x92,
-	0xd5, 0xde, 0x2c, 0x74, 0x89, 0xc8, 0xc7, 0xfb, 0x50, 0x1c, 0x79, 0x53, 0xd7, 0xf4, 0x1d, 0xf7,
-	0x47, 0x15, 0xd5, 0xa4, 0xa3, 0x3c, 0x59, 0x04, 0x94, 0xff, 0x41, 0xe6, 0xb9, 0xb8, 0x08, 0x05,
-	0x62, 0xf7, 0xbb, 0x3a, 0x5a, 0xc3, 0x00, 0xeb, 0x0d, 0xdb, 0x30, 0xcf, 0xcf, 0x91, 0xa4, 0x9c,
-	0x40, 0xb9, 0x11, 0x3b, 0xde, 0x68, 0x94, 0x41, 0xd4, 0xa0, 0xc4, 0x68, 0x34, 0x76, 0x59, 0x2a,
-	0x27, 0x09, 0xb9, 0xe5, 0x90, 0xf2, 0x4b, 0x82, 0x75, 0x0e, 0x62, 0x85, 0x58, 0x7b, 0x46, 0x7c,
-	0xf0, 0x02, 0xb1, 0x15, 0xbe, 0x48, 0x9b, 0xfb, 0x83, 0x16, 0x1f, 0x00, 0xdc, 0x4e, 0x83, 0xe1,
-	0x5d, 0x7a, 0x9c, 0x17, 0xc7, 0x4b, 0x11, 0x5e, 0x2d, 0x3c, 0x3b, 0xa4, 0x7e, 0x55, 0x4e, 0xab,
-	0x9f, 0x02, 0x18, 0x83, 0xec, 0x50, 0x46, 0xab, 0x85, 0x9a, 0x74, 0x54, 0x26, 0xc2, 0x56, 0xce,
-	0xb2, 0xfb, 0x6f, 0x43, 0xa9, 0xd1, 0xb1, 0xf4, 0xf6, 0x80, 0xd4, 0xbb, 0x17, 0x4d, 0xb4, 0x86,
-	0x37, 0x41, 0x36, 0xea, 0xbd, 0x3a, 0x92, 0xf0, 0x2e, 0x54, 0x5a, 0xcd, 0xfe, 0xa0, 0x6f, 0x7d,
-	0x19, 0x18, 0xa6, 0x31, 0x30, 0x7b, 0xe8, 0x11, 0x29, 0x5f, 0x61, 0xdb, 0xf6, 0xc6, 0x3e, 0x65,
-	0x0f, 0x91, 0xfb, 0xea, 0x2f, 0x7f, 0x01, 0xc5, 0x06, 0xa7, 0x6e, 0xd1, 0x78, 0x82, 0xff, 0x83,
-	0xcd, 0xc4, 0xa5, 0xc2, 0x16, 0x9a, 0x5b, 0xe4, 0xc9, 0xe7, 0xf3, 0x88, 0x59, 0x14, 0xf8, 0x63,
-	0x71, 0x9a, 0x13, 0xf7, 0x5a, 0x8a, 0x28, 0xdf, 0x61, 0x77, 0x45, 0x33, 0xdc, 0x84, 0x22, 0x9d,
-	0x8e, 0x83, 0xc8, 0x63, 0x93, 0xfb, 0xec, 0x75, 0x0e, 0xff, 0xcd, 0x59, 0x9f, 0xa7, 0x93, 0x45,
-	0x25, 0xae, 0xc2, 0xc6, 0xb7, 0x07, 0x3a, 0xf5, 0xd8, 0x4c, 0xb4, 0x2e, 0x90, 0xb9, 0xab, 0xfc,
-	0x94, 0xa0, 0x72, 0x49, 0x7d, 0x6f, 0xe4, 0xc6, 0xec, 0xb5, 0xa7, 0x83, 0x3f, 0x2d, 0xd3, 0xe7,
-	0x04, 0x7d, 0x6d, 0x85, 0x0e, 0x1f, 0xc0, 0x2a, 0x6c, 0xe5, 0x10, 0x76, 0xe6, 0x6c, 0x8b, 0x29,
-	0x63, 0x90, 0x27, 0xf3, 0x09, 0x97, 0x89, 0xb0, 0x95, 0x0a, 0x94, 0xaf, 0x83, 0x07, 0xdf, 0x89,
-	0xd3, 0x2b, 0x28, 0x09, 0x14, 0x84, 0x8f, 0xf7, 0xa0, 0xe0, 0x2d, 0xed, 0x7f, 0xea, 0xf0, 0x68,
-	0xcc, 0x68, 0xc4, 0xb2, 0xb5, 0x4d, 0x1d, 0x8c, 0x20, 0xef, 0xfa, 0x4e, 0xb6, 0xab, 0xdc, 0xc4,
-	0x27, 0x20, 0xdf, 0x79, 0xbe, 0x23, 0xf6, 0xb3, 0xa2, 0xed, 0xaf, 0x40, 0x17, 0x5d, 0xda, 0x9e,
-	0xef, 0x10, 0x91, 0x79, 0xfc, 0x19, 0xf6, 0x56, 0xbd, 0x05, 0xdf, 0xd1, 0xae, 0xd5, 0x6d, 0x66,
-	0xdf, 0x2c, 0xb1, 0x7a, 0x1d, 0x13, 0x49, 0x3c, 0x7a, 0x71, 0x63, 0x5e, 0xa1, 0x1c, 0xb7, 0x6e,
-	0xec, 0x9e, 0x81, 0xf2, 0xc7, 0x6f, 0x61, 0xeb, 0xd9, 0x3c, 0xf8, 0xbe, 0xdb, 0xad, 0x7a, 0xbb,
-	0xf9, 0x5e, 0xfb, 0x30, 0x38, 0xd5, 0x52, 0x05, 0x9d, 0xe8, 0xa7, 0x9a, 0x8e, 0xa4, 0xe3, 0x8f,
-	0x50, 0x7c, 0x42, 0xe0, 0x22, 0xe7, 0x66, 0x87, 0x37, 0x29, 0xc1, 0x86, 0xdd, 0xbf, 0xec, 0x98,
-	0xdd, 0x36, 0x92, 0xf0, 0x06, 0xe4, 0x0d, 0x93, 0xa0, 0x1c, 0x57, 0xd2, 0x3b, 0x96, 0xdd, 0x34,
-	0x06, 0x22, 0x2d, 0xdf, 0x28, 0xdc, 0xe4, 0xc3, 0x24, 0xba, 0x5d, 0x17, 0x7f, 0xcc, 0xd3, 0xdf,
-	0x01, 0x00, 0x00, 0xff, 0xff, 0x12, 0xce, 0x5c, 0x7e, 0x42, 0x05, 0x00, 0x00,
+	// 1320 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x57, 0xcd, 0x6e, 0xdb, 0xc6,
+	0x13, 0x0f, 0x49, 0x49, 0xb6, 0x47, 0x96, 0x42, 0x6f, 0x9c, 0x44, 0xf8, 0xff, 0x83, 0x44, 0x60,
+	0xdb, 0xc4, 0x30, 0x02, 0xb5, 0x95, 0xd1, 0xa0, 0x40, 0x83, 0xa6, 0xb2, 0x3e, 0x6c, 0xc1, 0xb6,
+	0x64, 0x2c, 0xe9, 0x06, 0x76, 0x0f, 0xea, 0x5a, 0x5c, 0x49, 0x8b, 0x48, 0x24, 0x4b, 0xae, 0xa2,
+	0xb8, 0xe8, 0xa5, 0xd7, 0x9e, 0x7b, 0xea, 0xad, 0xe8, 0x1b, 0xf4, 0xd4, 0x07, 0xea, 0x83, 0x14,
+	0xbb, 0x4b, 0x4a, 0x94, 0xac, 0xe4, 0x94, 0xdb, 0xce, 0x6f, 0x66, 0x87, 0xf3, 0x3d, 0x4b, 0x28,
+	0x04, 0xb3, 0xf0, 0xf3, 0x60, 0x16, 0x56, 0x82, 0xd0, 0xe7, 0x3e, 0xda, 0x61, 0x7e, 0x85, 0xf1,
+	0xfe, 0xa8, 0x32, 0x1b, 0x91, 0x70, 0x50, 0x09, 0x66, 0xa1, 0xf5, 0xb7, 0x06, 0xf9, 0x73, 0xc2,
+	0xfb, 0xa3, 0x63, 0x4a, 0x5c, 0x1a, 0xa2, 0x63, 0xc8, 0xf7, 0xfd, 0x49, 0x10, 0xd2, 0x28, 0x62,
+	0xbe, 0x57, 0xd2, 0xca, 0xda, 0x5e, 0xbe, 0xfa, 0xb4, 0x72, 0xeb, 0x62, 0xa5, 0xbe, 0x90, 0xb2,
+	0x29, 0xe7, 0xcc, 0x1b, 0x46, 0x38, 0x7d, 0x15, 0x3d, 0x82, 0xad, 0xeb, 0xb1, 0xdf, 0x7f, 0x63,
+	0xb3, 0x9f, 0x69, 0x49, 0x2f, 0x6b, 0x7b, 0x06, 0x5e, 0x00, 0xe8, 0x1b, 0xd8, 0x1c, 0x50, 0xc2,
+	0xa7, 0x21, 0x8d, 0x4a, 0x46, 0xd9, 0xd8, 0x2b, 0x56, 0x9f, 0xac, 0xf9, 0x88, 0xb4, 0xac, 0xa5,
+	0xe4, 0xf0, 0xfc, 0x82, 0xf5, 0x9b, 0x06, 0x60, 0xdf, 0x78, 0xfd, 0xd8, 0xe6, 0x17, 0x90, 0xe1,
+	0x37, 0x01, 0x95, 0xc6, 0x16, 0xab, 0xd6, 0x1a, 0x3d, 0x0b, 0xe1, 0x8a, 0x73, 0x13, 0x50, 0x2c,
+	0xe5, 0x85, 0x85, 0x03, 0x36, 0xa6, 0x6d, 0xcf, 0xa5, 0xef, 0x4a, 0xa6, 0xb2, 0x70, 0x0e, 0x58,
+	0x4f, 0x21, 0x23, 0x64, 0xd1, 0x16, 0x64, 0xb1, 0x7d, 0xd9, 0xa9, 0x9b, 0x77, 0x10, 0x40, 0xee,
+	0xd0, 0x6e, 0xb4, 0x5b, 0x2d, 0x53, 0x43, 0x1b, 0x60, 0xd4, 0x1b, 0x75, 0x53, 0xb7, 0x7e, 0x84,
+	0xed, 0xc3, 0xc8, 0x65, 0x83, 0x41, 0x6c, 0x4d, 0x19, 0xf2, 0x9c, 0x84, 0x43, 0xca, 0x95, 0x5e,
+	0x4d, 0xea, 0x4d, 0x43, 0xa8, 0x02, 0x88, 0xbe, 0xe3, 0x21, 0x71, 0x12, 0x8c, 0xf5, 0x69, 0x54,
+	0xd2, 0xcb, 0xc6, 0x9e, 0x81, 0xd7, 0x70, 0xac, 0x3f, 0x75, 0xc8, 0x09, 0x0f, 0xba, 0x01, 0xaa,
+	0x2e, 0xb9, 0xfa, 0xf8, 0x3d, 0xae, 0x76, 0x83, 0xf7, 0xba, 0xa9, 0xaf, 0xb8, 0x89, 0x1e, 0x03,
+	0xc8, 0xac, 0x28, 0xb6, 0x21, 0xd9, 0x29, 0x64, 0x91, 0xc6, 0x80, 0x78, 0xa5, 0x4c, 0x3a, 0x8d,
+	0x01, 0xf1, 0x10, 0x82, 0x8c, 0x4b, 0x38, 0x29, 0x65, 0xcb, 0xda, 0xde, 0x36, 0x96, 0x67, 0xf4,
+	0x00, 0x72, 0xfe, 0x60, 0x10, 0x51, 0x5e, 0xca, 0x49, 0xf1, 0x98, 0x12, 0xb2, 0x91, 0xa8, 0x85,
+	0x0d, 0x89, 0xca, 0xb3, 0x75, 0x14, 0x07, 0xf9, 0x2e, 0xe4, 0x0f, 0x4f, 0xbb, 0xf5, 0x93, 0x1e,
+	0xae, 0x75, 0x8e, 0x9a, 0xe6, 0x1d, 0xb4, 0x09, 0x99, 0x46, 0xcd, 0xa9, 0x99, 0x9a, 0x60, 0xd5,
+	0x8f, 0x2f, 0x3a, 0x09, 0xcb, 0x40, 0xf7, 0xa0, 0x78, 0xdc, 0xbc, 0xec, 0x5d, 0x76, 0x2f, 0x7a,
+	0x8d, 0x76, 0xa3, 0xd7, 0x76, 0xcc, 0x5f, 0x4d, 0xeb, 0x0f, 0x1d, 0xee, 0xda, 0x6c, 0xe8, 0xc9,
+	0x0a, 0xf9, 0xe8, 0xb5, 0xfc, 0x12, 0x36, 0xfa, 0xa3, 0xa9, 0xf7, 0x86, 0x86, 0x32, 0x80, 0xf9,
+	0xb5, 0x45, 0x56, 0x57, 0x12, 0x73, 0x0d, 0xc9, 0x95, 0xe5, 0x4e, 0x30, 0x56, 0x3b, 0xa1, 0x0c,
+	0x79, 0x91, 0x8d, 0x06, 0x1b, 0xd2, 0x88, 0x47, 0x32, 0xc4, 0x9b, 0x38, 0x0d, 0xa1, 0x57, 0xa9,
+	0x5e, 0xc9, 0xca, 0x5e, 0xf9, 0x64, 0x5d, 0xe2, 0x13, 0xef, 0x6f, 0xf7, 0xcb, 0x0f, 0xb0, 0x75,
+	0x28, 0xbe, 0x77, 0x4c, 0xa2, 0x11, 0xfa, 0x1f, 0x6c, 0xce, 0x28, 0x91, 0x67, 0x19, 0x92, 0x02,
+	0x9e, 0xd3, 0xa2, 0x18, 0x22, 0x1e, 0xfa, 0xde, 0x50, 0x72, 0x75, 0x99, 0xd4, 0x14, 0x32, 0x4f,
+	0xa1, 0x91, 0x4a, 0xe1, 0x67, 0x90, 0x6f, 0xa5, 0x8c, 0x7d, 0x00, 0xb9, 0x68, 0x44, 0xaa, 0x5f,
+	0xbd, 0x28, 0x69, 0x65, 0x63, 0x6f, 0x1b, 0xc7, 0x94, 0xd5, 0x83, 0xbb, 0x2b, 0x01, 0x42, 0x25,
+	0xd8, 0x98, 0x30, 0x4f, 0x46, 0x45, 0x75, 0x49, 0x42, 0x0a, 0x0e, 0x79, 0x3b, 0x4c, 0x4d, 0x8e,
+	0x84, 0x94, 0x77, 0xc8, 0xbb, 0x54, 0x24, 0x13, 0xd2, 0x7a, 0x0b, 0xf7, 0xd6, 0xe4, 0x11, 0x35,
+	0x61, 0x8b, 0x8c, 0x87, 0x7e, 0xc8, 0xf8, 0x68, 0x12, 0xb7, 0xcd, 0xb3, 0x0f, 0x97, 0x40, 0x2d,
+	0x11, 0xc7, 0x8b, 0x9b, 0xe2, 0xbb, 0x3f, 0x4d, 0xc9, 0x98, 0xf1, 0x1b, 0x69, 0x51, 0x16, 0x27,
+	0xa4, 0xf5, 0x8f, 0x06, 0xc5, 0x33, 0xe2, 0xb1, 0x01, 0x8d, 0xf8, 0x47, 0x2f, 0xbc, 0x6f, 0xd3,
+	0xd6, 0xeb, 0xd2, 0xfa, 0xf2, 0x1a, 0x3d, 0x22, 0x39, 0x6b, 0xcd, 0xfe, 0x60, 0xe9, 0x59, 0xcf,
+	0x60, 0x27, 0xb1, 0x7c, 0x51, 0x1f, 0x08, 0x32, 0xa3, 0xa4, 0x36, 0xb6, 0xb1, 0x3c, 0x5b, 0x45,
+	0xd8, 0x7e, 0xed, 0x4f, 0x3d, 0x37, 0x52, 0x0e, 0x5a, 0x33, 0xc8, 0x4a, 0x1a, 0xed, 0x42, 0x96,
+	0xa5, 0xc6, 0x9c, 0x22, 0x04, 0x1a, 0x71, 0x12, 0xf2, 0x38, 0x79, 0x8a, 0x40, 0x26, 0x18, 0xd4,
+	0x73, 0x63, 0x2b, 0xc4, 0x11, 0x7d, 0x01, 0x99, 0x37, 0xcc, 0x73, 0x65, 0xcd, 0x17, 0xab, 0x8f,
+	0xd6, 0x38, 0x26, 0xbf, 0x72, 0xc2, 0x3c, 0x17, 0x4b, 0x49, 0xeb, 0x17, 0x28, 0x5e, 0xb1, 0x40,
+	0x4e, 0xa6, 0x8f, 0x1e, 0xeb, 0x32, 0xe4, 0x49, 0xd8, 0x1f, 0xb1, 0xb7, 0x34, 0x55, 0x78, 0x69,
+	0xc8, 0xfa, 0x57, 0x87, 0x42, 0xf2, 0xf9, 0xa6, 0xc7, 0xc3, 0x1b, 0x11, 0x2c, 0x8f, 0x4c, 0x54,
+	0xfd, 0x6e, 0x61, 0x79, 0x46, 0xaf, 0x20, 0x37, 0xa1, 0x7c, 0xe4, 0xbb, 0x25, 0xfd, 0xbd, 0xe5,
+	0xb6, 0xa4, 0xa5, 0x72, 0x26, 0xc5, 0x71, 0x7c, 0x0d, 0x3d, 0x87, 0x9d, 0xb1, 0xdf, 0x27, 0x63,
+	0xe5, 0x61, 0x57, 0xcd, 0x52, 0x15, 0xb6, 0xdb, 0x0c, 0xd1, 0xb3, 0x62, 0xec, 0xc6, 0x62, 0x6a,
+	0x42, 0xa7, 0x10, 0xf4, 0x14, 0x8a, 0x89, 0x97, 0xd4, 0x95, 0x9e, 0x65, 0xa5, 0xcc, 0x0a, 0x8a,
+	0xf6, 0xc1, 0x9c, 0x7a, 0x2b, 0x92, 0x6a, 0x80, 0xdf, 0xc2, 0x45, 0x82, 0xfb, 0x61, 0xff, 0xa0,
+	0x2a, 0x67, 0x79, 0x01, 0x2b, 0x02, 0x7d, 0x0a, 0x05, 0x6f, 0x3a, 0x11, 0x0b, 0xe8, 0xdc, 0x67,
+	0x1e, 0x8f, 0x4a, 0x9b, 0xf2, 0xfa, 0x32, 0x68, 0x95, 0x21, 0xa7, 0xfc, 0x15, 0x9b, 0xd5, 0x76,
+	0xba, 0x58, 0x8c, 0xfb, 0x3c, 0x6c, 0x34, 0x9a, 0xad, 0xd3, 0x9a, 0xd3, 0x34, 0x37, 0xad, 0xbf,
+	0x74, 0xd8, 0x49, 0x02, 0x34, 0xbf, 0x28, 0xec, 0x5b, 0x58, 0x11, 0x7b, 0xab, 0xaa, 0xee, 0x16,
+	0x2e, 0x36, 0xec, 0xd4, 0x5b, 0x45, 0xe3, 0x8c, 0xae, 0xe1, 0x88, 0x34, 0x5e, 0x33, 0x1e, 0xc9,
+	0x20, 0x17, 0xb0, 0x3c, 0x8b, 0x8e, 0xf7, 0xa6, 0x93, 0x43, 0x16, 0xcf, 0xe4, 0x02, 0x4e, 0x48,
+	0x31, 0xe2, 0x66, 0xcc, 0x73, 0xfd, 0x59, 0xbc, 0xf6, 0x62, 0x4a, 0xf8, 0xaf, 0x4e, 0x98, 0x12,
+	0xf7, 0xdc, 0x8f, 0xe2, 0xf0, 0x2d, 0x83, 0x22, 0x1f, 0x0a, 0x78, 0x1d, 0x32, 0x4e, 0x85, 0x98,
+	0x5a, 0x88, 0x2b, 0xa8, 0xc8, 0xab, 0x42, 0x5a, 0xd3, 0xf1, 0x58, 0x86, 0x72, 0x13, 0xa7, 0x10,
+	0xab, 0x0d, 0xf9, 0xda, 0x94, 0x8f, 0x9c, 0x90, 0xb0, 0xb1, 0x5a, 0x32, 0xc1, 0xf4, 0x7a, 0xcc,
+	0xfa, 0x27, 0xf4, 0x26, 0xee, 0xdd, 0x05, 0x20, 0xb8, 0x51, 0xb2, 0x1f, 0xe2, 0xb9, 0xbe, 0x00,
+	0xac, 0x87, 0x70, 0xff, 0x7b, 0x32, 0x66, 0x2e, 0xe1, 0xcc, 0xf7, 0xea, 0xa4, 0x3f, 0x8a, 0x37,
+	0xa8, 0xf5, 0xbb, 0x06, 0xbb, 0x2b, 0x9c, 0x79, 0xdd, 0x07, 0x84, 0x8f, 0x92, 0xba, 0x17, 0xe7,
+	0xf9, 0x72, 0xd0, 0x17, 0xcb, 0x41, 0x8e, 0x6b, 0xdf, 0x75, 0xd8, 0x64, 0x31, 0xae, 0x15, 0xa9,
+	0x26, 0x87, 0xef, 0x52, 0x19, 0xdc, 0x0c, 0x56, 0x84, 0x08, 0xe1, 0xdc, 0x2c, 0xb9, 0x83, 0x54,
+	0x84, 0x97, 0xc1, 0xfd, 0x0e, 0x6c, 0xa7, 0x5f, 0x86, 0xa8, 0x08, 0xd0, 0xe9, 0xf6, 0x5a, 0xcd,
+	0x9a, 0x73, 0x21, 0xab, 0xe9, 0x21, 0xdc, 0x3b, 0xbb, 0x38, 0x75, 0xda, 0x3d, 0xa7, 0x86, 0x8f,
+	0x9a, 0x4e, 0x6f, 0xfe, 0x68, 0xbb, 0x0f, 0x3b, 0xf5, 0x0b, 0xdb, 0xe9, 0x9e, 0xf5, 0xd4, 0x6b,
+	0xc3, 0x6e, 0x5f, 0x35, 0x4d, 0x7d, 0xff, 0x0c, 0xcc, 0xd5, 0xed, 0x89, 0x4a, 0xb0, 0xdb, 0xe9,
+	0xf6, 0xec, 0xf6, 0x51, 0x47, 0x6a, 0x4d, 0x69, 0x7f, 0x02, 0xff, 0x5f, 0xc0, 0xb7, 0xd5, 0x69,
+	0xfb, 0xdf, 0xc1, 0xee, 0xba, 0x75, 0x22, 0xde, 0x34, 0x9d, 0x6e, 0xa7, 0x19, 0x3f, 0x24, 0x71,
+	0xd7, 0x39, 0x6d, 0x9b, 0x9a, 0x40, 0x8f, 0xae, 0xda, 0xe7, 0xa6, 0x2e, 0x4e, 0x57, 0xb6, 0xd3,
+	0x30, 0x8d, 0xfd, 0xe7, 0x50, 0x58, 0x1a, 0xe9, 0xe2, 0x11, 0x64, 0x1f, 0xd7, 0x4e, 0x9a, 0x5f,
+	0x56, 0xbf, 0xee, 0x1d, 0x54, 0x95, 0x86, 0x3a, 0xae, 0x1f, 0x54, 0xeb, 0xa6, 0xb6, 0xff, 0x12,
+	0xb6, 0xe6, 0x73, 0x52, 0x28, 0x69, 0xb5, 0x4f, 0xe3, 0x9e, 0xb2, 0x2f, 0xcf, 0x4e, 0xdb, 0x9d,
+	0x13, 0xf5, 0x5c, 0x6d, 0xb4, 0xb1, 0xa9, 0xcb, 0xe7, 0xd4, 0x69, 0xd7, 0x6e, 0x36, 0x7a, 0x52,
+	0xcc, 0x38, 0xcc, 0x5e, 0x19, 0xc1, 0x2c, 0xbc, 0xce, 0xc9, 0x5f, 0x84, 0x83, 0xff, 0x06, 0x00,
+	0x9e, 0x70, 0x68, 0xcc, 0x33, 0x0c, 0x00, 0x00,
 }
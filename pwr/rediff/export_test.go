@@ -0,0 +1,21 @@
+package rediff
+
+// SetWindowedDiffThreshold makes files larger than n be diffed one
+// window at a time, and returns a function that restores the default.
+func SetWindowedDiffThreshold(n int64) func() {
+	previous := windowedDiffThreshold
+	windowedDiffThreshold = n
+	return func() {
+		windowedDiffThreshold = previous
+	}
+}
+
+// SetMaxMemorySpool makes workers spool bsdiff output to temporary files
+// past n bytes, and returns a function that restores the default.
+func SetMaxMemorySpool(n int64) func() {
+	previous := maxMemorySpool
+	maxMemorySpool = n
+	return func() {
+		maxMemorySpool = previous
+	}
+}
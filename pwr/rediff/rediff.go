@@ -3,6 +3,8 @@ package rediff
 import (
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	validation "github.com/go-ozzo/ozzo-validation"
 	"github.com/itchio/headway/state"
@@ -25,6 +27,26 @@ type FileOrigin map[int64]int64
 type DiffMapping struct {
 	TargetIndex int64
 	NumBytes    int64
+
+	// ExtraTargetIndices are other target files the source file has blocks
+	// in common with, see Params.MaxTargetsPerFile. The source file is
+	// bsdiff'd against the concatenation of TargetIndex and all of these.
+	ExtraTargetIndices []int64
+}
+
+// TargetIndices returns all the target files of a mapping, in the
+// order they're concatenated in.
+func (dm *DiffMapping) TargetIndices() []int64 {
+	res := []int64{dm.TargetIndex}
+	return append(res, dm.ExtraTargetIndices...)
+}
+
+func (dm *DiffMapping) targetSize(targetContainer *tlc.Container) int64 {
+	var size int64
+	for _, targetIndex := range dm.TargetIndices() {
+		size += targetContainer.Files[targetIndex].Size
+	}
+	return size
 }
 
 // DiffMappings contains one diff mapping for each pair of files to be bsdiff'd
@@ -35,9 +57,14 @@ type DiffMappings map[int64]*DiffMapping
 func (dm DiffMappings) ToString(sourceContainer tlc.Container, targetContainer tlc.Container) string {
 	s := ""
 	for sourceIndex, diffMapping := range dm {
+		var targetPaths []string
+		for _, targetIndex := range diffMapping.TargetIndices() {
+			targetPaths = append(targetPaths, targetContainer.Files[targetIndex].Path)
+		}
+
 		s += fmt.Sprintf("%s <- %s (%s in common)\n",
 			sourceContainer.Files[sourceIndex].Path,
-			targetContainer.Files[diffMapping.TargetIndex].Path,
+			strings.Join(targetPaths, " + "),
 			united.FormatBytes(diffMapping.NumBytes),
 		)
 	}
@@ -53,12 +80,14 @@ type context struct {
 	targetContainer *tlc.Container
 	sourceContainer *tlc.Container
 	diffMappings    DiffMappings
+	plan            *Plan
 }
 
 type Context interface {
 	GetTargetContainer() *tlc.Container
 	GetSourceContainer() *tlc.Container
 	GetDiffMappings() DiffMappings
+	GetPlan() *Plan
 	Partitions() int
 	Optimize(params OptimizeParams) error
 }
@@ -71,12 +100,19 @@ type Params struct {
 	// rediff.Context is in charge of resuming, since it uses it twice.
 	PatchReader savior.SeekSource
 
+	// TrustedKeys (optional) is the key set the patch must be signed with.
+	// Unsigned or mis-signed patches are refused, see pwr.AuthenticateSource.
+	TrustedKeys *pwr.KeySet
+
 	// RediffSizeLimit (optional) is the maximum size of a file we'll attempt to rediff.
 	// If a file is larger than that, ops will just be copied.
 	RediffSizeLimit int64
 
 	// optional
 	SuffixSortConcurrency int
+	// BsdiffWindowSize (optional) is how much of a file larger than
+	// bsdiff.MaxFileSize is diffed at a time, see bsdiff.DiffContext.DoWindowed
+	BsdiffWindowSize int64
 	// optional
 	Partitions int
 	// optional
@@ -89,6 +125,23 @@ type Params struct {
 	ForceMapAll bool
 	// optional
 	MeasureMem bool
+
+	// MaxTargetsPerFile (optional) is how many target files a source file can
+	// be bsdiff'd against, for example when it was assembled from several old
+	// files. 0 or 1 means only the target file it has the most in common with.
+	// Patches that use more list pwr.PatchFeature_MULTI_TARGET_BSDIFF, so older
+	// patchers, which would ignore BsdiffHeader.ExtraTargetIndices, refuse them.
+	MaxTargetsPerFile int
+
+	// Workers (optional) is the number of files bsdiff'd concurrently.
+	// 0 or 1 means one file at a time, writing bsdiff output as it goes.
+	Workers int
+	// MemoryBudget (optional) bounds, in bytes, the estimated memory used by
+	// bsdiff'ing: files that would go over it on their own keep their rsync
+	// operations, files that would go over it with their output spooled are
+	// bsdiff'd alone (see Plan), and files bsdiff'd concurrently (or waiting
+	// to be written out) share it. 0 means no bound other than Workers.
+	MemoryBudget int64
 }
 
 type OptimizeParams struct {
@@ -98,7 +151,9 @@ type OptimizeParams struct {
 	PatchWriter io.Writer
 }
 
-const DefaultRediffSizeLimit = 4 * 1024 * 1024 * 1024 // 4GB
+// DefaultRediffSizeLimit is the default for Params.RediffSizeLimit. Files
+// larger than bsdiff.MaxFileSize are diffed one window at a time.
+const DefaultRediffSizeLimit = 64 * 1024 * 1024 * 1024 // 64GB
 
 // NewContext initializes the diffing process, it also analyzes the patch
 // to find diff mapping so that it's ready for optimization
@@ -110,6 +165,12 @@ func NewContext(params Params) (Context, error) {
 		return nil, err
 	}
 
+	// refuse unsigned or mis-signed patches if we have trusted keys
+	params.PatchReader, err = pwr.AuthenticateSource(params.PatchReader, params.TrustedKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	// apply default params
 	if params.RediffSizeLimit == 0 {
 		params.RediffSizeLimit = DefaultRediffSizeLimit
@@ -120,8 +181,9 @@ func NewContext(params Params) (Context, error) {
 	}
 	err = cx.analyzePatch()
 	if err != nil {
-		return nil, err
+		return nil, pwr.AuthError(params.PatchReader, err)
 	}
+	cx.planMemory()
 
 	return cx, nil
 }
@@ -139,16 +201,16 @@ func (cx *context) analyzePatch() error {
 
 	rctx := wire.NewReadContext(cx.params.PatchReader)
 
-	err = rctx.ExpectMagic(pwr.PatchMagic)
+	ph, err := pwr.ReadPatchHeader(rctx)
 	if err != nil {
 		return err
 	}
 
-	ph := &pwr.PatchHeader{}
-	err = rctx.ReadMessage(ph)
+	err = pwr.ValidateBlockSize(ph.BlockSize)
 	if err != nil {
-		return err
+		return errors.WithStack(err)
 	}
+	blockSize := pwr.ResolveBlockSize(ph.BlockSize)
 
 	rctx, err = pwr.DecompressWire(rctx, ph.Compression)
 	if err != nil {
@@ -214,11 +276,15 @@ func (cx *context) analyzePatch() error {
 				alreadyReused := bytesReusedPerFileIndex[rop.FileIndex]
 				lastBlockIndex := rop.BlockIndex + rop.BlockSpan
 				targetFile := targetContainer.Files[rop.FileIndex]
-				lastBlockSize := pwr.ComputeBlockSize(targetFile.Size, lastBlockIndex)
-				otherBlocksSize := pwr.BlockSize*rop.BlockSpan - 1
+				lastBlockSize := pwr.ComputeBlockSizeFor(targetFile.Size, lastBlockIndex, blockSize)
+				otherBlocksSize := blockSize*rop.BlockSpan - 1
 
 				bytesReusedPerFileIndex[rop.FileIndex] = alreadyReused + otherBlocksSize + lastBlockSize
 
+			case pwr.SyncOp_CHUNK_RANGE:
+				numBlockRange++
+				bytesReusedPerFileIndex[rop.FileIndex] += rop.Size
+
 			case pwr.SyncOp_DATA:
 				numData++
 
@@ -280,6 +346,7 @@ func (cx *context) analyzePatch() error {
 			}
 
 			if diffMapping != nil {
+				cx.addExtraTargets(diffMapping, sourceFile, bytesReusedPerFileIndex)
 				cx.diffMappings[int64(sourceFileIndex)] = diffMapping
 			}
 		}
@@ -287,12 +354,71 @@ func (cx *context) analyzePatch() error {
 		doneBytes += sourceFile.Size
 	}
 
+	err = pwr.FinishAuthentication(cx.params.PatchReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	return nil
 }
 
+// addExtraTargets adds the target files, other than the mapping's main one,
+// that contribute the most bytes to a source file, up to Params.MaxTargetsPerFile
+// in total, as long as their concatenation doesn't exceed Params.RediffSizeLimit
+// and diffing against it fits in Params.MemoryBudget.
+func (cx *context) addExtraTargets(diffMapping *DiffMapping, sourceFile *tlc.File, bytesReusedPerFileIndex FileOrigin) {
+	if cx.params.MaxTargetsPerFile <= 1 {
+		return
+	}
+
+	var candidates []int64
+	for targetFileIndex, numBytes := range bytesReusedPerFileIndex {
+		if targetFileIndex != diffMapping.TargetIndex && numBytes > 0 {
+			candidates = append(candidates, targetFileIndex)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := bytesReusedPerFileIndex[candidates[i]], bytesReusedPerFileIndex[candidates[j]]
+		if a != b {
+			return a > b
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	oldSize := cx.targetContainer.Files[diffMapping.TargetIndex].Size
+	for _, targetFileIndex := range candidates {
+		if len(diffMapping.ExtraTargetIndices)+1 >= cx.params.MaxTargetsPerFile {
+			break
+		}
+
+		targetFile := cx.targetContainer.Files[targetFileIndex]
+		if oldSize+targetFile.Size > cx.params.RediffSizeLimit {
+			continue
+		}
+
+		diffMapping.ExtraTargetIndices = append(diffMapping.ExtraTargetIndices, targetFileIndex)
+		if cx.params.MemoryBudget > 0 && cx.estimateMemory(diffMapping, sourceFile, false) > cx.params.MemoryBudget {
+			diffMapping.ExtraTargetIndices = diffMapping.ExtraTargetIndices[:len(diffMapping.ExtraTargetIndices)-1]
+			continue
+		}
+
+		oldSize += targetFile.Size
+		diffMapping.NumBytes += bytesReusedPerFileIndex[targetFileIndex]
+	}
+}
+
 // OptimizePatch uses the information computed by AnalyzePatch to write a new version of
 // the patch, but with bsdiff instead of rsync diffs for each DiffMapping.
 func (cx *context) Optimize(params OptimizeParams) error {
+	err := cx.optimize(params)
+	if err != nil {
+		return pwr.AuthError(cx.params.PatchReader, err)
+	}
+	return nil
+}
+
+func (cx *context) optimize(params OptimizeParams) error {
 	consumer := cx.params.Consumer
 
 	err := validation.ValidateStruct(&params,
@@ -312,18 +438,7 @@ func (cx *context) Optimize(params OptimizeParams) error {
 	rctx := wire.NewReadContext(cx.params.PatchReader)
 	wctx := wire.NewWriteContext(params.PatchWriter)
 
-	err = wctx.WriteMagic(pwr.PatchMagic)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	err = rctx.ExpectMagic(pwr.PatchMagic)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	ph := &pwr.PatchHeader{}
-	err = rctx.ReadMessage(ph)
+	ph, err := pwr.ReadPatchHeader(rctx)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -333,10 +448,19 @@ func (cx *context) Optimize(params OptimizeParams) error {
 		compression = defaultRediffCompressionSettings()
 	}
 
+	// rsync ops are copied as-is, so they need the same block size
 	wph := &pwr.PatchHeader{
 		Compression: compression,
+		BlockSize:   ph.BlockSize,
 	}
-	err = wctx.WriteMessage(wph)
+	for _, diffMapping := range cx.diffMappings {
+		if len(diffMapping.ExtraTargetIndices) > 0 {
+			// patchers that can't read extra target indices must refuse this patch
+			wph.Features = append(wph.Features, pwr.PatchFeature_MULTI_TARGET_BSDIFF)
+			break
+		}
+	}
+	err = pwr.WritePatchHeader(wctx, wph)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -382,6 +506,7 @@ func (cx *context) Optimize(params OptimizeParams) error {
 		Partitions:            cx.params.Partitions,
 		Stats:                 cx.params.BsdiffStats,
 		MeasureMem:            cx.params.MeasureMem,
+		WindowSize:            cx.params.BsdiffWindowSize,
 	}
 
 	bconsumer := &state.Consumer{}
@@ -401,6 +526,12 @@ func (cx *context) Optimize(params OptimizeParams) error {
 
 	var doneSize int64
 
+	var scheduler *rediffScheduler
+	if cx.params.Workers > 1 {
+		scheduler = cx.startRediffScheduler(params, sourceContainer)
+		defer scheduler.stop()
+	}
+
 	for sourceFileIndex, sourceFile := range sourceContainer.Files {
 		sh.Reset()
 		err = rctx.ReadMessage(sh)
@@ -449,6 +580,7 @@ func (cx *context) Optimize(params OptimizeParams) error {
 
 			bh.Reset()
 			bh.TargetIndex = diffMapping.TargetIndex
+			bh.ExtraTargetIndices = diffMapping.ExtraTargetIndices
 			err = wctx.WriteMessage(bh)
 			if err != nil {
 				return errors.WithStack(err)
@@ -466,36 +598,62 @@ func (cx *context) Optimize(params OptimizeParams) error {
 				}
 			}
 
-			// then bsdiff
-			sourceFileReader, err := params.SourcePool.GetReadSeeker(int64(sourceFileIndex))
-			if err != nil {
-				return errors.WithStack(err)
-			}
+			if scheduler != nil && !scheduler.isUnspooled(int64(sourceFileIndex)) {
+				// bsdiff'd ahead of time by a worker
+				consumer.ProgressLabel(fmt.Sprintf("*%s", sourceFile.Path))
 
-			targetFileReader, err := params.TargetPool.GetReadSeeker(diffMapping.TargetIndex)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+				err = scheduler.writeJob(int64(sourceFileIndex), wctx.Writer())
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			} else {
+				if scheduler != nil {
+					// too large to be spooled, workers wait while we diff it
+					err = scheduler.startUnspooled(int64(sourceFileIndex))
+					if err != nil {
+						return errors.WithStack(err)
+					}
+				}
 
-			consumer.ProgressLabel(fmt.Sprintf(">%s", sourceFile.Path))
+				// then bsdiff
+				sourceFileReader, err := params.SourcePool.GetReadSeeker(int64(sourceFileIndex))
+				if err != nil {
+					return errors.WithStack(err)
+				}
 
-			_, err = sourceFileReader.Seek(0, io.SeekStart)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+				targetFileReader, err := pwr.OpenBsdiffTargets(params.TargetPool, diffMapping.TargetIndices())
+				if err != nil {
+					return errors.WithStack(err)
+				}
 
-			consumer.ProgressLabel(fmt.Sprintf("<%s", sourceFile.Path))
+				consumer.ProgressLabel(fmt.Sprintf(">%s", sourceFile.Path))
 
-			_, err = targetFileReader.Seek(0, io.SeekStart)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+				_, err = sourceFileReader.Seek(0, io.SeekStart)
+				if err != nil {
+					return errors.WithStack(err)
+				}
 
-			consumer.ProgressLabel(fmt.Sprintf("*%s", sourceFile.Path))
+				consumer.ProgressLabel(fmt.Sprintf("<%s", sourceFile.Path))
 
-			err = bdc.Do(targetFileReader, sourceFileReader, wctx.WriteMessage, bconsumer)
-			if err != nil {
-				return errors.WithStack(err)
+				_, err = targetFileReader.Seek(0, io.SeekStart)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+
+				consumer.ProgressLabel(fmt.Sprintf("*%s", sourceFile.Path))
+
+				if needsWindowedDiff(diffMapping.targetSize(targetContainer), sourceFile.Size) {
+					err = bdc.DoWindowed(targetFileReader, sourceFileReader, wctx.WriteMessage, bconsumer)
+				} else {
+					err = bdc.Do(targetFileReader, sourceFileReader, wctx.WriteMessage, bconsumer)
+				}
+				if err != nil {
+					return errors.WithStack(err)
+				}
+
+				if scheduler != nil {
+					scheduler.finishUnspooled(int64(sourceFileIndex))
+				}
 			}
 
 			doneSize += sourceFile.Size
@@ -513,6 +671,12 @@ func (cx *context) Optimize(params OptimizeParams) error {
 		consumer.Progress(float64(doneSize) / float64(totalRediffSize))
 	}
 
+	// the patch is read again, it has to be authenticated again
+	err = pwr.FinishAuthentication(cx.params.PatchReader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
 	err = wctx.Close()
 	if err != nil {
 		return errors.WithStack(err)
@@ -521,6 +685,16 @@ func (cx *context) Optimize(params OptimizeParams) error {
 	return nil
 }
 
+// windowedDiffThreshold is the size above which files are diffed one window
+// at a time. Only tests lower it from bsdiff.MaxFileSize.
+var windowedDiffThreshold = bsdiff.MaxFileSize
+
+// needsWindowedDiff returns true if a pair of files is too large
+// to be bsdiff'd all at once.
+func needsWindowedDiff(targetSize int64, sourceSize int64) bool {
+	return targetSize > windowedDiffThreshold || sourceSize > windowedDiffThreshold
+}
+
 func (cx *context) Partitions() int {
 	return cx.params.Partitions
 }
@@ -537,6 +711,10 @@ func (cx *context) GetDiffMappings() DiffMappings {
 	return cx.diffMappings
 }
 
+func (cx *context) GetPlan() *Plan {
+	return cx.plan
+}
+
 func defaultRediffCompressionSettings() *pwr.CompressionSettings {
 	return &pwr.CompressionSettings{
 		Algorithm: pwr.CompressionAlgorithm_BROTLI,
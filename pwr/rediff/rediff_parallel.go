@@ -0,0 +1,440 @@
+package rediff
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/wharf/bsdiff"
+	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// maxMemorySpool is how much of a file's bsdiff output is held in memory
+// until it's that file's turn to be written. The rest goes to a temporary file.
+var maxMemorySpool int64 = 32 * 1024 * 1024
+
+// estimateDiffMemory returns a rough idea of how much memory bsdiff'ing
+// a file uses: both files are held in memory, and the suffix array takes
+// 8 bytes per byte of the target. When spooled, the output is also held
+// until it's that file's turn to be written, up to maxMemorySpool.
+func estimateDiffMemory(targetSize int64, sourceSize int64, windowSize int64, spooled bool) int64 {
+	if needsWindowedDiff(targetSize, sourceSize) {
+		// only a window of the source and two of the target are held
+		// in memory, but the whole output might be spooled.
+		if windowSize <= 0 {
+			windowSize = bsdiff.DefaultWindowSize
+		}
+		mem := estimateWholeDiffMemory(windowSize*2, windowSize)
+		if spooled {
+			mem += spoolMemory(sourceSize)
+		}
+		return mem
+	}
+
+	mem := estimateWholeDiffMemory(targetSize, sourceSize)
+	if spooled {
+		mem += spoolMemory(sourceSize * 2)
+	}
+	return mem
+}
+
+func estimateWholeDiffMemory(targetSize int64, sourceSize int64) int64 {
+	return targetSize*(1+1+8) + sourceSize*(1+1)
+}
+
+func spoolMemory(outputSize int64) int64 {
+	if outputSize > maxMemorySpool {
+		return maxMemorySpool
+	}
+	return outputSize
+}
+
+// A memoryBudget lets files be diffed concurrently as long as their
+// estimated memory use stays under a limit. A single file that's over
+// the limit is still allowed, but only when nothing else is in flight.
+// Unspooled files always wait for that, see acquireAlone.
+type memoryBudget struct {
+	limit int64
+
+	lock      sync.Mutex
+	cond      *sync.Cond
+	used      int64
+	cancelled bool
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	mb := &memoryBudget{limit: limit}
+	mb.cond = sync.NewCond(&mb.lock)
+	return mb
+}
+
+// acquire blocks until cost fits in the budget, and returns false
+// if the budget was cancelled while waiting.
+func (mb *memoryBudget) acquire(cost int64) bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	for !mb.cancelled && mb.limit > 0 && mb.used > 0 && mb.used+cost > mb.limit {
+		mb.cond.Wait()
+	}
+	if mb.cancelled {
+		return false
+	}
+
+	mb.used += cost
+	return true
+}
+
+// acquireAlone blocks until nothing else is in flight, and returns
+// false if the budget was cancelled while waiting.
+func (mb *memoryBudget) acquireAlone(cost int64) bool {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	for !mb.cancelled && mb.used > 0 {
+		mb.cond.Wait()
+	}
+	if mb.cancelled {
+		return false
+	}
+
+	mb.used += cost
+	return true
+}
+
+func (mb *memoryBudget) release(cost int64) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	mb.used -= cost
+	mb.cond.Broadcast()
+}
+
+func (mb *memoryBudget) cancel() {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	mb.cancelled = true
+	mb.cond.Broadcast()
+}
+
+// A rediffJob is a single file being bsdiff'd by a worker, or
+// by Optimize itself if it's unspooled
+type rediffJob struct {
+	sourceIndex int64
+	diffMapping *DiffMapping
+	cost        int64
+	unspooled   bool
+
+	// bsdiff messages for this file, as they'd be written to the patch
+	spool spool
+	err   error
+	// closed when an unspooled job can start
+	ready chan struct{}
+	// closed when the worker (or Optimize) is done with this job
+	done chan struct{}
+}
+
+// A rediffScheduler bsdiffs up to Params.Workers files at once, ahead
+// of Optimize, which writes their output in file index order. Unspooled
+// files are bsdiff'd by Optimize, while workers wait.
+type rediffScheduler struct {
+	jobs   map[int64]*rediffJob
+	budget *memoryBudget
+
+	cancel chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (cx *context) startRediffScheduler(params OptimizeParams, sourceContainer *tlc.Container) *rediffScheduler {
+	rs := &rediffScheduler{
+		jobs:   make(map[int64]*rediffJob),
+		budget: newMemoryBudget(cx.params.MemoryBudget),
+		cancel: make(chan struct{}),
+	}
+
+	var orderedJobs []*rediffJob
+	for sourceFileIndex := range sourceContainer.Files {
+		sourceIndex := int64(sourceFileIndex)
+		diffMapping := cx.diffMappings[sourceIndex]
+		if diffMapping == nil {
+			continue
+		}
+
+		job := &rediffJob{
+			sourceIndex: sourceIndex,
+			diffMapping: diffMapping,
+			cost:        cx.plan.EstimatedMemory[sourceIndex],
+			unspooled:   cx.plan.Unspooled[sourceIndex],
+			ready:       make(chan struct{}),
+			done:        make(chan struct{}),
+		}
+		rs.jobs[job.sourceIndex] = job
+		orderedJobs = append(orderedJobs, job)
+	}
+
+	jobsChan := make(chan *rediffJob)
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		defer close(jobsChan)
+
+		// jobs are handed out in order, so the one Optimize is waiting
+		// for always got its share of the budget before later ones.
+		for _, job := range orderedJobs {
+			if job.unspooled {
+				// Optimize gets to it once all the jobs before it are
+				// written, and nothing else starts until it's done.
+				if !rs.budget.acquireAlone(job.cost) {
+					return
+				}
+				close(job.ready)
+
+				select {
+				case <-job.done:
+				case <-rs.cancel:
+					return
+				}
+				continue
+			}
+
+			if !rs.budget.acquire(job.cost) {
+				return
+			}
+
+			select {
+			case jobsChan <- job:
+			case <-rs.cancel:
+				return
+			}
+		}
+	}()
+
+	// pools aren't safe for concurrent use, workers take turns
+	// reading whole files out of them.
+	var poolLock sync.Mutex
+	var statsLock sync.Mutex
+
+	for i := 0; i < cx.params.Workers; i++ {
+		rs.wg.Add(1)
+		go func() {
+			defer rs.wg.Done()
+
+			for job := range jobsChan {
+				job.err = cx.runRediffJob(params, job, &poolLock, &statsLock)
+				close(job.done)
+			}
+		}()
+	}
+
+	return rs
+}
+
+// runRediffJob bsdiffs a single file into its job's spool
+func (cx *context) runRediffJob(params OptimizeParams, job *rediffJob, poolLock *sync.Mutex, statsLock *sync.Mutex) error {
+	var stats *bsdiff.DiffStats
+	if cx.params.BsdiffStats != nil {
+		stats = &bsdiff.DiffStats{}
+		defer func() {
+			statsLock.Lock()
+			mergeDiffStats(cx.params.BsdiffStats, stats)
+			statsLock.Unlock()
+		}()
+	}
+
+	// each job gets its own context, so its buffers can
+	// be reclaimed once it's done.
+	bdc := &bsdiff.DiffContext{
+		SuffixSortConcurrency: cx.params.SuffixSortConcurrency,
+		Partitions:            cx.params.Partitions,
+		Stats:                 stats,
+		MeasureMem:            cx.params.MeasureMem,
+		WindowSize:            cx.params.BsdiffWindowSize,
+	}
+	wctx := wire.NewWriteContext(&job.spool)
+
+	targetData, sourceData, err := func() ([]byte, []byte, error) {
+		poolLock.Lock()
+		defer poolLock.Unlock()
+
+		targetData, err := readWholeFile(params.TargetPool, job.diffMapping.TargetIndices()...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sourceData, err := readWholeFile(params.SourcePool, job.sourceIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return targetData, sourceData, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	err = bdc.Do(bytes.NewReader(targetData), bytes.NewReader(sourceData), wctx.WriteMessage, &state.Consumer{})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// isUnspooled returns true if a file is to be bsdiff'd by Optimize,
+// see startUnspooled
+func (rs *rediffScheduler) isUnspooled(sourceIndex int64) bool {
+	return rs.jobs[sourceIndex].unspooled
+}
+
+// startUnspooled waits for all the files before an unspooled one to be
+// written, and for workers to stop picking up new ones. Optimize can then
+// bsdiff it straight to the patch, and call finishUnspooled.
+func (rs *rediffScheduler) startUnspooled(sourceIndex int64) error {
+	job := rs.jobs[sourceIndex]
+	select {
+	case <-job.ready:
+		return nil
+	case <-rs.cancel:
+		return errors.New("rediff: scheduler stopped")
+	}
+}
+
+// finishUnspooled lets workers pick up new files again
+func (rs *rediffScheduler) finishUnspooled(sourceIndex int64) {
+	job := rs.jobs[sourceIndex]
+	rs.budget.release(job.cost)
+	close(job.done)
+}
+
+// writeJob waits for a file's bsdiff output, and writes it to w
+func (rs *rediffScheduler) writeJob(sourceIndex int64, w io.Writer) error {
+	job := rs.jobs[sourceIndex]
+	<-job.done
+
+	if job.err != nil {
+		return errors.WithStack(job.err)
+	}
+
+	_, err := job.spool.WriteTo(w)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = job.spool.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rs.budget.release(job.cost)
+	return nil
+}
+
+// stop makes workers stop picking up new jobs, waits for them,
+// and gets rid of the output of jobs that weren't written.
+func (rs *rediffScheduler) stop() {
+	close(rs.cancel)
+	rs.budget.cancel()
+	rs.wg.Wait()
+
+	for _, job := range rs.jobs {
+		job.spool.Close()
+	}
+}
+
+// A spool holds bsdiff output in memory, up to maxMemorySpool,
+// then in a temporary file.
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+}
+
+var _ io.Writer = (*spool)(nil)
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > maxMemorySpool {
+		f, err := ioutil.TempFile("", "rediff-spool")
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		s.file = f
+
+		_, err = s.buf.WriteTo(f)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		s.buf = bytes.Buffer{}
+	}
+
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// WriteTo copies everything written to the spool so far to w
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	if s.file == nil {
+		return s.buf.WriteTo(w)
+	}
+
+	_, err := s.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close frees the spool's memory, and removes its temporary file
+func (s *spool) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		os.Remove(name)
+		return errors.WithStack(err)
+	}
+
+	err = os.Remove(name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readWholeFile reads a file of pool, or the concatenation of several
+func readWholeFile(pool lake.Pool, fileIndices ...int64) ([]byte, error) {
+	r, err := pwr.OpenBsdiffTargets(pool, fileIndices)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+func mergeDiffStats(dst *bsdiff.DiffStats, src *bsdiff.DiffStats) {
+	dst.TimeSpentSorting += src.TimeSpentSorting
+	dst.TimeSpentScanning += src.TimeSpentScanning
+	if src.BiggestAdd > dst.BiggestAdd {
+		dst.BiggestAdd = src.BiggestAdd
+	}
+}
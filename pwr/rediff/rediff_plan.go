@@ -0,0 +1,112 @@
+package rediff
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/itchio/headway/united"
+	"github.com/itchio/lake/tlc"
+)
+
+// A Plan sums up what Optimize is going to do with the diff mappings
+// found while analyzing a patch, given Params.MemoryBudget.
+type Plan struct {
+	// EstimatedMemory maps the index of each source file that's going
+	// to be bsdiff'd to how much memory doing so is estimated to use.
+	EstimatedMemory map[int64]int64
+
+	// PeakMemory is the largest estimate of a single file.
+	PeakMemory int64
+
+	// Unspooled lists the source files that are bsdiff'd straight to the
+	// patch, while other workers wait, when Params.Workers is over 1:
+	// those that are diffed one window at a time, and those that would
+	// use more than Params.MemoryBudget if their output was spooled.
+	Unspooled map[int64]bool
+
+	// Skipped lists the source files that had a diff mapping, but
+	// that would use more than Params.MemoryBudget to bsdiff, even
+	// unspooled. Their rsync operations are copied as-is instead.
+	Skipped []*SkippedFile
+}
+
+// A SkippedFile is a source file rediff won't bsdiff to stay
+// under Params.MemoryBudget.
+type SkippedFile struct {
+	SourceIndex     int64
+	DiffMapping     *DiffMapping
+	EstimatedMemory int64
+}
+
+// ToString returns a human-readable list of skipped files.
+func (p *Plan) ToString(sourceContainer tlc.Container, targetContainer tlc.Container) string {
+	s := ""
+	for _, sf := range p.Skipped {
+		var targetPaths []string
+		for _, targetIndex := range sf.DiffMapping.TargetIndices() {
+			targetPaths = append(targetPaths, targetContainer.Files[targetIndex].Path)
+		}
+
+		s += fmt.Sprintf("%s <- %s (skipped, would use %s)\n",
+			sourceContainer.Files[sf.SourceIndex].Path,
+			strings.Join(targetPaths, " + "),
+			united.FormatBytes(sf.EstimatedMemory),
+		)
+	}
+	return s
+}
+
+// estimateMemory returns how much memory bsdiff'ing a source file
+// against the targets of its mapping is estimated to use.
+func (cx *context) estimateMemory(diffMapping *DiffMapping, sourceFile *tlc.File, spooled bool) int64 {
+	return estimateDiffMemory(diffMapping.targetSize(cx.targetContainer), sourceFile.Size, cx.params.BsdiffWindowSize, spooled)
+}
+
+// planMemory goes through the diff mappings found by analyzePatch, and
+// skips the files that would use more than Params.MemoryBudget on their
+// own. With several workers, it picks the files that can't be spooled.
+// Files diffed concurrently are kept under budget by the scheduler.
+func (cx *context) planMemory() {
+	plan := &Plan{
+		EstimatedMemory: make(map[int64]int64),
+		Unspooled:       make(map[int64]bool),
+	}
+	budget := cx.params.MemoryBudget
+
+	for sourceFileIndex, sourceFile := range cx.sourceContainer.Files {
+		sourceIndex := int64(sourceFileIndex)
+		diffMapping := cx.diffMappings[sourceIndex]
+		if diffMapping == nil {
+			continue
+		}
+
+		mem := cx.estimateMemory(diffMapping, sourceFile, false)
+		if budget > 0 && mem > budget {
+			plan.Skipped = append(plan.Skipped, &SkippedFile{
+				SourceIndex:     sourceIndex,
+				DiffMapping:     diffMapping,
+				EstimatedMemory: mem,
+			})
+			delete(cx.diffMappings, sourceIndex)
+			continue
+		}
+
+		if cx.params.Workers > 1 {
+			// workers spool their output until it's that file's turn to be written
+			spooledMem := cx.estimateMemory(diffMapping, sourceFile, true)
+			windowed := needsWindowedDiff(diffMapping.targetSize(cx.targetContainer), sourceFile.Size)
+			if windowed || (budget > 0 && spooledMem > budget) {
+				plan.Unspooled[sourceIndex] = true
+			} else {
+				mem = spooledMem
+			}
+		}
+
+		plan.EstimatedMemory[sourceIndex] = mem
+		if mem > plan.PeakMemory {
+			plan.PeakMemory = mem
+		}
+	}
+
+	cx.plan = plan
+}
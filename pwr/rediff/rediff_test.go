@@ -3,8 +3,10 @@ package rediff_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
@@ -22,7 +24,10 @@ import (
 	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/pwr/patcher"
 	"github.com/itchio/wharf/pwr/rediff"
+	"github.com/itchio/wharf/wire"
 	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 )
 
 type brotliCompressor struct{}
@@ -49,6 +54,14 @@ type rediffScenario struct {
 	v1         wtest.TestDirSettings
 	v2         wtest.TestDirSettings
 	partitions int
+
+	workers      int
+	memoryBudget int64
+
+	maxTargetsPerFile int
+	bsdiffWindowSize  int64
+	checkMappings     func(rc rediff.Context)
+	checkPatch        func(patch []byte)
 }
 
 func Test_RediffOneSeq(t *testing.T) {
@@ -195,6 +208,236 @@ func Test_RediffStillBetter(t *testing.T) {
 	})
 }
 
+func Test_RediffParallel(t *testing.T) {
+	var v1, v2 []wtest.TestDirEntry
+	for i := 0; i < 12; i++ {
+		path := fmt.Sprintf("dir%d/file-%d", i%3, i)
+		seed := int64(0x10 + i)
+		size := pwr.BlockSize*int64(1+i%4) + int64(i*17)
+		v1 = append(v1, wtest.TestDirEntry{Path: path, Seed: seed, Size: size})
+		v2 = append(v2, wtest.TestDirEntry{Path: path, Seed: seed, Size: size, Bsmods: []wtest.Bsmod{
+			wtest.Bsmod{Interval: pwr.BlockSize/3 + int64(i), Delta: 0x4},
+		}})
+	}
+	// untouched files in between bsdiff'd ones
+	v1 = append(v1, wtest.TestDirEntry{Path: "same", Seed: 0x99})
+	v2 = append(v2, wtest.TestDirEntry{Path: "same", Seed: 0x99})
+
+	for _, memoryBudget := range []int64{0, 1, pwr.BlockSize * 40} {
+		runRediffScenario(t, rediffScenario{
+			name:         fmt.Sprintf("parallel rediff (budget %d)", memoryBudget),
+			v1:           wtest.TestDirSettings{Entries: v1},
+			v2:           wtest.TestDirSettings{Entries: v2},
+			partitions:   2,
+			workers:      4,
+			memoryBudget: memoryBudget,
+		})
+	}
+}
+
+func Test_RediffParallelWindowed(t *testing.T) {
+	// diff files over 4 blocks one window at a time, and
+	// spool most of the output of others to temporary files
+	defer rediff.SetWindowedDiffThreshold(pwr.BlockSize * 4)()
+	defer rediff.SetMaxMemorySpool(1024)()
+
+	var v1, v2 []wtest.TestDirEntry
+	for i := 0; i < 6; i++ {
+		path := fmt.Sprintf("file-%d", i)
+		seed := int64(0x40 + i)
+		size := pwr.BlockSize*int64(3+i%3) + int64(i*23)
+		v1 = append(v1, wtest.TestDirEntry{Path: path, Seed: seed, Size: size})
+		v2 = append(v2, wtest.TestDirEntry{Path: path, Seed: seed, Size: size, Bsmods: []wtest.Bsmod{
+			wtest.Bsmod{Interval: pwr.BlockSize/3 + int64(i), Delta: 0x4},
+		}})
+	}
+
+	runRediffScenario(t, rediffScenario{
+		name:             "parallel windowed rediff",
+		v1:               wtest.TestDirSettings{Entries: v1},
+		v2:               wtest.TestDirSettings{Entries: v2},
+		workers:          3,
+		bsdiffWindowSize: pwr.BlockSize,
+		checkMappings: func(rc rediff.Context) {
+			plan := rc.GetPlan()
+			assert.Len(t, rc.GetDiffMappings(), 6)
+			for sourceIndex, f := range rc.GetSourceContainer().Files {
+				windowed := f.Size > pwr.BlockSize*4
+				assert.EqualValues(t, windowed, plan.Unspooled[int64(sourceIndex)], "windowed files aren't spooled")
+			}
+		},
+	})
+}
+
+func Test_RediffMemoryBudget(t *testing.T) {
+	v1 := wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "small", Seed: 0x1, Size: pwr.BlockSize * 2},
+			{Path: "medium", Seed: 0x3, Size: pwr.BlockSize * 3},
+			{Path: "large", Seed: 0x2, Size: pwr.BlockSize * 8},
+		},
+	}
+	v2 := wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "small", Seed: 0x1, Size: pwr.BlockSize * 2, Bsmods: []wtest.Bsmod{
+				wtest.Bsmod{Interval: pwr.BlockSize/3 + 1, Delta: 0x4},
+			}},
+			{Path: "medium", Seed: 0x3, Size: pwr.BlockSize * 3, Bsmods: []wtest.Bsmod{
+				wtest.Bsmod{Interval: pwr.BlockSize/3 + 1, Delta: 0x4},
+			}},
+			{Path: "large", Seed: 0x2, Size: pwr.BlockSize * 8, Bsmods: []wtest.Bsmod{
+				wtest.Bsmod{Interval: pwr.BlockSize/3 + 1, Delta: 0x4},
+			}},
+		},
+	}
+
+	// enough for the small file, for the medium one only if its
+	// output isn't spooled, and not for the large one
+	memoryBudget := pwr.BlockSize * 40
+
+	for _, workers := range []int{0, 2} {
+		runRediffScenario(t, rediffScenario{
+			name:         fmt.Sprintf("memory budget (%d workers)", workers),
+			v1:           v1,
+			v2:           v2,
+			workers:      workers,
+			memoryBudget: memoryBudget,
+			checkMappings: func(rc rediff.Context) {
+				sourceContainer := rc.GetSourceContainer()
+				plan := rc.GetPlan()
+
+				if assert.Len(t, plan.Skipped, 1) {
+					skipped := plan.Skipped[0]
+					assert.EqualValues(t, "large", sourceContainer.Files[skipped.SourceIndex].Path)
+					assert.True(t, skipped.EstimatedMemory > memoryBudget)
+				}
+
+				mappings := rc.GetDiffMappings()
+				assert.Len(t, mappings, 2)
+				for sourceIndex := range mappings {
+					path := sourceContainer.Files[sourceIndex].Path
+					assert.True(t, plan.EstimatedMemory[sourceIndex] <= memoryBudget)
+
+					// with workers, the medium file is diffed alone, straight to the patch
+					unspooled := workers > 1 && path == "medium"
+					assert.EqualValues(t, unspooled, plan.Unspooled[sourceIndex], "%s unspooled", path)
+				}
+			},
+		})
+	}
+}
+
+func Test_PlanToString(t *testing.T) {
+	sourceContainer := tlc.Container{
+		Files: []*tlc.File{{Path: "joined"}},
+	}
+	targetContainer := tlc.Container{
+		Files: []*tlc.File{{Path: "first"}, {Path: "second"}},
+	}
+
+	plan := &rediff.Plan{
+		Skipped: []*rediff.SkippedFile{
+			{
+				SourceIndex: 0,
+				DiffMapping: &rediff.DiffMapping{
+					TargetIndex:        0,
+					ExtraTargetIndices: []int64{1},
+				},
+				EstimatedMemory: 1024,
+			},
+		},
+	}
+
+	s := plan.ToString(sourceContainer, targetContainer)
+	assert.Contains(t, s, "joined <- first + second (skipped")
+}
+
+func Test_RediffMultiTarget(t *testing.T) {
+	rng := rand.New(rand.NewSource(0xb0b))
+	var parts [][]byte
+	for i := 0; i < 3; i++ {
+		part := make([]byte, pwr.BlockSize*4+int64(i*31))
+		rng.Read(part)
+		parts = append(parts, part)
+	}
+
+	// the new bundle is all the old parts, with their first half
+	// slightly modified, so rsync only finds their second half
+	var bundle []byte
+	for _, part := range parts {
+		modified := append([]byte(nil), part...)
+		for j := 0; j < len(modified)/2; j += 997 {
+			modified[j] += 0x4
+		}
+		bundle = append(bundle, modified...)
+	}
+
+	v1 := wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "assets/part-0", Data: parts[0]},
+			{Path: "assets/part-1", Data: parts[1]},
+			{Path: "assets/part-2", Data: parts[2]},
+			{Path: "other", Seed: 0x99},
+		},
+	}
+	v2 := wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "assets/bundle", Data: bundle},
+			{Path: "other", Seed: 0x99},
+		},
+	}
+
+	for _, maxTargets := range []int{0, 2, 3} {
+		for _, workers := range []int{0, 2} {
+			maxTargets := maxTargets
+			runRediffScenario(t, rediffScenario{
+				name:              fmt.Sprintf("multi-target rediff (%d targets, %d workers)", maxTargets, workers),
+				v1:                v1,
+				v2:                v2,
+				partitions:        2,
+				workers:           workers,
+				maxTargetsPerFile: maxTargets,
+				checkMappings: func(rc rediff.Context) {
+					bundleIndex := int64(-1)
+					for i, f := range rc.GetSourceContainer().Files {
+						if f.Path == "assets/bundle" {
+							bundleIndex = int64(i)
+						}
+					}
+
+					dm := rc.GetDiffMappings()[bundleIndex]
+					if dm == nil {
+						t.Fatalf("no diff mapping for bundle")
+					}
+
+					expected := maxTargets
+					if expected < 1 {
+						expected = 1
+					}
+					assert.EqualValues(t, expected, len(dm.TargetIndices()))
+				},
+				checkPatch: func(patch []byte) {
+					// patchers that predate multi-target bsdiff refuse these patches
+					rctx := wire.NewReadContext(seeksource.FromBytes(patch))
+					wtest.Must(t, rctx.Resume(nil))
+					err := rctx.ExpectMagic(pwr.PatchMagic)
+					if maxTargets > 1 {
+						assert.Equal(t, wire.ErrFormat, errors.Cause(err))
+					} else {
+						assert.NoError(t, err)
+					}
+
+					rctx = wire.NewReadContext(seeksource.FromBytes(patch))
+					wtest.Must(t, rctx.Resume(nil))
+					header, err := pwr.ReadPatchHeader(rctx)
+					wtest.Must(t, err)
+					assert.EqualValues(t, maxTargets > 1, header.HasFeature(pwr.PatchFeature_MULTI_TARGET_BSDIFF))
+				},
+			})
+		}
+	}
+}
+
 func runRediffScenario(t *testing.T, scenario rediffScenario) {
 	log := t.Logf
 
@@ -296,11 +539,19 @@ func runRediffScenario(t *testing.T, scenario rediffScenario) {
 			SuffixSortConcurrency: 0,
 			PatchReader:           seeksource.FromBytes(patchBuffer.Bytes()),
 			Partitions:            scenario.partitions,
+			Workers:               scenario.workers,
+			MemoryBudget:          scenario.memoryBudget,
+			MaxTargetsPerFile:     scenario.maxTargetsPerFile,
+			BsdiffWindowSize:      scenario.bsdiffWindowSize,
 
 			BsdiffStats: &stats,
 		})
 		wtest.Must(t, err)
 
+		if scenario.checkMappings != nil {
+			scenario.checkMappings(rc)
+		}
+
 		log("Optimizing (%d partitions)...", rc.Partitions())
 
 		optimizedPatchBuffer := new(bytes.Buffer)
@@ -313,12 +564,47 @@ func runRediffScenario(t *testing.T, scenario rediffScenario) {
 		})
 		wtest.Must(t, oErr)
 
+		if scenario.checkPatch != nil {
+			scenario.checkPatch(optimizedPatchBuffer.Bytes())
+		}
+
 		log("Optimized patch in %s (spent %s sorting, %s scanning)",
 			time.Since(beforeOptimize),
 			stats.TimeSpentSorting,
 			stats.TimeSpentScanning,
 		)
 
+		if scenario.workers > 1 {
+			// compressors don't always give the same output for the same
+			// data written in different chunks, so compare uncompressed patches
+			optimizeUncompressed := func(workers int) []byte {
+				rc, err := rediff.NewContext(rediff.Params{
+					Compression: &pwr.CompressionSettings{
+						Algorithm: pwr.CompressionAlgorithm_NONE,
+					},
+					PatchReader:       seeksource.FromBytes(patchBuffer.Bytes()),
+					Partitions:        scenario.partitions,
+					Workers:           workers,
+					MemoryBudget:      scenario.memoryBudget,
+					MaxTargetsPerFile: scenario.maxTargetsPerFile,
+					BsdiffWindowSize:  scenario.bsdiffWindowSize,
+				})
+				wtest.Must(t, err)
+
+				buf := new(bytes.Buffer)
+				wtest.Must(t, rc.Optimize(rediff.OptimizeParams{
+					TargetPool:  fspool.New(rc.GetTargetContainer(), v1),
+					SourcePool:  fspool.New(rc.GetSourceContainer(), v2),
+					PatchWriter: buf,
+				}))
+				return buf.Bytes()
+			}
+
+			if !bytes.Equal(optimizeUncompressed(0), optimizeUncompressed(scenario.workers)) {
+				t.Errorf("%s: optimizing with %d workers gave a different patch than sequentially", scenario.name, scenario.workers)
+			}
+		}
+
 		before := patchBuffer.Len()
 		after := optimizedPatchBuffer.Len()
 
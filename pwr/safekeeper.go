@@ -17,10 +17,12 @@ type fileBlocks = map[int]error
 type safeKeeper struct {
 	inner lake.Pool
 
-	open SafeKeeperOpen
+	open        SafeKeeperOpen
+	trustedKeys *KeySet
 
 	blockValidatorLock sync.Mutex
 	blockValidator     BlockValidator
+	blockSize          int64
 	sigError           error
 
 	bufLock sync.Mutex
@@ -34,6 +36,10 @@ var _ lake.Pool = (*safeKeeper)(nil)
 type SafeKeeperParams struct {
 	Inner lake.Pool
 	Open  SafeKeeperOpen
+
+	// TrustedKeys (optional) is the key set the signature opened
+	// must be signed with, see ReadTrustedSignature
+	TrustedKeys *KeySet
 }
 
 func NewSafeKeeper(params SafeKeeperParams) (lake.Pool, error) {
@@ -45,12 +51,11 @@ func NewSafeKeeper(params SafeKeeperParams) (lake.Pool, error) {
 	}
 
 	sk := &safeKeeper{
-		inner: params.Inner,
-		open:  params.Open,
+		inner:       params.Inner,
+		open:        params.Open,
+		trustedKeys: params.TrustedKeys,
 
 		validBlocks: make(map[int64]fileBlocks),
-
-		buf: make([]byte, BlockSize),
 	}
 	return sk, nil
 }
@@ -106,7 +111,7 @@ func (sk *safeKeeper) getBlockValidator() (BlockValidator, error) {
 	// correctly so it doesn't.
 	ctx := context.Background()
 
-	sigInfo, err := ReadSignature(ctx, source)
+	sigInfo, err := ReadTrustedSignature(ctx, source, sk.trustedKeys)
 	if err != nil {
 		sk.sigError = err
 		return nil, err
@@ -119,6 +124,8 @@ func (sk *safeKeeper) getBlockValidator() (BlockValidator, error) {
 	}
 
 	sk.blockValidator = NewBlockValidator(hashInfo)
+	sk.blockSize = hashInfo.BlockSize
+	sk.buf = make([]byte, sk.blockSize)
 	return sk.blockValidator, nil
 }
 
@@ -132,18 +139,19 @@ func (sk *safeKeeper) validateBlock(skr *safeKeeperReader) error {
 	}
 	blocks := sk.validBlocks[skr.fileIndex]
 
-	blockIndex := skr.offset / BlockSize
+	bv, err := sk.getBlockValidator()
+	if err != nil {
+		return err
+	}
+
+	blockIndex := skr.offset / sk.blockSize
 	if _, checked := blocks[int(blockIndex)]; !checked {
-		bv, err := sk.getBlockValidator()
-		if err != nil {
-			return err
-		}
 
 		blockSize := bv.BlockSize(skr.fileIndex, blockIndex)
 		buf := sk.buf[:blockSize]
 
 		savedOffset := skr.offset
-		blockOffset := blockIndex * BlockSize
+		blockOffset := blockIndex * sk.blockSize
 		_, err = skr.rs.Seek(blockOffset, io.SeekStart)
 		if err != nil {
 			// restore offset
@@ -2,6 +2,7 @@ package pwr
 
 import (
 	"context"
+	"crypto/sha256"
 	"io"
 
 	"github.com/itchio/savior"
@@ -19,6 +20,15 @@ import (
 type SignatureInfo struct {
 	Container *tlc.Container
 	Hashes    []wsync.BlockHash
+
+	// BlockSize is the size of hashed blocks, 0 means the default BlockSize
+	BlockSize int64
+
+	// Chunker is set when hashes are of content-defined chunks
+	Chunker *ChunkerSettings
+
+	// FileDigests holds the SHA-256 of each file, if the signature has them
+	FileDigests [][]byte
 }
 
 // ComputeSignature compute the signature of all blocks of all files in a given container,
@@ -41,6 +51,63 @@ func ComputeSignature(ctx context.Context, container *tlc.Container, pool lake.P
 // ComputeSignatureToWriter is a variant of ComputeSignature that writes hashes
 // to a callback
 func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, pool lake.Pool, consumer *state.Consumer, sigWriter wsync.SignatureWriter) error {
+	return computeSignatureToWriter(ctx, container, pool, BlockSize, nil, consumer, sigWriter)
+}
+
+// ComputeSignatureWithBlockSize is like ComputeSignature, but hashes blocks
+// of the given size instead of the default BlockSize. The result can be used
+// as the TargetSignature of a DiffContext with the same block size.
+func ComputeSignatureWithBlockSize(ctx context.Context, container *tlc.Container, pool lake.Pool, blockSize int64, consumer *state.Consumer) ([]wsync.BlockHash, error) {
+	err := ValidateBlockSize(blockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var signature []wsync.BlockHash
+
+	err = computeSignatureToWriter(ctx, container, pool, blockSize, nil, consumer, func(bl wsync.BlockHash) error {
+		signature = append(signature, bl)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return signature, nil
+}
+
+// ComputeChunkSignature is like ComputeSignature, but hashes content-defined chunks
+// instead of fixed-size blocks. The result can be used as the TargetSignature of
+// a DiffContext with the same chunker settings.
+func ComputeChunkSignature(ctx context.Context, container *tlc.Container, pool lake.Pool, chunker *ChunkerSettings, consumer *state.Consumer) ([]wsync.BlockHash, error) {
+	var signature []wsync.BlockHash
+
+	err := ComputeChunkSignatureToWriter(ctx, container, pool, chunker, consumer, func(bl wsync.BlockHash) error {
+		signature = append(signature, bl)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return signature, nil
+}
+
+// ComputeChunkSignatureToWriter is a variant of ComputeChunkSignature that writes hashes
+// to a callback
+func ComputeChunkSignatureToWriter(ctx context.Context, container *tlc.Container, pool lake.Pool, chunker *ChunkerSettings, consumer *state.Consumer, sigWriter wsync.SignatureWriter) error {
+	if chunker == nil {
+		return errors.Errorf("no chunker settings specified")
+	}
+	err := chunker.Params().Validate()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return computeSignatureToWriter(ctx, container, pool, BlockSize, chunker, consumer, sigWriter)
+}
+
+func computeSignatureToWriter(ctx context.Context, container *tlc.Container, pool lake.Pool, blockSize int64, chunker *ChunkerSettings, consumer *state.Consumer, sigWriter wsync.SignatureWriter) error {
 	var err error
 
 	defer func() {
@@ -49,7 +116,7 @@ func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, poo
 		}
 	}()
 
-	sctx := mksync()
+	sctx := mksync(blockSize)
 
 	totalBytes := container.Size
 	fileOffset := int64(0)
@@ -76,7 +143,11 @@ func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, poo
 		}
 
 		cr := counter.NewReaderCallback(onRead, reader)
-		err = sctx.CreateSignature(ctx, int64(fileIndex), cr, sigWriter)
+		if chunker != nil {
+			err = sctx.CreateChunkSignature(ctx, int64(fileIndex), cr, chunker.Params(), sigWriter)
+		} else {
+			err = sctx.CreateSignature(ctx, int64(fileIndex), cr, sigWriter)
+		}
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -91,14 +162,34 @@ func ComputeSignatureToWriter(ctx context.Context, container *tlc.Container, poo
 // ReadSignature reads the hashes from all files of a given container, from a
 // wharf signature file.
 func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*SignatureInfo, error) {
-	rawSigWire := wire.NewReadContext(signatureReader)
-	err := rawSigWire.ExpectMagic(SignatureMagic)
+	return ReadTrustedSignature(ctx, signatureReader, nil)
+}
+
+// ReadTrustedSignature is like ReadSignature, but when trustedKeys is set,
+// the signature file must be signed with one of them.
+func ReadTrustedSignature(ctx context.Context, signatureReader savior.SeekSource, trustedKeys *KeySet) (*SignatureInfo, error) {
+	signatureReader, err := AuthenticateSource(signatureReader, trustedKeys)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	header := &SignatureHeader{}
-	err = rawSigWire.ReadMessage(header)
+	sigInfo, err := readSignature(ctx, signatureReader)
+	if err != nil {
+		return nil, AuthError(signatureReader, err)
+	}
+
+	err = FinishAuthentication(signatureReader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return sigInfo, nil
+}
+
+func readSignature(ctx context.Context, signatureReader savior.SeekSource) (*SignatureInfo, error) {
+	var err error
+
+	rawSigWire := wire.NewReadContext(signatureReader)
+	header, err := ReadSignatureHeader(rawSigWire)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -108,6 +199,12 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 		return nil, errors.WithStack(err)
 	}
 
+	err = ValidateBlockSize(header.BlockSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	blockSize := ResolveBlockSize(header.BlockSize)
+
 	container := &tlc.Container{}
 	err = sigWire.ReadMessage(container)
 	if err != nil {
@@ -118,6 +215,32 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 		}
 	}
 
+	if header.Chunker != nil {
+		err = header.Chunker.Params().Validate()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		hashes, err := readChunkHashes(ctx, sigWire, container)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		digests, err := readFileDigests(sigWire, header, container)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		signature := &SignatureInfo{
+			Container:   container,
+			Hashes:      hashes,
+			BlockSize:   blockSize,
+			Chunker:     header.Chunker,
+			FileDigests: digests,
+		}
+		return signature, nil
+	}
+
 	var hashes []wsync.BlockHash
 	hash := &BlockHash{}
 
@@ -129,7 +252,7 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 			// keep going!
 		}
 
-		numBlocks := ComputeNumBlocks(f.Size)
+		numBlocks := ComputeNumBlocksFor(f.Size, blockSize)
 		if numBlocks == 0 {
 			hash.Reset()
 			err = sigWire.ReadMessage(hash)
@@ -167,8 +290,8 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 
 			// full blocks have a shortSize of 0, for more compact storage
 			shortSize := int32(0)
-			if (blockIndex+1)*BlockSize > f.Size {
-				shortSize = int32(f.Size % BlockSize)
+			if (blockIndex+1)*blockSize > f.Size {
+				shortSize = int32(f.Size % blockSize)
 			}
 
 			blockHash := wsync.BlockHash{
@@ -184,9 +307,96 @@ func ReadSignature(ctx context.Context, signatureReader savior.SeekSource) (*Sig
 		}
 	}
 
+	digests, err := readFileDigests(sigWire, header, container)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	signature := &SignatureInfo{
-		Container: container,
-		Hashes:    hashes,
+		Container:   container,
+		Hashes:      hashes,
+		BlockSize:   blockSize,
+		FileDigests: digests,
 	}
 	return signature, nil
 }
+
+// readFileDigests reads the digests that follow the block hashes,
+// for signatures that have them.
+func readFileDigests(sigWire *wire.ReadContext, header *SignatureHeader, container *tlc.Container) ([][]byte, error) {
+	if !header.FileDigests {
+		return nil, nil
+	}
+
+	fileDigests := &FileDigests{}
+	err := sigWire.ReadMessage(fileDigests)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading file digests")
+	}
+
+	if len(fileDigests.Sha256) != len(container.Files) {
+		return nil, errors.Errorf("expected %d file digests in signature, got %d", len(container.Files), len(fileDigests.Sha256))
+	}
+	for fileIndex, digest := range fileDigests.Sha256 {
+		if len(digest) != sha256.Size {
+			return nil, errors.Errorf("invalid digest for (%s): expected %d bytes, got %d", container.Files[fileIndex].Path, sha256.Size, len(digest))
+		}
+	}
+
+	return fileDigests.Sha256, nil
+}
+
+// readChunkHashes reads content-defined chunk hashes: their sizes add
+// up to the size of the file they belong to.
+func readChunkHashes(ctx context.Context, sigWire *wire.ReadContext, container *tlc.Container) ([]wsync.BlockHash, error) {
+	var hashes []wsync.BlockHash
+	hash := &BlockHash{}
+
+	for fileIndex, f := range container.Files {
+		select {
+		case <-ctx.Done():
+			return nil, werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		offset := int64(0)
+		for blockIndex := int64(0); ; blockIndex++ {
+			hash.Reset()
+			err := sigWire.ReadMessage(hash)
+			if err != nil {
+				if errors.Cause(err) == io.EOF {
+					return hashes, nil
+				}
+				return nil, errors.WithStack(err)
+			}
+
+			if hash.Size < 0 || offset+hash.Size > f.Size {
+				return nil, errors.Errorf("corrupted signature: chunk %d of %s spans %d-%d, but file is %d bytes", blockIndex, f.Path, offset, offset+hash.Size, f.Size)
+			}
+
+			hashes = append(hashes, wsync.BlockHash{
+				FileIndex:  int64(fileIndex),
+				BlockIndex: blockIndex,
+
+				WeakHash:   hash.WeakHash,
+				StrongHash: hash.StrongHash,
+
+				Offset: offset,
+				Size:   hash.Size,
+			})
+			offset += hash.Size
+
+			if offset == f.Size {
+				// empty files have a single empty chunk
+				break
+			}
+
+			if hash.Size == 0 {
+				return nil, errors.Errorf("corrupted signature: empty chunk %d in non-empty file %s", blockIndex, f.Path)
+			}
+		}
+	}
+
+	return hashes, nil
+}
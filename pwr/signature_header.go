@@ -0,0 +1,85 @@
+package pwr
+
+import (
+	"fmt"
+
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupportedSignatureFeature is returned when a signature needs
+// something this version of wharf can't do
+var ErrUnsupportedSignatureFeature = fmt.Errorf("signature needs an unsupported feature")
+
+// supportedSignatureFeatures lists the features this version of wharf can read
+var supportedSignatureFeatures = map[SignatureFeature]bool{
+	SignatureFeature_SIGNATURE_CUSTOM_BLOCK_SIZE: true,
+}
+
+// HasFeature returns true if the signature header lists feature
+func (sh *SignatureHeader) HasFeature(feature SignatureFeature) bool {
+	for _, f := range sh.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadSignatureHeader reads the magic number and header of a signature,
+// and makes sure we support all the features it lists.
+func ReadSignatureHeader(rctx *wire.ReadContext) (*SignatureHeader, error) {
+	magic, err := rctx.ReadMagic()
+	if err != nil {
+		return nil, err
+	}
+
+	if magic != SignatureMagic && magic != FeatureSignatureMagic {
+		return nil, errors.WithStack(wire.ErrFormat)
+	}
+
+	header := &SignatureHeader{}
+	err = rctx.ReadMessage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if (magic == FeatureSignatureMagic) != (len(header.Features) > 0) {
+		return nil, errors.Errorf("signature header lists %d features, but magic is %x", len(header.Features), magic)
+	}
+
+	for _, f := range header.Features {
+		if !supportedSignatureFeatures[f] {
+			return nil, errors.Wrapf(ErrUnsupportedSignatureFeature, "feature %s", f)
+		}
+	}
+
+	return header, nil
+}
+
+// WriteSignatureHeader writes the magic number that goes with the
+// features of a signature header, then the header itself. Headers with
+// a custom block size get the SIGNATURE_CUSTOM_BLOCK_SIZE feature.
+func WriteSignatureHeader(wctx *wire.WriteContext, header *SignatureHeader) error {
+	if header.BlockSize != 0 && !header.HasFeature(SignatureFeature_SIGNATURE_CUSTOM_BLOCK_SIZE) {
+		// readers that only know about 64KB blocks would misread every hash
+		header.Features = append(header.Features, SignatureFeature_SIGNATURE_CUSTOM_BLOCK_SIZE)
+	}
+
+	magic := SignatureMagic
+	if len(header.Features) > 0 {
+		magic = FeatureSignatureMagic
+	}
+
+	err := wctx.WriteMagic(magic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = wctx.WriteMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package pwr
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wtest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SignatureHeaderFeatures(t *testing.T) {
+	write := func(header *SignatureHeader) []byte {
+		buf := new(bytes.Buffer)
+		wctx := wire.NewWriteContext(buf)
+		wtest.Must(t, WriteSignatureHeader(wctx, header))
+		wtest.Must(t, wctx.Close())
+		return buf.Bytes()
+	}
+
+	read := func(data []byte) (*SignatureHeader, error) {
+		rctx := wire.NewReadContext(seeksource.FromBytes(data))
+		wtest.Must(t, rctx.Resume(nil))
+		return ReadSignatureHeader(rctx)
+	}
+
+	expectMagic := func(data []byte, magic int32) error {
+		rctx := wire.NewReadContext(seeksource.FromBytes(data))
+		wtest.Must(t, rctx.Resume(nil))
+		return rctx.ExpectMagic(magic)
+	}
+
+	// default block size: readable by older versions
+	data := write(&SignatureHeader{})
+	wtest.Must(t, expectMagic(data, SignatureMagic))
+	header, err := read(data)
+	wtest.Must(t, err)
+	assert.Empty(t, header.Features)
+
+	// custom block size: refused by older versions
+	data = write(&SignatureHeader{BlockSize: MinBlockSize})
+	assert.Equal(t, wire.ErrFormat, errors.Cause(expectMagic(data, SignatureMagic)))
+	header, err = read(data)
+	wtest.Must(t, err)
+	assert.True(t, header.HasFeature(SignatureFeature_SIGNATURE_CUSTOM_BLOCK_SIZE))
+	assert.EqualValues(t, MinBlockSize, header.BlockSize)
+
+	_, err = read(write(&SignatureHeader{
+		Features: []SignatureFeature{SignatureFeature(42)},
+	}))
+	assert.Equal(t, ErrUnsupportedSignatureFeature, errors.Cause(err))
+
+	// features and magic have to agree
+	buf := new(bytes.Buffer)
+	wctx := wire.NewWriteContext(buf)
+	wtest.Must(t, wctx.WriteMagic(FeatureSignatureMagic))
+	wtest.Must(t, wctx.WriteMessage(&SignatureHeader{}))
+	wtest.Must(t, wctx.Close())
+	_, err = read(buf.Bytes())
+	assert.Error(t, err)
+}
@@ -57,6 +57,13 @@ func (vp *ValidatingPool) GetReadSeeker(fileIndex int64) (io.ReadSeeker, error)
 // pool's writer. It tries really hard to be transparent, but does buffer some data,
 // which means some writing is only done when the returned writer is closed.
 func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
+	return vp.getWriterAt(fileIndex, 0)
+}
+
+// getWriterAt is like GetWriter, except the first block written is validated as
+// block startBlockIndex of the file. Data still goes to the start of the underlying
+// pool's writer, so it's only meant for pools that discard what they're given.
+func (vp *ValidatingPool) getWriterAt(fileIndex int64, startBlockIndex int64) (io.WriteCloser, error) {
 	var wounds chan *Wound
 	var woundsDone chan bool
 
@@ -85,7 +92,7 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		vp.sctx = wsync.NewContext(int(BlockSize))
+		vp.sctx = wsync.NewContext(int(vp.hashInfo.BlockSize))
 	}
 
 	w, err := vp.Pool.GetWriter(fileIndex)
@@ -94,7 +101,7 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 	}
 
 	bv := NewBlockValidator(vp.hashInfo)
-	var blockIndex int64
+	blockIndex := startBlockIndex
 	validate := func(data []byte) error {
 		var err error
 
@@ -126,7 +133,7 @@ func (vp *ValidatingPool) GetWriter(fileIndex int64) (io.WriteCloser, error) {
 
 	dw := &drip.Writer{
 		Writer:   ocw,
-		Buffer:   make([]byte, BlockSize),
+		Buffer:   make([]byte, vp.hashInfo.BlockSize),
 		Validate: validate,
 	}
 
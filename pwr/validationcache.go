@@ -0,0 +1,228 @@
+package pwr
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// A validationCache remembers which files were found valid during the last
+// validation, along with their size, modification time and inode. Files that
+// still look the same on disk, and that the signature still describes the same
+// way, don't need to be hashed again.
+type validationCache struct {
+	hashInfo *HashInfo
+
+	// entries from the cache file, by path
+	previous map[string]*ValidationCacheEntry
+
+	// entries for files seen during this validation, by file index
+	current map[int64]*ValidationCacheEntry
+
+	// files that received at least one wound during this validation
+	wounded      map[int64]bool
+	woundedMutex sync.Mutex
+}
+
+// loadValidationCache reads the cache at cachePath. A missing or unreadable
+// cache is treated as empty, so that at worst, everything gets hashed again.
+func loadValidationCache(cachePath string, signature *SignatureInfo, consumer *state.Consumer) (*validationCache, error) {
+	hashInfo, err := ComputeHashInfo(signature)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	vc := &validationCache{
+		hashInfo: hashInfo,
+		previous: make(map[string]*ValidationCacheEntry),
+		current:  make(map[int64]*ValidationCacheEntry),
+		wounded:  make(map[int64]bool),
+	}
+
+	err = vc.read(cachePath)
+	if err != nil {
+		// start over with an empty cache
+		vc.previous = make(map[string]*ValidationCacheEntry)
+		if !os.IsNotExist(errors.Cause(err)) {
+			consumer.Warnf("Ignoring validation cache: %s", err.Error())
+		}
+	}
+	return vc, nil
+}
+
+func (vc *validationCache) read(cachePath string) error {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	source := seeksource.FromFile(f)
+	_, err = source.Resume(nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rc := wire.NewReadContext(source)
+	err = rc.ExpectMagic(ValidationCacheMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header := &ValidationCacheHeader{}
+	err = rc.ReadMessage(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for {
+		entry := &ValidationCacheEntry{}
+		err = rc.ReadMessage(entry)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		vc.previous[entry.Path] = entry
+	}
+}
+
+// signatureHash returns a hash of everything the signature says
+// about the contents of a file.
+func (vc *validationCache) signatureHash(signature *SignatureInfo, fileIndex int64) []byte {
+	hasher := sha256.New()
+	scratch := make([]byte, 8)
+
+	Endianness.PutUint64(scratch, uint64(vc.hashInfo.BlockSize))
+	hasher.Write(scratch)
+	Endianness.PutUint64(scratch, uint64(signature.Container.Files[fileIndex].Size))
+	hasher.Write(scratch)
+
+	if signature.FileDigests != nil {
+		hasher.Write(signature.FileDigests[fileIndex])
+	}
+	for _, bh := range vc.hashInfo.Groups[fileIndex] {
+		Endianness.PutUint32(scratch, bh.WeakHash)
+		hasher.Write(scratch[:4])
+		hasher.Write(bh.StrongHash)
+	}
+	return hasher.Sum(nil)
+}
+
+// observe records what a file looks like on disk before it's validated,
+// and returns true if it was found valid last time and hasn't changed since.
+func (vc *validationCache) observe(signature *SignatureInfo, fileIndex int64, stats os.FileInfo) bool {
+	if stats == nil || !stats.Mode().IsRegular() {
+		return false
+	}
+
+	file := signature.Container.Files[fileIndex]
+	entry := &ValidationCacheEntry{
+		Path:          file.Path,
+		Size:          stats.Size(),
+		ModTime:       stats.ModTime().UnixNano(),
+		Inode:         fileInode(stats),
+		SignatureHash: vc.signatureHash(signature, fileIndex),
+	}
+	vc.current[fileIndex] = entry
+
+	previous, ok := vc.previous[file.Path]
+	if !ok {
+		return false
+	}
+
+	return previous.Size == file.Size &&
+		previous.Size == entry.Size &&
+		previous.ModTime == entry.ModTime &&
+		previous.Inode == entry.Inode &&
+		string(previous.SignatureHash) == string(entry.SignatureHash)
+}
+
+// watch relays wounds to out, remembering which files were wounded.
+// The returned done channel is closed once in is closed and all
+// wounds have been relayed.
+func (vc *validationCache) watch(out chan *Wound) (chan *Wound, chan struct{}) {
+	in := make(chan *Wound, cap(out))
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer close(out)
+
+		for wound := range in {
+			if wound.Kind == WoundKind_FILE {
+				vc.woundedMutex.Lock()
+				vc.wounded[wound.Index] = true
+				vc.woundedMutex.Unlock()
+			}
+			out <- wound
+		}
+	}()
+
+	return in, done
+}
+
+// save writes an entry for every file that was observed and not wounded,
+// replacing the cache file atomically.
+func (vc *validationCache) save(cachePath string) error {
+	err := os.MkdirAll(filepath.Dir(cachePath), 0o755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmpPath := cachePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = func() error {
+		defer f.Close()
+
+		wc := wire.NewWriteContext(f)
+		err := wc.WriteMagic(ValidationCacheMagic)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		err = wc.WriteMessage(&ValidationCacheHeader{})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		vc.woundedMutex.Lock()
+		defer vc.woundedMutex.Unlock()
+
+		for fileIndex := range vc.hashInfo.Container.Files {
+			entry, ok := vc.current[int64(fileIndex)]
+			if !ok || vc.wounded[int64(fileIndex)] {
+				continue
+			}
+
+			err = wc.WriteMessage(entry)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		return errors.WithStack(f.Close())
+	}()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, cachePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package pwr
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -26,6 +29,10 @@ import (
 // and so it isn't done yet.
 const MaxWoundSize int64 = 4 * 1024 * 1024 // 4MB
 
+// QuickReadSize is the size of reads done when hashing whole files in
+// quick validation mode
+const QuickReadSize = 4 * 1024 * 1024 // 4MB
+
 // ValidatorContext holds both input and output parameters to the validation
 // process (checking that a container corresponds to its signature: that all
 // directories exist, symlinks exist and point to the right destinations, files
@@ -34,11 +41,38 @@ type ValidatorContext struct {
 	WoundsPath string
 	HealPath   string
 
+	// HealPaths (optional) lists several heal specs, to be tried in order
+	// by a FallbackHealer. It takes precedence over HealPath.
+	HealPaths []string
+
 	Consumer *state.Consumer
 
 	// FailFast makes Validate return Wounds as errors and stop checking
 	FailFast bool
 
+	// Quick makes Validate hash whole files and compare them with the file
+	// digests of the signature, only checking individual blocks of files that
+	// don't match. It has no effect if the signature has no file digests.
+	Quick bool
+
+	// CachePath (optional) is where the validation cache is stored. Files that
+	// haven't changed on disk since they were last found valid aren't hashed
+	// again, and are reported as healthy.
+	CachePath string
+
+	// Full makes Validate hash every file, even those found in the validation
+	// cache. The cache is still updated.
+	Full bool
+
+	// SaveConsumer (optional) is asked whether a checkpoint should be saved
+	// between files, and regularly while validating large files. It isn't
+	// asked once validation is done and only healing is left.
+	SaveConsumer ValidatorSaveConsumer
+
+	// CheckpointInterval (optional) is roughly how often, in bytes, SaveConsumer
+	// is asked while validating a large file. 0 means DefaultCheckpointInterval.
+	CheckpointInterval int64
+
 	// Result
 
 	// internal
@@ -54,18 +88,66 @@ const floatIntFactor = 10000.0
 // contained in signature. FailFast mode returns an error on the first corruption
 // seen, other modes write wounds to a file or for a wounds consumer, like a healer.
 func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signature *SignatureInfo) error {
+	return vctx.Resume(ctx, nil, target, signature)
+}
+
+// Resume is like Validate, but starts from a checkpoint previously saved by a
+// ValidatorSaveConsumer (or from the start, if checkpoint is nil). Wounds recorded
+// in the checkpoint are sent to the wounds consumer again, directories and symlinks
+// are checked again, and files are checked starting from where validation left off.
+func (vctx *ValidatorContext) Resume(ctx context.Context, checkpoint *ValidatorCheckpoint, target string, signature *SignatureInfo) error {
 	if vctx.Consumer == nil {
 		vctx.Consumer = &state.Consumer{}
 	}
 
+	if signature.Chunker != nil {
+		return fmt.Errorf("ValidatorContext: signatures made of content-defined chunks can't be used for validation")
+	}
+
+	var initialBytesDone int64
+	if checkpoint != nil {
+		err := validateCheckpoint(checkpoint, signature)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range signature.Container.Files[:checkpoint.FileIndex] {
+			initialBytesDone += f.Size
+		}
+		initialBytesDone += checkpoint.Offset
+	}
+
+	var cache *validationCache
+	if vctx.CachePath != "" {
+		var err error
+		cache, err = loadValidationCache(vctx.CachePath, signature, vctx.Consumer)
+		if err != nil {
+			return err
+		}
+	}
+
 	vctx.Wounds = make(chan *Wound, 1024)
+	consumerWounds := vctx.Wounds
+	var cacheDone chan struct{}
+	if cache != nil {
+		// the cache needs to know which files were wounded
+		vctx.Wounds, cacheDone = cache.watch(consumerWounds)
+	}
+
+	var tracker *woundTracker
+	if vctx.SaveConsumer != nil {
+		// checkpoints need to know which wounds were found
+		tracker = newWoundTracker(vctx.Wounds)
+		vctx.Wounds = tracker.in
+	}
+
 	workerErrs := make(chan error, 1)
 	consumerErrs := make(chan error, 1)
 	cancelled := make(chan struct{})
 
 	var woundsStateConsumer *state.Consumer
 	var healerProgress float64
-	var bytesDone int64
+	bytesDone := initialBytesDone
 	var progressMutex sync.Mutex
 
 	updateProgress := func() {
@@ -90,7 +172,7 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 		if vctx.WoundsPath != "" {
 			return fmt.Errorf("ValidatorContext: FailFast is not compatible with WoundsPath")
 		}
-		if vctx.HealPath != "" {
+		if vctx.HealPath != "" || len(vctx.HealPaths) > 0 {
 			return fmt.Errorf("ValidatorContext: FailFast is not compatible with HealPath")
 		}
 
@@ -99,7 +181,7 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 		vctx.WoundsConsumer = &WoundsWriter{
 			WoundsPath: vctx.WoundsPath,
 		}
-	} else if vctx.HealPath != "" {
+	} else if vctx.HealPath != "" || len(vctx.HealPaths) > 0 {
 		// healers can deal with "everything missing"
 		err := os.MkdirAll(target, 0o755)
 		if err != nil {
@@ -124,11 +206,20 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 			}
 		}
 
-		healer, err := NewHealer(vctx.HealPath, target)
+		var healer Healer
+		if len(vctx.HealPaths) > 0 {
+			healer, err = NewFallbackHealer(vctx.HealPaths, target)
+		} else {
+			healer, err = NewHealer(vctx.HealPath, target)
+		}
 		if err != nil {
 			return err
 		}
 
+		if sh, ok := healer.(SignatureHealer); ok {
+			sh.SetSignature(signature)
+		}
+
 		woundsStateConsumer = &state.Consumer{
 			OnProgress: func(progress float64) {
 				progressMutex.Lock()
@@ -155,14 +246,23 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 	}
 
 	go func() {
-		consumerErrs <- vctx.WoundsConsumer.Do(ctx, signature.Container, vctx.Wounds)
+		consumerErrs <- vctx.WoundsConsumer.Do(ctx, signature.Container, consumerWounds)
 
 		// throw away wounds until closed
-		for range vctx.Wounds {
+		for range consumerWounds {
 			// muffin
 		}
 	}()
 
+	if checkpoint != nil {
+		// report progress from where we left off
+		updateProgress()
+
+		for _, wound := range checkpoint.Wounds {
+			vctx.Wounds <- wound
+		}
+	}
+
 	// validate dirs and symlinks first
 	for dirIndex, dir := range signature.Container.Dirs {
 		path := filepath.Join(target, filepath.FromSlash(dir.Path))
@@ -242,12 +342,17 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 
 	fileIndices := make(chan int64)
 
-	go vctx.validate(target, signature, fileIndices, workerErrs, onProgress, cancelled)
+	go vctx.validate(target, signature, cache, checkpoint, tracker, fileIndices, workerErrs, onProgress, cancelled)
 
 	var retErr error
 	sending := true
 
-	for fileIndex := range signature.Container.Files {
+	firstFileIndex := 0
+	if checkpoint != nil {
+		firstFileIndex = int(checkpoint.FileIndex)
+	}
+
+	for fileIndex := firstFileIndex; fileIndex < len(signature.Container.Files); fileIndex++ {
 		if !sending {
 			break
 		}
@@ -290,12 +395,47 @@ func (vctx *ValidatorContext) Validate(ctx context.Context, target string, signa
 		}
 	}
 
+	if cache != nil {
+		<-cacheDone
+		if retErr == nil {
+			err := cache.save(vctx.CachePath)
+			if err != nil {
+				vctx.Consumer.Warnf("Could not save validation cache: %s", err.Error())
+			}
+		}
+	}
+
 	return retErr
 }
 
+// validateCheckpoint makes sure a checkpoint makes sense for a given signature
+func validateCheckpoint(checkpoint *ValidatorCheckpoint, signature *SignatureInfo) error {
+	files := signature.Container.Files
+	if checkpoint.FileIndex < 0 || checkpoint.FileIndex > int64(len(files)) {
+		return errors.Errorf("invalid checkpoint: file index %d out of range [0, %d]", checkpoint.FileIndex, len(files))
+	}
+
+	if checkpoint.Offset != 0 {
+		if checkpoint.FileIndex == int64(len(files)) || checkpoint.Offset < 0 || checkpoint.Offset > files[checkpoint.FileIndex].Size {
+			return errors.Errorf("invalid checkpoint: offset %d out of range for file %d", checkpoint.Offset, checkpoint.FileIndex)
+		}
+		if checkpoint.Offset%ResolveBlockSize(signature.BlockSize) != 0 {
+			return errors.Errorf("invalid checkpoint: offset %d is not block-aligned", checkpoint.Offset)
+		}
+	}
+
+	for _, wound := range checkpoint.Wounds {
+		if wound.Kind != WoundKind_FILE || wound.Index < 0 || wound.Index >= int64(len(files)) {
+			return errors.Errorf("invalid checkpoint: unexpected wound %s", wound.String())
+		}
+	}
+	return nil
+}
+
 type onProgressFunc func(delta int64)
 
-func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo, fileIndices chan int64,
+func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo, cache *validationCache,
+	checkpoint *ValidatorCheckpoint, tracker *woundTracker, fileIndices chan int64,
 	errs chan error, onProgress onProgressFunc, cancelled chan struct{}) {
 
 	var retErr error
@@ -327,9 +467,90 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 		},
 	}
 
+	blockSize := ResolveBlockSize(signature.BlockSize)
+
+	// with a save consumer, files are validated in segments, so that
+	// checkpoints can be saved without waiting for large files to be done
+	var segmentSize int64
+	if vctx.SaveConsumer != nil {
+		interval := vctx.CheckpointInterval
+		if interval == 0 {
+			interval = DefaultCheckpointInterval
+		}
+
+		segmentSize = interval - interval%blockSize
+		if segmentSize < blockSize {
+			segmentSize = blockSize
+		}
+	}
+
+	maybeSave := func(fileIndex int64, offset int64) error {
+		if vctx.SaveConsumer == nil || !vctx.SaveConsumer.ShouldSave() {
+			return nil
+		}
+
+		// make sure all wounds found so far are accounted for
+		tracker.sync()
+
+		c := &ValidatorCheckpoint{
+			FileIndex: fileIndex,
+			Offset:    offset,
+			Wounds:    tracker.pending(vctx.WoundsConsumer),
+		}
+
+		action, err := vctx.SaveConsumer.Save(c)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if action == AfterSaveStop {
+			return ErrStop
+		}
+		return nil
+	}
+
+	var quickBuf []byte
+
+	// checkDigest hashes a whole file with large sequential reads, and
+	// returns true if it matches the digest found in the signature
+	checkDigest := func(fileIndex int64) bool {
+		file := signature.Container.Files[fileIndex]
+
+		reader, err := targetPool.GetReader(fileIndex)
+		if err != nil {
+			return false
+		}
+
+		if quickBuf == nil {
+			quickBuf = make([]byte, QuickReadSize)
+		}
+
+		hasher := sha256.New()
+		lastCount := int64(0)
+		countingWriter := counter.NewWriterCallback(func(count int64) {
+			onProgress(count - lastCount)
+			lastCount = count
+		}, hasher)
+
+		// hide io.WriterTo so our buffer actually gets used
+		hashedBytes, err := io.CopyBuffer(countingWriter, struct{ io.Reader }{reader}, quickBuf)
+		if err == nil && hashedBytes == file.Size && bytes.Equal(hasher.Sum(nil), signature.FileDigests[fileIndex]) {
+			return true
+		}
+
+		// the block-level pass reports progress for this file again
+		onProgress(-lastCount)
+		return false
+	}
+
 	doOne := func(fileIndex int64) error {
 		file := signature.Container.Files[fileIndex]
 
+		startOffset := int64(0)
+		if checkpoint != nil && fileIndex == checkpoint.FileIndex {
+			startOffset = checkpoint.Offset
+		}
+
 		doWholeFileWound := func() {
 			wound := &Wound{
 				Kind:  WoundKind_FILE,
@@ -345,6 +566,20 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 			}
 		}
 
+		doWholeFileHealthy := func() {
+			wound := &Wound{
+				Kind:  WoundKind_CLOSED_FILE,
+				Index: fileIndex,
+				Start: 0,
+				End:   file.Size,
+			}
+
+			select {
+			case vctx.Wounds <- wound:
+			case <-cancelled:
+			}
+		}
+
 		path := filepath.Join(target, filepath.FromSlash(file.Path))
 		stats, err := os.Lstat(path)
 		if err == nil {
@@ -360,6 +595,18 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 				doWholeFileWound()
 				return nil
 			}
+
+			if startOffset == 0 && cache != nil && cache.observe(signature, fileIndex, stats) && !vctx.Full {
+				vctx.Consumer.Debugf("(%s) unchanged since last validation", file.Path)
+				onProgress(file.Size)
+				doWholeFileHealthy()
+				return nil
+			}
+		}
+
+		if startOffset == 0 && vctx.Quick && signature.FileDigests != nil && checkDigest(fileIndex) {
+			doWholeFileHealthy()
+			return nil
 		}
 
 		var reader io.Reader
@@ -372,25 +619,59 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 			return nil
 		}
 
-		var writer io.WriteCloser
-		writer, err = validatingPool.GetWriter(fileIndex)
-		if err != nil {
-			return err
+		if startOffset > 0 {
+			err = skipBytes(reader, startOffset)
+			if err != nil {
+				vctx.Consumer.Debugf("(%s) could not resume at %d: %+v", file.Path, startOffset, err)
+
+				// file changed since the checkpoint was saved
+				doWholeFileWound()
+				return nil
+			}
 		}
 
-		defer writer.Close()
+		validateSegment := func(startBlockIndex int64, segmentReader io.Reader) (int64, error) {
+			writer, err := validatingPool.getWriterAt(fileIndex, startBlockIndex)
+			if err != nil {
+				return 0, err
+			}
 
-		lastCount := int64(0)
-		countingWriter := counter.NewWriterCallback(func(count int64) {
-			delta := count - lastCount
-			onProgress(delta)
-			lastCount = count
-		}, writer)
+			// closing makes sure all wounds for this segment have been sent
+			defer writer.Close()
 
-		var writtenBytes int64
-		writtenBytes, err = io.Copy(countingWriter, reader)
-		if err != nil {
-			return err
+			lastCount := int64(0)
+			countingWriter := counter.NewWriterCallback(func(count int64) {
+				delta := count - lastCount
+				onProgress(delta)
+				lastCount = count
+			}, writer)
+
+			return io.Copy(countingWriter, segmentReader)
+		}
+
+		writtenBytes := startOffset
+		for {
+			lastSegment := segmentSize == 0 || writtenBytes+segmentSize >= file.Size
+
+			segmentReader := reader
+			if !lastSegment {
+				segmentReader = io.LimitReader(reader, segmentSize)
+			}
+
+			segmentBytes, err := validateSegment(writtenBytes/blockSize, segmentReader)
+			if err != nil {
+				return err
+			}
+			writtenBytes += segmentBytes
+
+			if lastSegment || segmentBytes < segmentSize {
+				break
+			}
+
+			err = maybeSave(fileIndex, writtenBytes)
+			if err != nil {
+				return err
+			}
 		}
 
 		if writtenBytes != file.Size {
@@ -420,6 +701,9 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 			}
 
 			err := doOne(fileIndex)
+			if err == nil {
+				err = maybeSave(fileIndex+1, 0)
+			}
 			if err != nil {
 				if retErr == nil {
 					retErr = err
@@ -433,6 +717,23 @@ func (vctx *ValidatorContext) validate(target string, signature *SignatureInfo,
 	}
 }
 
+// skipBytes advances reader by n bytes, seeking if possible
+func skipBytes(reader io.Reader, n int64) error {
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return errors.WithStack(err)
+	}
+
+	skipped, err := io.CopyN(ioutil.Discard, reader, n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if skipped != n {
+		return errors.Errorf("could only skip %d of %d bytes", skipped, n)
+	}
+	return nil
+}
+
 // AssertValid validates target in FailFast mode - it's a shorthand
 // so that setting up ValidatorContext isn't needed
 func AssertValid(target string, signature *SignatureInfo) error {
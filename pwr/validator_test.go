@@ -0,0 +1,275 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/itchio/headway/state"
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/fspool"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_QuickValidate(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "quickvalidate")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	dir := filepath.Join(mainDir, "dir")
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file-1", Seed: 0x1, Size: BlockSize*3 + 12},
+			{Path: "subdir/file-2", Seed: 0x2, Size: BlockSize * 5},
+			{Path: "empty", Size: -1},
+		},
+	})
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	writeSignature := func(workers int) []byte {
+		signatureBuffer := new(bytes.Buffer)
+		dctx := &DiffContext{
+			Compression: &CompressionSettings{},
+
+			SourceContainer: container,
+			Pool:            fspool.New(container, dir),
+
+			TargetContainer: &tlc.Container{},
+
+			FileDigests: true,
+			Workers:     workers,
+			PoolFactory: func() (lake.Pool, error) {
+				return fspool.New(container, dir), nil
+			},
+		}
+		wtest.Must(t, dctx.WritePatch(context.Background(), ioutil.Discard, signatureBuffer))
+		assert.Len(t, dctx.SourceDigests, len(container.Files))
+		return signatureBuffer.Bytes()
+	}
+
+	signatureBytes := writeSignature(1)
+	assert.EqualValues(t, signatureBytes, writeSignature(3), "parallel diff should write the same digests")
+
+	signatureReader := seeksource.FromBytes(signatureBytes)
+	_, err = signatureReader.Resume(nil)
+	wtest.Must(t, err)
+	sigInfo, err := ReadSignature(context.Background(), signatureReader)
+	wtest.Must(t, err)
+
+	assert.Len(t, sigInfo.FileDigests, len(container.Files))
+	for fileIndex, f := range container.Files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+		wtest.Must(t, err)
+		digest := sha256.Sum256(data)
+		assert.EqualValues(t, digest[:], sigInfo.FileDigests[fileIndex], "digest of %s", f.Path)
+	}
+
+	validate := func() int64 {
+		vctx := &ValidatorContext{
+			Quick: true,
+		}
+		wtest.Must(t, vctx.Validate(context.Background(), dir, sigInfo))
+		return vctx.WoundsConsumer.TotalCorrupted()
+	}
+
+	assert.EqualValues(t, 0, validate())
+	wtest.Must(t, AssertValid(dir, sigInfo))
+
+	// a corrupted file should still get block-level wounds
+	corruptedPath := filepath.Join(dir, "subdir", "file-2")
+	data, err := ioutil.ReadFile(corruptedPath)
+	wtest.Must(t, err)
+	data[BlockSize*2+100] ^= 0xff
+	wtest.Must(t, ioutil.WriteFile(corruptedPath, data, 0644))
+
+	assert.EqualValues(t, BlockSize, validate())
+}
+
+func Test_ValidationCache(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "validationcache")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	dir := filepath.Join(mainDir, "dir")
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file-1", Seed: 0x1, Size: BlockSize*3 + 12},
+			{Path: "subdir/file-2", Seed: 0x2, Size: BlockSize * 5},
+			{Path: "empty", Size: -1},
+		},
+	})
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, dir), nil)
+	wtest.Must(t, err)
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	cachePath := filepath.Join(mainDir, "cache", "validation.cache")
+
+	validate := func(full bool) int64 {
+		var lastProgress float64
+		vctx := &ValidatorContext{
+			CachePath: cachePath,
+			Full:      full,
+			Consumer: &state.Consumer{
+				OnProgress: func(progress float64) {
+					lastProgress = progress
+				},
+			},
+		}
+		wtest.Must(t, vctx.Validate(context.Background(), dir, sigInfo))
+		assert.InDelta(t, 1.0, lastProgress, 0.0001)
+		return vctx.WoundsConsumer.TotalCorrupted()
+	}
+
+	assert.EqualValues(t, 0, validate(false))
+	_, err = os.Stat(cachePath)
+	wtest.Must(t, err)
+
+	// corrupt a file behind the cache's back: same size, same mtime
+	corrupt := func(path string, offset int64, keepModTime bool) {
+		stats, err := os.Stat(path)
+		wtest.Must(t, err)
+		data, err := ioutil.ReadFile(path)
+		wtest.Must(t, err)
+		data[offset] ^= 0xff
+		wtest.Must(t, ioutil.WriteFile(path, data, 0644))
+		if keepModTime {
+			wtest.Must(t, os.Chtimes(path, stats.ModTime(), stats.ModTime()))
+		}
+	}
+	corrupt(filepath.Join(dir, "subdir", "file-2"), BlockSize*2+100, true)
+
+	assert.EqualValues(t, 0, validate(false), "cached files should be skipped")
+	assert.EqualValues(t, BlockSize, validate(true), "full validation should rehash everything")
+	assert.EqualValues(t, BlockSize, validate(false), "wounded files should be dropped from the cache")
+
+	// files whose mtime changed are hashed again
+	corrupt(filepath.Join(dir, "file-1"), 3, false)
+	wtest.Must(t, os.Chtimes(filepath.Join(dir, "file-1"), time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	assert.EqualValues(t, 2*BlockSize, validate(false))
+
+	// an unreadable cache is ignored
+	wtest.Must(t, ioutil.WriteFile(cachePath, []byte("garbage"), 0644))
+	assert.EqualValues(t, 2*BlockSize, validate(false))
+}
+
+type testSaveConsumer struct {
+	checkpoints []*ValidatorCheckpoint
+	stop        bool
+}
+
+var _ ValidatorSaveConsumer = (*testSaveConsumer)(nil)
+
+func (tsc *testSaveConsumer) ShouldSave() bool {
+	return true
+}
+
+func (tsc *testSaveConsumer) Save(c *ValidatorCheckpoint) (AfterSaveAction, error) {
+	tsc.checkpoints = append(tsc.checkpoints, c)
+	if tsc.stop {
+		return AfterSaveStop, nil
+	}
+	return AfterSaveContinue, nil
+}
+
+func Test_ValidatorCheckpoint(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "validatorcheckpoint")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	dir := filepath.Join(mainDir, "dir")
+	wtest.MakeTestDir(t, dir, wtest.TestDirSettings{
+		Entries: []wtest.TestDirEntry{
+			{Path: "file-1", Seed: 0x1, Size: BlockSize*5 + 12},
+			{Path: "file-2", Seed: 0x2, Size: BlockSize * 3},
+			{Path: "file-3", Seed: 0x3, Size: 193},
+		},
+	})
+	container, err := tlc.WalkAny(dir, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	hashes, err := ComputeSignature(context.Background(), container, fspool.New(container, dir), nil)
+	wtest.Must(t, err)
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	// corrupt a block in the first half of file-1
+	corruptedPath := filepath.Join(dir, "file-1")
+	data, err := ioutil.ReadFile(corruptedPath)
+	wtest.Must(t, err)
+	data[BlockSize+100] ^= 0xff
+	wtest.Must(t, ioutil.WriteFile(corruptedPath, data, 0644))
+
+	// without stopping, checkpoints are offered regularly
+	tsc := &testSaveConsumer{}
+	vctx := &ValidatorContext{
+		SaveConsumer:       tsc,
+		CheckpointInterval: BlockSize * 2,
+	}
+	wtest.Must(t, vctx.Validate(context.Background(), dir, sigInfo))
+	assert.EqualValues(t, BlockSize, vctx.WoundsConsumer.TotalCorrupted())
+	assert.True(t, len(tsc.checkpoints) >= 4)
+
+	first := tsc.checkpoints[0]
+	assert.EqualValues(t, 0, first.FileIndex)
+	assert.EqualValues(t, BlockSize*2, first.Offset)
+	assert.Len(t, first.Wounds, 1)
+
+	// stop after every save, round-trip checkpoints through gob, and resume
+	var checkpoint *ValidatorCheckpoint
+	var resumes int
+	for {
+		var lastProgress float64
+		tsc := &testSaveConsumer{stop: true}
+		vctx := &ValidatorContext{
+			SaveConsumer:       tsc,
+			CheckpointInterval: BlockSize * 2,
+			Consumer: &state.Consumer{
+				OnProgress: func(progress float64) {
+					lastProgress = progress
+				},
+			},
+		}
+
+		err := vctx.Resume(context.Background(), checkpoint, dir, sigInfo)
+		if err == nil {
+			assert.EqualValues(t, BlockSize, vctx.WoundsConsumer.TotalCorrupted(), "wounds from checkpoint should be reported again")
+			assert.InDelta(t, 1.0, lastProgress, 0.0001)
+			break
+		}
+		assert.Equal(t, ErrStop, err)
+		resumes++
+		if !assert.True(t, resumes < 10, "validation should make progress") {
+			break
+		}
+
+		buf := new(bytes.Buffer)
+		wtest.Must(t, gob.NewEncoder(buf).Encode(tsc.checkpoints[0]))
+		checkpoint = &ValidatorCheckpoint{}
+		wtest.Must(t, gob.NewDecoder(buf).Decode(checkpoint))
+	}
+	assert.True(t, resumes >= 4)
+
+	// checkpoints that don't match the signature are rejected
+	err = vctx.Resume(context.Background(), &ValidatorCheckpoint{FileIndex: 0, Offset: 12}, dir, sigInfo)
+	assert.Error(t, err)
+	err = vctx.Resume(context.Background(), &ValidatorCheckpoint{FileIndex: 4}, dir, sigInfo)
+	assert.Error(t, err)
+}
@@ -0,0 +1,430 @@
+package pwr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/itchio/arkive/zip"
+	"github.com/itchio/headway/state"
+	"github.com/itchio/kompress/flate"
+	"github.com/itchio/savior"
+	"github.com/itchio/wharf/werrors"
+	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
+)
+
+// DefaultZipIndexSyncInterval is the minimum amount of uncompressed data
+// between two sync points of a deflated entry. Each sync point costs up to
+// 32KiB (before compression), so this keeps the index around 3% of the size
+// of the uncompressed data, in the worst case.
+const DefaultZipIndexSyncInterval int64 = 1024 * 1024 // 1MiB
+
+const (
+	zipLocalHeaderSignature = 0x04034b50
+	zipLocalHeaderLen       = 30
+	zipMaxExtraLen          = 0xffff
+)
+
+// A ZipIndex allows random access into the entries of a zip archive,
+// as found in a wharf zip index file (.pzi)
+type ZipIndex struct {
+	ArchiveSize int64
+	Entries     []*ZipIndexEntryInfo
+
+	entriesByName map[string]*ZipIndexEntryInfo
+}
+
+// ZipIndexEntryInfo describes a single entry of an indexed zip archive,
+// along with the points from which it can be decompressed.
+type ZipIndexEntryInfo struct {
+	*ZipIndexEntry
+
+	// SyncPoints are sorted by increasing uncompressed offset
+	SyncPoints []*ZipIndexSyncPoint
+}
+
+// ZipIndexSettings controls how a zip index file is written
+type ZipIndexSettings struct {
+	// Compression used for the body of the index. Required.
+	Compression *CompressionSettings
+
+	// SyncInterval is the minimum amount of uncompressed data between two
+	// sync points. If zero, DefaultZipIndexSyncInterval is used.
+	SyncInterval int64
+
+	// Consumer (optional) to report progress to
+	Consumer *state.Consumer
+}
+
+// WriteZipIndex reads the central directory of a zip archive, inflates all its
+// deflated entries, and writes a wharf zip index file (.pzi) to indexWriter.
+func WriteZipIndex(ctx context.Context, archive io.ReaderAt, archiveSize int64, settings *ZipIndexSettings, indexWriter io.Writer) error {
+	if settings == nil || settings.Compression == nil {
+		return errors.New("No compression settings specified, bailing out")
+	}
+
+	consumer := settings.Consumer
+	if consumer == nil {
+		consumer = &state.Consumer{}
+	}
+
+	syncInterval := settings.SyncInterval
+	if syncInterval <= 0 {
+		syncInterval = DefaultZipIndexSyncInterval
+	}
+
+	zr, err := zip.NewReader(archive, archiveSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	rawIndexWire := wire.NewWriteContext(indexWriter)
+	err = rawIndexWire.WriteMagic(ZipIndexMagic)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	err = rawIndexWire.WriteMessage(&ZipIndexHeader{
+		Compression: settings.Compression,
+		ArchiveSize: archiveSize,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	indexWire, err := CompressWire(rawIndexWire, settings.Compression)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var totalSize int64
+	for _, zf := range zr.File {
+		totalSize += int64(zf.CompressedSize64)
+	}
+	var doneSize int64
+
+	for _, zf := range zr.File {
+		select {
+		case <-ctx.Done():
+			return werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		consumer.ProgressLabel(zf.Name)
+
+		dataOffset, err := zf.DataOffset()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		localHeaderOffset, err := findZipLocalHeader(archive, zf.Name, dataOffset)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		entry := &ZipIndexEntry{
+			Name:              zf.Name,
+			LocalHeaderOffset: localHeaderOffset,
+			DataOffset:        dataOffset,
+			CompressedSize:    int64(zf.CompressedSize64),
+			UncompressedSize:  int64(zf.UncompressedSize64),
+			Crc32:             zf.CRC32,
+		}
+
+		var syncPoints []*ZipIndexSyncPoint
+
+		switch zf.Method {
+		case zip.Store:
+			entry.Method = ZipIndexEntry_STORE
+		case zip.Deflate:
+			entry.Method = ZipIndexEntry_DEFLATE
+
+			onProgress := func(compressedOffset int64) {
+				if totalSize > 0 {
+					consumer.Progress(float64(doneSize+compressedOffset) / float64(totalSize))
+				}
+			}
+			syncPoints, err = computeZipSyncPoints(ctx, archive, entry, syncInterval, onProgress)
+			if err != nil {
+				return errors.Wrapf(err, "indexing (%s)", zf.Name)
+			}
+		default:
+			return errors.Errorf("(%s): unsupported compression method %d", zf.Name, zf.Method)
+		}
+
+		entry.NumSyncPoints = int64(len(syncPoints))
+		err = indexWire.WriteMessage(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, sp := range syncPoints {
+			err = indexWire.WriteMessage(sp)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		doneSize += entry.CompressedSize
+		if totalSize > 0 {
+			consumer.Progress(float64(doneSize) / float64(totalSize))
+		}
+	}
+
+	err = indexWire.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// findZipLocalHeader returns the offset of the local file header of an entry,
+// given the offset of its data. The central directory only tells us where the
+// data starts, and the local header's extra field may be of any length, so
+// we look for a local header that ends exactly at dataOffset.
+func findZipLocalHeader(archive io.ReaderAt, name string, dataOffset int64) (int64, error) {
+	minLen := int64(zipLocalHeaderLen + len(name))
+
+	// most local headers have short (or no) extra fields, so try
+	// a small window first, before looking further back.
+	for _, extraLen := range []int64{1024, zipMaxExtraLen} {
+		windowLen := minLen + extraLen
+		if windowLen > dataOffset {
+			windowLen = dataOffset
+		}
+		if windowLen < minLen {
+			break
+		}
+
+		buf := make([]byte, windowLen)
+		_, err := archive.ReadAt(buf, dataOffset-windowLen)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+
+		for i := windowLen - minLen; i >= 0; i-- {
+			header := buf[i:]
+			if binary.LittleEndian.Uint32(header[0:4]) != zipLocalHeaderSignature {
+				continue
+			}
+
+			nameLen := int64(binary.LittleEndian.Uint16(header[26:28]))
+			extraFieldLen := int64(binary.LittleEndian.Uint16(header[28:30]))
+			if nameLen != int64(len(name)) || i+zipLocalHeaderLen+nameLen+extraFieldLen != windowLen {
+				continue
+			}
+
+			if !bytes.Equal(header[zipLocalHeaderLen:zipLocalHeaderLen+nameLen], []byte(name)) {
+				continue
+			}
+
+			return dataOffset - windowLen + i, nil
+		}
+	}
+
+	return 0, errors.Errorf("(%s): could not find local file header", name)
+}
+
+// computeZipSyncPoints inflates a deflated entry, and records the state of the
+// inflater on the first block boundary after every syncInterval bytes of output.
+func computeZipSyncPoints(ctx context.Context, archive io.ReaderAt, entry *ZipIndexEntry, syncInterval int64, onProgress func(compressedOffset int64)) ([]*ZipIndexSyncPoint, error) {
+	compressed := io.NewSectionReader(archive, entry.DataOffset, entry.CompressedSize)
+	sr := flate.NewSaverReader(bufio.NewReader(compressed))
+	defer sr.Close()
+
+	var syncPoints []*ZipIndexSyncPoint
+	buf := make([]byte, 32*1024)
+	var uncompressedOffset int64
+	var lastSync int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, werrors.ErrCancelled
+		default:
+			// keep going!
+		}
+
+		n, err := sr.Read(buf)
+		uncompressedOffset += int64(n)
+
+		if err == flate.ReadyToSaveError {
+			checkpoint, err := sr.Save()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+
+			syncPoints = append(syncPoints, syncPointFromCheckpoint(checkpoint))
+			lastSync = uncompressedOffset
+			onProgress(checkpoint.Roffset)
+			continue
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		if uncompressedOffset-lastSync >= syncInterval {
+			sr.WantSave()
+		}
+	}
+
+	if uncompressedOffset != entry.UncompressedSize {
+		return nil, errors.Errorf("inflated to %d bytes, expected %d", uncompressedOffset, entry.UncompressedSize)
+	}
+
+	return syncPoints, nil
+}
+
+func syncPointFromCheckpoint(c *flate.Checkpoint) *ZipIndexSyncPoint {
+	window := c.DictDecoderHist
+	if !c.DictDecoderFull {
+		// the rest of the window hasn't been written to yet
+		window = window[:c.DictDecoderWrPos]
+	}
+
+	return &ZipIndexSyncPoint{
+		CompressedOffset:   c.Roffset,
+		UncompressedOffset: c.Woffset,
+		Bits:               c.B,
+		NumBits:            uint32(c.Nb),
+		Window:             append([]byte{}, window...),
+		WindowReadPos:      int64(c.DictDecoderRdPos),
+		WindowWritePos:     int64(c.DictDecoderWrPos),
+		WindowFull:         c.DictDecoderFull,
+	}
+}
+
+func (sp *ZipIndexSyncPoint) toCheckpoint() *flate.Checkpoint {
+	// the inflater always uses a 32KiB window
+	hist := make([]byte, 32*1024)
+	copy(hist, sp.Window)
+
+	return &flate.Checkpoint{
+		Roffset:          sp.CompressedOffset,
+		Woffset:          sp.UncompressedOffset,
+		B:                sp.Bits,
+		Nb:               uint(sp.NumBits),
+		DictDecoderHist:  hist,
+		DictDecoderRdPos: int(sp.WindowReadPos),
+		DictDecoderWrPos: int(sp.WindowWritePos),
+		DictDecoderFull:  sp.WindowFull,
+	}
+}
+
+// ReadZipIndex reads all entries and sync points from a wharf zip index file.
+func ReadZipIndex(indexReader savior.SeekSource) (*ZipIndex, error) {
+	rawIndexWire := wire.NewReadContext(indexReader)
+	err := rawIndexWire.ExpectMagic(ZipIndexMagic)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	header := &ZipIndexHeader{}
+	err = rawIndexWire.ReadMessage(header)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	indexWire, err := DecompressWire(rawIndexWire, header.Compression)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	index := &ZipIndex{
+		ArchiveSize:   header.ArchiveSize,
+		entriesByName: make(map[string]*ZipIndexEntryInfo),
+	}
+
+	for {
+		entry := &ZipIndexEntry{}
+		err = indexWire.ReadMessage(entry)
+		if err != nil {
+			if errors.Cause(err) == io.EOF {
+				break
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		info := &ZipIndexEntryInfo{
+			ZipIndexEntry: entry,
+		}
+
+		for i := int64(0); i < entry.NumSyncPoints; i++ {
+			sp := &ZipIndexSyncPoint{}
+			err = indexWire.ReadMessage(sp)
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading sync point %d of (%s)", i, entry.Name)
+			}
+			info.SyncPoints = append(info.SyncPoints, sp)
+		}
+
+		index.Entries = append(index.Entries, info)
+		index.entriesByName[entry.Name] = info
+	}
+
+	return index, nil
+}
+
+// FindEntry returns the entry with the given name, or nil if there's none.
+func (zi *ZipIndex) FindEntry(name string) *ZipIndexEntryInfo {
+	return zi.entriesByName[name]
+}
+
+// NewReaderAt returns a reader for the uncompressed data of an entry, starting
+// at offset. For deflated entries, decompression starts from the closest sync
+// point before offset, so only a fraction of the entry needs to be inflated.
+// The entry's CRC32 is not checked.
+func (zei *ZipIndexEntryInfo) NewReaderAt(archive io.ReaderAt, offset int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > zei.UncompressedSize {
+		return nil, errors.Errorf("(%s): offset %d out of bounds [0,%d]", zei.Name, offset, zei.UncompressedSize)
+	}
+
+	switch zei.Method {
+	case ZipIndexEntry_STORE:
+		r := io.NewSectionReader(archive, zei.DataOffset+offset, zei.UncompressedSize-offset)
+		return ioutil.NopCloser(r), nil
+
+	case ZipIndexEntry_DEFLATE:
+		var sp *ZipIndexSyncPoint
+		for _, candidate := range zei.SyncPoints {
+			if candidate.UncompressedOffset > offset {
+				break
+			}
+			sp = candidate
+		}
+
+		var fr io.ReadCloser
+		var start int64
+		if sp == nil {
+			compressed := io.NewSectionReader(archive, zei.DataOffset, zei.CompressedSize)
+			fr = flate.NewReader(bufio.NewReader(compressed))
+		} else {
+			compressed := io.NewSectionReader(archive, zei.DataOffset+sp.CompressedOffset, zei.CompressedSize-sp.CompressedOffset)
+			sr, err := sp.toCheckpoint().Resume(bufio.NewReader(compressed))
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			fr = sr
+			start = sp.UncompressedOffset
+		}
+
+		_, err := io.CopyN(ioutil.Discard, fr, offset-start)
+		if err != nil {
+			fr.Close()
+			return nil, errors.Wrapf(err, "(%s): seeking to %d", zei.Name, offset)
+		}
+		return fr, nil
+	}
+
+	return nil, errors.Errorf("(%s): unsupported compression method %s", zei.Name, zei.Method.String())
+}
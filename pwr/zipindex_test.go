@@ -0,0 +1,268 @@
+package pwr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itchio/arkive/zip"
+	"github.com/itchio/lake/pools"
+	"github.com/itchio/lake/tlc"
+	"github.com/itchio/randsource"
+	"github.com/itchio/savior/seeksource"
+	"github.com/itchio/wharf/wtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type zipIndexTestEntry struct {
+	name   string
+	method uint16
+	extra  []byte
+	data   []byte
+}
+
+func makeZipIndexTestArchive(t *testing.T, archivePath string) []zipIndexTestEntry {
+	prng := randsource.Reader{
+		Source: rand.New(rand.NewSource(0x1337)),
+	}
+
+	// random runs, repeated a few times, so that deflate
+	// actually has something to compress.
+	var bigData []byte
+	for len(bigData) < 3*1024*1024 {
+		run, err := ioutil.ReadAll(io.LimitReader(prng, 8*1024))
+		wtest.Must(t, err)
+		for i := 0; i < 3; i++ {
+			bigData = append(bigData, run...)
+		}
+	}
+
+	smallData, err := ioutil.ReadAll(io.LimitReader(prng, 1500))
+	wtest.Must(t, err)
+
+	entries := []zipIndexTestEntry{
+		{name: "big", method: zip.Deflate, data: bigData},
+		{name: "sub/stored", method: zip.Store, data: smallData},
+		{name: "sub/extra", method: zip.Deflate, extra: []byte{0xfe, 0xca, 0x04, 0x00, 0x01, 0x02, 0x03, 0x04}, data: smallData},
+		{name: "sub/empty", method: zip.Deflate, data: nil},
+	}
+
+	archiveWriter, err := os.Create(archivePath)
+	wtest.Must(t, err)
+	defer archiveWriter.Close()
+
+	zw := zip.NewWriter(archiveWriter)
+	for _, e := range entries {
+		fh := &zip.FileHeader{
+			Name:  e.name,
+			Extra: e.extra,
+		}
+		fh.Method = e.method
+		fh.SetMode(0644)
+
+		writer, err := zw.CreateHeader(fh)
+		wtest.Must(t, err)
+		_, err = writer.Write(e.data)
+		wtest.Must(t, err)
+	}
+	wtest.Must(t, zw.Close())
+
+	return entries
+}
+
+func writeTestZipIndex(t *testing.T, archivePath string, indexPath string) {
+	archiveFile, err := os.Open(archivePath)
+	wtest.Must(t, err)
+	defer archiveFile.Close()
+
+	stats, err := archiveFile.Stat()
+	wtest.Must(t, err)
+
+	indexWriter, err := os.Create(indexPath)
+	wtest.Must(t, err)
+	defer indexWriter.Close()
+
+	wtest.Must(t, WriteZipIndex(context.Background(), archiveFile, stats.Size(), &ZipIndexSettings{
+		Compression:  &CompressionSettings{},
+		SyncInterval: 128 * 1024,
+	}, indexWriter))
+}
+
+func Test_ZipIndex(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "zipindex")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	archivePath := filepath.Join(mainDir, "archive.zip")
+	entries := makeZipIndexTestArchive(t, archivePath)
+
+	indexPath := filepath.Join(mainDir, "archive.pzi")
+	writeTestZipIndex(t, archivePath, indexPath)
+
+	indexBytes, err := ioutil.ReadFile(indexPath)
+	wtest.Must(t, err)
+
+	source := seeksource.FromBytes(indexBytes)
+	_, err = source.Resume(nil)
+	wtest.Must(t, err)
+
+	index, err := ReadZipIndex(source)
+	wtest.Must(t, err)
+
+	archiveFile, err := os.Open(archivePath)
+	wtest.Must(t, err)
+	defer archiveFile.Close()
+
+	stats, err := archiveFile.Stat()
+	wtest.Must(t, err)
+	assert.EqualValues(t, stats.Size(), index.ArchiveSize)
+	assert.EqualValues(t, len(entries), len(index.Entries))
+	assert.Nil(t, index.FindEntry("nope"))
+
+	for _, e := range entries {
+		entry := index.FindEntry(e.name)
+		if !assert.NotNil(t, entry, e.name) {
+			continue
+		}
+
+		assert.EqualValues(t, len(e.data), entry.UncompressedSize)
+
+		header := make([]byte, 4)
+		_, err = archiveFile.ReadAt(header, entry.LocalHeaderOffset)
+		wtest.Must(t, err)
+		assert.EqualValues(t, zipLocalHeaderSignature, Endianness.Uint32(header))
+
+		offsets := []int64{0, int64(len(e.data)) / 2, int64(len(e.data))}
+		if e.name == "big" {
+			assert.True(t, len(entry.SyncPoints) > 8, "big entry should have many sync points")
+			offsets = append(offsets, 64*1024, int64(len(e.data))-BlockSize, entry.SyncPoints[3].UncompressedOffset)
+		}
+
+		for _, offset := range offsets {
+			reader, err := entry.NewReaderAt(archiveFile, offset)
+			wtest.Must(t, err)
+
+			buf, err := ioutil.ReadAll(io.LimitReader(reader, BlockSize))
+			wtest.Must(t, err)
+			wtest.Must(t, reader.Close())
+
+			end := offset + BlockSize
+			if end > int64(len(e.data)) {
+				end = int64(len(e.data))
+			}
+			assert.True(t, bytes.Equal(e.data[offset:end], buf), fmt.Sprintf("%s at %d", e.name, offset))
+		}
+
+		_, err = entry.NewReaderAt(archiveFile, int64(len(e.data))+1)
+		assert.Error(t, err)
+	}
+}
+
+func Test_ArchiveHealerWithIndex(t *testing.T) {
+	mainDir, err := ioutil.TempDir("", "archivehealerindex")
+	wtest.Must(t, err)
+	defer os.RemoveAll(mainDir)
+
+	archivePath := filepath.Join(mainDir, "archive.zip")
+	entries := makeZipIndexTestArchive(t, archivePath)
+
+	indexPath := filepath.Join(mainDir, "archive.pzi")
+	writeTestZipIndex(t, archivePath, indexPath)
+
+	container, err := tlc.WalkAny(archivePath, tlc.WalkOpts{})
+	wtest.Must(t, err)
+
+	pool, err := pools.New(container, archivePath)
+	wtest.Must(t, err)
+
+	hashes, err := ComputeSignature(context.Background(), container, pool, nil)
+	wtest.Must(t, err)
+
+	sigInfo := &SignatureInfo{
+		Container: container,
+		Hashes:    hashes,
+	}
+
+	targetDir := filepath.Join(mainDir, "target")
+	for _, e := range entries {
+		path := filepath.Join(targetDir, filepath.FromSlash(e.name))
+		wtest.Must(t, os.MkdirAll(filepath.Dir(path), 0755))
+		wtest.Must(t, ioutil.WriteFile(path, e.data, 0644))
+	}
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	// corrupt one block near the end of the big file
+	bigPath := filepath.Join(targetDir, "big")
+	bigData := append([]byte{}, entries[0].data...)
+	corruptedBlock := int64(len(bigData))/BlockSize - 2
+	for i := int64(0); i < BlockSize; i++ {
+		bigData[corruptedBlock*BlockSize+i] = ^bigData[corruptedBlock*BlockSize+i]
+	}
+	wtest.Must(t, ioutil.WriteFile(bigPath, bigData, 0644))
+	assert.Error(t, AssertValid(targetDir, sigInfo))
+
+	heal := func(wounds []*Wound) *ArchiveHealer {
+		healer := &ArchiveHealer{
+			ArchivePath: archivePath,
+			IndexPath:   indexPath,
+			Target:      targetDir,
+		}
+
+		woundsChan := make(chan *Wound)
+		done := make(chan error)
+		go func() {
+			done <- healer.Do(context.Background(), container, woundsChan)
+		}()
+
+		for _, w := range wounds {
+			woundsChan <- w
+		}
+		close(woundsChan)
+
+		wtest.Must(t, <-done)
+		return healer
+	}
+
+	fileIndex := func(path string) int64 {
+		for i, f := range container.Files {
+			if f.Path == path {
+				return int64(i)
+			}
+		}
+		t.Fatalf("file not found in container: %s", path)
+		return -1
+	}
+
+	healer := heal([]*Wound{
+		{
+			Kind:  WoundKind_FILE,
+			Index: fileIndex("big"),
+			Start: corruptedBlock * BlockSize,
+			End:   (corruptedBlock + 1) * BlockSize,
+		},
+	})
+	assert.True(t, healer.HasWounds())
+	assert.EqualValues(t, BlockSize, healer.TotalHealed())
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+
+	// missing files get healed in full
+	wtest.Must(t, os.RemoveAll(filepath.Join(targetDir, "sub")))
+
+	var wounds []*Wound
+	for _, e := range entries[1:] {
+		wounds = append(wounds, &Wound{
+			Kind:  WoundKind_FILE,
+			Index: fileIndex(e.name),
+			Start: 0,
+			End:   int64(len(e.data)),
+		})
+	}
+	heal(wounds)
+	wtest.Must(t, AssertValid(targetDir, sigInfo))
+}
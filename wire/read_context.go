@@ -14,6 +14,10 @@ import (
 var (
 	// ErrFormat is returned when we find a magic number that isn't the one we expected
 	ErrFormat = fmt.Errorf("wrong magic (invalid input file)")
+
+	// ErrMessageTooLarge is returned when a message is larger than the
+	// maximum size set with SetMaxMessageSize
+	ErrMessageTooLarge = fmt.Errorf("message too large")
 )
 
 // ReadContext holds state of a wharf wire format reader
@@ -23,7 +27,8 @@ type ReadContext struct {
 	countingReader *countingReader
 	offset         int64
 
-	protoBuffer *proto.Buffer
+	protoBuffer    *proto.Buffer
+	maxMessageSize int64
 
 	saveState               saveState
 	sourceCheckpoint        *savior.SourceCheckpoint
@@ -67,6 +72,13 @@ func NewReadContext(source savior.Source) *ReadContext {
 	return r
 }
 
+// SetMaxMessageSize sets the largest message ReadMessage will accept,
+// so that input files can't make us allocate without limit.
+// A size of 0 (the default) means no limit.
+func (r *ReadContext) SetMaxMessageSize(size int64) {
+	r.maxMessageSize = size
+}
+
 func (r *ReadContext) GetSource() savior.Source {
 	return r.source
 }
@@ -145,10 +157,9 @@ func (r *ReadContext) PopCheckpoint() *MessageReaderCheckpoint {
 
 // ExpectMagic returns an error if the next 32-bit int is not the magic number specified
 func (r *ReadContext) ExpectMagic(magic int32) error {
-	var readMagic int32
-	err := binary.Read(r.countingReader, Endianness, &readMagic)
+	readMagic, err := r.ReadMagic()
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
 	if magic != readMagic {
@@ -158,6 +169,17 @@ func (r *ReadContext) ExpectMagic(magic int32) error {
 	return nil
 }
 
+// ReadMagic reads a magic number, for formats that have several
+func (r *ReadContext) ReadMagic() (int32, error) {
+	var magic int32
+	err := binary.Read(r.countingReader, Endianness, &magic)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	return magic, nil
+}
+
 // ReadMessage deserializes a protobuf message from the underlying reader
 func (r *ReadContext) ReadMessage(msg proto.Message) error {
 	savior.Debugf("wire.ReadContext: Reading message at %d", r.offset)
@@ -167,6 +189,10 @@ func (r *ReadContext) ReadMessage(msg proto.Message) error {
 		return errors.WithStack(err)
 	}
 
+	if r.maxMessageSize > 0 && length > uint64(r.maxMessageSize) {
+		return errors.Wrapf(ErrMessageTooLarge, "wire.ReadContext: message at %d is %d bytes, max is %d", r.offset, length, r.maxMessageSize)
+	}
+
 	msgBuf := r.protoBuffer.Bytes()
 	if cap(msgBuf) < int(length) {
 		msgBuf = make([]byte, nextPowerOf2(int(length)))
@@ -14,6 +14,7 @@ import (
 	"github.com/itchio/savior/seeksource"
 
 	"github.com/itchio/wharf/wire"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -108,6 +109,34 @@ func Test_ReadContext(t *testing.T) {
 	}
 }
 
+func Test_ReadContextMaxMessageSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := wire.NewWriteContext(buf)
+	writeSampleMessages(t, w)
+	must(t, w.Close())
+
+	r := wire.NewReadContext(seeksource.FromBytes(buf.Bytes()))
+	r.SetMaxMessageSize(128 * 1024)
+
+	must(t, r.Resume(nil))
+	must(t, r.ExpectMagic(magic))
+
+	err := r.ReadMessage(&wire.Sample{})
+	assert.Error(t, err)
+	assert.Equal(t, wire.ErrMessageTooLarge, errors.Cause(err))
+
+	r = wire.NewReadContext(seeksource.FromBytes(buf.Bytes()))
+	r.SetMaxMessageSize(512 * 1024)
+
+	must(t, r.Resume(nil))
+	must(t, r.ExpectMagic(magic))
+
+	msg := &wire.Sample{}
+	for !msg.Eof {
+		must(t, r.ReadMessage(msg))
+	}
+}
+
 func writeSampleMessages(t *testing.T, w *wire.WriteContext) {
 	rng := rand.New(rand.NewSource(0xd00d627))
 	must(t, w.WriteMagic(magic))
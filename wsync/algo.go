@@ -119,6 +119,38 @@ func (ctx *Context) ApplySingleFull(output io.Writer, pool lake.Pool, op Operati
 			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, remaining), buffer)
 			return nil
 		}
+	case OpChunkRange:
+		target, err := pool.GetReadSeeker(op.FileIndex)
+		if err != nil {
+			if failFast {
+				return errors.WithStack(err)
+			}
+			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, op.Size), buffer)
+			return nil
+		}
+
+		_, err = target.Seek(op.Offset, os.SEEK_SET)
+		if err != nil {
+			if failFast {
+				return errors.WithStack(err)
+			}
+			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, op.Size), buffer)
+			return nil
+		}
+
+		copied, err := io.CopyBuffer(output, io.LimitReader(target, op.Size), buffer)
+		if err == nil && copied < op.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if failFast {
+				return errors.Wrapf(err, "While copying %d bytes", op.Size)
+			}
+
+			remaining := op.Size - copied
+			io.CopyBuffer(output, io.LimitReader(&devNullReader{}, remaining), buffer)
+			return nil
+		}
 	case OpData:
 		_, err := output.Write(op.Data)
 		if err != nil {
@@ -167,7 +199,6 @@ func (ctx *Context) ComputeDiff(source io.Reader, library *BlockLibrary, ops Ope
 	var n, validTo int
 	var αPop, αPush, β, β1, β2 uint32
 	var rolling, lastRun bool
-	var shortSize int32
 
 	// Store the previous non-data operation for combining.
 	var prevOp *Operation
@@ -218,7 +249,7 @@ func (ctx *Context) ComputeDiff(source io.Reader, library *BlockLibrary, ops Ope
 		return nil
 	}
 
-	for !lastRun {
+	for {
 		// Determine if the buffer should be extended.
 		if sum.tail+ctx.blockSize > validTo {
 			// Determine if the buffer should be wrapped.
@@ -248,8 +279,6 @@ func (ctx *Context) ComputeDiff(source io.Reader, library *BlockLibrary, ops Ope
 					return errors.WithStack(err)
 				}
 				lastRun = true
-
-				shortSize = int32(n)
 			}
 		}
 
@@ -281,6 +310,12 @@ func (ctx *Context) ComputeDiff(source io.Reader, library *BlockLibrary, ops Ope
 		if !skip {
 			// Determine if there is a hash match.
 			if hh, ok := library.hashLookup[β]; ok {
+				// full blocks have 0 shortSize, even when they're found
+				// near the end of the source
+				var shortSize int32
+				if sum.head-sum.tail < ctx.blockSize {
+					shortSize = int32(sum.head - sum.tail)
+				}
 				blockHash = ctx.findUniqueHash(hh, buffer[sum.tail:sum.head], shortSize, preferredFileIndex)
 			}
 		}
@@ -310,12 +345,18 @@ func (ctx *Context) ComputeDiff(source io.Reader, library *BlockLibrary, ops Ope
 			// May trigger "data wrap".
 			data.head = sum.tail
 			data.tail = sum.tail
+
+			if lastRun && sum.tail >= validTo {
+				// nothing left after that block
+				break
+			}
 		} else {
 			if lastRun {
 				err = enqueue(Operation{Type: OpData, Data: buffer[data.tail:validTo]})
 				if err != nil {
 					return errors.WithStack(err)
 				}
+				break
 			} else {
 				// The following is for the next loop iteration, so don't try to calculate if last.
 				if rolling {
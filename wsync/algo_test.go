@@ -0,0 +1,156 @@
+package wsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+const algoTestBlockSize = 16 * 1024
+
+// algoTestTarget returns a target file that doesn't end on a block
+// boundary, and a block library for it
+func algoTestTarget(t *testing.T, rs *Context) (*content, *BlockLibrary) {
+	target := &content{Len: algoTestBlockSize*4 + 193, Seed: 0x5}
+	target.Fill(t)
+
+	var sig []BlockHash
+	must(t, rs.CreateSignature(context.Background(), 0, bytes.NewReader(target.Data), func(bl BlockHash) error {
+		sig = append(sig, bl)
+		return nil
+	}))
+	return target, NewBlockLibrary(sig)
+}
+
+func diffOps(t *testing.T, rs *Context, lib *BlockLibrary, source []byte) []Operation {
+	var ops []Operation
+	must(t, rs.ComputeDiff(bytes.NewReader(source), lib, func(op Operation) error {
+		op.Data = append([]byte{}, op.Data...)
+		ops = append(ops, op)
+		return nil
+	}, -1))
+	return ops
+}
+
+func applyOps(t *testing.T, rs *Context, target []byte, ops []Operation) []byte {
+	opsOut := make(chan Operation, len(ops))
+	for _, op := range ops {
+		opsOut <- op
+	}
+	close(opsOut)
+
+	result := new(bytes.Buffer)
+	pool := &SinglePool{reader: bytes.NewReader(target), size: int64(len(target))}
+	must(t, rs.ApplyPatch(result, pool, opsOut))
+	return result.Bytes()
+}
+
+func formatOps(ops []Operation) []string {
+	var res []string
+	for _, op := range ops {
+		switch op.Type {
+		case OpBlockRange:
+			res = append(res, fmt.Sprintf("blocks %d+%d", op.BlockIndex, op.BlockSpan))
+		case OpData:
+			res = append(res, fmt.Sprintf("data %d", len(op.Data)))
+		}
+	}
+	return res
+}
+
+func Test_DiffShiftedTail(t *testing.T) {
+	rs := NewContext(algoTestBlockSize)
+	target, lib := algoTestTarget(t, rs)
+
+	prefix := []byte("thirteen byte")
+	cases := []struct {
+		description string
+		source      []byte
+		blocks      int64
+	}{
+		{
+			description: "unaligned copy of the whole target",
+			source:      append(append([]byte{}, prefix...), target.Data...),
+			blocks:      5,
+		},
+		{
+			description: "unaligned full blocks followed by fresh data",
+			source:      append(append(append([]byte{}, prefix...), target.Data[:algoTestBlockSize*4]...), []byte("tail")...),
+			blocks:      4,
+		},
+	}
+
+	for _, c := range cases {
+		ops := diffOps(t, rs, lib, c.source)
+
+		var blocks int64
+		for _, op := range ops {
+			if op.Type == OpBlockRange {
+				blocks += op.BlockSpan
+			}
+		}
+		if blocks != c.blocks {
+			t.Errorf("%s: expected %d blocks to be reused, got %d", c.description, c.blocks, blocks)
+		}
+
+		if !bytes.Equal(applyOps(t, rs, target.Data, ops), c.source) {
+			t.Errorf("%s: result is different from the source", c.description)
+		}
+	}
+}
+
+// Sources that don't have target blocks near their end at an unaligned
+// offset must be diffed exactly like they used to be.
+func Test_DiffOpsUnchanged(t *testing.T) {
+	rs := NewContext(algoTestBlockSize)
+	target, lib := algoTestTarget(t, rs)
+
+	fresh := &content{Len: algoTestBlockSize*2 + 51, Seed: 0x9}
+	fresh.Fill(t)
+
+	cases := []struct {
+		description string
+		source      []byte
+		ops         []string
+	}{
+		{
+			description: "aligned copy of the whole target",
+			source:      target.Data,
+			ops:         []string{"blocks 0+5"},
+		},
+		{
+			description: "aligned full blocks followed by fresh data",
+			source:      append(append([]byte{}, target.Data[:algoTestBlockSize*4]...), []byte("tail")...),
+			ops:         []string{"blocks 0+4", "data 4"},
+		},
+		{
+			description: "fresh data followed by unaligned full blocks and more fresh data",
+			source:      append(append(append([]byte{}, []byte("head")...), target.Data[:algoTestBlockSize*2]...), fresh.Data...),
+			ops:         []string{"data 4", "blocks 0+2", "data 32819"},
+		},
+		{
+			description: "fresh data only",
+			source:      fresh.Data,
+			ops:         []string{"data 32819"},
+		},
+		{
+			description: "empty source",
+			source:      nil,
+			ops:         []string{"data 0"},
+		},
+	}
+
+	for _, c := range cases {
+		ops := diffOps(t, rs, lib, c.source)
+
+		actual := formatOps(ops)
+		if fmt.Sprintf("%v", actual) != fmt.Sprintf("%v", c.ops) {
+			t.Errorf("%s: expected ops %v, got %v", c.description, c.ops, actual)
+		}
+
+		if !bytes.Equal(applyOps(t, rs, target.Data, ops), c.source) {
+			t.Errorf("%s: result is different from the source", c.description)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package wsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/itchio/wharf/werrors"
+	"github.com/pkg/errors"
+)
+
+// ChunkerParams control where content-defined chunk boundaries fall.
+// Chunks are never smaller than MinSize (except at the end of a file),
+// never larger than MaxSize, and tend towards AvgSize.
+type ChunkerParams struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// DefaultChunkerParams yields chunks averaging the same size as
+// fixed-size blocks.
+var DefaultChunkerParams = ChunkerParams{
+	MinSize: 16 * 1024,
+	AvgSize: 64 * 1024,
+	MaxSize: 256 * 1024,
+}
+
+// Validate returns an error if the chunker can't work with those params
+func (cp ChunkerParams) Validate() error {
+	if cp.MinSize <= 0 || cp.MinSize >= cp.AvgSize || cp.AvgSize >= cp.MaxSize {
+		return errors.WithStack(fmt.Errorf("invalid chunker params %+v: must have 0 < MinSize < AvgSize < MaxSize", cp))
+	}
+	if cp.AvgSize&(cp.AvgSize-1) != 0 {
+		return errors.WithStack(fmt.Errorf("invalid chunker params %+v: AvgSize must be a power of two", cp))
+	}
+	if cp.MaxSize > MaxDataOp {
+		return errors.WithStack(fmt.Errorf("invalid chunker params %+v: MaxSize must be at most %d", cp, MaxDataOp))
+	}
+	return nil
+}
+
+// gearTable maps each byte to a random 64-bit value for the gear hash.
+// Chunk boundaries (and thus signatures) depend on it, so it must never change.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64
+	state := uint64(0x77686172667773)
+	for i := range gearTable {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// A Chunker splits a stream into content-defined chunks using the FastCDC
+// algorithm: a gear hash is rolled over the data, and a boundary is placed
+// wherever its top bits are all zero. Inserting or removing bytes only moves
+// the boundaries near the edit, so later chunks still match.
+type Chunker struct {
+	reader io.Reader
+	params ChunkerParams
+
+	// masks used before and after reaching AvgSize, which respectively
+	// make boundaries less and more likely ("normalized chunking")
+	maskHard uint64
+	maskEasy uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// NewChunker returns a chunker that reads from reader
+func NewChunker(reader io.Reader, params ChunkerParams) (*Chunker, error) {
+	err := params.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	avgBits := uint(bits.TrailingZeros(uint(params.AvgSize)))
+	return &Chunker{
+		reader:   reader,
+		params:   params,
+		maskHard: topBits(avgBits + 1),
+		maskEasy: topBits(avgBits - 1),
+		buf:      make([]byte, params.MaxSize*4),
+	}, nil
+}
+
+// topBits returns a mask with the n most significant bits set. The gear
+// hash's top bits depend on the last 64 bytes, the bottom ones only on
+// the last few.
+func topBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk, which is only valid until the
+// following call. It returns io.EOF once the stream is exhausted.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.params.MaxSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.reader, c.buf[c.end:])
+		c.end += n
+		if err != nil {
+			if errors.Cause(err) != io.EOF && errors.Cause(err) != io.ErrUnexpectedEOF {
+				return nil, errors.WithStack(err)
+			}
+			c.eof = true
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	size := c.cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+size]
+	c.start += size
+	return chunk, nil
+}
+
+func (c *Chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.params.MinSize {
+		return n
+	}
+	if n > c.params.MaxSize {
+		n = c.params.MaxSize
+	}
+
+	normal := c.params.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.params.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskHard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskEasy == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// NewChunkLibrary returns a new chunk library containing all
+// the given content-defined chunk hashes, for fast lookup later.
+func NewChunkLibrary(hashes []BlockHash) *ChunkLibrary {
+	hashLookup := make(map[string][]BlockHash)
+
+	for _, hash := range hashes {
+		if hash.Size == 0 {
+			// empty files, nothing to re-use there
+			continue
+		}
+		key := string(hash.StrongHash)
+		hashLookup[key] = append(hashLookup[key], hash)
+	}
+
+	return &ChunkLibrary{hashLookup}
+}
+
+// CreateChunkSignature is like CreateSignature, but hashes
+// content-defined chunks instead of fixed-size blocks.
+func (ctx *Context) CreateChunkSignature(cctx context.Context, fileIndex int64, fileReader io.Reader, params ChunkerParams, writeHash SignatureWriter) error {
+	chunker, err := NewChunker(fileReader, params)
+	if err != nil {
+		return err
+	}
+
+	blockIndex := int64(0)
+	offset := int64(0)
+
+	hashChunk := func(chunk []byte) error {
+		blockHash := BlockHash{
+			FileIndex:  fileIndex,
+			BlockIndex: blockIndex,
+			StrongHash: ctx.uniqueHash(chunk),
+			Offset:     offset,
+			Size:       int64(len(chunk)),
+		}
+
+		err := writeHash(blockHash)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		blockIndex++
+		offset += int64(len(chunk))
+		return nil
+	}
+
+	cancelCounter := 0
+	for {
+		chunk, err := chunker.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.WithStack(err)
+		}
+
+		err = hashChunk(chunk)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		cancelCounter++
+		if cancelCounter > 128 {
+			cancelCounter = 0
+			select {
+			case <-cctx.Done():
+				return werrors.ErrCancelled
+			default:
+				// keep going
+			}
+		}
+	}
+
+	// like fixed-size signatures, empty files have a single empty chunk
+	if blockIndex == 0 {
+		err := hashChunk([]byte{})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// ComputeChunkDiff is like ComputeDiff, but splits the source in content-defined
+// chunks and looks them up in a chunk library. It emits OpChunkRange and OpData
+// operations, and the same rules apply regarding data buffer reuse.
+func (ctx *Context) ComputeChunkDiff(source io.Reader, library *ChunkLibrary, params ChunkerParams, ops OperationWriter, preferredFileIndex int64) (err error) {
+	ops = makeOperationCleaner(ops)
+
+	chunker, err := NewChunker(source, params)
+	if err != nil {
+		return err
+	}
+
+	if len(ctx.buffer) < MaxDataOp {
+		ctx.buffer = make([]byte, MaxDataOp)
+	}
+	data := ctx.buffer[:0]
+
+	// Store the previous chunk range for combining.
+	var prevOp *Operation
+	numOps := 0
+
+	flushRange := func() error {
+		if prevOp == nil {
+			return nil
+		}
+		op := *prevOp
+		prevOp = nil
+		numOps++
+		return ops(op)
+	}
+
+	flushData := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		op := Operation{Type: OpData, Data: data}
+		data = data[:0]
+		numOps++
+		return ops(op)
+	}
+
+	for {
+		chunk, err := chunker.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.WithStack(err)
+		}
+
+		blockHash := ctx.findChunk(library, chunk, preferredFileIndex)
+		if blockHash == nil {
+			err = flushRange()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if len(data)+len(chunk) > MaxDataOp {
+				err = flushData()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+			data = append(data, chunk...)
+			continue
+		}
+
+		err = flushData()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if prevOp != nil && prevOp.FileIndex == blockHash.FileIndex && prevOp.Offset+prevOp.Size == blockHash.Offset {
+			// combine [prevOp][chunk] into [ prevOp ]
+			prevOp.Size += blockHash.Size
+			continue
+		}
+
+		err = flushRange()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		prevOp = &Operation{
+			Type:      OpChunkRange,
+			FileIndex: blockHash.FileIndex,
+			Offset:    blockHash.Offset,
+			Size:      blockHash.Size,
+		}
+	}
+
+	err = flushRange()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = flushData()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if numOps == 0 {
+		// empty files get a single empty data op, like with ComputeDiff
+		err = ops(Operation{Type: OpData, Data: data})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// findChunk returns a chunk from the library with the same contents
+// as data, preferably from the given file.
+func (ctx *Context) findChunk(library *ChunkLibrary, data []byte, preferredFileIndex int64) *BlockHash {
+	hh, ok := library.hashLookup[string(ctx.uniqueHash(data))]
+	if !ok {
+		return nil
+	}
+
+	var found *BlockHash
+	for i := range hh {
+		block := &hh[i]
+		if block.Size != int64(len(data)) {
+			continue
+		}
+		if block.FileIndex == preferredFileIndex {
+			return block
+		}
+		if found == nil {
+			found = block
+		}
+	}
+	return found
+}
@@ -0,0 +1,150 @@
+package wsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkSizes(t *testing.T, data []byte, params ChunkerParams) []int {
+	chunker, err := NewChunker(bytes.NewReader(data), params)
+	must(t, err)
+
+	var sizes []int
+	total := 0
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		must(t, err)
+
+		if len(chunk) > params.MaxSize {
+			t.Fatalf("chunk of %d bytes exceeds max size %d", len(chunk), params.MaxSize)
+		}
+		if !bytes.Equal(chunk, data[total:total+len(chunk)]) {
+			t.Fatalf("chunk at %d doesn't match input", total)
+		}
+		total += len(chunk)
+		sizes = append(sizes, len(chunk))
+	}
+
+	if total != len(data) {
+		t.Fatalf("chunks add up to %d bytes, expected %d", total, len(data))
+	}
+	for i, size := range sizes[:len(sizes)-1] {
+		if size < params.MinSize {
+			t.Fatalf("chunk %d is %d bytes, less than min size %d", i, size, params.MinSize)
+		}
+	}
+	return sizes
+}
+
+func Test_ChunkerParams(t *testing.T) {
+	must(t, DefaultChunkerParams.Validate())
+
+	for _, params := range []ChunkerParams{
+		{},
+		{MinSize: 1024, AvgSize: 1000, MaxSize: 4096},
+		{MinSize: 4096, AvgSize: 2048, MaxSize: 8192},
+		{MinSize: 1024, AvgSize: 2048, MaxSize: MaxDataOp * 2},
+	} {
+		if params.Validate() == nil {
+			t.Errorf("expected params %+v to be invalid", params)
+		}
+	}
+}
+
+func Test_ChunkerResync(t *testing.T) {
+	data := make([]byte, 8*1024*1024)
+	_, err := rand.New(rand.NewSource(0xc0ffee)).Read(data)
+	must(t, err)
+
+	params := DefaultChunkerParams
+	sizes := chunkSizes(t, data, params)
+	if len(sizes) < 32 {
+		t.Fatalf("expected many chunks, got %d", len(sizes))
+	}
+
+	// insert a few bytes near the start: only the first chunks should change
+	inserted := append(append(append([]byte{}, data[:1000]...), []byte("hello there")...), data[1000:]...)
+	insertedSizes := chunkSizes(t, inserted, params)
+
+	boundaries := make(map[int]bool)
+	offset := 0
+	for _, size := range sizes {
+		offset += size
+		boundaries[offset] = true
+	}
+
+	shared := 0
+	offset = 0
+	for _, size := range insertedSizes {
+		offset += size
+		if boundaries[offset-len("hello there")] {
+			shared++
+		}
+	}
+
+	if shared < len(sizes)-2 {
+		t.Fatalf("only %d of %d chunk boundaries survived the insertion", shared, len(sizes))
+	}
+}
+
+func Test_ChunkDiff(t *testing.T) {
+	rng := rand.New(rand.NewSource(0x1234))
+
+	target := make([]byte, 3*1024*1024+17)
+	_, err := rng.Read(target)
+	must(t, err)
+
+	fresh := make([]byte, 200*1024)
+	_, err = rng.Read(fresh)
+	must(t, err)
+
+	var source []byte
+	source = append(source, target[:12345]...)
+	source = append(source, fresh...)
+	source = append(source, target[12345:]...)
+
+	params := DefaultChunkerParams
+	ctx := NewContext(64 * 1024)
+
+	var signature []BlockHash
+	must(t, ctx.CreateChunkSignature(context.Background(), 0, bytes.NewReader(target), params, func(bh BlockHash) error {
+		signature = append(signature, bh)
+		return nil
+	}))
+
+	var ops []Operation
+	var reused, numFresh int64
+	must(t, ctx.ComputeChunkDiff(bytes.NewReader(source), NewChunkLibrary(signature), params, func(op Operation) error {
+		switch op.Type {
+		case OpChunkRange:
+			reused += op.Size
+		case OpData:
+			numFresh += int64(len(op.Data))
+			op.Data = append([]byte{}, op.Data...)
+		}
+		ops = append(ops, op)
+		return nil
+	}, 0))
+
+	if numFresh > int64(len(fresh))+4*int64(params.MaxSize) {
+		t.Errorf("expected about %d fresh bytes, got %d", len(fresh), numFresh)
+	}
+	if reused+numFresh != int64(len(source)) {
+		t.Errorf("ops add up to %d bytes, expected %d", reused+numFresh, len(source))
+	}
+
+	output := new(bytes.Buffer)
+	pool := &SinglePool{reader: bytes.NewReader(target), size: int64(len(target))}
+	for _, op := range ops {
+		must(t, ctx.ApplySingle(output, pool, op))
+	}
+	if !bytes.Equal(source, output.Bytes()) {
+		t.Errorf("reconstructed source doesn't match")
+	}
+}
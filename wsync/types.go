@@ -19,6 +19,11 @@ const (
 	// the file we're reconstructing, because we weren't able to re-use
 	// data from the old files set
 	OpData
+
+	// OpChunkRange is a type of operation where a range of bytes is copied
+	// from an old file into the file we're reconstructing. It's used with
+	// content-defined chunks, which don't line up with a block size.
+	OpChunkRange
 )
 
 // Operation describes a step required to mutate target to align to source.
@@ -28,6 +33,10 @@ type Operation struct {
 	BlockIndex int64
 	BlockSpan  int64
 	Data       []byte
+
+	// Offset and Size are only used by OpChunkRange
+	Offset int64
+	Size   int64
 }
 
 // An OperationWriter consumes sync operations and does whatever it wants with them
@@ -43,6 +52,11 @@ type BlockHash struct {
 	ShortSize int32
 
 	StrongHash []byte
+
+	// Offset and Size locate content-defined chunks within their file,
+	// they're unused for fixed-size blocks
+	Offset int64
+	Size   int64
 }
 
 // A SignatureWriter consumes block hashes and does whatever it wants with them
@@ -60,3 +74,9 @@ type Context struct {
 type BlockLibrary struct {
 	hashLookup map[uint32][]BlockHash
 }
+
+// A ChunkLibrary contains a collection of content-defined chunk hashes,
+// indexed by their strong hashes for fast lookup.
+type ChunkLibrary struct {
+	hashLookup map[string][]BlockHash
+}